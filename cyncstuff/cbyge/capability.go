@@ -0,0 +1,82 @@
+package cbyge
+
+// A Capability is a feature which some devices support.
+type Capability string
+
+const (
+	CapabilityOnOff      Capability = "on_off"
+	CapabilityBrightness Capability = "brightness"
+	CapabilityColorTone  Capability = "color_tone"
+	CapabilityRGB        Capability = "rgb"
+)
+
+// AllCapabilities lists every known Capability.
+var AllCapabilities = []Capability{
+	CapabilityOnOff,
+	CapabilityBrightness,
+	CapabilityColorTone,
+	CapabilityRGB,
+}
+
+// deviceTypeCapabilities maps the device types reported in the device
+// properties to the features of those devices.
+var deviceTypeCapabilities = map[Capability][]int{
+	CapabilityOnOff: {
+		1, 5, 6, 7, 8, 9, 10, 11, 13, 14, 15, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29,
+		30, 31, 32, 33, 34, 35, 36, 37, 48, 49, 51, 52, 53, 54, 55, 56, 57, 58, 59, 61, 62, 63,
+		64, 65, 66, 67, 68, 80, 81, 82, 83, 85, 128, 129, 130, 131, 132, 133, 134, 135, 136,
+		137, 138, 139, 140, 141, 142, 143, 144, 145, 146, 147, 148, 149, 150, 151, 152, 153,
+		154, 156, 158, 159, 160, 161, 162, 163, 164, 165, 169, 170,
+	},
+	CapabilityBrightness: {
+		1, 5, 6, 7, 8, 9, 10, 11, 13, 14, 15, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29,
+		30, 31, 32, 33, 34, 35, 36, 37, 48, 49, 55, 56, 80, 81, 82, 83, 85, 128, 129, 130, 131,
+		132, 133, 134, 135, 136, 137, 138, 139, 140, 141, 142, 143, 144, 145, 146, 147, 148,
+		149, 150, 151, 152, 153, 154, 156, 158, 159, 160, 161, 162, 163, 164, 165, 169, 170,
+	},
+	CapabilityColorTone: {
+		5, 6, 7, 8, 10, 11, 14, 15, 19, 20, 21, 22, 23, 25, 26, 28, 29, 30, 31, 32, 33, 34, 35,
+		80, 82, 83, 85, 129, 130, 131, 132, 133, 135, 136, 137, 138, 139, 140, 141, 142, 143,
+		144, 145, 146, 147, 153, 154, 156, 158, 159, 160, 161, 162, 163, 164, 165,
+	},
+	CapabilityRGB: {
+		6, 7, 8, 21, 22, 23, 30, 31, 32, 33, 34, 35, 131, 132, 133, 137, 138, 139, 140, 141,
+		142, 143, 146, 147, 153, 154, 156, 158, 159, 160, 161, 162, 163, 164, 165,
+	},
+}
+
+// DeviceType gets the type code of the device, which determines what the
+// device can do.
+func (c *ControllerDevice) DeviceType() int {
+	return c.deviceType
+}
+
+// HasCapability checks if the device supports a feature.
+//
+// Devices of unknown types are assumed to support every feature.
+func (c *ControllerDevice) HasCapability(capability Capability) bool {
+	if !containsInt(deviceTypeCapabilities[CapabilityOnOff], c.deviceType) {
+		return true
+	}
+	return containsInt(deviceTypeCapabilities[capability], c.deviceType)
+}
+
+// Capabilities lists the features which the device supports.
+func (c *ControllerDevice) Capabilities() []Capability {
+	var res []Capability
+	for _, capability := range AllCapabilities {
+		if c.HasCapability(capability) {
+			res = append(res, capability)
+		}
+	}
+	return res
+}
+
+func containsInt(list []int, x int) bool {
+	for _, y := range list {
+		if x == y {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/unixpickle/cbyge"
+)
+
+func runLogin(opts *Options, args []string) error {
+	fs := flag.NewFlagSet("login", flag.ContinueOnError)
+	email := fs.String("email", "", "account email (prompted if empty)")
+	password := fs.String("password", "", "account password (prompted if empty)")
+	no2FA := fs.Bool("no-2fa", false, "log in without 2FA (only works for older accounts)")
+	if err := fs.Parse(args); err != nil {
+		return &UsageError{Msg: err.Error()}
+	}
+
+	stdin := bufio.NewReader(os.Stdin)
+	prompt := func(label string, value *string) error {
+		if *value != "" {
+			return nil
+		}
+		fmt.Fprint(os.Stderr, label+": ")
+		line, err := stdin.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		*value = strings.TrimSpace(line)
+		return nil
+	}
+	if err := prompt("Email", email); err != nil {
+		return err
+	}
+	if *password == "" && isTerminal(os.Stdin) {
+		restore, err := disableEcho()
+		if err != nil {
+			return usageErrorf("cannot hide the password while it is typed (%s); "+
+				"pass -password or pipe the password to standard input", err)
+		}
+		err = promptHidden(restore, func() error {
+			return prompt("Password", password)
+		})
+		if err != nil {
+			return err
+		}
+	} else if err := prompt("Password", password); err != nil {
+		return err
+	}
+
+	var info *cbyge.SessionInfo
+	var err error
+	if *no2FA {
+		info, err = cbyge.Login(*email, *password, "")
+	} else {
+		if err := cbyge.Login2FAStage1(*email, ""); err != nil {
+			return err
+		}
+		var code string
+		if err := prompt("Verification code (sent by email)", &code); err != nil {
+			return err
+		}
+		info, err = cbyge.Login2FAStage2(*email, *password, "", code)
+	}
+	if err != nil {
+		return err
+	}
+	if err := saveSession(opts.SessionPath, info); err != nil {
+		return err
+	}
+	if opts.JSON {
+		return printJSON(map[string]interface{}{
+			"user_id": info.UserID,
+			"session": opts.SessionPath,
+		})
+	}
+	fmt.Println("Saved session to", opts.SessionPath)
+	return nil
+}
+
+// promptHidden runs a prompt while echo is disabled, and then calls
+// restore, even if the prompt is interrupted.
+func promptHidden(restore func(), f func() error) error {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-interrupt:
+			restore()
+			fmt.Fprintln(os.Stderr)
+			os.Exit(ExitError)
+		case <-done:
+		}
+	}()
+
+	err := f()
+	restore()
+	// The newline typed after the password was not shown.
+	fmt.Fprintln(os.Stderr)
+	return err
+}
+
+// isTerminal checks if a file is a terminal, rather than a pipe or a
+// regular file.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func runDevices(opts *Options, args []string) error {
+	if len(args) > 1 {
+		return usageErrorf("usage: cbyge %s", commands["devices"].Usage)
+	}
+	selector := "all"
+	if len(args) == 1 {
+		selector = args[0]
+	}
+	ctrl, err := newController(opts)
+	if err != nil {
+		return err
+	}
+	devs, groups, err := selectDevices(ctrl, selector)
+	if err != nil {
+		return err
+	}
+
+	deviceGroups := map[string][]string{}
+	for _, g := range groups {
+		for _, d := range g.Devices() {
+			deviceGroups[d.DeviceID()] = append(deviceGroups[d.DeviceID()], g.Name())
+		}
+	}
+
+	if opts.JSON {
+		res := []interface{}{}
+		for _, d := range devs {
+			obj := encodeDevice(d, d.LastStatus(), nil)
+			obj["groups"] = append([]string{}, deviceGroups[d.DeviceID()]...)
+			obj["capabilities"] = d.Capabilities()
+			res = append(res, obj)
+		}
+		return printJSON(res)
+	}
+	var rows [][]string
+	for _, d := range devs {
+		row := append([]string{d.DeviceID(), d.Name()}, statusColumns(d.LastStatus(), nil)...)
+		row = append(row, strings.Join(deviceGroups[d.DeviceID()], ", "))
+		rows = append(rows, row)
+	}
+	printTable([]string{"ID", "NAME", "ONLINE", "ON", "BRIGHTNESS", "COLOR", "GROUPS"}, rows)
+	return nil
+}
+
+func runStatus(opts *Options, args []string) error {
+	if len(args) != 1 {
+		return usageErrorf("usage: cbyge %s", commands["status"].Usage)
+	}
+	ctrl, err := newController(opts)
+	if err != nil {
+		return err
+	}
+	devs, _, err := selectDevices(ctrl, args[0])
+	if err != nil {
+		return err
+	}
+	statuses, errs := ctrl.DeviceStatuses(devs)
+	if err := printStatuses(opts, devs, statuses, errs); err != nil {
+		return err
+	}
+	return combineErrors(errs)
+}
+
+func runOn(opts *Options, args []string) error {
+	return runSetOnOff(opts, "on", args, true)
+}
+
+func runOff(opts *Options, args []string) error {
+	return runSetOnOff(opts, "off", args, false)
+}
+
+func runSetOnOff(opts *Options, name string, args []string, on bool) error {
+	if len(args) != 1 {
+		return usageErrorf("usage: cbyge %s", commands[name].Usage)
+	}
+	return applyToDevices(opts, args[0], func(c *cbyge.Controller, d *cbyge.ControllerDevice) error {
+		return c.SetDeviceStatus(d, on)
+	})
+}
+
+func runBrightness(opts *Options, args []string) error {
+	if len(args) != 2 {
+		return usageErrorf("usage: cbyge %s", commands["brightness"].Usage)
+	}
+	lum, err := parseIntArg("brightness", strings.TrimSuffix(args[1], "%"), 1, 100)
+	if err != nil {
+		return err
+	}
+	return applyToDevices(opts, args[0], func(c *cbyge.Controller, d *cbyge.ControllerDevice) error {
+		return c.SetDeviceLum(d, lum)
+	})
+}
+
+func runCT(opts *Options, args []string) error {
+	if len(args) != 2 {
+		return usageErrorf("usage: cbyge %s", commands["ct"].Usage)
+	}
+	tone, err := parseIntArg("color tone", args[1], 0, 100)
+	if err != nil {
+		return err
+	}
+	return applyToDevices(opts, args[0], func(c *cbyge.Controller, d *cbyge.ControllerDevice) error {
+		return c.SetDeviceCT(d, tone)
+	})
+}
+
+func runRGB(opts *Options, args []string) error {
+	var rgb [3]uint8
+	if len(args) == 2 && strings.HasPrefix(args[1], "#") && len(args[1]) == 7 {
+		value, err := strconv.ParseUint(args[1][1:], 16, 32)
+		if err != nil {
+			return usageErrorf("invalid color: %s", args[1])
+		}
+		rgb = [3]uint8{uint8(value >> 16), uint8(value >> 8), uint8(value)}
+	} else if len(args) == 4 {
+		for i, arg := range args[1:] {
+			x, err := parseIntArg("color component", arg, 0, 0xff)
+			if err != nil {
+				return err
+			}
+			rgb[i] = uint8(x)
+		}
+	} else {
+		return usageErrorf("usage: cbyge %s", commands["rgb"].Usage)
+	}
+	return applyToDevices(opts, args[0], func(c *cbyge.Controller, d *cbyge.ControllerDevice) error {
+		return c.SetDeviceRGB(d, rgb[0], rgb[1], rgb[2])
+	})
+}
+
+// A Scene is a saved set of device settings.
+type Scene struct {
+	Name    string         `json:"name,omitempty"`
+	Devices []*SceneDevice `json:"devices"`
+}
+
+// A SceneDevice gives the settings for the devices matching a selector.
+//
+// Unset fields are left unchanged.
+type SceneDevice struct {
+	Selector   string  `json:"selector"`
+	On         *bool   `json:"on,omitempty"`
+	Brightness *int    `json:"brightness,omitempty"`
+	ColorTone  *int    `json:"color_tone,omitempty"`
+	RGB        *[3]int `json:"rgb,omitempty"`
+}
+
+// Validate checks that the settings are in range.
+func (s *SceneDevice) Validate() error {
+	if s.Brightness != nil && (*s.Brightness < 1 || *s.Brightness > 100) {
+		return fmt.Errorf("brightness out of range [1, 100] for %q", s.Selector)
+	}
+	if s.ColorTone != nil && (*s.ColorTone < 0 || *s.ColorTone > 100) {
+		return fmt.Errorf("color_tone out of range [0, 100] for %q", s.Selector)
+	}
+	if s.RGB != nil {
+		for _, x := range s.RGB {
+			if x < 0 || x > 0xff {
+				return fmt.Errorf("rgb out of range [0, 255] for %q", s.Selector)
+			}
+		}
+	}
+	return nil
+}
+
+// A SceneController sets device statuses, like a *cbyge.Controller.
+type SceneController interface {
+	SetDeviceStatus(d *cbyge.ControllerDevice, status bool) error
+	SetDeviceLum(d *cbyge.ControllerDevice, lum int) error
+	SetDeviceRGB(d *cbyge.ControllerDevice, r, g, b uint8) error
+	SetDeviceCT(d *cbyge.ControllerDevice, ct int) error
+}
+
+// Apply changes a device to match the scene.
+func (s *SceneDevice) Apply(c SceneController, d *cbyge.ControllerDevice) error {
+	if s.On != nil && !*s.On {
+		return c.SetDeviceStatus(d, false)
+	}
+	if s.On != nil {
+		if err := c.SetDeviceStatus(d, true); err != nil {
+			return err
+		}
+	}
+	if s.Brightness != nil {
+		if err := c.SetDeviceLum(d, *s.Brightness); err != nil {
+			return err
+		}
+	}
+	if s.RGB != nil {
+		rgb := *s.RGB
+		return c.SetDeviceRGB(d, uint8(rgb[0]), uint8(rgb[1]), uint8(rgb[2]))
+	} else if s.ColorTone != nil {
+		return c.SetDeviceCT(d, *s.ColorTone)
+	}
+	return nil
+}
+
+func runScene(opts *Options, args []string) error {
+	if len(args) == 2 && args[0] == "apply" {
+		return applyScene(opts, args[1])
+	} else if (len(args) == 2 || len(args) == 3) && args[0] == "save" {
+		selector := "all"
+		if len(args) == 3 {
+			selector = args[2]
+		}
+		return saveScene(opts, args[1], selector)
+	}
+	return usageErrorf("usage: cbyge %s", commands["scene"].Usage)
+}
+
+func applyScene(opts *Options, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var scene Scene
+	if err := json.Unmarshal(data, &scene); err != nil {
+		return usageErrorf("invalid scene file %s: %s", path, err)
+	}
+	ctrl, err := newController(opts)
+	if err != nil {
+		return err
+	}
+	devs, groups, err := selectDevices(ctrl, "all")
+	if err != nil {
+		return err
+	}
+
+	// Later entries override earlier ones for the same device.
+	env := &cbyge.SelectorEnv{Groups: groups}
+	settings := map[string]*SceneDevice{}
+	var targets []*cbyge.ControllerDevice
+	for _, entry := range scene.Devices {
+		if err := entry.Validate(); err != nil {
+			return usageErrorf("invalid scene file %s: %s", path, err)
+		}
+		selector, err := cbyge.ParseSelector(entry.Selector)
+		if err != nil {
+			return err
+		}
+		for _, d := range selector.Select(env, devs) {
+			if _, ok := settings[d.DeviceID()]; !ok {
+				targets = append(targets, d)
+			}
+			settings[d.DeviceID()] = entry
+		}
+	}
+	if len(targets) == 0 {
+		return &NotFoundError{Selector: "scene " + path}
+	}
+	return applyEach(opts, ctrl, targets, func(c *cbyge.Controller, d *cbyge.ControllerDevice) error {
+		return settings[d.DeviceID()].Apply(c, d)
+	})
+}
+
+func saveScene(opts *Options, path, selector string) error {
+	ctrl, err := newController(opts)
+	if err != nil {
+		return err
+	}
+	devs, _, err := selectDevices(ctrl, selector)
+	if err != nil {
+		return err
+	}
+	statuses, errs := ctrl.DeviceStatuses(devs)
+	scene := &Scene{Name: strings.TrimSuffix(path, ".json"), Devices: []*SceneDevice{}}
+	skipped := []string{}
+	for i, d := range devs {
+		status := statuses[i]
+		if errs[i] != nil || !status.IsOnline {
+			fmt.Fprintln(os.Stderr, "Skipping offline device", d.DeviceID(), d.Name())
+			skipped = append(skipped, d.DeviceID())
+			continue
+		}
+		entry := &SceneDevice{Selector: d.DeviceID(), On: &status.IsOn}
+		if status.IsOn {
+			brightness := int(status.Brightness)
+			entry.Brightness = &brightness
+			if status.UseRGB {
+				entry.RGB = &[3]int{int(status.RGB[0]), int(status.RGB[1]), int(status.RGB[2])}
+			} else {
+				tone := int(status.ColorTone)
+				entry.ColorTone = &tone
+			}
+		}
+		scene.Devices = append(scene.Devices, entry)
+	}
+	data, err := json.MarshalIndent(scene, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	if opts.JSON {
+		return printJSON(map[string]interface{}{
+			"path":    path,
+			"saved":   len(scene.Devices),
+			"skipped": skipped,
+		})
+	}
+	fmt.Printf("Saved %d devices to %s\n", len(scene.Devices), path)
+	return nil
+}
+
+func runWatch(opts *Options, args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	interval := fs.Duration("interval", time.Second*5, "time between status checks")
+	if err := fs.Parse(args); err != nil {
+		return &UsageError{Msg: err.Error()}
+	}
+	if fs.NArg() > 1 || *interval <= 0 {
+		return usageErrorf("usage: cbyge %s", commands["watch"].Usage)
+	}
+	selector := "all"
+	if fs.NArg() == 1 {
+		selector = fs.Arg(0)
+	}
+	ctrl, err := newController(opts)
+	if err != nil {
+		return err
+	}
+	devs, _, err := selectDevices(ctrl, selector)
+	if err != nil {
+		return err
+	}
+
+	cache := cbyge.NewStatusCache(ctrl, devs, *interval)
+	defer cache.Close()
+	cache.Refresh()
+	cache.Start(*interval)
+	var version uint64
+	for {
+		var changes []cbyge.StatusChange
+		changes, version = cache.WaitChanges(version, time.Minute)
+		for _, change := range changes {
+			if err := printChange(opts, change); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// applyToDevices runs f on every device matching a selector and prints the
+// results.
+func applyToDevices(opts *Options, selector string,
+	f func(c *cbyge.Controller, d *cbyge.ControllerDevice) error) error {
+	ctrl, err := newController(opts)
+	if err != nil {
+		return err
+	}
+	devs, _, err := selectDevices(ctrl, selector)
+	if err != nil {
+		return err
+	}
+	return applyEach(opts, ctrl, devs, f)
+}
+
+func applyEach(opts *Options, ctrl *cbyge.Controller, devs []*cbyge.ControllerDevice,
+	f func(c *cbyge.Controller, d *cbyge.ControllerDevice) error) error {
+	errs := make([]error, len(devs))
+	for i, d := range devs {
+		errs[i] = f(ctrl, d)
+	}
+	if opts.JSON {
+		res := []interface{}{}
+		for i, d := range devs {
+			obj := map[string]interface{}{"id": d.DeviceID(), "name": d.Name()}
+			if errs[i] != nil {
+				obj["error"] = errs[i].Error()
+			}
+			res = append(res, obj)
+		}
+		if err := printJSON(res); err != nil {
+			return err
+		}
+	} else {
+		var rows [][]string
+		for i, d := range devs {
+			result := "ok"
+			if errs[i] != nil {
+				result = errs[i].Error()
+			}
+			rows = append(rows, []string{d.DeviceID(), d.Name(), result})
+		}
+		printTable([]string{"ID", "NAME", "RESULT"}, rows)
+	}
+	return combineErrors(errs)
+}
+
+// combineErrors gets the error for a command which ran on several devices.
+//
+// If every device failed, the first error is returned so that the exit code
+// reflects its cause.
+func combineErrors(errs []error) error {
+	var first error
+	var failed int
+	for _, err := range errs {
+		if err != nil {
+			failed++
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if failed == 0 {
+		return nil
+	} else if failed == len(errs) {
+		return first
+	}
+	return &PartialError{Failed: failed, Total: len(errs)}
+}
+
+func parseIntArg(name, arg string, min, max int) (int, error) {
+	x, err := strconv.Atoi(arg)
+	if err != nil || x < min || x > max {
+		return 0, usageErrorf("invalid %s %q (expected %d-%d)", name, arg, min, max)
+	}
+	return x, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/unixpickle/cbyge"
+)
+
+func TestCombineErrors(t *testing.T) {
+	err1 := errors.New("first")
+	err2 := errors.New("second")
+	if err := combineErrors(nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := combineErrors([]error{nil, nil}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := combineErrors([]error{err1, err2}); err != err1 {
+		t.Errorf("expected the first error but got %v", err)
+	}
+	var partialErr *PartialError
+	err := combineErrors([]error{nil, err1, err2})
+	if !errors.As(err, &partialErr) || partialErr.Failed != 2 || partialErr.Total != 3 {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestSceneDeviceValidate(t *testing.T) {
+	valid := []string{
+		`{"selector": "all"}`,
+		`{"selector": "all", "on": false, "brightness": 1, "color_tone": 0}`,
+		`{"selector": "all", "brightness": 100, "color_tone": 100}`,
+		`{"selector": "all", "rgb": [0, 128, 255]}`,
+	}
+	invalid := []string{
+		`{"selector": "all", "brightness": 0}`,
+		`{"selector": "all", "brightness": 101}`,
+		`{"selector": "all", "color_tone": -1}`,
+		`{"selector": "all", "color_tone": 101}`,
+		`{"selector": "all", "rgb": [0, 256, 0]}`,
+		`{"selector": "all", "rgb": [-1, 0, 0]}`,
+	}
+	for _, data := range valid {
+		if err := parseSceneDevice(t, data).Validate(); err != nil {
+			t.Errorf("%s: %v", data, err)
+		}
+	}
+	for _, data := range invalid {
+		if err := parseSceneDevice(t, data).Validate(); err == nil {
+			t.Errorf("%s: expected an error", data)
+		}
+	}
+}
+
+func TestSceneDeviceApply(t *testing.T) {
+	cases := map[string][]string{
+		`{"selector": "1"}`: nil,
+
+		// Turning a device off leaves its other settings alone.
+		`{"selector": "1", "on": false, "brightness": 50, "color_tone": 10}`: {"status false"},
+
+		`{"selector": "1", "on": true, "brightness": 50, "color_tone": 10}`: {
+			"status true", "lum 50", "ct 10"},
+		`{"selector": "1", "brightness": 20, "color_tone": 10, "rgb": [1, 2, 3]}`: {
+			"lum 20", "rgb 1 2 3"},
+	}
+	d := &cbyge.ControllerDevice{}
+	for data, expected := range cases {
+		c := &fakeSceneController{}
+		if err := parseSceneDevice(t, data).Apply(c, d); err != nil {
+			t.Errorf("%s: %v", data, err)
+		}
+		if !reflect.DeepEqual(c.calls, expected) {
+			t.Errorf("%s: expected calls %v but got %v", data, expected, c.calls)
+		}
+	}
+
+	// The first failure stops the remaining calls.
+	c := &fakeSceneController{err: cbyge.UnreachableError}
+	err := parseSceneDevice(t, `{"selector": "1", "on": true, "brightness": 50}`).Apply(c, d)
+	if err != cbyge.UnreachableError || !reflect.DeepEqual(c.calls, []string{"status true"}) {
+		t.Errorf("unexpected error %v with calls %v", err, c.calls)
+	}
+}
+
+func parseSceneDevice(t *testing.T, data string) *SceneDevice {
+	var res SceneDevice
+	if err := json.Unmarshal([]byte(data), &res); err != nil {
+		t.Fatal(err)
+	}
+	return &res
+}
+
+// fakeSceneController records calls, failing each one with err.
+type fakeSceneController struct {
+	err   error
+	calls []string
+}
+
+func (f *fakeSceneController) SetDeviceStatus(d *cbyge.ControllerDevice, status bool) error {
+	f.calls = append(f.calls, fmt.Sprint("status ", status))
+	return f.err
+}
+
+func (f *fakeSceneController) SetDeviceLum(d *cbyge.ControllerDevice, lum int) error {
+	f.calls = append(f.calls, fmt.Sprint("lum ", lum))
+	return f.err
+}
+
+func (f *fakeSceneController) SetDeviceRGB(d *cbyge.ControllerDevice, r, g, b uint8) error {
+	f.calls = append(f.calls, fmt.Sprint("rgb ", r, " ", g, " ", b))
+	return f.err
+}
+
+func (f *fakeSceneController) SetDeviceCT(d *cbyge.ControllerDevice, ct int) error {
+	f.calls = append(f.calls, fmt.Sprint("ct ", ct))
+	return f.err
+}
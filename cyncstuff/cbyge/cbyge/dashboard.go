@@ -0,0 +1,701 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/unixpickle/cbyge"
+	"github.com/unixpickle/essentials"
+)
+
+const (
+	dashboardPacketLogSize = 500
+	dashboardSyncDelay     = time.Second * 2
+	dashboardStep          = 10
+)
+
+const (
+	ansiReset   = "\x1b[0m"
+	ansiBold    = "\x1b[1m"
+	ansiDim     = "\x1b[2m"
+	ansiReverse = "\x1b[7m"
+	ansiRed     = "\x1b[31m"
+	ansiYellow  = "\x1b[33m"
+	ansiCyan    = "\x1b[36m"
+)
+
+// dashboardColors are the colors that the 'c' key cycles through.
+var dashboardColors = [][3]uint8{
+	{255, 0, 0},
+	{255, 128, 0},
+	{255, 255, 0},
+	{0, 255, 0},
+	{0, 255, 255},
+	{0, 0, 255},
+	{128, 0, 255},
+	{255, 255, 255},
+}
+
+type dashboard struct {
+	ctrl   *cbyge.Controller
+	policy *cbyge.ScoredSwitchPolicy
+	cache  *cbyge.StatusCache
+	devs   []*cbyge.ControllerDevice
+
+	redraw chan struct{}
+	done   chan struct{}
+
+	lock     sync.Mutex
+	statuses map[string]cbyge.StatusChange
+	selected int
+	offset   int
+	colorIdx int
+	packets  []string
+	message  string
+	isError  bool
+	lastSync time.Time
+
+	// Changes made from the keyboard are sent in the background, one
+	// at a time per device. desired holds the status that each busy
+	// device should end up with.
+	desired map[string]cbyge.ControllerDeviceStatus
+	busy    map[string]bool
+}
+
+func runDashboard(opts *Options, args []string) error {
+	fs := flag.NewFlagSet("dashboard", flag.ContinueOnError)
+	interval := fs.Duration("interval", time.Second*10, "time between status checks")
+	if err := fs.Parse(args); err != nil {
+		return &UsageError{Msg: err.Error()}
+	}
+	if fs.NArg() > 1 || *interval <= 0 {
+		return usageErrorf("usage: cbyge %s", commands["dashboard"].Usage)
+	}
+	selector := "all"
+	if fs.NArg() == 1 {
+		selector = fs.Arg(0)
+	}
+	ctrl, err := newController(opts)
+	if err != nil {
+		return err
+	}
+	devs, _, err := selectDevices(ctrl, selector)
+	if err != nil {
+		return err
+	}
+
+	restore, err := makeRaw()
+	if err != nil {
+		return err
+	}
+	defer restore()
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	d := &dashboard{
+		ctrl:     ctrl,
+		policy:   cbyge.NewScoredSwitchPolicy(),
+		devs:     devs,
+		redraw:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		statuses: map[string]cbyge.StatusChange{},
+		message:  "fetching statuses...",
+		desired:  map[string]cbyge.ControllerDeviceStatus{},
+		busy:     map[string]bool{},
+	}
+	defer close(d.done)
+	ctrl.SetSwitchPolicy(d.policy)
+	d.cache = cbyge.NewStatusCache(ctrl, devs, *interval)
+	ctrl.SetPacketHook(d.logPacket)
+	defer d.cache.Close()
+	d.cache.Start(*interval)
+	go d.watchStatuses()
+	go func() {
+		d.cache.Refresh()
+		d.setMessage("", false)
+	}()
+
+	return d.loop()
+}
+
+func (d *dashboard) loop() error {
+	keys := make(chan string, 16)
+	go readKeys(os.Stdin, keys)
+	resize := make(chan os.Signal, 1)
+	notifyResize(resize)
+	defer signal.Stop(resize)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	width, height := dashboardSize()
+	for {
+		d.draw(width, height)
+		select {
+		case key, ok := <-keys:
+			if !ok || !d.handleKey(key) {
+				return nil
+			}
+		case <-resize:
+			width, height = dashboardSize()
+		case <-d.redraw:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *dashboard) watchStatuses() {
+	var version uint64
+	for {
+		changes, newVersion := d.cache.WaitChanges(version, time.Minute)
+		select {
+		case <-d.done:
+			return
+		default:
+		}
+		version = newVersion
+		d.lock.Lock()
+		for _, change := range changes {
+			d.statuses[change.Device.DeviceID()] = change
+		}
+		d.lock.Unlock()
+		d.triggerRedraw()
+	}
+}
+
+// handleKey responds to a key press, returning false to quit.
+func (d *dashboard) handleKey(key string) bool {
+	switch key {
+	case "q", "ctrl-c":
+		return false
+	case "up", "k":
+		d.moveSelection(-1)
+	case "down", "j":
+		d.moveSelection(1)
+	case "enter", " ":
+		d.update(func(s *cbyge.ControllerDeviceStatus) {
+			s.IsOn = !s.IsOn
+		})
+	case "right", "+", "=":
+		d.update(func(s *cbyge.ControllerDeviceStatus) {
+			s.IsOn = true
+			s.Brightness = uint8(clampInt(int(s.Brightness)+dashboardStep, 1, 100))
+		})
+	case "left", "-":
+		d.update(func(s *cbyge.ControllerDeviceStatus) {
+			s.Brightness = uint8(clampInt(int(s.Brightness)-dashboardStep, 1, 100))
+		})
+	case "]", "[":
+		step := dashboardStep
+		if key == "[" {
+			step = -step
+		}
+		d.update(func(s *cbyge.ControllerDeviceStatus) {
+			if !s.UseRGB {
+				s.ColorTone = uint8(clampInt(int(s.ColorTone)+step, 0, 100))
+			}
+			s.UseRGB = false
+		})
+	case "c":
+		d.lock.Lock()
+		color := dashboardColors[d.colorIdx]
+		d.colorIdx = (d.colorIdx + 1) % len(dashboardColors)
+		d.lock.Unlock()
+		d.update(func(s *cbyge.ControllerDeviceStatus) {
+			s.UseRGB = true
+			s.RGB = color
+		})
+	case "r":
+		d.setMessage("refreshing...", false)
+		go func() {
+			d.cache.Refresh()
+			d.setMessage("refreshed", false)
+		}()
+	case "l":
+		d.lock.Lock()
+		d.packets = nil
+		d.lock.Unlock()
+	}
+	return true
+}
+
+func (d *dashboard) moveSelection(delta int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.selected = clampInt(d.selected+delta, 0, len(d.devs)-1)
+}
+
+// update changes the status of the selected device in the background.
+//
+// The new status is shown right away, and is reverted to the device's real
+// status if the change fails.
+func (d *dashboard) update(f func(s *cbyge.ControllerDeviceStatus)) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	dev := d.devs[d.selected]
+	status, err := d.deviceStatus(dev)
+	if err != nil || !status.IsOnline {
+		d.setMessageLocked(dev.Name()+" is offline", true)
+		return
+	}
+	newStatus := status
+	f(&newStatus)
+	if newStatus == status {
+		return
+	}
+	d.desired[dev.DeviceID()] = newStatus
+	if !d.busy[dev.DeviceID()] {
+		d.busy[dev.DeviceID()] = true
+		go d.sendChanges(dev, status)
+	}
+	d.triggerRedraw()
+}
+
+func (d *dashboard) sendChanges(dev *cbyge.ControllerDevice, current cbyge.ControllerDeviceStatus) {
+	id := dev.DeviceID()
+	for {
+		d.lock.Lock()
+		target := d.desired[id]
+		if target == current {
+			delete(d.desired, id)
+			delete(d.busy, id)
+			d.lock.Unlock()
+			d.triggerRedraw()
+			return
+		}
+		d.lock.Unlock()
+
+		if err := sendStatus(d.ctrl, dev, current, target); err != nil {
+			d.lock.Lock()
+			delete(d.desired, id)
+			delete(d.busy, id)
+			d.setMessageLocked(dev.Name()+": "+err.Error(), true)
+			d.lock.Unlock()
+			d.cache.Invalidate(dev)
+			d.cache.Status(dev)
+			return
+		}
+		d.cache.Update(dev, target, nil)
+		current = target
+	}
+}
+
+// sendStatus makes the calls needed to take a device from one status to
+// another.
+func sendStatus(c *cbyge.Controller, dev *cbyge.ControllerDevice,
+	old, status cbyge.ControllerDeviceStatus) error {
+	if status.IsOn != old.IsOn {
+		if err := c.SetDeviceStatus(dev, status.IsOn); err != nil {
+			return err
+		}
+	}
+	if status.Brightness != old.Brightness {
+		if err := c.SetDeviceLum(dev, int(status.Brightness)); err != nil {
+			return err
+		}
+	}
+	if status.UseRGB && (!old.UseRGB || status.RGB != old.RGB) {
+		return c.SetDeviceRGB(dev, status.RGB[0], status.RGB[1], status.RGB[2])
+	} else if !status.UseRGB && (old.UseRGB || status.ColorTone != old.ColorTone) {
+		return c.SetDeviceCT(dev, int(status.ColorTone))
+	}
+	return nil
+}
+
+// deviceStatus gets the status to display for a device, including changes
+// which are still being sent.
+//
+// The caller must hold d.lock.
+func (d *dashboard) deviceStatus(dev *cbyge.ControllerDevice) (cbyge.ControllerDeviceStatus, error) {
+	if status, ok := d.desired[dev.DeviceID()]; ok {
+		return status, nil
+	}
+	change, ok := d.statuses[dev.DeviceID()]
+	if !ok {
+		return cbyge.ControllerDeviceStatus{}, nil
+	}
+	return change.Status, change.Err
+}
+
+// logPacket is the Controller's packet hook.
+//
+// Sync packets from the server indicate that some device changed, so they
+// trigger a refresh of every status, at most once per dashboardSyncDelay.
+func (d *dashboard) logPacket(p *cbyge.Packet, outgoing bool) {
+	dir := "<-"
+	if outgoing {
+		dir = "->"
+	}
+	entry := time.Now().Format("15:04:05.000") + " " + dir + " " + p.String()
+
+	d.lock.Lock()
+	d.packets = append(d.packets, entry)
+	if len(d.packets) > dashboardPacketLogSize {
+		d.packets = append([]string{}, d.packets[len(d.packets)-dashboardPacketLogSize:]...)
+	}
+	isSync := p.Type == cbyge.PacketTypeSync || p.Type == cbyge.PacketTypePipeSync
+	refresh := !outgoing && isSync && time.Since(d.lastSync) > dashboardSyncDelay
+	if refresh {
+		d.lastSync = time.Now()
+	}
+	d.lock.Unlock()
+
+	if refresh {
+		for _, dev := range d.devs {
+			d.cache.Invalidate(dev)
+		}
+		go d.cache.Statuses(d.devs)
+	}
+	d.triggerRedraw()
+}
+
+func (d *dashboard) setMessage(msg string, isError bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.setMessageLocked(msg, isError)
+}
+
+func (d *dashboard) setMessageLocked(msg string, isError bool) {
+	d.message = msg
+	d.isError = isError
+	d.triggerRedraw()
+}
+
+func (d *dashboard) triggerRedraw() {
+	select {
+	case d.redraw <- struct{}{}:
+	default:
+	}
+}
+
+func (d *dashboard) draw(width, height int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// Header, table header, two pane titles, message and help.
+	available := essentials.MaxInt(0, height-6)
+	tableRows := essentials.MinInt(len(d.devs), essentials.MaxInt(1, available/2))
+	topology := d.topologyLines()
+	topologyRows := essentials.MinInt(len(topology), essentials.MaxInt(1, (available-tableRows)/3))
+	packetRows := essentials.MaxInt(0, available-tableRows-topologyRows)
+
+	if d.selected < d.offset {
+		d.offset = d.selected
+	} else if d.selected >= d.offset+tableRows {
+		d.offset = d.selected - tableRows + 1
+	}
+
+	var lines []styledLine
+	title := fmt.Sprintf(" cbyge dashboard  %d devices", len(d.devs))
+	clock := time.Now().Format("15:04:05 ")
+	lines = append(lines, styledLine{{
+		Text:  padRight(title, width-len(clock)) + clock,
+		Style: ansiBold + ansiReverse,
+	}})
+	lines = append(lines, styledLine{{
+		Text: fmt.Sprintf("  %-20s %-12s %-4s %-15s %-7s %s", "NAME", "ID", "ON",
+			"BRIGHTNESS", "TONE", "COLOR"),
+		Style: ansiBold,
+	}})
+	for i := d.offset; i < d.offset+tableRows && i < len(d.devs); i++ {
+		lines = append(lines, d.deviceLine(i))
+	}
+	lines = append(lines, styledLine{{Text: "Switches", Style: ansiBold}})
+	lines = append(lines, topology[:topologyRows]...)
+	lines = append(lines, styledLine{{Text: "Packets", Style: ansiBold}})
+	packets := d.packets[essentials.MaxInt(0, len(d.packets)-packetRows):]
+	for _, packet := range packets {
+		style := ""
+		if strings.Contains(packet, " -> ") {
+			style = ansiCyan
+		} else if strings.Contains(packet, "type="+strconv.Itoa(cbyge.PacketTypeSync)+",") {
+			style = ansiYellow
+		}
+		lines = append(lines, styledLine{{Text: packet, Style: style}})
+	}
+	for i := len(packets); i < packetRows; i++ {
+		lines = append(lines, nil)
+	}
+	msgStyle := ""
+	if d.isError {
+		msgStyle = ansiRed
+	}
+	lines = append(lines, styledLine{{Text: d.message, Style: msgStyle}})
+	lines = append(lines, styledLine{{
+		Text: "↑↓ select  space toggle  ←→ brightness  [] tone  c color  " +
+			"r refresh  l clear log  q quit",
+		Style: ansiDim,
+	}})
+
+	var frame strings.Builder
+	frame.WriteString("\x1b[H")
+	for i, line := range lines {
+		if i >= height {
+			break
+		}
+		if i > 0 {
+			frame.WriteString("\r\n")
+		}
+		frame.WriteString(line.Render(width))
+	}
+	frame.WriteString("\x1b[J")
+	os.Stdout.WriteString(frame.String())
+}
+
+// deviceLine renders a row of the device table.
+//
+// The caller must hold d.lock.
+func (d *dashboard) deviceLine(idx int) styledLine {
+	dev := d.devs[idx]
+	prefix := []rune("  ")
+	if idx == d.selected {
+		prefix[0] = '>'
+	}
+	if d.busy[dev.DeviceID()] {
+		prefix[1] = '*'
+	}
+	row := fmt.Sprintf("%s%-20s %-12s ", string(prefix), truncate(dev.Name(), 20),
+		dev.DeviceID())
+	baseStyle := ""
+	if idx == d.selected {
+		baseStyle = ansiReverse
+	}
+
+	status, err := d.deviceStatus(dev)
+	_, fetched := d.statuses[dev.DeviceID()]
+	if !fetched && err == nil && !d.busy[dev.DeviceID()] {
+		return styledLine{{Text: row + "...", Style: baseStyle}}
+	} else if err != nil || !status.IsOnline {
+		msg := "offline"
+		if err != nil {
+			msg += ": " + err.Error()
+		}
+		return styledLine{
+			{Text: row, Style: baseStyle},
+			{Text: msg, Style: baseStyle + ansiDim},
+		}
+	}
+
+	on := "off"
+	if status.IsOn {
+		on = "on"
+	}
+	filled := (int(status.Brightness) + 5) / 10
+	bar := strings.Repeat("█", filled) + strings.Repeat("░", 10-filled)
+	tone := "rgb"
+	if !status.UseRGB {
+		tone = "ct " + strconv.Itoa(int(status.ColorTone))
+	}
+	row += fmt.Sprintf("%-4s %s %3d%% %-7s ", on, bar, status.Brightness, tone)
+	return styledLine{
+		{Text: row, Style: baseStyle},
+		{Text: "      ", Style: swatchStyle(status)},
+	}
+}
+
+// topologyLines lists the known switches, starting with the ones that can
+// reach the selected device in order of preference.
+//
+// The caller must hold d.lock.
+func (d *dashboard) topologyLines() []styledLine {
+	selected := d.devs[d.selected]
+	owners := map[uint32]string{}
+	reach := map[uint32]int{}
+	for _, dev := range d.devs {
+		if id, ok := dev.SwitchID(); ok {
+			owners[id] = dev.Name()
+		}
+		for _, id := range d.ctrl.DeviceSwitches(dev) {
+			reach[id]++
+		}
+	}
+	if len(reach) == 0 {
+		return []styledLine{{{Text: "  no switches discovered yet", Style: ansiDim}}}
+	}
+
+	ranked := d.ctrl.DeviceSwitches(selected)
+	rank := map[uint32]int{}
+	for i, id := range ranked {
+		rank[id] = i + 1
+	}
+	var others []uint32
+	for id := range reach {
+		if rank[id] == 0 {
+			others = append(others, id)
+		}
+	}
+	sort.Slice(others, func(i, j int) bool {
+		return others[i] < others[j]
+	})
+
+	var res []styledLine
+	for _, id := range append(ranked, others...) {
+		prefix := "    "
+		style := ansiDim
+		if r := rank[id]; r != 0 {
+			prefix = fmt.Sprintf("  #%d", r)
+			style = ""
+		}
+		owner := owners[id]
+		if owner == "" {
+			owner = "(unknown device)"
+		}
+		text := fmt.Sprintf("%s %-12d %-20s reaches %-3d ", prefix, id, truncate(owner, 20),
+			reach[id])
+		stats := d.policy.Stats(id)
+		if stats.Samples == 0 {
+			text += "no calls yet"
+		} else {
+			text += fmt.Sprintf("ok %3.0f%%  rtt %-6s flaps %d", stats.SuccessRate()*100,
+				stats.MeanRTT.Round(time.Millisecond), stats.Flaps)
+		}
+		res = append(res, styledLine{{Text: text, Style: style}})
+	}
+	return res
+}
+
+// swatchStyle gets a background color resembling the light from a device.
+func swatchStyle(status cbyge.ControllerDeviceStatus) string {
+	if !status.IsOn {
+		return "\x1b[48;2;40;40;40m"
+	}
+	var color [3]float64
+	if status.UseRGB {
+		for i, x := range status.RGB {
+			color[i] = float64(x)
+		}
+	} else {
+		// Interpolate from warm white to cool white.
+		warm := [3]float64{255, 147, 41}
+		cool := [3]float64{201, 226, 255}
+		t := float64(status.ColorTone) / 100
+		for i := range color {
+			color[i] = warm[i]*(1-t) + cool[i]*t
+		}
+	}
+	scale := 0.2 + 0.8*float64(status.Brightness)/100
+	return fmt.Sprintf("\x1b[48;2;%d;%d;%dm", int(color[0]*scale), int(color[1]*scale),
+		int(color[2]*scale))
+}
+
+// A styledLine is a line of text made up of differently styled pieces.
+type styledLine []styledText
+
+type styledText struct {
+	Text  string
+	Style string
+}
+
+// Render draws the line, cut off after width columns.
+func (s styledLine) Render(width int) string {
+	var res strings.Builder
+	for _, piece := range s {
+		if width <= 0 {
+			break
+		}
+		text := truncate(piece.Text, width)
+		width -= len([]rune(text))
+		if piece.Style == "" {
+			res.WriteString(text)
+		} else {
+			res.WriteString(piece.Style + text + ansiReset)
+		}
+	}
+	res.WriteString("\x1b[K")
+	return res.String()
+}
+
+// readKeys reads key presses from a raw terminal until it is closed.
+func readKeys(r io.Reader, keys chan<- string) {
+	defer close(keys)
+	buf := make([]byte, 64)
+	var pending []byte
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			return
+		}
+		parsed, rest := parseKeys(append(pending, buf[:n]...))
+		pending = append([]byte{}, rest...)
+		for _, key := range parsed {
+			keys <- key
+		}
+	}
+}
+
+// parseKeys names the keys in a chunk of terminal input.
+//
+// An escape sequence which may be cut off at the end of the chunk is
+// returned separately, to be parsed along with the next chunk.
+func parseKeys(data []byte) ([]string, []byte) {
+	arrows := map[byte]string{'A': "up", 'B': "down", 'C': "right", 'D': "left"}
+	var res []string
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == 0x1b && i+1 == len(data):
+			return res, data[i:]
+		case c == 0x1b && (data[i+1] == '[' || data[i+1] == 'O'):
+			// Skip parameters, such as the modifiers in "\x1b[1;5A", up to
+			// the final byte.
+			end := i + 2
+			for end < len(data) && (data[end] < 0x40 || data[end] > 0x7e) {
+				end++
+			}
+			if end == len(data) {
+				return res, data[i:]
+			}
+			if name, ok := arrows[data[end]]; ok {
+				res = append(res, name)
+			}
+			i = end
+		case c == 0x1b:
+			res = append(res, "esc")
+		case c == 3:
+			res = append(res, "ctrl-c")
+		case c == '\r' || c == '\n':
+			res = append(res, "enter")
+		default:
+			res = append(res, string(rune(c)))
+		}
+	}
+	return res, nil
+}
+
+func dashboardSize() (width, height int) {
+	width, height, err := terminalSize()
+	if err != nil || width <= 0 || height <= 0 {
+		return 80, 24
+	}
+	return width, height
+}
+
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:essentials.MaxInt(0, n)])
+}
+
+func padRight(s string, n int) string {
+	s = truncate(s, n)
+	return s + strings.Repeat(" ", essentials.MaxInt(0, n-len([]rune(s))))
+}
+
+func clampInt(x, min, max int) int {
+	if x < min {
+		return min
+	}
+	if x > max {
+		return max
+	}
+	return x
+}
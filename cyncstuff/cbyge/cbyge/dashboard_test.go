@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestParseKeys(t *testing.T) {
+	cases := []struct {
+		Data string
+		Keys []string
+		Rest string
+	}{
+		{"q", []string{"q"}, ""},
+		{"jk +\r\n", []string{"j", "k", " ", "+", "enter", "enter"}, ""},
+		{"\x03", []string{"ctrl-c"}, ""},
+		{"\x1b[A\x1b[B\x1b[C\x1b[D", []string{"up", "down", "right", "left"}, ""},
+		{"\x1bOA\x1bOD", []string{"up", "left"}, ""},
+		{"\x1b[1;5Cx", []string{"right", "x"}, ""},
+		{"\x1b[3~q", []string{"q"}, ""},
+		{"\x1b", nil, "\x1b"},
+		{"\x1bq", []string{"esc", "q"}, ""},
+		{"j\x1b[", []string{"j"}, "\x1b["},
+		{"\x1b[1;5", nil, "\x1b[1;5"},
+		{"\x1bO", nil, "\x1bO"},
+	}
+	for _, c := range cases {
+		keys, rest := parseKeys([]byte(c.Data))
+		if !reflect.DeepEqual(keys, c.Keys) || string(rest) != c.Rest {
+			t.Errorf("%q: expected %q, %q but got %q, %q", c.Data, c.Keys, c.Rest, keys,
+				rest)
+		}
+	}
+}
+
+func TestReadKeysSplit(t *testing.T) {
+	r := &chunkReader{chunks: []string{"j\x1b", "[A\x1b[", "1;5", "Bk\x1b", "O", "C"}}
+	keys := make(chan string, 10)
+	readKeys(r, keys)
+	var actual []string
+	for key := range keys {
+		actual = append(actual, key)
+	}
+	expected := []string{"j", "up", "down", "k", "right"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %q but got %q", expected, actual)
+	}
+}
+
+func TestStyledLineRender(t *testing.T) {
+	line := styledLine{
+		{Text: "ab"},
+		{Text: "cdé", Style: ansiBold},
+		{Text: "fg"},
+	}
+	cases := map[int]string{
+		0:  "\x1b[K",
+		1:  "a\x1b[K",
+		4:  "ab" + ansiBold + "cd" + ansiReset + "\x1b[K",
+		5:  "ab" + ansiBold + "cdé" + ansiReset + "\x1b[K",
+		6:  "ab" + ansiBold + "cdé" + ansiReset + "f\x1b[K",
+		80: "ab" + ansiBold + "cdé" + ansiReset + "fg\x1b[K",
+	}
+	for width, expected := range cases {
+		if actual := line.Render(width); actual != expected {
+			t.Errorf("width %d: expected %q but got %q", width, expected, actual)
+		}
+	}
+}
+
+func TestTruncatePad(t *testing.T) {
+	cases := []struct {
+		Text      string
+		N         int
+		Truncated string
+		Padded    string
+	}{
+		{"hello", 10, "hello", "hello     "},
+		{"hello", 5, "hello", "hello"},
+		{"hello", 3, "hel", "hel"},
+		{"héllo", 2, "hé", "hé"},
+		{"héllo", 6, "héllo", "héllo "},
+		{"hello", 0, "", ""},
+		{"hello", -1, "", ""},
+	}
+	for _, c := range cases {
+		if actual := truncate(c.Text, c.N); actual != c.Truncated {
+			t.Errorf("truncate(%q, %d): expected %q but got %q", c.Text, c.N, c.Truncated,
+				actual)
+		}
+		if actual := padRight(c.Text, c.N); actual != c.Padded {
+			t.Errorf("padRight(%q, %d): expected %q but got %q", c.Text, c.N, c.Padded, actual)
+		}
+	}
+}
+
+// chunkReader returns each chunk from a separate call to Read.
+type chunkReader struct {
+	chunks []string
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(c.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.chunks[0])
+	c.chunks = c.chunks[1:]
+	return n, nil
+}
@@ -0,0 +1,240 @@
+// Command cbyge controls C by GE devices from the command line.
+//
+// Run cbyge -help for a list of subcommands.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/unixpickle/cbyge"
+)
+
+// Exit codes, so that scripts can tell failures apart.
+const (
+	ExitOK          = 0
+	ExitError       = 1
+	ExitUsage       = 2
+	ExitAuth        = 3
+	ExitNotFound    = 4
+	ExitUnreachable = 5
+	ExitRemote      = 6
+	ExitPartial     = 7
+)
+
+// Options are the flags shared by every subcommand.
+type Options struct {
+	SessionPath string
+	JSON        bool
+	Timeout     time.Duration
+}
+
+type command struct {
+	Usage   string
+	Summary string
+	Run     func(opts *Options, args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	// Commands are set up in init() since they refer back to the
+	// table for their usage messages.
+	commands = map[string]command{
+		"login": {"login [-email E] [-password P] [-no-2fa]",
+			"log in and save the session", runLogin},
+		"devices": {"devices [SELECTOR]",
+			"list devices and their last known statuses", runDevices},
+		"status": {"status SELECTOR",
+			"fetch the live status of devices", runStatus},
+		"on":  {"on SELECTOR", "turn devices on", runOn},
+		"off": {"off SELECTOR", "turn devices off", runOff},
+		"brightness": {"brightness SELECTOR PERCENT",
+			"set brightness (1-100)", runBrightness},
+		"ct": {"ct SELECTOR TONE",
+			"set color tone (0=warm, 100=cool)", runCT},
+		"rgb": {"rgb SELECTOR (#RRGGBB | R G B)",
+			"set an RGB color", runRGB},
+		"scene": {"scene (apply FILE | save FILE [SELECTOR])",
+			"apply a scene file, or save the current statuses as one", runScene},
+		"watch": {"watch [-interval D] [SELECTOR]",
+			"print status changes until interrupted", runWatch},
+		"dashboard": {"dashboard [-interval D] [SELECTOR]",
+			"show an interactive dashboard in the terminal", runDashboard},
+	}
+}
+
+func main() {
+	opts := &Options{}
+	flag.StringVar(&opts.SessionPath, "session", cbyge.DefaultSessionPath(),
+		"session file (also "+cbyge.SessionEnvVar+")")
+	flag.BoolVar(&opts.JSON, "json", false, "print JSON instead of tables")
+	flag.DurationVar(&opts.Timeout, "timeout", cbyge.DefaultTimeout,
+		"timeout for each call to a device")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(ExitUsage)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "unknown command:", flag.Arg(0))
+		usage()
+		os.Exit(ExitUsage)
+	}
+	if err := cmd.Run(opts, flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "cbyge:", err)
+		os.Exit(exitCode(err))
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: cbyge [flags] <command> [args]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd := commands[name]
+		fmt.Fprintf(os.Stderr, "  %-45s %s\n", cmd.Usage, cmd.Summary)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Devices are chosen with selectors, like '123456,789012' or")
+	fmt.Fprintln(os.Stderr, "'group:kitchen & is_on & !name:*night*'.")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Flags:")
+	flag.PrintDefaults()
+}
+
+// A UsageError indicates that a command was called incorrectly.
+type UsageError struct {
+	Msg string
+}
+
+func (u *UsageError) Error() string {
+	return u.Msg
+}
+
+func usageErrorf(format string, args ...interface{}) error {
+	return &UsageError{Msg: fmt.Sprintf(format, args...)}
+}
+
+// A SessionError indicates that there is no usable session.
+type SessionError struct {
+	Err error
+}
+
+func (s *SessionError) Error() string {
+	return s.Err.Error() + " (run 'cbyge login')"
+}
+
+func (s *SessionError) Unwrap() error {
+	return s.Err
+}
+
+// A NotFoundError indicates that a selector matched no devices.
+type NotFoundError struct {
+	Selector string
+}
+
+func (n *NotFoundError) Error() string {
+	return fmt.Sprintf("no devices match %q", n.Selector)
+}
+
+// A PartialError indicates that a command failed for some devices.
+type PartialError struct {
+	Failed int
+	Total  int
+}
+
+func (p *PartialError) Error() string {
+	return fmt.Sprintf("failed for %d of %d devices", p.Failed, p.Total)
+}
+
+func exitCode(err error) int {
+	var usageErr *UsageError
+	var selectorErr *cbyge.SelectorError
+	var sessionErr *SessionError
+	var notFoundErr *NotFoundError
+	var partialErr *PartialError
+	var remoteErr *cbyge.RemoteError
+	switch {
+	case errors.As(err, &usageErr), errors.As(err, &selectorErr):
+		return ExitUsage
+	case errors.As(err, &sessionErr), cbyge.IsAccessTokenError(err),
+		cbyge.IsCredentialsError(err):
+		return ExitAuth
+	case errors.As(err, &notFoundErr):
+		return ExitNotFound
+	case errors.As(err, &partialErr):
+		return ExitPartial
+	case errors.Is(err, cbyge.UnreachableError), cbyge.IsConvergenceError(err):
+		return ExitUnreachable
+	case errors.Is(err, cbyge.RemoteCallError), errors.As(err, &remoteErr):
+		return ExitRemote
+	}
+	return ExitError
+}
+
+func loadSession(path string) (*cbyge.SessionInfo, error) {
+	info, err := cbyge.LoadSessionInfo(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, &SessionError{Err: errors.New("no session at " + path)}
+	} else if errors.Is(err, cbyge.InvalidSessionError) {
+		return nil, &SessionError{Err: errors.New("invalid session file " + path)}
+	}
+	return info, err
+}
+
+func saveSession(path string, info *cbyge.SessionInfo) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+func newController(opts *Options) (*cbyge.Controller, error) {
+	info, err := loadSession(opts.SessionPath)
+	if err != nil {
+		return nil, err
+	}
+	return cbyge.NewController(info, opts.Timeout), nil
+}
+
+// selectDevices finds the devices matching a selector, along with all of
+// the groups.
+func selectDevices(ctrl *cbyge.Controller, source string) ([]*cbyge.ControllerDevice,
+	[]*cbyge.ControllerGroup, error) {
+	selector, err := cbyge.ParseSelector(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	devs, groups, err := ctrl.DevicesAndGroups()
+	if err != nil {
+		if cbyge.IsAccessTokenError(err) {
+			return nil, nil, &SessionError{Err: errors.New("the session has expired")}
+		}
+		return nil, nil, err
+	}
+	devs = selector.Select(&cbyge.SelectorEnv{Groups: groups}, devs)
+	if len(devs) == 0 {
+		return nil, nil, &NotFoundError{Selector: source}
+	}
+	return devs, groups, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/unixpickle/cbyge"
+)
+
+func TestExitCode(t *testing.T) {
+	_, selectorErr := cbyge.ParseSelector("1 &")
+	cases := []struct {
+		Err  error
+		Code int
+	}{
+		{errors.New("something else"), ExitError},
+		{usageErrorf("usage: cbyge on SELECTOR"), ExitUsage},
+		{selectorErr, ExitUsage},
+		{&SessionError{Err: errors.New("no session")}, ExitAuth},
+		{&cbyge.RemoteError{Code: cbyge.RemoteErrorCodeAccessTokenRefresh}, ExitAuth},
+		{&cbyge.RemoteError{Code: cbyge.RemoteErrorCodePasswordError}, ExitAuth},
+		{&NotFoundError{Selector: "x"}, ExitNotFound},
+		{&PartialError{Failed: 1, Total: 2}, ExitPartial},
+		{cbyge.UnreachableError, ExitUnreachable},
+		{&cbyge.ConvergenceError{DeviceID: "1"}, ExitUnreachable},
+		{cbyge.RemoteCallError, ExitRemote},
+		{&cbyge.RemoteError{Code: 1}, ExitRemote},
+
+		// Wrapped errors keep their codes.
+		{fmt.Errorf("set status: %w", cbyge.UnreachableError), ExitUnreachable},
+		{fmt.Errorf("login: %w", &cbyge.RemoteError{Code: cbyge.RemoteErrorCodeUserNotExists}),
+			ExitAuth},
+	}
+	for _, c := range cases {
+		if actual := exitCode(c.Err); actual != c.Code {
+			t.Errorf("%v: expected exit code %d but got %d", c.Err, c.Code, actual)
+		}
+	}
+}
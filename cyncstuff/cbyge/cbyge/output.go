@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/unixpickle/cbyge"
+)
+
+// printTable prints rows with aligned columns.
+func printTable(header []string, rows [][]string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+}
+
+func printJSON(obj interface{}) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+func encodeStatus(status cbyge.ControllerDeviceStatus) map[string]interface{} {
+	if !status.IsOnline {
+		return map[string]interface{}{"is_online": false}
+	}
+	return map[string]interface{}{
+		"is_online":  true,
+		"is_on":      status.IsOn,
+		"brightness": status.Brightness,
+		"color_tone": status.ColorTone,
+		"use_rgb":    status.UseRGB,
+		"rgb":        status.RGB,
+	}
+}
+
+func encodeDevice(d *cbyge.ControllerDevice, status cbyge.ControllerDeviceStatus,
+	err error) map[string]interface{} {
+	res := map[string]interface{}{
+		"id":     d.DeviceID(),
+		"name":   d.Name(),
+		"status": encodeStatus(status),
+	}
+	if err != nil {
+		res["error"] = err.Error()
+	}
+	return res
+}
+
+// statusColumns formats a status as the ONLINE, ON, BRIGHTNESS, and COLOR
+// columns of a table.
+func statusColumns(status cbyge.ControllerDeviceStatus, err error) []string {
+	if err != nil || !status.IsOnline {
+		return []string{"no", "-", "-", "-"}
+	}
+	on := "off"
+	if status.IsOn {
+		on = "on"
+	}
+	color := "ct " + strconv.Itoa(int(status.ColorTone))
+	if status.UseRGB {
+		color = fmt.Sprintf("#%02x%02x%02x", status.RGB[0], status.RGB[1], status.RGB[2])
+	}
+	return []string{"yes", on, strconv.Itoa(int(status.Brightness)) + "%", color}
+}
+
+func printStatuses(opts *Options, devs []*cbyge.ControllerDevice,
+	statuses []cbyge.ControllerDeviceStatus, errs []error) error {
+	if opts.JSON {
+		res := []interface{}{}
+		for i, d := range devs {
+			res = append(res, encodeDevice(d, statuses[i], errs[i]))
+		}
+		return printJSON(res)
+	}
+	var rows [][]string
+	for i, d := range devs {
+		row := append([]string{d.DeviceID(), d.Name()}, statusColumns(statuses[i], errs[i])...)
+		if errs[i] != nil {
+			row = append(row, errs[i].Error())
+		}
+		rows = append(rows, row)
+	}
+	printTable([]string{"ID", "NAME", "ONLINE", "ON", "BRIGHTNESS", "COLOR", "ERROR"}, rows)
+	return nil
+}
+
+func printChange(opts *Options, change cbyge.StatusChange) error {
+	if opts.JSON {
+		obj := encodeDevice(change.Device, change.Status, change.Err)
+		obj["time"] = time.Now().Format(time.RFC3339)
+		return printJSON(obj)
+	}
+	columns := statusColumns(change.Status, change.Err)
+	desc := "offline"
+	if columns[0] == "yes" {
+		desc = strings.Join(columns[1:], " ")
+	}
+	fmt.Printf("%s  %s  %s  %s\n", time.Now().Format("15:04:05"), change.Device.DeviceID(),
+		change.Device.Name(), desc)
+	return nil
+}
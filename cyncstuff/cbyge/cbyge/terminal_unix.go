@@ -0,0 +1,68 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// makeRaw puts the terminal into raw mode with stty, returning a function
+// that restores the previous mode.
+func makeRaw() (restore func(), err error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, errors.New("standard input is not a terminal")
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return nil, err
+	}
+	return func() {
+		stty(strings.TrimSpace(saved))
+	}, nil
+}
+
+// disableEcho stops the terminal from showing what is typed, returning a
+// function that restores the previous mode.
+func disableEcho() (restore func(), err error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, errors.New("standard input is not a terminal")
+	}
+	if _, err := stty("-echo"); err != nil {
+		return nil, err
+	}
+	return func() {
+		stty(strings.TrimSpace(saved))
+	}, nil
+}
+
+// terminalSize gets the number of columns and rows in the terminal.
+func terminalSize() (width, height int, err error) {
+	out, err := stty("size")
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := fmt.Sscanf(out, "%d %d", &height, &width); err != nil {
+		return 0, 0, err
+	}
+	return width, height, nil
+}
+
+// notifyResize sends on ch whenever the terminal is resized.
+func notifyResize(ch chan<- os.Signal) {
+	signal.Notify(ch, syscall.SIGWINCH)
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
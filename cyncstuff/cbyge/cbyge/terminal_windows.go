@@ -0,0 +1,21 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func makeRaw() (restore func(), err error) {
+	return nil, errors.New("the dashboard is not supported on Windows")
+}
+
+func disableEcho() (restore func(), err error) {
+	return nil, errors.New("hiding typed input is not supported on Windows")
+}
+
+func terminalSize() (width, height int, err error) {
+	return 0, 0, errors.New("the dashboard is not supported on Windows")
+}
+
+func notifyResize(ch chan<- os.Signal) {
+}
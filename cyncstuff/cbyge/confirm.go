@@ -0,0 +1,161 @@
+package cbyge
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultConfirmPolls           = 4
+	DefaultConfirmResends         = 2
+	DefaultConfirmPollInterval    = time.Second / 4
+	DefaultConfirmMaxPollInterval = time.Second * 2
+)
+
+// A ConfirmPolicy configures confirmed writes.
+//
+// When confirmed writes are enabled, every synchronous setter on a Controller
+// reads back the device's status until it reflects the requested change,
+// resending the change if the device does not converge.
+type ConfirmPolicy struct {
+	// MaxPolls is the number of status reads after each write.
+	// If it is 0, DefaultConfirmPolls is used.
+	MaxPolls int
+
+	// MaxResends is the number of times a write is sent again after the
+	// device's status fails to reflect it.
+	MaxResends int
+
+	// PollInterval is the delay before the first status read. The delay
+	// doubles after every read, up to MaxPollInterval.
+	//
+	// If PollInterval is 0, DefaultConfirmPollInterval is used. If
+	// MaxPollInterval is 0, the delay is not limited.
+	PollInterval    time.Duration
+	MaxPollInterval time.Duration
+}
+
+// DefaultConfirmPolicy creates a ConfirmPolicy with the default settings.
+func DefaultConfirmPolicy() *ConfirmPolicy {
+	return &ConfirmPolicy{
+		MaxPolls:        DefaultConfirmPolls,
+		MaxResends:      DefaultConfirmResends,
+		PollInterval:    DefaultConfirmPollInterval,
+		MaxPollInterval: DefaultConfirmMaxPollInterval,
+	}
+}
+
+// SetConfirmPolicy enables confirmed writes for synchronous setters like
+// SetDeviceLum().
+//
+// If p is nil, confirmed writes are disabled, which is the default.
+// Asynchronous setters never confirm their writes.
+//
+// When a device never converges, setters return a *ConvergenceError.
+func (c *Controller) SetConfirmPolicy(p *ConfirmPolicy) {
+	c.policyLock.Lock()
+	defer c.policyLock.Unlock()
+	c.confirmPolicy = p
+}
+
+func (c *Controller) getConfirmPolicy() *ConfirmPolicy {
+	c.policyLock.RLock()
+	defer c.policyLock.RUnlock()
+	return c.confirmPolicy
+}
+
+func (c *Controller) confirmWrite(d *ControllerDevice, context string, p *ConfirmPolicy,
+	send func() error, check func(ControllerDeviceStatus) bool) error {
+	status := func() (ControllerDeviceStatus, error) {
+		return c.DeviceStatus(d)
+	}
+	return confirmWrite(d.deviceID, context, p, send, status, check, time.Sleep)
+}
+
+// confirmWrite sends a change and polls status until check passes, resending
+// the change as needed. It waits between polls by calling sleep.
+func confirmWrite(deviceID, context string, p *ConfirmPolicy, send func() error,
+	status func() (ControllerDeviceStatus, error), check func(ControllerDeviceStatus) bool,
+	sleep func(time.Duration)) error {
+	maxPolls := p.MaxPolls
+	if maxPolls <= 0 {
+		maxPolls = DefaultConfirmPolls
+	}
+	pollInterval := p.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = DefaultConfirmPollInterval
+	}
+	var lastStatus ControllerDeviceStatus
+	var lastErr error
+	for attempt := 0; attempt <= p.MaxResends; attempt++ {
+		if err := send(); err != nil {
+			return err
+		}
+		interval := pollInterval
+		for i := 0; i < maxPolls; i++ {
+			sleep(interval)
+			interval *= 2
+			if p.MaxPollInterval != 0 && interval > p.MaxPollInterval {
+				interval = p.MaxPollInterval
+			}
+			current, err := status()
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			lastStatus = current
+			if check(current) {
+				return nil
+			}
+		}
+	}
+	return &ConvergenceError{
+		Context:  context,
+		DeviceID: deviceID,
+		Writes:   p.MaxResends + 1,
+		Status:   lastStatus,
+		Err:      lastErr,
+	}
+}
+
+// A ConvergenceError is returned by a confirmed write when the device's status
+// never reflects the requested change.
+type ConvergenceError struct {
+	Context  string
+	DeviceID string
+
+	// Writes is the number of times the change was sent.
+	Writes int
+
+	// Status is the last status read from the device.
+	// If no read succeeded, Status.IsOnline is false.
+	Status ControllerDeviceStatus
+
+	// Err is the last error encountered while reading the status, if any.
+	Err error
+}
+
+func (c *ConvergenceError) Error() string {
+	msg := "device " + c.DeviceID + " did not converge to the requested status"
+	if c.Err != nil && !c.Status.IsOnline {
+		msg += " (" + c.Err.Error() + ")"
+	}
+	if c.Context == "" {
+		return msg
+	}
+	return c.Context + ": " + msg
+}
+
+// Unwrap gets the last error encountered while reading the status, so that
+// errors.Is() and errors.As() can see it.
+func (c *ConvergenceError) Unwrap() error {
+	return c.Err
+}
+
+// IsConvergenceError returns true if the error was the result of a confirmed
+// write that never took effect.
+func IsConvergenceError(err error) bool {
+	var ce *ConvergenceError
+	return errors.As(err, &ce)
+}
@@ -0,0 +1,167 @@
+package cbyge
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/essentials"
+)
+
+func TestConfirmWriteConverges(t *testing.T) {
+	fake := &fakeStatusSource{
+		statuses: []ControllerDeviceStatus{offStatus(), offStatus(), onStatus()},
+	}
+	policy := &ConfirmPolicy{MaxPolls: 4, MaxResends: 2, PollInterval: time.Second}
+	err := confirmWrite("1", "set status", policy, fake.Send, fake.Status, isOn, fake.Sleep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.writes != 1 || fake.polls != 3 {
+		t.Errorf("unexpected writes %d and polls %d", fake.writes, fake.polls)
+	}
+	expected := []time.Duration{time.Second, time.Second * 2, time.Second * 4}
+	if !reflect.DeepEqual(fake.sleeps, expected) {
+		t.Errorf("expected sleeps %v but got %v", expected, fake.sleeps)
+	}
+}
+
+func TestConfirmWriteResends(t *testing.T) {
+	// The first write is lost, and the status converges after the second.
+	fake := &fakeStatusSource{
+		statuses: []ControllerDeviceStatus{offStatus(), offStatus(), offStatus(), onStatus()},
+	}
+	policy := &ConfirmPolicy{MaxPolls: 3, MaxResends: 1, PollInterval: time.Second,
+		MaxPollInterval: time.Second * 3}
+	err := confirmWrite("1", "set status", policy, fake.Send, fake.Status, isOn, fake.Sleep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.writes != 2 || fake.polls != 4 {
+		t.Errorf("unexpected writes %d and polls %d", fake.writes, fake.polls)
+	}
+
+	// The interval restarts after each write, and is capped.
+	expected := []time.Duration{time.Second, time.Second * 2, time.Second * 3, time.Second}
+	if !reflect.DeepEqual(fake.sleeps, expected) {
+		t.Errorf("expected sleeps %v but got %v", expected, fake.sleeps)
+	}
+}
+
+func TestConfirmWriteMaxPollInterval(t *testing.T) {
+	fake := &fakeStatusSource{}
+	policy := &ConfirmPolicy{MaxPolls: 5, PollInterval: time.Second,
+		MaxPollInterval: time.Second * 3}
+	confirmWrite("1", "", policy, fake.Send, fake.Status, isOn, fake.Sleep)
+	expected := []time.Duration{time.Second, time.Second * 2, time.Second * 3,
+		time.Second * 3, time.Second * 3}
+	if !reflect.DeepEqual(fake.sleeps, expected) {
+		t.Errorf("expected sleeps %v but got %v", expected, fake.sleeps)
+	}
+
+	// The defaults are used for zero values.
+	fake = &fakeStatusSource{}
+	confirmWrite("1", "", &ConfirmPolicy{}, fake.Send, fake.Status, isOn, fake.Sleep)
+	if len(fake.sleeps) != DefaultConfirmPolls || fake.sleeps[0] != DefaultConfirmPollInterval {
+		t.Errorf("unexpected sleeps: %v", fake.sleeps)
+	}
+}
+
+func TestConfirmWriteNeverConverges(t *testing.T) {
+	fake := &fakeStatusSource{
+		statuses: []ControllerDeviceStatus{offStatus()},
+		errs:     []error{nil, UnreachableError},
+	}
+	policy := &ConfirmPolicy{MaxPolls: 2, MaxResends: 2, PollInterval: time.Millisecond}
+	err := confirmWrite("1", "set status", policy, fake.Send, fake.Status, isOn, fake.Sleep)
+	var ce *ConvergenceError
+	if !errors.As(err, &ce) || !IsConvergenceError(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fake.writes != 3 || fake.polls != 6 {
+		t.Errorf("unexpected writes %d and polls %d", fake.writes, fake.polls)
+	}
+	if ce.DeviceID != "1" || ce.Writes != 3 || ce.Status != offStatus() {
+		t.Errorf("unexpected error fields: %+v", ce)
+	}
+
+	// The last read error is kept, but only mentioned when no status was read.
+	if !errors.Is(err, UnreachableError) {
+		t.Error("error should unwrap to the last read error")
+	}
+	expected := "set status: device 1 did not converge to the requested status"
+	if err.Error() != expected {
+		t.Errorf("expected %q but got %q", expected, err.Error())
+	}
+	ce = &ConvergenceError{DeviceID: "2", Writes: 1, Err: UnreachableError}
+	expected = "device 2 did not converge to the requested status (" +
+		UnreachableError.Error() + ")"
+	if ce.Error() != expected {
+		t.Errorf("expected %q but got %q", expected, ce.Error())
+	}
+	if IsConvergenceError(UnreachableError) {
+		t.Error("unexpected convergence error")
+	}
+	if !IsConvergenceError(errors.Wrap(ce, "context")) {
+		t.Error("wrapped error should be a convergence error")
+	}
+}
+
+func TestConfirmWriteSendError(t *testing.T) {
+	fake := &fakeStatusSource{sendErr: RemoteCallError}
+	err := confirmWrite("1", "", DefaultConfirmPolicy(), fake.Send, fake.Status, isOn,
+		fake.Sleep)
+	if err != RemoteCallError || fake.polls != 0 {
+		t.Errorf("unexpected error %v after %d polls", err, fake.polls)
+	}
+}
+
+// fakeStatusSource returns statuses and errors in order, repeating the last
+// ones once they run out.
+type fakeStatusSource struct {
+	statuses []ControllerDeviceStatus
+	errs     []error
+	sendErr  error
+
+	writes int
+	polls  int
+	sleeps []time.Duration
+}
+
+func (f *fakeStatusSource) Send() error {
+	f.writes++
+	return f.sendErr
+}
+
+func (f *fakeStatusSource) Status() (ControllerDeviceStatus, error) {
+	f.polls++
+	var status ControllerDeviceStatus
+	var err error
+	if len(f.statuses) > 0 {
+		status = f.statuses[essentials.MinInt(f.polls, len(f.statuses))-1]
+	}
+	if len(f.errs) > 0 {
+		err = f.errs[essentials.MinInt(f.polls, len(f.errs))-1]
+	}
+	return status, err
+}
+
+func (f *fakeStatusSource) Sleep(d time.Duration) {
+	f.sleeps = append(f.sleeps, d)
+}
+
+func isOn(s ControllerDeviceStatus) bool {
+	return s.IsOnline && s.IsOn
+}
+
+func onStatus() ControllerDeviceStatus {
+	return ControllerDeviceStatus{
+		IsOnline:                true,
+		StatusPaginatedResponse: StatusPaginatedResponse{IsOn: true, Brightness: 50},
+	}
+}
+
+func offStatus() ControllerDeviceStatus {
+	return ControllerDeviceStatus{IsOnline: true}
+}
@@ -22,9 +22,10 @@ type ControllerDeviceStatus struct {
 }
 
 type ControllerDevice struct {
-	deviceID string
-	switchID uint64
-	name     string
+	deviceID   string
+	switchID   uint64
+	name       string
+	deviceType int
 
 	lastStatus     ControllerDeviceStatus
 	lastStatusLock sync.RWMutex
@@ -50,6 +51,16 @@ func (c *ControllerDevice) LastStatus() ControllerDeviceStatus {
 	return c.lastStatus
 }
 
+// SwitchID gets the ID of the wifi-connected switch built into the device.
+//
+// If the device has no switch of its own, ok is false.
+func (c *ControllerDevice) SwitchID() (id uint32, ok bool) {
+	if !c.hasSwitch() {
+		return 0, false
+	}
+	return uint32(c.switchID), true
+}
+
 func (c *ControllerDevice) hasSwitch() bool {
 	return c.switchID&0xffffffff == c.switchID
 }
@@ -63,6 +74,28 @@ func (c *ControllerDevice) deviceIndex() int {
 	return int(parsed % 1000)
 }
 
+// A ControllerGroup is a user-defined group of devices, such as a room.
+type ControllerGroup struct {
+	groupID string
+	name    string
+	devices []*ControllerDevice
+}
+
+// GroupID gets a unique identifier for the group.
+func (c *ControllerGroup) GroupID() string {
+	return c.groupID
+}
+
+// Name gets the user-assigned name of the group.
+func (c *ControllerGroup) Name() string {
+	return c.name
+}
+
+// Devices gets the devices in the group.
+func (c *ControllerGroup) Devices() []*ControllerDevice {
+	return append([]*ControllerDevice{}, c.devices...)
+}
+
 // A Controller is a high-level API for manipulating C by GE devices.
 type Controller struct {
 	sessionInfoLock sync.RWMutex
@@ -70,11 +103,16 @@ type Controller struct {
 	timeout         time.Duration
 
 	// Each device has a list of switches which can reach it, and
-	// a current index into this list which is incremented round-robin
-	// every time reaching the device results in an error.
+	// the switch policy decides which of them to use.
 	switchMappingLock sync.RWMutex
 	switches          map[string][]uint32
-	switchIndices     map[string]int
+
+	// Optional behavior which can be configured after creation.
+	policyLock    sync.RWMutex
+	switchPolicy  SwitchPolicy
+	confirmPolicy *ConfirmPolicy
+	retryPolicy   *RetryPolicy
+	packetHook    PacketHook
 
 	// Prevent multiple PacketConns at once, since the server boots
 	// off one connection when anoher is made.
@@ -98,8 +136,8 @@ func NewController(s *SessionInfo, timeout time.Duration) *Controller {
 		sessionInfo: s,
 		timeout:     timeout,
 
-		switches:      map[string][]uint32{},
-		switchIndices: map[string]int{},
+		switches:     map[string][]uint32{},
+		switchPolicy: NewScoredSwitchPolicy(),
 
 		seqID: uint16(rng.Int63()),
 	}
@@ -128,16 +166,56 @@ func (c *Controller) Login(email, password string) error {
 	return nil
 }
 
+// SetSwitchPolicy changes the policy used to pick switches for devices.
+//
+// By default, a ScoredSwitchPolicy is used.
+func (c *Controller) SetSwitchPolicy(p SwitchPolicy) {
+	c.policyLock.Lock()
+	defer c.policyLock.Unlock()
+	c.switchPolicy = p
+}
+
+// A PacketHook is called with every packet that a Controller sends or
+// receives. The outgoing flag is true for packets sent to the server.
+//
+// Hooks are called synchronously, so they should return quickly.
+type PacketHook func(p *Packet, outgoing bool)
+
+// SetPacketHook sets a function to observe the packets sent and received by
+// the Controller. Pass nil to remove the hook.
+func (c *Controller) SetPacketHook(h PacketHook) {
+	c.policyLock.Lock()
+	defer c.policyLock.Unlock()
+	c.packetHook = h
+}
+
+// DeviceSwitches gets the IDs of the switches known to reach a device, in
+// the order that the switch policy prefers them.
+//
+// Switches are discovered when device statuses are fetched, so this is empty
+// until the first status call succeeds.
+func (c *Controller) DeviceSwitches(d *ControllerDevice) []uint32 {
+	return c.rankedSwitches(d)
+}
+
 // Devices enumerates the devices available to the account.
 //
 // Each device's status is available through its LastStatus() method.
 func (c *Controller) Devices() ([]*ControllerDevice, error) {
+	devs, _, err := c.DevicesAndGroups()
+	return devs, err
+}
+
+// DevicesAndGroups is like Devices, but also enumerates the groups which the
+// user has created for the devices.
+func (c *Controller) DevicesAndGroups() ([]*ControllerDevice, []*ControllerGroup, error) {
 	sessInfo := c.getSessionInfo()
 	devicesResponse, err := GetDevices(sessInfo.UserID, sessInfo.AccessToken)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	var results []*ControllerDevice
+	var groups []*ControllerGroup
 	for _, dev := range devicesResponse {
 		if !dev.IsOnline && !dev.IsActive {
 			// Some devices have no bulbs array, and can cause
@@ -148,23 +226,40 @@ func (c *Controller) Devices() ([]*ControllerDevice, error) {
 		props, err := GetDeviceProperties(sessInfo.AccessToken, dev.ProductID, dev.ID)
 		if err != nil {
 			if !IsPropertyNotExistsError(err) {
-				return nil, err
+				return nil, nil, err
 			}
 			continue
 		}
+		// Groups refer to devices by their index within
+		// this particular home.
+		indexToDev := map[int]*ControllerDevice{}
 		for _, bulb := range props.Bulbs {
 			cd := &ControllerDevice{
-				deviceID: strconv.FormatInt(bulb.DeviceID, 10),
-				switchID: bulb.SwitchID,
-				name:     bulb.DisplayName,
+				deviceID:   strconv.FormatInt(bulb.DeviceID, 10),
+				switchID:   bulb.SwitchID,
+				name:       bulb.DisplayName,
+				deviceType: bulb.DeviceType,
 			}
 			results = append(results, cd)
+			indexToDev[cd.deviceIndex()] = cd
+		}
+		for _, group := range props.Groups {
+			cg := &ControllerGroup{
+				groupID: strconv.FormatUint(uint64(dev.ID), 10) + "-" + strconv.Itoa(group.GroupID),
+				name:    group.DisplayName,
+			}
+			for _, idx := range group.DeviceIDs {
+				if d, ok := indexToDev[idx%1000]; ok {
+					cg.devices = append(cg.devices, d)
+				}
+			}
+			groups = append(groups, cg)
 		}
 	}
 	// Update device status. If this fails, we swallow the error
 	// because the device(s) are automatically marked offline.
 	c.DeviceStatuses(results)
-	return results, nil
+	return results, groups, nil
 }
 
 // DeviceStatus gets the status for a previously enumerated device.
@@ -174,17 +269,16 @@ func (c *Controller) Devices() ([]*ControllerDevice, error) {
 func (c *Controller) DeviceStatus(d *ControllerDevice) (ControllerDeviceStatus, error) {
 	var packets []*Packet
 	seqIDs := map[uint16]bool{}
-	c.switchMappingLock.RLock()
+	switches := c.rankedSwitches(d)
 	var curSwitch uint32
-	if len(c.switches[d.deviceID]) > 0 {
-		curSwitch = c.switches[d.deviceID][c.switchIndices[d.deviceID]]
+	if len(switches) > 0 {
+		curSwitch = switches[0]
 	}
-	for _, switchID := range c.switches[d.deviceID] {
+	for _, switchID := range switches {
 		seqID := c.nextSeqID()
 		packets = append(packets, NewPacketGetStatusPaginated(switchID, seqID))
 		seqIDs[seqID] = true
 	}
-	c.switchMappingLock.RUnlock()
 
 	if len(packets) == 0 {
 		return ControllerDeviceStatus{}, errors.Wrap(UnreachableError, "lookup device status")
@@ -193,6 +287,8 @@ func (c *Controller) DeviceStatus(d *ControllerDevice) (ControllerDeviceStatus,
 	var responsePacket *StatusPaginatedResponse
 	var decodeErr error
 	var numResponses int
+	responded := map[uint32]bool{}
+	start := time.Now()
 	err := c.callAndWait(packets, false, func(p *Packet) bool {
 		if seq, err := p.Seq(); err == nil && p.IsResponse && !seqIDs[seq] {
 			// This is a response to a packet we did not send.
@@ -206,6 +302,10 @@ func (c *Controller) DeviceStatus(d *ControllerDevice) (ControllerDeviceStatus,
 				// device, since it will be the most up-to-date.
 				switchID := binary.BigEndian.Uint32(p.Data[:4])
 				isPrimary := d.isSwitch(switchID)
+				if !responded[switchID] {
+					responded[switchID] = true
+					c.recordSwitch(d, switchID, time.Since(start), nil)
+				}
 
 				for _, resp := range responses {
 					if resp.Device == d.deviceIndex() {
@@ -232,9 +332,22 @@ func (c *Controller) DeviceStatus(d *ControllerDevice) (ControllerDeviceStatus,
 			if decodeErr == nil {
 				decodeErr = RemoteCallError
 			}
+			switchID := binary.BigEndian.Uint32(p.Data[:4])
+			if !responded[switchID] {
+				responded[switchID] = true
+				c.recordSwitch(d, switchID, time.Since(start), RemoteCallError)
+			}
 		}
 		return numResponses >= len(packets)
 	})
+	if err != nil {
+		// Switches which never answered are as good as broken.
+		for _, switchID := range switches {
+			if !responded[switchID] {
+				c.recordSwitch(d, switchID, time.Since(start), err)
+			}
+		}
+	}
 
 	if responsePacket != nil {
 		status := ControllerDeviceStatus{
@@ -252,7 +365,6 @@ func (c *Controller) DeviceStatus(d *ControllerDevice) (ControllerDeviceStatus,
 	} else if err == nil {
 		err = UnreachableError
 	}
-	c.switchFailed(d)
 	return ControllerDeviceStatus{}, errors.Wrap(err, "lookup device status")
 }
 
@@ -268,11 +380,13 @@ func (c *Controller) DeviceStatuses(devs []*ControllerDevice) ([]ControllerDevic
 	packets := make([]*Packet, 0, len(devs))
 	devIndexToDev := map[int]*ControllerDevice{}
 	switchToPacketIndex := map[uint32]int{}
+	switchToDev := map[uint32]*ControllerDevice{}
 	seqIDs := map[uint16]bool{}
 	for _, d := range devs {
 		devIndexToDev[d.deviceIndex()] = d
 		if d.hasSwitch() {
 			switchToPacketIndex[uint32(d.switchID)] = len(packets)
+			switchToDev[uint32(d.switchID)] = d
 			seqID := c.nextSeqID()
 			packet := NewPacketGetStatusPaginated(uint32(d.switchID), seqID)
 			packets = append(packets, packet)
@@ -289,6 +403,7 @@ func (c *Controller) DeviceStatuses(devs []*ControllerDevice) ([]ControllerDevic
 	}
 
 	devToStatus := map[*ControllerDevice]ControllerDeviceStatus{}
+	start := time.Now()
 	err := c.callAndWait(packets, false, func(p *Packet) bool {
 		if seq, err := p.Seq(); err == nil && p.IsResponse && !seqIDs[seq] {
 			// This is a response to a packet we did not send.
@@ -301,6 +416,7 @@ func (c *Controller) DeviceStatuses(devs []*ControllerDevice) ([]ControllerDevic
 				return false
 			}
 			hasResponses[devIdx] = true
+			c.recordSwitch(switchToDev[switchID], switchID, time.Since(start), nil)
 			responses, err := DecodeStatusPaginatedResponse(p)
 			if err == nil {
 				for _, resp := range responses {
@@ -321,6 +437,8 @@ func (c *Controller) DeviceStatuses(devs []*ControllerDevice) ([]ControllerDevic
 			packetIdx, ok := switchToPacketIndex[switchID]
 			if ok && !hasResponses[packetIdx] {
 				hasResponses[packetIdx] = true
+				c.recordSwitch(switchToDev[switchID], switchID, time.Since(start),
+					RemoteCallError)
 			}
 		}
 		for _, hasResponse := range hasResponses {
@@ -330,6 +448,13 @@ func (c *Controller) DeviceStatuses(devs []*ControllerDevice) ([]ControllerDevic
 		}
 		return true
 	})
+	if err != nil {
+		for switchID, packetIdx := range switchToPacketIndex {
+			if !hasResponses[packetIdx] {
+				c.recordSwitch(switchToDev[switchID], switchID, time.Since(start), err)
+			}
+		}
+	}
 
 	// Even if there was no timeout, some devices may simply not
 	// be reachable because they aren't connected to any switches.
@@ -367,27 +492,27 @@ func (c *Controller) SetDeviceStatusAsync(d *ControllerDevice, status bool) erro
 }
 
 func (c *Controller) setDeviceStatus(d *ControllerDevice, status, async bool) error {
-	switchID, err := c.currentSwitch(d)
-	if err != nil {
-		return errors.Wrap(err, "set device status")
-	}
 	statusInt := 0
 	if status {
 		statusInt = 1
 	}
-	packet := NewPacketSetDeviceStatus(switchID, c.nextSeqID(), d.deviceIndex(), statusInt)
-	return c.checkedSwitch(d, c.callAndWaitSimple(packet, "set device status", async))
+	return c.write(d, "set device status", async, func(switchID uint32) *Packet {
+		return NewPacketSetDeviceStatus(switchID, c.nextSeqID(), d.deviceIndex(), statusInt)
+	}, func(s ControllerDeviceStatus) bool {
+		return s.IsOn == status
+	})
 }
 
 // BlastDeviceStatuses asynchronously turns on or off many devices in bulk.
 // It will use up to numSwitches switches per device, providing redundancy if
-// some switches are not connected.
+// some switches are not connected. The switches are chosen by the
+// Controller's SwitchPolicy.
 // If numSwitches is 0, one switch will be used per device.
 func (c *Controller) BlastDeviceStatuses(ds []*ControllerDevice, statuses []bool,
 	numSwitches int) error {
 	var packets []*Packet
 	for i, d := range ds {
-		switchIDs, err := c.randomSwitches(d, numSwitches)
+		switchIDs, err := c.preferredSwitches(d, numSwitches)
 		if err != nil {
 			return errors.Wrap(err, "blast device statuses")
 		}
@@ -420,12 +545,11 @@ func (c *Controller) SetDeviceLumAsync(d *ControllerDevice, lum int) error {
 }
 
 func (c *Controller) setDeviceLum(d *ControllerDevice, lum int, async bool) error {
-	switchID, err := c.currentSwitch(d)
-	if err != nil {
-		return errors.Wrap(err, "set device luminance")
-	}
-	packet := NewPacketSetLum(switchID, c.nextSeqID(), d.deviceIndex(), lum)
-	return c.checkedSwitch(d, c.callAndWaitSimple(packet, "set device luminance", async))
+	return c.write(d, "set device luminance", async, func(switchID uint32) *Packet {
+		return NewPacketSetLum(switchID, c.nextSeqID(), d.deviceIndex(), lum)
+	}, func(s ControllerDeviceStatus) bool {
+		return int(s.Brightness) == lum
+	})
 }
 
 // SetDeviceRGB changes a device's RGB.
@@ -440,12 +564,11 @@ func (c *Controller) SetDeviceRGBAsync(d *ControllerDevice, r, g, b uint8) error
 }
 
 func (c *Controller) setDeviceRGB(d *ControllerDevice, r, g, b uint8, async bool) error {
-	switchID, err := c.currentSwitch(d)
-	if err != nil {
-		return errors.Wrap(err, "set device RGB")
-	}
-	packet := NewPacketSetRGB(switchID, c.nextSeqID(), d.deviceIndex(), r, g, b)
-	return c.checkedSwitch(d, c.callAndWaitSimple(packet, "set device RGB", async))
+	return c.write(d, "set device RGB", async, func(switchID uint32) *Packet {
+		return NewPacketSetRGB(switchID, c.nextSeqID(), d.deviceIndex(), r, g, b)
+	}, func(s ControllerDeviceStatus) bool {
+		return s.UseRGB && s.RGB == [3]uint8{r, g, b}
+	})
 }
 
 // SetDeviceCT changes a device's color tone.
@@ -462,82 +585,82 @@ func (c *Controller) SetDeviceCTAsync(d *ControllerDevice, ct int) error {
 }
 
 func (c *Controller) setDeviceCT(d *ControllerDevice, ct int, async bool) error {
-	switchID, err := c.currentSwitch(d)
-	if err != nil {
-		return errors.Wrap(err, "set device color tone")
+	return c.write(d, "set device color tone", async, func(switchID uint32) *Packet {
+		return NewPacketSetCT(switchID, c.nextSeqID(), d.deviceIndex(), ct)
+	}, func(s ControllerDeviceStatus) bool {
+		return !s.UseRGB && int(s.ColorTone) == ct
+	})
+}
+
+// write sends a packet to a device through its current switch.
+//
+// If confirmed writes are enabled and async is false, then the device status
+// is polled until check() returns true for it.
+func (c *Controller) write(d *ControllerDevice, context string, async bool,
+	makePacket func(switchID uint32) *Packet, check func(ControllerDeviceStatus) bool) error {
+	send := func() error {
+		return c.sendWithRetry(d, context, async, makePacket)
+	}
+	policy := c.getConfirmPolicy()
+	if policy == nil || async {
+		return send()
 	}
-	packet := NewPacketSetCT(switchID, c.nextSeqID(), d.deviceIndex(), ct)
-	return c.checkedSwitch(d, c.callAndWaitSimple(packet, "set device color tone", async))
+	return c.confirmWrite(d, context, policy, send, check)
 }
 
 func (c *Controller) addSwitchMapping(dev *ControllerDevice, switchID uint32) {
 	c.switchMappingLock.Lock()
 	defer c.switchMappingLock.Unlock()
 
-	// If this is the device's switch, then we should set
-	// the device to use this switch since it's known to be
-	// accessible.
-	updateIndex := dev.isSwitch(switchID)
-
-	for i, x := range c.switches[dev.deviceID] {
+	for _, x := range c.switches[dev.deviceID] {
 		if x == switchID {
-			if updateIndex {
-				c.switchIndices[dev.deviceID] = i
-			}
 			return
 		}
 	}
 	c.switches[dev.deviceID] = append(c.switches[dev.deviceID], switchID)
-	if updateIndex {
-		c.switchIndices[dev.deviceID] = len(c.switches[dev.deviceID]) - 1
-	}
 }
 
-func (c *Controller) currentSwitch(dev *ControllerDevice) (uint32, error) {
+// rankedSwitches gets the switches which can reach a device, ordered by the
+// switch policy.
+func (c *Controller) rankedSwitches(dev *ControllerDevice) []uint32 {
 	c.switchMappingLock.RLock()
-	defer c.switchMappingLock.RUnlock()
-
-	switches := c.switches[dev.deviceID]
+	switches := append([]uint32{}, c.switches[dev.deviceID]...)
+	c.switchMappingLock.RUnlock()
 	if len(switches) == 0 {
-		return 0, UnreachableError
+		return nil
 	}
-	return switches[c.switchIndices[dev.deviceID]], nil
+	return c.getSwitchPolicy().Rank(dev, switches)
 }
 
-func (c *Controller) checkedSwitch(dev *ControllerDevice, err error) error {
-	if err != nil {
-		c.switchFailed(dev)
+func (c *Controller) preferredSwitches(dev *ControllerDevice, max int) ([]uint32, error) {
+	switches := c.rankedSwitches(dev)
+	if len(switches) == 0 {
+		return nil, UnreachableError
 	}
-	return err
+	return switches[:essentials.MaxInt(1, essentials.MinInt(len(switches), max))], nil
 }
 
-func (c *Controller) switchFailed(dev *ControllerDevice) {
-	c.switchMappingLock.Lock()
-	defer c.switchMappingLock.Unlock()
-	// Round-robin through supported switches.
-	switches := c.switches[dev.deviceID]
-	c.switchIndices[dev.deviceID] = (c.switchIndices[dev.deviceID] + 1) % len(switches)
+func (c *Controller) checkedCall(dev *ControllerDevice, switchID uint32, p *Packet,
+	context string, async bool, timeout time.Duration) error {
+	start := time.Now()
+	err := c.callAndWaitSimple(p, context, async, timeout)
+	c.recordSwitch(dev, switchID, time.Since(start), err)
+	return err
 }
 
-func (c *Controller) randomSwitches(dev *ControllerDevice, max int) ([]uint32, error) {
-	c.switchMappingLock.RLock()
-	defer c.switchMappingLock.RUnlock()
-	ordered := c.switches[dev.deviceID]
-	if len(ordered) == 0 {
-		return nil, UnreachableError
-	}
-	cur := c.switchIndices[dev.deviceID]
-	res := []uint32{ordered[cur]}
-
-	shuffled := append(append([]uint32{}, ordered[:cur]...), ordered[cur+1:]...)
-	rand.Shuffle(len(shuffled), func(i, j int) {
-		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
-	})
+func (c *Controller) recordSwitch(dev *ControllerDevice, switchID uint32, rtt time.Duration,
+	err error) {
+	c.getSwitchPolicy().Record(dev, switchID, rtt, err)
+}
 
-	return append(res, shuffled[:essentials.MinInt(len(shuffled), max-1)]...), nil
+func (c *Controller) getSwitchPolicy() SwitchPolicy {
+	c.policyLock.RLock()
+	defer c.policyLock.RUnlock()
+	return c.switchPolicy
 }
 
-func (c *Controller) callAndWaitSimple(p *Packet, context string, async bool) error {
+func (c *Controller) callAndWaitSimple(p *Packet, context string, async bool,
+	timeout time.Duration) error {
 	seq, err := p.Seq()
 	if err != nil {
 		return err
@@ -559,7 +682,7 @@ func (c *Controller) callAndWaitSimple(p *Packet, context string, async bool) er
 	// never receive a sync packet and the call times out.
 	gotResponse := false
 	gotSync := false
-	err = c.callAndWait([]*Packet{p}, true, func(p *Packet) bool {
+	err = c.callAndWaitTimeout([]*Packet{p}, true, timeout, func(p *Packet) bool {
 		seq1, err := p.Seq()
 		if err == nil && seq == seq1 && p.IsResponse {
 			gotResponse = true
@@ -577,9 +700,32 @@ func (c *Controller) callAndWaitSimple(p *Packet, context string, async bool) er
 	return nil
 }
 
+// Ping connects and authenticates to the packet server, checking that it is
+// reachable and that the session is still valid.
+//
+// Like other calls, it waits for any call in progress to finish, since a
+// new connection would cut off the existing one.
+func (c *Controller) Ping() error {
+	c.packetConnLock.Lock()
+	defer c.packetConnLock.Unlock()
+
+	conn, err := NewPacketConn()
+	if err != nil {
+		return errors.Wrap(err, "ping")
+	}
+	defer conn.Close()
+	sessInfo := c.getSessionInfo()
+	return errors.Wrap(conn.Auth(sessInfo.UserID, sessInfo.Authorize, c.timeout), "ping")
+}
+
 // callAndWait sends packets on a new PacketConn and waits until f returns
 // true on a response, or waits for a timeout.
 func (c *Controller) callAndWait(p []*Packet, checkError bool, f func(*Packet) bool) error {
+	return c.callAndWaitTimeout(p, checkError, c.timeout, f)
+}
+
+func (c *Controller) callAndWaitTimeout(p []*Packet, checkError bool, timeout time.Duration,
+	f func(*Packet) bool) error {
 	c.packetConnLock.Lock()
 	defer c.packetConnLock.Unlock()
 
@@ -597,7 +743,7 @@ func (c *Controller) callAndWait(p []*Packet, checkError bool, f func(*Packet) b
 	defer conn.Close()
 
 	sessInfo := c.getSessionInfo()
-	if err := conn.Auth(sessInfo.UserID, sessInfo.Authorize, c.timeout); err != nil {
+	if err := conn.Auth(sessInfo.UserID, sessInfo.Authorize, timeout); err != nil {
 		return err
 	}
 
@@ -616,6 +762,7 @@ func (c *Controller) callAndWait(p []*Packet, checkError bool, f func(*Packet) b
 				errChan <- err
 				return
 			}
+			c.observePacket(packet, false)
 			if checkError && packet.IsResponse {
 				seq, err := packet.Seq()
 				if err == nil && checkSeqs[seq] && len(packet.Data) > 0 {
@@ -634,12 +781,13 @@ func (c *Controller) callAndWait(p []*Packet, checkError bool, f func(*Packet) b
 	}()
 
 	for _, subPacket := range p {
+		c.observePacket(subPacket, true)
 		if err := conn.Write(subPacket); err != nil {
 			return err
 		}
 	}
 
-	timeout := time.After(c.timeout)
+	timeoutChan := time.After(timeout)
 	for {
 		select {
 		case packet, ok := <-packets:
@@ -657,7 +805,7 @@ func (c *Controller) callAndWait(p []*Packet, checkError bool, f func(*Packet) b
 			}
 		case err := <-errChan:
 			return err
-		case <-timeout:
+		case <-timeoutChan:
 			return errors.New("timeout waiting for response")
 		}
 	}
@@ -686,6 +834,7 @@ func (c *Controller) blastPackets(p []*Packet) error {
 	}
 
 	for _, subPacket := range p {
+		c.observePacket(subPacket, true)
 		if err := conn.Write(subPacket); err != nil {
 			conn.Close()
 			return err
@@ -695,6 +844,15 @@ func (c *Controller) blastPackets(p []*Packet) error {
 	return conn.Close()
 }
 
+func (c *Controller) observePacket(p *Packet, outgoing bool) {
+	c.policyLock.RLock()
+	hook := c.packetHook
+	c.policyLock.RUnlock()
+	if hook != nil {
+		hook(p, outgoing)
+	}
+}
+
 func (c *Controller) getSessionInfo() *SessionInfo {
 	c.sessionInfoLock.RLock()
 	defer c.sessionInfoLock.RUnlock()
@@ -1,8 +1,10 @@
 module github.com/unixpickle/cbyge
 
-go 1.14
+go 1.16
 
 require (
+	github.com/gorilla/websocket v1.5.0
 	github.com/pkg/errors v0.9.1
 	github.com/unixpickle/essentials v1.3.0
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
 )
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// harHeader and harTrailer surround the entries of a HAR file.
+const (
+	harHeader = `{
+  "log": {
+    "version": "1.2",
+    "creator": {"name": "cbyge httpproxy", "version": "1.0"},
+    "entries": [`
+	harTrailer = "\n    ]\n  }\n}\n"
+)
+
+// A HARWriter records exchanges in a HAR (HTTP Archive) file.
+//
+// Each exchange is written over the end of the file, followed by a new
+// trailer, so that the file is always a complete HAR document without
+// keeping old entries in memory.
+type HARWriter struct {
+	lock    sync.Mutex
+	file    *os.File
+	offset  int64
+	entries int
+}
+
+// NewHARWriter creates a HARWriter which writes to path.
+func NewHARWriter(path string) (*HARWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteString(harHeader + harTrailer); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &HARWriter{file: f, offset: int64(len(harHeader))}, nil
+}
+
+// An Exchange is a request and response which passed through the proxy.
+type Exchange struct {
+	Start       time.Time
+	Wait        time.Duration
+	Receive     time.Duration
+	Method      string
+	URL         string
+	Proto       string
+	ReqHeader   http.Header
+	ReqBody     []byte
+	ReqBodySize int64
+
+	Status       int
+	StatusText   string
+	RespHeader   http.Header
+	RespBody     []byte
+	RespBodySize int64
+
+	// Truncated is true if the bodies were too long to store completely.
+	Truncated bool
+}
+
+// Add records an exchange and saves the file.
+func (h *HARWriter) Add(e *Exchange) error {
+	data, err := json.MarshalIndent(newHAREntry(e), "      ", "  ")
+	if err != nil {
+		return err
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	entry := "\n      " + string(data)
+	if h.entries > 0 {
+		entry = "," + entry
+	}
+	if _, err := h.file.WriteAt([]byte(entry+harTrailer), h.offset); err != nil {
+		return err
+	}
+	h.offset += int64(len(entry))
+	h.entries++
+	return nil
+}
+
+type harEntry struct {
+	StartedDateTime string                 `json:"startedDateTime"`
+	Time            float64                `json:"time"`
+	Request         *harRequest            `json:"request"`
+	Response        *harResponse           `json:"response"`
+	Cache           map[string]interface{} `json:"cache"`
+	Timings         map[string]float64     `json:"timings"`
+	Comment         string                 `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     *harContent    `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+func newHAREntry(e *Exchange) *harEntry {
+	wait := float64(e.Wait) / float64(time.Millisecond)
+	receive := float64(e.Receive) / float64(time.Millisecond)
+	entry := &harEntry{
+		StartedDateTime: e.Start.Format(time.RFC3339Nano),
+		Time:            wait + receive,
+		Request: &harRequest{
+			Method:      e.Method,
+			URL:         e.URL,
+			HTTPVersion: e.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(e.ReqHeader),
+			QueryString: harQuery(e.URL),
+			HeadersSize: -1,
+			BodySize:    e.ReqBodySize,
+		},
+		Response: &harResponse{
+			Status:      e.Status,
+			StatusText:  e.StatusText,
+			HTTPVersion: e.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(e.RespHeader),
+			Content: &harContent{
+				Size:     e.RespBodySize,
+				MimeType: e.RespHeader.Get("Content-Type"),
+			},
+			RedirectURL: e.RespHeader.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    e.RespBodySize,
+		},
+		Cache:   map[string]interface{}{},
+		Timings: map[string]float64{"send": 0, "wait": wait, "receive": receive},
+	}
+	if len(e.ReqBody) > 0 {
+		entry.Request.PostData = &harPostData{
+			MimeType: e.ReqHeader.Get("Content-Type"),
+			Text:     string(e.ReqBody),
+		}
+	}
+	if utf8.Valid(e.RespBody) {
+		entry.Response.Content.Text = string(e.RespBody)
+	} else {
+		entry.Response.Content.Text = base64.StdEncoding.EncodeToString(e.RespBody)
+		entry.Response.Content.Encoding = "base64"
+	}
+	if e.Truncated {
+		entry.Comment = "bodies were truncated"
+	}
+	return entry
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	res := []harNameValue{}
+	for name, values := range h {
+		for _, value := range values {
+			res = append(res, harNameValue{Name: name, Value: value})
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+func harQuery(rawURL string) []harNameValue {
+	res := []harNameValue{}
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return res
+	}
+	for name, values := range req.URL.Query() {
+		for _, value := range values {
+			res = append(res, harNameValue{Name: name, Value: value})
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
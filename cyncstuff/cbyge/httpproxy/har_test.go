@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHARWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.har")
+	h, err := NewHARWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.file.Close()
+	if entries := readHAR(t, path); len(entries) != 0 {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+
+	// The file is a complete document after every entry.
+	for i := 0; i < 3; i++ {
+		exchange := &Exchange{
+			Start:      time.Now(),
+			Method:     "POST",
+			URL:        "https://api.example.com/v2/user_auth?n=" + strconv.Itoa(i),
+			Proto:      "HTTP/1.1",
+			ReqHeader:  http.Header{"Content-Type": {"application/json"}},
+			ReqBody:    []byte(`{"n":` + strconv.Itoa(i) + `}`),
+			Status:     200,
+			RespHeader: http.Header{},
+			RespBody:   []byte{0xff, 0xfe},
+			Truncated:  i == 2,
+		}
+		if err := h.Add(exchange); err != nil {
+			t.Fatal(err)
+		}
+		entries := readHAR(t, path)
+		if len(entries) != i+1 {
+			t.Fatalf("expected %d entries but got %d", i+1, len(entries))
+		}
+		for j, entry := range entries {
+			if entry.Request.QueryString[0].Value != strconv.Itoa(j) {
+				t.Errorf("entry %d has the wrong query: %v", j, entry.Request.QueryString)
+			}
+		}
+		last := entries[i]
+		if last.Request.PostData.Text != string(exchange.ReqBody) {
+			t.Errorf("unexpected post data: %+v", last.Request.PostData)
+		}
+		if last.Response.Content.Encoding != "base64" || last.Response.Content.Text != "//4=" {
+			t.Errorf("unexpected content: %+v", last.Response.Content)
+		}
+		if (last.Comment != "") != exchange.Truncated {
+			t.Errorf("unexpected comment: %q", last.Comment)
+		}
+	}
+}
+
+func readHAR(t *testing.T, path string) []*harEntry {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Log struct {
+			Version string      `json:"version"`
+			Entries []*harEntry `json:"entries"`
+		} `json:"log"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("invalid HAR: %v\n%s", err, data)
+	}
+	if doc.Log.Version != "1.2" {
+		t.Fatalf("unexpected version: %q", doc.Log.Version)
+	}
+	return doc.Log.Entries
+}
@@ -3,55 +3,241 @@ package main
 import (
 	"bytes"
 	"flag"
-	"io/ioutil"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/unixpickle/essentials"
 )
 
-var TargetURL url.URL
-
 func main() {
 	var target string
 	var addr string
+	var harPath string
+	var noRedact bool
+	proxy := &Proxy{}
 	flag.StringVar(&target, "target", "https://api.gelighting.com", "target URL base")
 	flag.StringVar(&addr, "addr", ":8080", "listen address")
+	flag.StringVar(&harPath, "har", "", "also write exchanges to this HAR file")
+	flag.BoolVar(&noRedact, "no-redact", false,
+		"log and capture passwords and tokens instead of hiding them")
+	flag.IntVar(&proxy.MaxBody, "max-body", 1<<20,
+		"maximum number of body bytes to log and capture per message")
+	flag.DurationVar(&proxy.Client.Timeout, "timeout", time.Minute,
+		"timeout for upstream requests")
 	flag.Parse()
 
 	targetURL, err := url.Parse(target)
 	essentials.Must(err)
-	TargetURL = *targetURL
+	proxy.Target = targetURL
+	proxy.Redact = !noRedact
+	if harPath != "" {
+		proxy.HAR, err = NewHARWriter(harPath)
+		essentials.Must(err)
+	}
 
-	http.HandleFunc("/", ProxyRequest)
-	essentials.Must(http.ListenAndServe(addr, nil))
+	// Redirects and compressed bodies are passed to the client untouched.
+	proxy.Client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	proxy.Client.Transport = &http.Transport{
+		Proxy:              http.ProxyFromEnvironment,
+		DisableCompression: true,
+	}
+
+	log.Printf("forwarding %s to %s", addr, targetURL)
+	essentials.Must(http.ListenAndServe(addr, proxy))
 }
 
-func ProxyRequest(w http.ResponseWriter, r *http.Request) {
-	var data []byte
-	if r.Body != nil {
-		data, _ = ioutil.ReadAll(r.Body)
-	}
+// hopHeaders are only meaningful for a single connection, so they are not
+// forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
 
-	log.Printf("%s <- %s", r.URL.String(), string(data))
+// A Proxy forwards HTTP requests to a target server, logging the exchanges.
+type Proxy struct {
+	Target *url.URL
+	Client http.Client
+
+	// Redact hides passwords and tokens in logs and captures.
+	Redact bool
+
+	// MaxBody limits how much of each body is logged and captured. Bodies
+	// are always forwarded in full.
+	MaxBody int
+
+	// HAR optionally records every exchange.
+	HAR *HARWriter
+}
+
+// ServeHTTP forwards a request and streams back the response.
+//
+// If the target cannot be reached, the client gets a 502 response.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	reqBody := &capture{limit: p.MaxBody}
+	var body io.Reader
+	if r.Body != nil && r.ContentLength != 0 {
+		body = io.TeeReader(r.Body, reqBody)
+	}
 
 	tu := *r.URL
-	tu.Host = TargetURL.Host
-	tu.Scheme = TargetURL.Scheme
-	proxyReq, err := http.NewRequest(r.Method, tu.String(), bytes.NewReader(data))
+	tu.Host = p.Target.Host
+	tu.Scheme = p.Target.Scheme
+	tu.Path = singleJoiningSlash(p.Target.Path, r.URL.Path)
+	proxyReq, err := http.NewRequestWithContext(r.Context(), r.Method, tu.String(), body)
+	if err != nil {
+		p.fail(w, r, err)
+		return
+	}
+	proxyReq.ContentLength = r.ContentLength
+	proxyReq.Header = cloneEndToEnd(r.Header)
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		proxyReq.Header.Add("X-Forwarded-For", clientIP)
+	}
+
+	resp, err := p.Client.Do(proxyReq)
 	if err != nil {
-		log.Println(err)
+		p.fail(w, r, err)
 		return
 	}
-	proxyReq.Header.Set("content-type", r.Header.Get("content-type"))
-	proxyReq.Header.Set("access-token", r.Header.Get("access-token"))
-	proxyReq.Header.Set("cookie", r.Header.Get("cookie"))
-	resp, err := (&http.Client{}).Do(proxyReq)
-	data, _ = ioutil.ReadAll(resp.Body)
-	log.Printf("%s (%s) -> %s", r.URL.String(), resp.Status, string(data))
-	w.Header().Set("set-cookie", resp.Header.Get("cookie"))
-	w.Header().Set("content-type", resp.Header.Get("content-type"))
+	defer resp.Body.Close()
+	wait := time.Since(start)
+
+	respHeader := cloneEndToEnd(resp.Header)
+	for name, values := range respHeader {
+		w.Header()[name] = values
+	}
 	w.WriteHeader(resp.StatusCode)
-	w.Write(data)
+
+	respBody := &capture{limit: p.MaxBody}
+	_, copyErr := io.Copy(flushWriter{w}, io.TeeReader(resp.Body, respBody))
+	receive := time.Since(start) - wait
+
+	exchange := &Exchange{
+		Start:        start,
+		Wait:         wait,
+		Receive:      receive,
+		Method:       r.Method,
+		URL:          tu.String(),
+		Proto:        r.Proto,
+		ReqHeader:    r.Header,
+		ReqBody:      reqBody.Bytes(),
+		ReqBodySize:  reqBody.size,
+		Status:       resp.StatusCode,
+		StatusText:   http.StatusText(resp.StatusCode),
+		RespHeader:   resp.Header,
+		RespBody:     respBody.Bytes(),
+		RespBodySize: respBody.size,
+		Truncated:    reqBody.truncated || respBody.truncated,
+	}
+	if p.Redact {
+		p.redact(exchange, proxyReq.URL)
+	}
+	log.Printf("%s %s <- %s", exchange.Method, exchange.URL, exchange.ReqBody)
+	log.Printf("%s %s (%s) -> %s", exchange.Method, exchange.URL, resp.Status,
+		exchange.RespBody)
+	if copyErr != nil {
+		log.Printf("%s %s: error copying response: %s", exchange.Method, exchange.URL,
+			copyErr)
+	}
+	if p.HAR != nil {
+		if err := p.HAR.Add(exchange); err != nil {
+			log.Printf("error writing HAR: %s", err)
+		}
+	}
+}
+
+func (p *Proxy) fail(w http.ResponseWriter, r *http.Request, err error) {
+	u := r.URL.String()
+	if p.Redact {
+		u = RedactURL(r.URL)
+	}
+	log.Printf("%s %s: %s", r.Method, u, err)
+	http.Error(w, "bad gateway: "+err.Error(), http.StatusBadGateway)
+}
+
+func (p *Proxy) redact(e *Exchange, u *url.URL) {
+	e.URL = RedactURL(u)
+	e.ReqHeader = RedactHeader(e.ReqHeader)
+	e.RespHeader = RedactHeader(e.RespHeader)
+	e.ReqBody = RedactBody(e.ReqHeader.Get("Content-Type"), e.ReqBody)
+	e.RespBody = RedactBody(e.RespHeader.Get("Content-Type"), e.RespBody)
+}
+
+// cloneEndToEnd copies a header without its hop-by-hop fields, including
+// the ones named in the Connection header.
+func cloneEndToEnd(h http.Header) http.Header {
+	res := h.Clone()
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			res.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		res.Del(name)
+	}
+	return res
+}
+
+func singleJoiningSlash(a, b string) string {
+	aSlash := strings.HasSuffix(a, "/")
+	bSlash := strings.HasPrefix(b, "/")
+	switch {
+	case aSlash && bSlash:
+		return a + b[1:]
+	case !aSlash && !bSlash && a != "" && b != "":
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// A capture keeps the first bytes written to it, up to a limit, and counts
+// the rest.
+type capture struct {
+	bytes.Buffer
+	limit     int
+	size      int64
+	truncated bool
+}
+
+func (c *capture) Write(data []byte) (int, error) {
+	c.size += int64(len(data))
+	if remaining := c.limit - c.Len(); remaining < len(data) {
+		c.truncated = true
+		if remaining > 0 {
+			c.Buffer.Write(data[:remaining])
+		}
+	} else {
+		c.Buffer.Write(data)
+	}
+	return len(data), nil
+}
+
+// flushWriter flushes after every write so that streamed responses reach
+// the client as they arrive.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(data []byte) (int, error) {
+	n, err := f.w.Write(data)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCapture(t *testing.T) {
+	c := &capture{limit: 5}
+	for _, chunk := range []string{"abc", "def", "gh"} {
+		if n, err := c.Write([]byte(chunk)); n != len(chunk) || err != nil {
+			t.Fatalf("unexpected write result: %d %v", n, err)
+		}
+	}
+	if c.String() != "abcde" || c.size != 8 || !c.truncated {
+		t.Errorf("unexpected capture: %q size=%d truncated=%v", c.String(), c.size, c.truncated)
+	}
+
+	c = &capture{limit: 6}
+	c.Write([]byte("abc"))
+	c.Write([]byte("def"))
+	if c.String() != "abcdef" || c.truncated {
+		t.Errorf("unexpected capture: %q truncated=%v", c.String(), c.truncated)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	var received string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = r.URL.RequestURI() + " " + string(body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Set-Cookie", "session=abc")
+		w.Write([]byte(`{"access_token":"secret-token","user_id":5}`))
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL + "/base")
+
+	harPath := filepath.Join(t.TempDir(), "capture.har")
+	har, err := NewHARWriter(harPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer har.file.Close()
+	proxy := httptest.NewServer(&Proxy{Target: targetURL, Redact: true, MaxBody: 20, HAR: har})
+	defer proxy.Close()
+
+	reqBody := `{"email":"a@b.c","password":"hunter2"}`
+	resp, err := http.Post(proxy.URL+"/v2/user_auth?code=9", "application/json",
+		strings.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// Bodies are forwarded in full and unredacted.
+	if received != "/base/v2/user_auth?code=9 "+reqBody {
+		t.Errorf("unexpected request at target: %s", received)
+	}
+	if !bytes.Contains(respBody, []byte("secret-token")) || resp.Header.Get("Set-Cookie") == "" {
+		t.Errorf("unexpected response: %s", respBody)
+	}
+
+	// The entry is added after the response is sent, so wait for the
+	// handler to return.
+	proxy.Close()
+
+	// The capture is truncated, so the JSON cannot be redacted.
+	entries := readHAR(t, harPath)
+	if len(entries) != 1 {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+	entry := entries[0]
+	if entry.Comment == "" || entry.Request.BodySize != int64(len(reqBody)) {
+		t.Errorf("unexpected entry: %+v", entry)
+	}
+	if entry.Request.PostData.Text != omittedJSON || entry.Response.Content.Text != omittedJSON {
+		t.Errorf("unexpected bodies: %q %q", entry.Request.PostData.Text,
+			entry.Response.Content.Text)
+	}
+	if strings.Contains(entry.Request.URL, "code=9") {
+		t.Errorf("URL was not redacted: %s", entry.Request.URL)
+	}
+	for _, h := range entry.Response.Headers {
+		if h.Name == "Set-Cookie" && h.Value != redacted {
+			t.Errorf("header was not redacted: %v", h)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const redacted = "REDACTED"
+
+// omittedJSON replaces JSON bodies which cannot be parsed, and therefore
+// cannot be redacted.
+const omittedJSON = "[JSON body omitted: it could not be parsed to redact it]"
+
+// sensitiveKeys are JSON keys and form fields whose values are redacted.
+var sensitiveKeys = map[string]bool{
+	"password":       true,
+	"access_token":   true,
+	"refresh_token":  true,
+	"authorize":      true,
+	"authorize_code": true,
+	"token":          true,
+	"code":           true,
+	"two_factor":     true,
+	"secret":         true,
+}
+
+// sensitiveHeaders are headers whose values are redacted.
+var sensitiveHeaders = map[string]bool{
+	"Access-Token":  true,
+	"Authorization": true,
+	"Cookie":        true,
+	"Set-Cookie":    true,
+}
+
+// RedactBody hides passwords and tokens in a JSON or form-encoded body.
+//
+// JSON which does not parse, such as a truncated body, is replaced with a
+// note, since its secrets cannot be found reliably. Other bodies are
+// returned unchanged.
+func RedactBody(contentType string, body []byte) []byte {
+	trimmed := strings.TrimSpace(string(body))
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		var obj interface{}
+		if err := json.Unmarshal(body, &obj); err == nil {
+			var buf bytes.Buffer
+			enc := json.NewEncoder(&buf)
+			enc.SetEscapeHTML(false)
+			if err := enc.Encode(redactJSON(obj)); err == nil {
+				return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+			}
+		}
+		return []byte(omittedJSON)
+	}
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		if values, err := url.ParseQuery(string(body)); err == nil {
+			return []byte(redactValues(values).Encode())
+		}
+	}
+	return body
+}
+
+// RedactURL hides sensitive query parameters.
+func RedactURL(u *url.URL) string {
+	res := *u
+	res.RawQuery = redactValues(u.Query()).Encode()
+	return res.String()
+}
+
+// RedactHeader hides the values of sensitive headers.
+func RedactHeader(h http.Header) http.Header {
+	res := h.Clone()
+	for name := range res {
+		if sensitiveHeaders[http.CanonicalHeaderKey(name)] {
+			res[name] = []string{redacted}
+		}
+	}
+	return res
+}
+
+func redactJSON(obj interface{}) interface{} {
+	switch obj := obj.(type) {
+	case map[string]interface{}:
+		for key, value := range obj {
+			if sensitiveKeys[strings.ToLower(key)] {
+				obj[key] = redacted
+			} else {
+				obj[key] = redactJSON(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range obj {
+			obj[i] = redactJSON(value)
+		}
+	}
+	return obj
+}
+
+func redactValues(values url.Values) url.Values {
+	for key := range values {
+		if sensitiveKeys[strings.ToLower(key)] {
+			values[key] = []string{redacted}
+		}
+	}
+	return values
+}
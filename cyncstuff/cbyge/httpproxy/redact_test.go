@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestRedactBodyJSON(t *testing.T) {
+	body := `{"email":"a@b.c","Password":"hunter2","data":{"access_token":"x",` +
+		`"list":[{"code":123,"name":"n"}],"count":2}}`
+	expected := `{"Password":"REDACTED","data":{"access_token":"REDACTED","count":2,` +
+		`"list":[{"code":"REDACTED","name":"n"}]},"email":"a@b.c"}`
+	if actual := string(RedactBody("application/json", []byte(body))); actual != expected {
+		t.Errorf("expected %s but got %s", expected, actual)
+	}
+
+	// The content type is not needed to recognize JSON.
+	body = ` [{"refresh_token":"y","url":"http://x/?a=1&b=2"}]`
+	expected = `[{"refresh_token":"REDACTED","url":"http://x/?a=1&b=2"}]`
+	if actual := string(RedactBody("", []byte(body))); actual != expected {
+		t.Errorf("expected %s but got %s", expected, actual)
+	}
+}
+
+func TestRedactBodyTruncatedJSON(t *testing.T) {
+	for _, body := range []string{`{"password":"hunter2","email":"a@`, `[{"token":`} {
+		if actual := string(RedactBody("application/json", []byte(body))); actual != omittedJSON {
+			t.Errorf("%s: unexpected result %s", body, actual)
+		}
+	}
+}
+
+func TestRedactBodyForm(t *testing.T) {
+	body := "email=a%40b.c&password=hunter2&two_factor=123456"
+	expected := "email=a%40b.c&password=REDACTED&two_factor=REDACTED"
+	actual := string(RedactBody("application/x-www-form-urlencoded; charset=utf-8",
+		[]byte(body)))
+	if actual != expected {
+		t.Errorf("expected %s but got %s", expected, actual)
+	}
+
+	// Other bodies are returned unchanged.
+	for _, contentType := range []string{"text/plain", ""} {
+		if actual := string(RedactBody(contentType, []byte(body))); actual != body {
+			t.Errorf("%s: unexpected result %s", contentType, actual)
+		}
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	u, err := url.Parse("https://api.example.com/v2/user?access_token=abc&id=5&Code=9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "https://api.example.com/v2/user?Code=REDACTED&access_token=REDACTED&id=5"
+	if actual := RedactURL(u); actual != expected {
+		t.Errorf("expected %s but got %s", expected, actual)
+	}
+	if u.Query().Get("access_token") != "abc" {
+		t.Error("the original URL was modified")
+	}
+}
+
+func TestRedactHeader(t *testing.T) {
+	h := http.Header{}
+	h.Set("Access-Token", "abc")
+	h.Set("Authorization", "Bearer abc")
+	h.Add("Set-Cookie", "a=1")
+	h.Add("Set-Cookie", "b=2")
+	h.Set("Content-Type", "application/json")
+	h["access-token"] = []string{"lowercase"}
+
+	expected := http.Header{
+		"Access-Token":  {redacted},
+		"Authorization": {redacted},
+		"Set-Cookie":    {redacted},
+		"Content-Type":  {"application/json"},
+		"access-token":  {redacted},
+	}
+	if actual := RedactHeader(h); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v but got %v", expected, actual)
+	}
+	if h.Get("Access-Token") != "abc" {
+		t.Error("the original header was modified")
+	}
+}
@@ -98,7 +98,14 @@ type DeviceProperties struct {
 		DeviceID    int64  `json:"deviceID"`
 		DisplayName string `json:"displayName"`
 		SwitchID    uint64 `json:"switchID"`
+		DeviceType  int    `json:"deviceType"`
 	} `json:"bulbsArray"`
+	Groups []struct {
+		GroupID     int    `json:"groupID"`
+		DisplayName string `json:"displayName"`
+		DeviceIDs   []int  `json:"deviceIDArray"`
+		IsSubgroup  bool   `json:"isSubgroup"`
+	} `json:"groupsArray"`
 }
 
 // Login authenticates with the server to create a new session.
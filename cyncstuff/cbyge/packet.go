@@ -38,6 +38,70 @@ func (p *Packet) Seq() (uint16, error) {
 	return binary.BigEndian.Uint16(p.Data[4:6]), nil
 }
 
+// PipeSwitchID gets the ID of the switch that a pipe packet is addressed to,
+// or that a pipe response came from.
+func (p *Packet) PipeSwitchID() (uint32, error) {
+	if p.Type != PacketTypePipe || len(p.Data) < 4 {
+		return 0, errors.New("packet has no switch ID")
+	}
+	return binary.BigEndian.Uint32(p.Data[:4]), nil
+}
+
+// PipeSubtype gets the subtype of a pipe packet, such as
+// PacketPipeTypeSetLum.
+func (p *Packet) PipeSubtype() (uint8, error) {
+	if p.Type != PacketTypePipe || len(p.Data) < 15 {
+		return 0, errors.New("packet has no pipe subtype")
+	}
+	return p.Data[13], nil
+}
+
+// PipePayload gets the data of a pipe packet which follows the subtype and
+// length fields.
+func (p *Packet) PipePayload() ([]byte, error) {
+	if _, err := p.PipeSubtype(); err != nil {
+		return nil, err
+	}
+	length := int(p.Data[14])
+	if length > len(p.Data)-15 {
+		return nil, errors.New("pipe payload buffer underflow")
+	}
+	return p.Data[15 : 15+length], nil
+}
+
+// PacketTypeName gets a short name for a packet type, such as "pipe".
+func PacketTypeName(t uint8) string {
+	switch t {
+	case PacketTypeAuth:
+		return "auth"
+	case PacketTypeSync:
+		return "sync"
+	case PacketTypePipe:
+		return "pipe"
+	case PacketTypePipeSync:
+		return "pipe_sync"
+	}
+	return fmt.Sprintf("type_%d", t)
+}
+
+// PacketPipeTypeName gets a short name for a pipe subtype, such as
+// "set_lum".
+func PacketPipeTypeName(subtype uint8) string {
+	switch subtype {
+	case PacketPipeTypeSetStatus:
+		return "set_status"
+	case PacketPipeTypeSetLum:
+		return "set_lum"
+	case PacketPipeTypeSetCT:
+		return "set_ct"
+	case PacketPipeTypeGetStatus:
+		return "get_status"
+	case PacketPipeTypeGetStatusPaginated:
+		return "get_status_paginated"
+	}
+	return fmt.Sprintf("0x%02x", subtype)
+}
+
 // NewPacketPipe creates a "pipe buffer" packet with a given subtype.
 func NewPacketPipe(deviceID uint32, seq uint16, subtype uint8, data []byte) *Packet {
 	if len(data) > 0xff {
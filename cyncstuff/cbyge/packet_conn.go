@@ -18,7 +18,13 @@ type PacketConn struct {
 
 // NewPacketConn creates a PacketConn connected to the default server.
 func NewPacketConn() (*PacketConn, error) {
-	remoteAddr, err := net.ResolveTCPAddr("tcp", DefaultPacketConnHost)
+	return NewPacketConnAddr(DefaultPacketConnHost)
+}
+
+// NewPacketConnAddr creates a PacketConn connected to a server at the given
+// host:port address, such as a proxy or a test server.
+func NewPacketConnAddr(addr string) (*PacketConn, error) {
+	remoteAddr, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
 		return nil, err
 	}
@@ -35,8 +41,13 @@ func NewPacketConnWrap(conn net.Conn) *PacketConn {
 }
 
 func (p *PacketConn) Read() (*Packet, error) {
+	return ReadPacket(p.conn)
+}
+
+// ReadPacket reads an encoded packet from a stream.
+func ReadPacket(r io.Reader) (*Packet, error) {
 	header := make([]byte, 5)
-	_, err := io.ReadFull(p.conn, header)
+	_, err := io.ReadFull(r, header)
 	if err != nil {
 		return nil, err
 	}
@@ -46,7 +57,7 @@ func (p *PacketConn) Read() (*Packet, error) {
 		return nil, errors.New("packet is unreasonably large")
 	}
 	data := make([]byte, length)
-	_, err = io.ReadFull(p.conn, data)
+	_, err = io.ReadFull(r, data)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,327 @@
+// Command pipescan probes a switch with pipe packets of unknown subtypes,
+// to help map out commands which have not been reverse engineered yet.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+	"github.com/unixpickle/essentials"
+)
+
+const usageText = `Usage: pipescan <command> [flags]
+
+Commands:
+  switches               list devices and the switches they belong to
+  scan [flags]           send probes to a switch and report what happens
+
+Probes are only sent when scan is passed -yes. Without it, scan prints the
+packets it would send. Run 'pipescan <command> -help' for the flags of a
+command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usageText)
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "switches":
+		err = runSwitches(os.Args[2:])
+	case "scan":
+		err = runScan(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usageText)
+		os.Exit(2)
+	}
+	if err != nil {
+		essentials.Die(err)
+	}
+}
+
+func runSwitches(args []string) error {
+	fs := flag.NewFlagSet("switches", flag.ExitOnError)
+	sessionPath := fs.String("session", cbyge.DefaultSessionPath(), "session file from 'cbyge login'")
+	fs.Parse(args)
+
+	info, err := cbyge.LoadSessionInfo(*sessionPath)
+	if err != nil {
+		return err
+	}
+	devs, err := cbyge.NewController(info, 0).Devices()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-12s %-6s %-12s %s\n", "DEVICE", "INDEX", "SWITCH", "NAME")
+	for _, dev := range devs {
+		switchID := "-"
+		if id, ok := dev.SwitchID(); ok {
+			switchID = strconv.FormatUint(uint64(id), 10)
+		}
+		fmt.Printf("%-12s %-6d %-12s %s\n", dev.DeviceID(), deviceIndex(dev), switchID,
+			dev.Name())
+	}
+	return nil
+}
+
+func runScan(args []string) error {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	sessionPath := fs.String("session", cbyge.DefaultSessionPath(), "session file from 'cbyge login'")
+	addr := fs.String("addr", cbyge.DefaultPacketConnHost, "packet server address")
+	switchID := fs.Uint64("switch", 0, "ID of the switch to probe (see 'pipescan switches')")
+	device := fs.Int("device", -1, "device index for the {dev} placeholder")
+	subtypeList := fs.String("subtypes", "", "subtypes to probe, like 0x00-0x3f,0xd3")
+	skipList := fs.String("skip", "", "subtypes never to send")
+	valueList := fs.String("values", "0", "values for the {v} placeholder, like 0-3,0xff")
+	var templates stringList
+	fs.Var(&templates, "payload",
+		"payload template of hex bytes, {dev}, {sub} and {v} (repeatable)\n"+
+			"(default \""+DefaultTemplate+"\")")
+	maxProbes := fs.Int("max", 64, "refuse to send more probes than this")
+	maxSilent := fs.Int("max-silent", 3, "stop after this many probes in a row get no response")
+	gap := fs.Duration("gap", time.Second, "delay between probes")
+	window := fs.Duration("window", time.Second*3, "how long to listen after each probe")
+	noRestore := fs.Bool("no-restore", false, "do not undo state changes caused by probes")
+	reportPath := fs.String("report", "pipescan-report.json", "JSON report file")
+	yes := fs.Bool("yes", false, "actually send the probes")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: pipescan scan -switch ID -subtypes LIST [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *switchID == 0 || *subtypeList == "" || fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if len(templates) == 0 {
+		templates = stringList{DefaultTemplate}
+	}
+
+	plan, err := makePlan(*subtypeList, *skipList, *valueList, templates, *device)
+	if err != nil {
+		return err
+	}
+	if len(plan) > *maxProbes {
+		return errors.Errorf("the scan has %d probes, which is more than -max %d",
+			len(plan), *maxProbes)
+	}
+	if !*yes {
+		for i, probe := range plan {
+			fmt.Printf("#%d %s payload=[%s]\n", i, cbyge.PacketPipeTypeName(probe.Subtype),
+				hexString(probe.Payload))
+		}
+		fmt.Printf("Dry run: pass -yes to send these %d probes to switch %d.\n", len(plan),
+			*switchID)
+		return nil
+	}
+
+	info, err := cbyge.LoadSessionInfo(*sessionPath)
+	if err != nil {
+		return err
+	}
+	scanner, err := NewScanner(*addr, info, uint32(*switchID), *window)
+	if err != nil {
+		return err
+	}
+	defer scanner.Close()
+
+	// Without a working baseline there is no way to notice or undo
+	// state changes, so the scan does not start.
+	before, _, err := scanner.Snapshot()
+	if err != nil {
+		return errors.Wrap(err, "the switch did not report statuses, so no probes were sent")
+	}
+	if _, ok := before[*device]; *device >= 0 && !ok {
+		fmt.Fprintf(os.Stderr, "warning: switch did not report a status for device %d\n",
+			*device)
+	}
+
+	report := &Report{
+		Switch:   uint32(*switchID),
+		Device:   *device,
+		Started:  time.Now().Format(time.RFC3339Nano),
+		Baseline: NewStatusRecords(before),
+		Probes:   []*ProbeResult{},
+	}
+	save := func() {
+		if err := report.Save(*reportPath); err != nil {
+			fmt.Fprintln(os.Stderr, "error saving report:", err)
+		}
+	}
+	save()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	silent := 0
+	for i, probe := range plan {
+		for _, p := range scanner.Drain() {
+			report.Background = append(report.Background, NewPacketRecord(0, p))
+		}
+		request, observed, err := scanner.Probe(probe)
+		result := NewProbeResult(i, probe, request, observed)
+		report.Probes = append(report.Probes, result)
+		if err != nil {
+			result.Error = err.Error()
+			report.Stopped = "connection failed: " + err.Error()
+			fmt.Println(result.Line())
+			break
+		}
+
+		after, observed, err := scanner.Snapshot()
+		result.AddFollowUp(observed)
+		if err != nil {
+			result.Error = err.Error()
+			report.Stopped = "the switch stopped reporting statuses"
+			fmt.Println(result.Line())
+			break
+		}
+		result.Changes = DiffStatuses(before, after)
+		if len(result.Changes) > 0 {
+			if *noRestore {
+				before = after
+			} else {
+				restored := restore(scanner, result, before, after)
+				result.Restored = &restored
+				if !restored {
+					report.Stopped = "could not restore the state changed by a probe"
+					fmt.Println(result.Line())
+					break
+				}
+			}
+		}
+		fmt.Println(result.Line())
+		save()
+
+		if result.Response == "none" {
+			silent++
+			if silent >= *maxSilent {
+				report.Stopped = fmt.Sprintf("%d probes in a row got no response", silent)
+				break
+			}
+		} else {
+			silent = 0
+		}
+		if i+1 < len(plan) {
+			select {
+			case <-interrupt:
+				report.Stopped = "interrupted"
+			case <-time.After(*gap):
+			}
+			if report.Stopped != "" {
+				break
+			}
+		}
+	}
+	save()
+
+	fmt.Println()
+	report.PrintSummary(os.Stdout)
+	fmt.Printf("\nWrote report to %s\n", *reportPath)
+	return nil
+}
+
+// makePlan lists every combination of subtype, template and value.
+func makePlan(subtypeList, skipList, valueList string, templates []string,
+	device int) ([]*Probe, error) {
+	subtypes, err := ParseByteList(subtypeList)
+	if err != nil {
+		return nil, errors.Wrap(err, "subtypes")
+	}
+	skip := map[uint8]bool{}
+	if skipList != "" {
+		skipped, err := ParseByteList(skipList)
+		if err != nil {
+			return nil, errors.Wrap(err, "skip")
+		}
+		for _, x := range skipped {
+			skip[x] = true
+		}
+	}
+	values, err := ParseByteList(valueList)
+	if err != nil {
+		return nil, errors.Wrap(err, "values")
+	}
+
+	var res []*Probe
+	for _, source := range templates {
+		template, err := ParsePayloadTemplate(source)
+		if err != nil {
+			return nil, err
+		}
+		if template.Uses("{dev}") && device < 0 {
+			return nil, errors.New("payload uses {dev}, so -device is required")
+		}
+		templateValues := values
+		if !template.Uses("{v}") {
+			templateValues = values[:1]
+		}
+		for _, subtype := range subtypes {
+			if skip[subtype] {
+				continue
+			}
+			for _, value := range templateValues {
+				payload := template.Expand(device, subtype, value)
+				if len(payload) > 0xff {
+					return nil, errors.Errorf("payload is too long: %d bytes", len(payload))
+				}
+				res = append(res, &Probe{
+					Subtype:  subtype,
+					Template: template,
+					Value:    value,
+					Payload:  payload,
+				})
+			}
+		}
+	}
+	if len(res) == 0 {
+		return nil, errors.New("every subtype was skipped")
+	}
+	return res, nil
+}
+
+// restore undoes the changes since before, and checks that it worked.
+//
+// The packets received meanwhile are added to the probe's result.
+func restore(scanner *Scanner, result *ProbeResult, before, after Statuses) bool {
+	observed, err := scanner.Restore(before, after)
+	result.AddFollowUp(observed)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error restoring state:", err)
+		return false
+	}
+	current, observed, err := scanner.Snapshot()
+	result.AddFollowUp(observed)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error checking restored state:", err)
+		return false
+	}
+	return len(DiffStatuses(before, current)) == 0
+}
+
+// deviceIndex is the index that pipe packets use to address a device, as
+// computed by the Controller.
+func deviceIndex(dev *cbyge.ControllerDevice) int {
+	id, _ := strconv.ParseUint(dev.DeviceID(), 10, 64)
+	return int(id % 1000)
+}
+
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, "; ")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
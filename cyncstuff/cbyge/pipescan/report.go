@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/unixpickle/cbyge"
+)
+
+// A Report records a scan of one switch.
+type Report struct {
+	Switch   uint32         `json:"switch"`
+	Device   int            `json:"device"`
+	Started  string         `json:"started"`
+	Baseline []StatusRecord `json:"baseline"`
+	Probes   []*ProbeResult `json:"probes"`
+
+	// Background lists the packets which arrived between probes.
+	Background []*PacketRecord `json:"background,omitempty"`
+
+	// Stopped explains why the scan ended before its last probe.
+	Stopped string `json:"stopped,omitempty"`
+}
+
+// A ProbeResult is everything observed after sending one probe.
+type ProbeResult struct {
+	Index    int    `json:"index"`
+	Time     string `json:"time"`
+	Subtype  string `json:"subtype"`
+	Template string `json:"template"`
+	Value    *uint8 `json:"value,omitempty"`
+	Payload  string `json:"payload"`
+	Request  string `json:"request"`
+
+	// Response is "ok", "error" or "none".
+	Response        string  `json:"response"`
+	ResponseData    string  `json:"response_data,omitempty"`
+	ResponseDelayMS float64 `json:"response_delay_ms,omitempty"`
+
+	// Pipe lists other pipe packets from the switch, which may carry data
+	// in reply to the probe.
+	Pipe  []*PacketRecord `json:"pipe,omitempty"`
+	Syncs []*PacketRecord `json:"syncs,omitempty"`
+	Other []*PacketRecord `json:"other,omitempty"`
+
+	// FollowUp lists the packets received while checking and restoring
+	// the statuses after the probe, which may include late replies to it.
+	FollowUp []*PacketRecord `json:"follow_up,omitempty"`
+
+	Changes  []StateChange `json:"changes,omitempty"`
+	Restored *bool         `json:"restored,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// A PacketRecord is a received packet, with its delay since the call that
+// was waiting on it.
+type PacketRecord struct {
+	DelayMS  float64 `json:"delay_ms"`
+	Type     string  `json:"type"`
+	Response bool    `json:"response"`
+	Subtype  string  `json:"subtype,omitempty"`
+	Payload  string  `json:"payload,omitempty"`
+	Data     string  `json:"data"`
+}
+
+// A StatusRecord is a device status reported by the switch.
+type StatusRecord struct {
+	Device     int      `json:"device"`
+	IsOn       bool     `json:"is_on"`
+	Brightness uint8    `json:"brightness"`
+	ColorTone  uint8    `json:"color_tone"`
+	UseRGB     bool     `json:"use_rgb"`
+	RGB        [3]uint8 `json:"rgb"`
+}
+
+// A StateChange is a difference in a device's status before and after a
+// probe.
+type StateChange struct {
+	Device int    `json:"device"`
+	Field  string `json:"field"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+func (s StateChange) String() string {
+	return fmt.Sprintf("device %d %s %s->%s", s.Device, s.Field, s.Before, s.After)
+}
+
+// Save writes the report as JSON.
+func (r *Report) Save(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// PrintSummary groups the probes by how the switch reacted to them.
+func (r *Report) PrintSummary(w io.Writer) {
+	var ok, failed, silent, changed, data []string
+	for _, probe := range r.Probes {
+		label := probe.label()
+		switch probe.Response {
+		case "ok":
+			ok = append(ok, label)
+		case "error":
+			failed = append(failed, label)
+		default:
+			silent = append(silent, label)
+		}
+		if len(probe.Changes) > 0 {
+			var changes []string
+			for _, c := range probe.Changes {
+				changes = append(changes, c.String())
+			}
+			changed = append(changed, label+" ("+strings.Join(changes, ", ")+")")
+		}
+		if len(probe.Pipe) > 0 {
+			var subtypes []string
+			for _, p := range probe.Pipe {
+				subtypes = append(subtypes, p.Subtype)
+			}
+			data = append(data, label+" -> "+strings.Join(subtypes, ","))
+		}
+	}
+	fmt.Fprintf(w, "Probed switch %d with %d packets.\n", r.Switch, len(r.Probes))
+	if r.Stopped != "" {
+		fmt.Fprintf(w, "Stopped early: %s\n", r.Stopped)
+	}
+	printGroup(w, "Changed device state", changed)
+	printGroup(w, "Sent other pipe packets", data)
+	printGroup(w, "Responded ok", ok)
+	printGroup(w, "Responded with an error", failed)
+	printGroup(w, "No response", silent)
+}
+
+func printGroup(w io.Writer, title string, items []string) {
+	fmt.Fprintf(w, "\n%s (%d):\n", title, len(items))
+	for _, item := range items {
+		fmt.Fprintf(w, "  %s\n", item)
+	}
+}
+
+func (p *ProbeResult) label() string {
+	res := p.Subtype
+	if p.Value != nil {
+		res += fmt.Sprintf(" v=0x%02x", *p.Value)
+	}
+	return res
+}
+
+// Line summarizes the result on one line.
+func (p *ProbeResult) Line() string {
+	parts := []string{
+		fmt.Sprintf("#%d", p.Index),
+		p.label(),
+		"payload=[" + p.Payload + "]",
+		"response=" + p.Response,
+	}
+	if p.ResponseData != "" {
+		parts = append(parts, fmt.Sprintf("(%.0fms)", p.ResponseDelayMS))
+	}
+	if len(p.Pipe) > 0 {
+		parts = append(parts, fmt.Sprintf("pipe=%d", len(p.Pipe)))
+	}
+	if len(p.Syncs) > 0 {
+		parts = append(parts, fmt.Sprintf("syncs=%d", len(p.Syncs)))
+	}
+	if len(p.FollowUp) > 0 {
+		parts = append(parts, fmt.Sprintf("follow_up=%d", len(p.FollowUp)))
+	}
+	for _, c := range p.Changes {
+		parts = append(parts, "["+c.String()+"]")
+	}
+	if p.Restored != nil {
+		parts = append(parts, fmt.Sprintf("restored=%v", *p.Restored))
+	}
+	if p.Error != "" {
+		parts = append(parts, "error="+p.Error)
+	}
+	return strings.Join(parts, " ")
+}
+
+// NewProbeResult sorts the packets received after a probe by their
+// relationship to it.
+func NewProbeResult(index int, probe *Probe, request *cbyge.Packet,
+	observed []*Observed) *ProbeResult {
+	res := &ProbeResult{
+		Index:    index,
+		Time:     time.Now().Format(time.RFC3339Nano),
+		Subtype:  cbyge.PacketPipeTypeName(probe.Subtype),
+		Template: probe.Template.Source,
+		Payload:  hexString(probe.Payload),
+		Request:  hexString(request.Data),
+		Response: "none",
+	}
+	if probe.Template.Uses("{v}") {
+		value := probe.Value
+		res.Value = &value
+	}
+	seq, _ := request.Seq()
+	switchID, _ := request.PipeSwitchID()
+	for _, o := range observed {
+		record := NewPacketRecord(o.Delay, o.Packet)
+		packetSwitch, err := o.Packet.PipeSwitchID()
+		fromSwitch := err == nil && packetSwitch == switchID
+		switch {
+		case isResponseTo(o.Packet, seq) && res.Response == "none":
+			res.Response = "ok"
+			if responseFailed(o.Packet) {
+				res.Response = "error"
+			}
+			res.ResponseData = record.Data
+			res.ResponseDelayMS = record.DelayMS
+		case o.Packet.Type == cbyge.PacketTypeSync || o.Packet.Type == cbyge.PacketTypePipeSync:
+			res.Syncs = append(res.Syncs, record)
+		case fromSwitch && !o.Packet.IsResponse:
+			res.Pipe = append(res.Pipe, record)
+		default:
+			res.Other = append(res.Other, record)
+		}
+	}
+	return res
+}
+
+// AddFollowUp records the packets received by a call made after the probe.
+func (p *ProbeResult) AddFollowUp(observed []*Observed) {
+	for _, o := range observed {
+		p.FollowUp = append(p.FollowUp, NewPacketRecord(o.Delay, o.Packet))
+	}
+}
+
+// NewPacketRecord decodes what it can of a received packet.
+func NewPacketRecord(delay time.Duration, p *cbyge.Packet) *PacketRecord {
+	res := &PacketRecord{
+		DelayMS:  float64(delay) / float64(time.Millisecond),
+		Type:     cbyge.PacketTypeName(p.Type),
+		Response: p.IsResponse,
+		Data:     hexString(p.Data),
+	}
+	if subtype, err := p.PipeSubtype(); err == nil {
+		res.Subtype = cbyge.PacketPipeTypeName(subtype)
+	}
+	if payload, err := p.PipePayload(); err == nil {
+		res.Payload = hexString(payload)
+	}
+	return res
+}
+
+// NewStatusRecords lists statuses in order of device index.
+func NewStatusRecords(s Statuses) []StatusRecord {
+	res := []StatusRecord{}
+	for _, device := range sortedDevices(s) {
+		status := s[device]
+		res = append(res, StatusRecord{
+			Device:     status.Device,
+			IsOn:       status.IsOn,
+			Brightness: status.Brightness,
+			ColorTone:  status.ColorTone,
+			UseRGB:     status.UseRGB,
+			RGB:        status.RGB,
+		})
+	}
+	return res
+}
+
+// DiffStatuses finds the fields which changed for each device.
+func DiffStatuses(before, after Statuses) []StateChange {
+	all := Statuses{}
+	for device, status := range before {
+		all[device] = status
+	}
+	for device, status := range after {
+		all[device] = status
+	}
+	var res []StateChange
+	for _, device := range sortedDevices(all) {
+		old, hadOld := before[device]
+		current, hasCurrent := after[device]
+		if hadOld != hasCurrent {
+			res = append(res, StateChange{
+				Device: device,
+				Field:  "present",
+				Before: fmt.Sprint(hadOld),
+				After:  fmt.Sprint(hasCurrent),
+			})
+			continue
+		}
+		add := func(field string, oldValue, newValue interface{}) {
+			b, a := fmt.Sprint(oldValue), fmt.Sprint(newValue)
+			if a != b {
+				res = append(res, StateChange{Device: device, Field: field, Before: b, After: a})
+			}
+		}
+		add("on", old.IsOn, current.IsOn)
+		add("brightness", old.Brightness, current.Brightness)
+		add("tone", old.ColorTone, current.ColorTone)
+		if old.UseRGB || current.UseRGB {
+			add("rgb", hexString(old.RGB[:]), hexString(current.RGB[:]))
+		}
+	}
+	return res
+}
+
+func sortedDevices(s Statuses) []int {
+	var res []int
+	for device := range s {
+		res = append(res, device)
+	}
+	sort.Ints(res)
+	return res
+}
+
+func hexString(data []byte) string {
+	var parts []string
+	for _, b := range data {
+		parts = append(parts, hex.EncodeToString([]byte{b}))
+	}
+	return strings.Join(parts, " ")
+}
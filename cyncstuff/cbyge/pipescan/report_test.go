@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/unixpickle/cbyge"
+)
+
+func TestDiffStatuses(t *testing.T) {
+	before := Statuses{
+		1: {Device: 1, IsOn: true, Brightness: 50, ColorTone: 20},
+		2: {Device: 2, UseRGB: true, RGB: [3]uint8{1, 2, 3}},
+		3: {Device: 3},
+	}
+	if changes := DiffStatuses(before, before); len(changes) != 0 {
+		t.Errorf("unexpected changes: %v", changes)
+	}
+
+	after := Statuses{
+		1: {Device: 1, IsOn: false, Brightness: 60, ColorTone: 20},
+		2: {Device: 2, UseRGB: true, RGB: [3]uint8{1, 2, 4}},
+		4: {Device: 4},
+	}
+	expected := []StateChange{
+		{Device: 1, Field: "on", Before: "true", After: "false"},
+		{Device: 1, Field: "brightness", Before: "50", After: "60"},
+		{Device: 2, Field: "rgb", Before: "01 02 03", After: "01 02 04"},
+		{Device: 3, Field: "present", Before: "true", After: "false"},
+		{Device: 4, Field: "present", Before: "false", After: "true"},
+	}
+	if changes := DiffStatuses(before, after); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected %v but got %v", expected, changes)
+	}
+
+	// Switching from a color tone to RGB changes both fields.
+	after = Statuses{3: {Device: 3, ColorTone: 0xfe, UseRGB: true, RGB: [3]uint8{0xff, 0, 0}}}
+	expected = []StateChange{
+		{Device: 3, Field: "tone", Before: "0", After: "254"},
+		{Device: 3, Field: "rgb", Before: "00 00 00", After: "ff 00 00"},
+	}
+	changes := DiffStatuses(Statuses{3: before[3]}, after)
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected %v but got %v", expected, changes)
+	}
+}
+
+func TestProbeResultFollowUp(t *testing.T) {
+	template, err := ParsePayloadTemplate(DefaultTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	probe := &Probe{Subtype: 0x10, Template: template, Payload: template.Expand(3, 0x10, 0)}
+	request := cbyge.NewPacketPipe(1234, 7, probe.Subtype, probe.Payload)
+	result := NewProbeResult(0, probe, request, nil)
+	if result.Response != "none" {
+		t.Errorf("unexpected response: %s", result.Response)
+	}
+
+	late := cbyge.NewPacketPipe(1234, 9, 0x11, []byte{1})
+	result.AddFollowUp([]*Observed{{Delay: time.Millisecond * 5, Packet: late}})
+	if len(result.FollowUp) != 1 || result.FollowUp[0].DelayMS != 5 ||
+		result.FollowUp[0].Payload != "01" {
+		t.Errorf("unexpected follow-up: %+v", result.FollowUp)
+	}
+	if line := result.Line(); line != "#0 0x10 v=0x00 payload=["+result.Payload+
+		"] response=none follow_up=1" {
+		t.Errorf("unexpected line: %s", line)
+	}
+}
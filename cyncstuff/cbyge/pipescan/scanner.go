@@ -0,0 +1,248 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+// A Probe is a single pipe packet to try on a switch.
+type Probe struct {
+	Subtype  uint8
+	Template *PayloadTemplate
+	Value    uint8
+	Payload  []byte
+}
+
+// Statuses maps device indices to the statuses reported by a switch.
+type Statuses map[int]cbyge.StatusPaginatedResponse
+
+// A Scanner sends probes to one switch over a single connection, and
+// records everything that comes back.
+type Scanner struct {
+	SwitchID uint32
+
+	// Window is how long to listen after each probe for responses and
+	// sync packets.
+	Window time.Duration
+
+	conn    *cbyge.PacketConn
+	packets chan *cbyge.Packet
+	readErr chan error
+	seq     uint16
+}
+
+// NewScanner connects and authenticates to the packet server.
+func NewScanner(addr string, info *cbyge.SessionInfo, switchID uint32,
+	window time.Duration) (*Scanner, error) {
+	conn, err := cbyge.NewPacketConnAddr(addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "new scanner")
+	}
+	if err := conn.Auth(info.UserID, info.Authorize, cbyge.PacketConnTimeout); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "new scanner")
+	}
+	s := &Scanner{
+		SwitchID: switchID,
+		Window:   window,
+		conn:     conn,
+		packets:  make(chan *cbyge.Packet, 64),
+		readErr:  make(chan error, 1),
+		seq:      uint16(rand.New(rand.NewSource(time.Now().UnixNano())).Int63()),
+	}
+	go s.readLoop()
+	return s, nil
+}
+
+// Close closes the connection.
+func (s *Scanner) Close() error {
+	return s.conn.Close()
+}
+
+// Snapshot asks the switch for the statuses of the devices it can see.
+//
+// The statuses arrive in a separate pipe packet from the switch, rather
+// than in the response to the request.
+func (s *Scanner) Snapshot() (Statuses, []*Observed, error) {
+	seq := s.nextSeq()
+	packet := cbyge.NewPacketGetStatusPaginated(s.SwitchID, seq)
+	var list []cbyge.StatusPaginatedResponse
+	var failed bool
+	observed, err := s.call(packet, s.Window, func(p *cbyge.Packet) bool {
+		if isResponseTo(p, seq) && responseFailed(p) {
+			failed = true
+			return true
+		}
+		if switchID, err := p.PipeSwitchID(); err != nil || switchID != s.SwitchID {
+			return false
+		}
+		if cbyge.IsStatusPaginatedResponse(p) {
+			var err error
+			list, err = cbyge.DecodeStatusPaginatedResponse(p)
+			return err == nil
+		}
+		return false
+	})
+	if err != nil {
+		return nil, observed, errors.Wrap(err, "snapshot")
+	}
+	if failed {
+		return nil, observed, errors.Wrap(cbyge.RemoteCallError, "snapshot")
+	}
+	if list == nil {
+		return nil, observed, errors.New("snapshot: no statuses from switch")
+	}
+	res := Statuses{}
+	for _, status := range list {
+		res[status.Device] = status
+	}
+	return res, observed, nil
+}
+
+// Probe sends a probe and listens for the whole window, since sync packets
+// may arrive well after the response.
+func (s *Scanner) Probe(probe *Probe) (*cbyge.Packet, []*Observed, error) {
+	packet := cbyge.NewPacketPipe(s.SwitchID, s.nextSeq(), probe.Subtype, probe.Payload)
+	observed, err := s.call(packet, s.Window, nil)
+	return packet, observed, err
+}
+
+// Restore sends the known set commands to undo the differences between
+// the statuses before and after a probe.
+//
+// It returns every packet received while waiting for the commands.
+func (s *Scanner) Restore(before, after Statuses) ([]*Observed, error) {
+	var allObserved []*Observed
+	for device, old := range before {
+		current, ok := after[device]
+		if !ok || current == old {
+			continue
+		}
+		var packets []*cbyge.Packet
+		if current.IsOn != old.IsOn {
+			status := 0
+			if old.IsOn {
+				status = 1
+			}
+			packets = append(packets,
+				cbyge.NewPacketSetDeviceStatus(s.SwitchID, s.nextSeq(), device, status))
+		}
+		if current.Brightness != old.Brightness && old.Brightness >= 1 && old.Brightness <= 100 {
+			packets = append(packets, cbyge.NewPacketSetLum(s.SwitchID, s.nextSeq(), device,
+				int(old.Brightness)))
+		}
+		if old.UseRGB && (!current.UseRGB || current.RGB != old.RGB) {
+			packets = append(packets, cbyge.NewPacketSetRGB(s.SwitchID, s.nextSeq(), device,
+				old.RGB[0], old.RGB[1], old.RGB[2]))
+		} else if !old.UseRGB && current.ColorTone != old.ColorTone && old.ColorTone <= 100 {
+			packets = append(packets, cbyge.NewPacketSetCT(s.SwitchID, s.nextSeq(), device,
+				int(old.ColorTone)))
+		}
+		for _, packet := range packets {
+			seq, _ := packet.Seq()
+			var response *cbyge.Packet
+			observed, err := s.call(packet, s.Window, func(p *cbyge.Packet) bool {
+				if isResponseTo(p, seq) {
+					response = p
+					return true
+				}
+				return false
+			})
+			allObserved = append(allObserved, observed...)
+			if err != nil {
+				return allObserved, errors.Wrap(err, "restore")
+			}
+			if response == nil {
+				return allObserved, errors.Errorf("restore: no response for device %d", device)
+			}
+			if responseFailed(response) {
+				return allObserved, errors.Wrap(cbyge.RemoteCallError, "restore")
+			}
+		}
+	}
+	return allObserved, nil
+}
+
+// An Observed packet was received while waiting on a call.
+type Observed struct {
+	// Delay is the time since the call was sent.
+	Delay  time.Duration
+	Packet *cbyge.Packet
+}
+
+// call writes a packet and collects the packets received until done
+// returns true or the timeout passes. A nil done waits for the timeout.
+//
+// Running out of time is not an error, since silence is a valid outcome of
+// a probe.
+func (s *Scanner) call(p *cbyge.Packet, timeout time.Duration,
+	done func(p *cbyge.Packet) bool) ([]*Observed, error) {
+	start := time.Now()
+	if err := s.conn.Write(p); err != nil {
+		return nil, err
+	}
+	var observed []*Observed
+	deadline := time.After(timeout)
+	for {
+		select {
+		case packet := <-s.packets:
+			observed = append(observed, &Observed{Delay: time.Since(start), Packet: packet})
+			if done != nil && done(packet) {
+				return observed, nil
+			}
+		case err := <-s.readErr:
+			// Leave the error for the next call too.
+			s.readErr <- err
+			return observed, err
+		case <-deadline:
+			return observed, nil
+		}
+	}
+}
+
+// Drain returns the packets which arrived outside of any call, such as
+// between probes.
+func (s *Scanner) Drain() []*cbyge.Packet {
+	var res []*cbyge.Packet
+	for {
+		select {
+		case packet := <-s.packets:
+			res = append(res, packet)
+		default:
+			return res
+		}
+	}
+}
+
+func (s *Scanner) readLoop() {
+	for {
+		packet, err := s.conn.Read()
+		if err != nil {
+			s.readErr <- err
+			return
+		}
+		s.packets <- packet
+	}
+}
+
+func (s *Scanner) nextSeq() uint16 {
+	s.seq++
+	return s.seq
+}
+
+func isResponseTo(p *cbyge.Packet, seq uint16) bool {
+	if !p.IsResponse {
+		return false
+	}
+	seq1, err := p.Seq()
+	return err == nil && seq1 == seq
+}
+
+// responseFailed checks the trailing error byte of a pipe response, as the
+// Controller does.
+func responseFailed(p *cbyge.Packet) bool {
+	return len(p.Data) > 0 && p.Data[len(p.Data)-1] != 0
+}
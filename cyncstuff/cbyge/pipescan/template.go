@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+// A PayloadTemplate describes the payload of a probe as hex bytes and
+// placeholders.
+//
+// The placeholders are {dev} for the two-byte device index, {sub} for the
+// subtype being probed, and {v} for each of the swept values.
+type PayloadTemplate struct {
+	Source string
+
+	parts []templatePart
+}
+
+type templatePart struct {
+	literal     []byte
+	placeholder string
+}
+
+// DefaultTemplate mimics the layout of the known set commands, where the
+// device index is followed by the subtype again.
+const DefaultTemplate = "00 00 00 00 00 {dev} 00 {sub} 00 00 {v}"
+
+// ParsePayloadTemplate parses a template like "00 {dev} 00 {sub} {v}".
+func ParsePayloadTemplate(s string) (*PayloadTemplate, error) {
+	res := &PayloadTemplate{Source: s}
+	for _, field := range strings.Fields(s) {
+		switch field {
+		case "{dev}", "{sub}", "{v}":
+			res.parts = append(res.parts, templatePart{placeholder: field})
+			continue
+		}
+		data, err := hex.DecodeString(field)
+		if err != nil {
+			return nil, errors.Errorf("invalid template field: %q", field)
+		}
+		res.parts = append(res.parts, templatePart{literal: data})
+	}
+	return res, nil
+}
+
+// Uses checks if the template contains a placeholder, such as "{v}".
+func (p *PayloadTemplate) Uses(placeholder string) bool {
+	for _, part := range p.parts {
+		if part.placeholder == placeholder {
+			return true
+		}
+	}
+	return false
+}
+
+// Expand fills in the placeholders to create a payload.
+func (p *PayloadTemplate) Expand(device int, subtype, value uint8) []byte {
+	var res []byte
+	for _, part := range p.parts {
+		switch part.placeholder {
+		case "{dev}":
+			res = append(res, byte(device>>8), byte(device))
+		case "{sub}":
+			res = append(res, subtype)
+		case "{v}":
+			res = append(res, value)
+		default:
+			res = append(res, part.literal...)
+		}
+	}
+	return res
+}
+
+// ParseByteList parses a comma-separated list of bytes and ranges, like
+// "0x00-0x0f,0xd2,set_lum". Pipe subtype names are also accepted.
+//
+// The result is sorted and has no duplicates.
+func ParseByteList(list string) ([]uint8, error) {
+	set := map[uint8]bool{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		bounds := strings.SplitN(item, "-", 2)
+		start, err := parseByte(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		end := start
+		if len(bounds) == 2 {
+			end, err = parseByte(bounds[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		if end < start {
+			return nil, errors.Errorf("invalid range: %q", item)
+		}
+		for i := int(start); i <= int(end); i++ {
+			set[uint8(i)] = true
+		}
+	}
+	if len(set) == 0 {
+		return nil, errors.Errorf("empty list: %q", list)
+	}
+	var res []uint8
+	for x := range set {
+		res = append(res, x)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i] < res[j]
+	})
+	return res, nil
+}
+
+func parseByte(s string) (uint8, error) {
+	s = strings.TrimSpace(s)
+	for i := 0; i < 0x100; i++ {
+		if cbyge.PacketPipeTypeName(uint8(i)) == s {
+			return uint8(i), nil
+		}
+	}
+	x, err := strconv.ParseUint(s, 0, 8)
+	if err != nil {
+		return 0, errors.Errorf("invalid byte: %q", s)
+	}
+	return uint8(x), nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/unixpickle/cbyge"
+)
+
+func TestParseByteList(t *testing.T) {
+	cases := map[string][]uint8{
+		"0":                   {0},
+		"0x00-0x03":           {0, 1, 2, 3},
+		"0xd2, 1,0xd2":        {1, 0xd2},
+		"250-0xff":            {250, 251, 252, 253, 254, 255},
+		"set_lum,,set_status": {cbyge.PacketPipeTypeSetStatus, cbyge.PacketPipeTypeSetLum},
+	}
+	for list, expected := range cases {
+		actual, err := ParseByteList(list)
+		if err != nil {
+			t.Errorf("%q: %v", list, err)
+		} else if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%q: expected %v but got %v", list, expected, actual)
+		}
+	}
+	for _, list := range []string{"", ",", "0x100", "3-1", "x", "1-", "-1", "0-0x1ff"} {
+		if _, err := ParseByteList(list); err == nil {
+			t.Errorf("%q: expected an error", list)
+		}
+	}
+}
+
+func TestParsePayloadTemplate(t *testing.T) {
+	template, err := ParsePayloadTemplate("00 {dev} 0a0b {sub} {v}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for placeholder, expected := range map[string]bool{"{dev}": true, "{sub}": true,
+		"{v}": true, "{x}": false} {
+		if template.Uses(placeholder) != expected {
+			t.Errorf("Uses(%q) should be %v", placeholder, expected)
+		}
+	}
+	payload := template.Expand(0x123, 0xd2, 7)
+	expected := []byte{0, 1, 0x23, 0x0a, 0x0b, 0xd2, 7}
+	if !bytes.Equal(payload, expected) {
+		t.Errorf("expected %x but got %x", expected, payload)
+	}
+
+	template, err = ParsePayloadTemplate(DefaultTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload = template.Expand(3, 0xd0, 1)
+	expected = []byte{0, 0, 0, 0, 0, 0, 3, 0, 0xd0, 0, 0, 1}
+	if !bytes.Equal(payload, expected) {
+		t.Errorf("expected %x but got %x", expected, payload)
+	}
+
+	for _, source := range []string{"0g", "{dev", "0", "00 {w}"} {
+		if _, err := ParsePayloadTemplate(source); err == nil {
+			t.Errorf("%q: expected an error", source)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/unixpickle/cbyge"
+)
+
+// A JSONLogger writes one JSON object per line for each forwarded packet.
+type JSONLogger struct {
+	lock sync.Mutex
+	w    io.Writer
+	c    io.Closer
+}
+
+// NewJSONLogger creates a JSONLogger which appends to a file, or writes to
+// standard output if path is "-".
+func NewJSONLogger(path string) (*JSONLogger, error) {
+	if path == "-" {
+		return &JSONLogger{w: os.Stdout}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLogger{w: f, c: f}, nil
+}
+
+// Log writes a decoded packet.
+//
+// The direction is "in" for packets from the client, and "out" for packets
+// from the server, like the names of saved packet files.
+func (j *JSONLogger) Log(connID int, direction string, p *cbyge.Packet) error {
+	data, err := json.Marshal(newPacketRecord(connID, direction, p))
+	if err != nil {
+		return err
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	_, err = j.w.Write(append(data, '\n'))
+	return err
+}
+
+// Close closes the underlying file, if there is one.
+func (j *JSONLogger) Close() error {
+	if j.c == nil {
+		return nil
+	}
+	return j.c.Close()
+}
+
+type packetRecord struct {
+	Time      string `json:"time"`
+	Conn      int    `json:"conn"`
+	Direction string `json:"direction"`
+	Type      string `json:"type"`
+	TypeID    uint8  `json:"type_id"`
+	Response  bool   `json:"response"`
+	Length    int    `json:"length"`
+	Data      string `json:"data"`
+
+	// Fields decoded from pipe packets.
+	Switch    *uint32        `json:"switch,omitempty"`
+	Seq       *uint16        `json:"seq,omitempty"`
+	Subtype   string         `json:"subtype,omitempty"`
+	SubtypeID *uint8         `json:"subtype_id,omitempty"`
+	Payload   string         `json:"payload,omitempty"`
+	Statuses  []statusRecord `json:"statuses,omitempty"`
+}
+
+type statusRecord struct {
+	Device     int      `json:"device"`
+	IsOn       bool     `json:"is_on"`
+	Brightness uint8    `json:"brightness"`
+	ColorTone  uint8    `json:"color_tone"`
+	UseRGB     bool     `json:"use_rgb"`
+	RGB        [3]uint8 `json:"rgb"`
+}
+
+func newPacketRecord(connID int, direction string, p *cbyge.Packet) *packetRecord {
+	res := &packetRecord{
+		Time:      time.Now().Format(time.RFC3339Nano),
+		Conn:      connID,
+		Direction: direction,
+		Type:      cbyge.PacketTypeName(p.Type),
+		TypeID:    p.Type,
+		Response:  p.IsResponse,
+		Length:    len(p.Data),
+		Data:      hex.EncodeToString(p.Data),
+	}
+	if switchID, err := p.PipeSwitchID(); err == nil {
+		res.Switch = &switchID
+	}
+	if seq, err := p.Seq(); err == nil {
+		res.Seq = &seq
+	}
+	if subtype, err := p.PipeSubtype(); err == nil {
+		res.Subtype = cbyge.PacketPipeTypeName(subtype)
+		res.SubtypeID = &subtype
+	}
+	if payload, err := p.PipePayload(); err == nil {
+		res.Payload = hex.EncodeToString(payload)
+	}
+	if p.IsResponse && cbyge.IsStatusPaginatedResponse(p) {
+		statuses, _ := cbyge.DecodeStatusPaginatedResponse(p)
+		for _, s := range statuses {
+			res.Statuses = append(res.Statuses, statusRecord{
+				Device:     s.Device,
+				IsOn:       s.IsOn,
+				Brightness: s.Brightness,
+				ColorTone:  s.ColorTone,
+				UseRGB:     s.UseRGB,
+				RGB:        s.RGB,
+			})
+		}
+	}
+	return res
+}
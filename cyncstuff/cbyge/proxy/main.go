@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -11,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/unixpickle/cbyge"
 	"github.com/unixpickle/essentials"
@@ -19,51 +21,192 @@ import (
 func main() {
 	var listenAddr string
 	var outputDir string
-	flag.StringVar(&listenAddr, "-source", ":23778", "address to listen on")
-	flag.StringVar(&outputDir, "-output", "saved-packets", "output directory")
+	var pcapPath string
+	var jsonPath string
+	var types string
+	var rulesPath string
+	proxy := &Proxy{}
+	flag.StringVar(&listenAddr, "source", ":23778", "address to listen on")
+	flag.StringVar(&proxy.Upstream, "upstream", cbyge.DefaultPacketConnHost,
+		"address of the packet server to forward to")
+	flag.StringVar(&outputDir, "output", "saved-packets",
+		"directory for saved packet files (empty to disable)")
+	flag.StringVar(&pcapPath, "pcapng", "", "also write packets to this pcapng file")
+	flag.StringVar(&jsonPath, "jsonl", "",
+		"append decoded packets as JSON lines to this file ('-' for stdout)")
+	flag.StringVar(&types, "types", "",
+		"comma-separated packet types to log and save, like 'pipe,sync' (default: all)")
+	flag.StringVar(&rulesPath, "rules", "", "JSON file of rules for changing packets")
 	flag.Parse()
 
+	proxy.OutputDir = outputDir
+	if types != "" {
+		var err error
+		proxy.Types, err = ParsePacketTypes(types)
+		if err != nil {
+			essentials.Die(err)
+		}
+	}
+	if rulesPath != "" {
+		var err error
+		proxy.Rules, err = LoadRules(rulesPath)
+		essentials.Must(err)
+		log.Printf("loaded %d rules from %s", len(proxy.Rules.Rules), rulesPath)
+	}
+	if pcapPath != "" {
+		var err error
+		proxy.Pcap, err = NewPcapWriter(pcapPath)
+		essentials.Must(err)
+		defer proxy.Pcap.Close()
+	}
+	if jsonPath != "" {
+		var err error
+		proxy.JSONLog, err = NewJSONLogger(jsonPath)
+		essentials.Must(err)
+		defer proxy.JSONLog.Close()
+	}
+
 	tcpAddr, err := net.ResolveTCPAddr("tcp", listenAddr)
 	essentials.Must(err)
 	listener, err := net.ListenTCP("tcp", tcpAddr)
 	essentials.Must(err)
 	defer listener.Close()
 
-	for {
-		conn, err := listener.Accept()
-		essentials.Must(err)
-		connDir, connID := MakeOutputDir(outputDir)
-		go HandleConn(conn, connID, connDir)
-	}
+	log.Printf("forwarding %s to %s", listener.Addr(), proxy.Upstream)
+	essentials.Must(proxy.Serve(listener))
 }
 
-func MakeOutputDir(root string) (string, int) {
-	for i := 0; true; i++ {
-		newDir := filepath.Join(root, strconv.Itoa(i))
-		if _, err := os.Stat(newDir); err == nil {
+// A Proxy forwards connections from clients to the packet server, recording
+// the packets that pass through.
+type Proxy struct {
+	Upstream string
+
+	// OutputDir is where each connection's packets are saved as files.
+	// If it is empty, no files are written.
+	OutputDir string
+
+	// Optional recorders.
+	Pcap    *PcapWriter
+	JSONLog *JSONLogger
+
+	// Types limits which packet types are logged and saved. If nil, every
+	// packet is. Every packet is forwarded and written to the pcapng file
+	// regardless, so that its TCP streams stay complete.
+	Types map[uint8]bool
+
+	// Rules optionally changes, delays, drops and injects packets. The
+	// packets which are actually forwarded are the ones recorded.
+	Rules *RuleSet
+
+	nextConnID int
+}
+
+// Serve accepts connections until the listener is closed.
+func (p *Proxy) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			log.Printf("accept: %s", err)
+			time.Sleep(time.Millisecond * 100)
 			continue
 		}
-		if err := os.MkdirAll(newDir, 0755); err == nil {
-			return newDir, i
-		} else if !os.IsExist(err) {
-			essentials.Must(err)
+		id, outDir, err := p.nextConn()
+		if err != nil {
+			log.Printf("create output directory: %s", err)
+			conn.Close()
+			continue
 		}
+		go p.HandleConn(conn, id, outDir)
 	}
-	panic("unreachable")
 }
 
-func HandleConn(conn net.Conn, id int, outDir string) {
+func (p *Proxy) nextConn() (int, string, error) {
+	if p.OutputDir == "" {
+		id := p.nextConnID
+		p.nextConnID++
+		return id, "", nil
+	}
+	outDir, id, err := MakeOutputDir(p.OutputDir)
+	return id, outDir, err
+}
+
+// HandleConn forwards packets between a client and a new connection to the
+// upstream server.
+//
+// Errors only affect this connection.
+func (p *Proxy) HandleConn(conn net.Conn, id int, outDir string) {
 	log.Printf("connection created with ID: %d", id)
 	defer log.Printf("connection terminated: %d", id)
 
 	clientConn := cbyge.NewPacketConnWrap(conn)
 	defer clientConn.Close()
 
-	serverConn, err := cbyge.NewPacketConn()
-	essentials.Must(err)
+	serverConn, err := cbyge.NewPacketConnAddr(p.Upstream)
+	if err != nil {
+		log.Printf("conn=%d error dialing upstream: %s", id, err)
+		return
+	}
 	defer serverConn.Close()
 
+	var stream *PcapStream
+	if p.Pcap != nil {
+		serverAddr, _ := net.ResolveTCPAddr("tcp", p.Upstream)
+		stream, err = p.Pcap.NewStream(conn.RemoteAddr(), serverAddr)
+		if err != nil {
+			log.Printf("conn=%d error writing pcapng: %s", id, err)
+		} else {
+			defer func() {
+				if err := stream.Close(); err != nil {
+					log.Printf("conn=%d error writing pcapng: %s", id, err)
+				}
+			}()
+		}
+	}
+
 	var packetLock sync.Mutex
+	var packetIdx int
+
+	record := func(direction string, packet *cbyge.Packet) {
+		packetLock.Lock()
+		defer packetLock.Unlock()
+		if stream != nil {
+			if err := stream.WritePacket(direction == "in", packet); err != nil {
+				log.Printf("conn=%d error writing pcapng: %s", id, err)
+			}
+		}
+		if p.Types != nil && !p.Types[packet.Type] {
+			return
+		}
+		log.Printf("conn=%d direction=%s packet=%s", id, direction, packet)
+		if outDir != "" {
+			if err := WritePacket(outDir, packetIdx, direction, packet); err != nil {
+				log.Printf("conn=%d error saving packet: %s", id, err)
+			}
+			packetIdx++
+		}
+		if p.JSONLog != nil {
+			if err := p.JSONLog.Log(id, direction, packet); err != nil {
+				log.Printf("conn=%d error logging packet: %s", id, err)
+			}
+		}
+	}
+
+	// Injected packets may be written to either connection, so writes
+	// are synchronized.
+	var clientLock, serverLock sync.Mutex
+	send := func(direction string, packet *cbyge.Packet) error {
+		record(direction, packet)
+		if direction == "in" {
+			serverLock.Lock()
+			defer serverLock.Unlock()
+			return serverConn.Write(packet)
+		}
+		clientLock.Lock()
+		defer clientLock.Unlock()
+		return clientConn.Write(packet)
+	}
 
 	var wg sync.WaitGroup
 	wg.Add(2)
@@ -76,12 +219,31 @@ func HandleConn(conn net.Conn, id int, outDir string) {
 			if err != nil {
 				return
 			}
-			packetLock.Lock()
-			WritePacket(outDir, direction, packet)
-			packetLock.Unlock()
-			log.Printf("conn=%d direction=%s packet=%s", id, direction, packet)
-			if dest.Write(packet) != nil {
-				return
+			if p.Rules == nil {
+				if send(direction, packet) != nil {
+					return
+				}
+				continue
+			}
+			res := p.Rules.Apply(direction, packet)
+			if len(res.Applied) > 0 {
+				log.Printf("conn=%d direction=%s %s packet=%s", id, direction, res, packet)
+			}
+			for _, injection := range res.Before {
+				if send(injection.Direction, injection.Packet) != nil {
+					return
+				}
+			}
+			time.Sleep(res.Delay)
+			if res.Packet != nil {
+				if send(direction, res.Packet) != nil {
+					return
+				}
+			}
+			for _, injection := range res.After {
+				if send(injection.Direction, injection.Packet) != nil {
+					return
+				}
 			}
 		}
 	}
@@ -91,22 +253,47 @@ func HandleConn(conn net.Conn, id int, outDir string) {
 	wg.Wait()
 }
 
-func WritePacket(outDir, direction string, packet *cbyge.Packet) {
-	listing, err := ioutil.ReadDir(outDir)
-	essentials.Must(err)
-	nextIdx := 0
-	for _, entry := range listing {
-		name := entry.Name()
-		parts := strings.Split(name, "_")
-		if len(parts) != 2 {
+// MakeOutputDir creates the next unused numbered directory for a
+// connection.
+func MakeOutputDir(root string) (string, int, error) {
+	for i := 0; true; i++ {
+		newDir := filepath.Join(root, strconv.Itoa(i))
+		if _, err := os.Stat(newDir); err == nil {
 			continue
 		}
-		x, err := strconv.Atoi(parts[0])
-		if err == nil {
-			nextIdx = essentials.MaxInt(nextIdx, x+1)
+		if err := os.MkdirAll(newDir, 0755); err == nil {
+			return newDir, i, nil
+		} else if !os.IsExist(err) {
+			return "", 0, err
 		}
 	}
-	outName := fmt.Sprintf("%06d_%s", nextIdx, direction)
+	panic("unreachable")
+}
+
+// WritePacket saves a packet in its encoded form.
+func WritePacket(outDir string, idx int, direction string, packet *cbyge.Packet) error {
+	outName := fmt.Sprintf("%06d_%s", idx, direction)
 	outFile := filepath.Join(outDir, outName)
-	essentials.Must(ioutil.WriteFile(outFile, packet.Encode(), 0644))
+	return ioutil.WriteFile(outFile, packet.Encode(), 0644)
+}
+
+// ParsePacketTypes parses a comma-separated list of packet type names or
+// numbers.
+func ParsePacketTypes(list string) (map[uint8]bool, error) {
+	names := map[string]uint8{}
+	for i := 0; i < 16; i++ {
+		names[cbyge.PacketTypeName(uint8(i))] = uint8(i)
+	}
+	res := map[uint8]bool{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if t, ok := names[name]; ok {
+			res[t] = true
+		} else if t, err := strconv.Atoi(name); err == nil && t >= 0 && t < 16 {
+			res[uint8(t)] = true
+		} else {
+			return nil, fmt.Errorf("unknown packet type: %q", name)
+		}
+	}
+	return res, nil
 }
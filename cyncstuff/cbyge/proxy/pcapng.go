@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/unixpickle/cbyge"
+)
+
+const (
+	pcapBlockSectionHeader  = 0x0a0d0d0a
+	pcapBlockInterface      = 1
+	pcapBlockEnhancedPacket = 6
+
+	// Packets are stored as bare IPv4 datagrams.
+	pcapLinkTypeRaw = 101
+
+	pcapOptionEnd      = 0
+	pcapOptionComment  = 1
+	pcapOptionEPBFlags = 2
+	pcapOptionTSResol  = 9
+
+	// Directions for the epb_flags option.
+	pcapInbound  = 1
+	pcapOutbound = 2
+
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+
+	// Large packets are split into several TCP segments, since an IPv4
+	// datagram cannot be longer than 64KiB.
+	pcapMaxSegment = 0xff00
+)
+
+// A PcapWriter writes forwarded packets to a pcapng file.
+//
+// The packets are wrapped in synthesized TCP/IP headers, so that tools like
+// Wireshark can follow each connection as a TCP stream.
+type PcapWriter struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+// NewPcapWriter creates a pcapng file and writes its header.
+func NewPcapWriter(path string) (*PcapWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &PcapWriter{file: f}
+
+	var shb bytes.Buffer
+	binary.Write(&shb, binary.LittleEndian, uint32(0x1a2b3c4d))
+	binary.Write(&shb, binary.LittleEndian, uint16(1))
+	binary.Write(&shb, binary.LittleEndian, uint16(0))
+	binary.Write(&shb, binary.LittleEndian, int64(-1))
+	writePcapOption(&shb, pcapOptionComment, []byte("cbyge packet proxy"))
+	writePcapOption(&shb, pcapOptionEnd, nil)
+
+	var idb bytes.Buffer
+	binary.Write(&idb, binary.LittleEndian, uint16(pcapLinkTypeRaw))
+	binary.Write(&idb, binary.LittleEndian, uint16(0))
+	binary.Write(&idb, binary.LittleEndian, uint32(0))
+	writePcapOption(&idb, pcapOptionTSResol, []byte{6})
+	writePcapOption(&idb, pcapOptionEnd, nil)
+
+	if err := p.writeBlock(pcapBlockSectionHeader, shb.Bytes()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := p.writeBlock(pcapBlockInterface, idb.Bytes()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// NewStream starts a synthesized TCP stream between a client and a server.
+//
+// Addresses which are not IPv4 are replaced with private placeholders.
+func (p *PcapWriter) NewStream(client, server net.Addr) (*PcapStream, error) {
+	s := &PcapStream{
+		writer:     p,
+		clientIP:   net.IPv4(10, 0, 0, 1).To4(),
+		serverIP:   net.IPv4(10, 0, 0, 2).To4(),
+		clientPort: 50000,
+		serverPort: 23778,
+		clientSeq:  1000,
+		serverSeq:  5000,
+	}
+	if addr, ok := client.(*net.TCPAddr); ok && addr != nil {
+		if ip := addr.IP.To4(); ip != nil {
+			s.clientIP = ip
+		}
+		s.clientPort = uint16(addr.Port)
+	}
+	if addr, ok := server.(*net.TCPAddr); ok && addr != nil {
+		if ip := addr.IP.To4(); ip != nil {
+			s.serverIP = ip
+		}
+		s.serverPort = uint16(addr.Port)
+	}
+
+	// Write a handshake so that the stream looks complete.
+	now := time.Now()
+	if err := s.writeSegment(now, true, tcpFlagSYN, nil); err != nil {
+		return nil, err
+	}
+	s.clientSeq++
+	if err := s.writeSegment(now, false, tcpFlagSYN|tcpFlagACK, nil); err != nil {
+		return nil, err
+	}
+	s.serverSeq++
+	if err := s.writeSegment(now, true, tcpFlagACK, nil); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close finishes the file.
+func (p *PcapWriter) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.file.Close()
+}
+
+func (p *PcapWriter) writeBlock(blockType uint32, body []byte) error {
+	length := uint32(12 + len(body))
+	var block bytes.Buffer
+	binary.Write(&block, binary.LittleEndian, blockType)
+	binary.Write(&block, binary.LittleEndian, length)
+	block.Write(body)
+	binary.Write(&block, binary.LittleEndian, length)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_, err := p.file.Write(block.Bytes())
+	return err
+}
+
+// A PcapStream records the packets of one proxied connection.
+type PcapStream struct {
+	writer *PcapWriter
+
+	lock       sync.Mutex
+	clientIP   net.IP
+	serverIP   net.IP
+	clientPort uint16
+	serverPort uint16
+	clientSeq  uint32
+	serverSeq  uint32
+	ipID       uint16
+}
+
+// WritePacket records a packet sent by the client or the server.
+func (s *PcapStream) WritePacket(fromClient bool, packet *cbyge.Packet) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	data := packet.Encode()
+	now := time.Now()
+	for len(data) > 0 {
+		n := len(data)
+		if n > pcapMaxSegment {
+			n = pcapMaxSegment
+		}
+		if err := s.writeSegment(now, fromClient, tcpFlagPSH|tcpFlagACK, data[:n]); err != nil {
+			return err
+		}
+		if fromClient {
+			s.clientSeq += uint32(n)
+		} else {
+			s.serverSeq += uint32(n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// Close records both sides of the connection shutting down.
+func (s *PcapStream) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	if err := s.writeSegment(now, true, tcpFlagFIN|tcpFlagACK, nil); err != nil {
+		return err
+	}
+	s.clientSeq++
+	if err := s.writeSegment(now, false, tcpFlagFIN|tcpFlagACK, nil); err != nil {
+		return err
+	}
+	s.serverSeq++
+	return s.writeSegment(now, true, tcpFlagACK, nil)
+}
+
+func (s *PcapStream) writeSegment(t time.Time, fromClient bool, flags uint8,
+	payload []byte) error {
+	srcIP, dstIP := s.clientIP, s.serverIP
+	srcPort, dstPort := s.clientPort, s.serverPort
+	seq, ack := s.clientSeq, s.serverSeq
+	direction := uint32(pcapInbound)
+	if !fromClient {
+		srcIP, dstIP = dstIP, srcIP
+		srcPort, dstPort = dstPort, srcPort
+		seq, ack = ack, seq
+		direction = pcapOutbound
+	}
+	if flags&tcpFlagACK == 0 {
+		ack = 0
+	}
+
+	var tcp bytes.Buffer
+	binary.Write(&tcp, binary.BigEndian, srcPort)
+	binary.Write(&tcp, binary.BigEndian, dstPort)
+	binary.Write(&tcp, binary.BigEndian, seq)
+	binary.Write(&tcp, binary.BigEndian, ack)
+	tcp.WriteByte(5 << 4)
+	tcp.WriteByte(flags)
+	binary.Write(&tcp, binary.BigEndian, uint16(0xffff))
+	binary.Write(&tcp, binary.BigEndian, uint16(0))
+	binary.Write(&tcp, binary.BigEndian, uint16(0))
+	tcp.Write(payload)
+	segment := tcp.Bytes()
+
+	var pseudo bytes.Buffer
+	pseudo.Write(srcIP)
+	pseudo.Write(dstIP)
+	pseudo.Write([]byte{0, 6})
+	binary.Write(&pseudo, binary.BigEndian, uint16(len(segment)))
+	pseudo.Write(segment)
+	binary.BigEndian.PutUint16(segment[16:18], internetChecksum(pseudo.Bytes()))
+
+	var ip bytes.Buffer
+	ip.Write([]byte{0x45, 0})
+	binary.Write(&ip, binary.BigEndian, uint16(20+len(segment)))
+	binary.Write(&ip, binary.BigEndian, s.ipID)
+	s.ipID++
+	ip.Write([]byte{0x40, 0, 64, 6, 0, 0})
+	ip.Write(srcIP)
+	ip.Write(dstIP)
+	header := ip.Bytes()
+	binary.BigEndian.PutUint16(header[10:12], internetChecksum(header))
+	ip.Write(segment)
+	datagram := ip.Bytes()
+
+	micros := uint64(t.UnixNano() / 1000)
+	var epb bytes.Buffer
+	binary.Write(&epb, binary.LittleEndian, uint32(0))
+	binary.Write(&epb, binary.LittleEndian, uint32(micros>>32))
+	binary.Write(&epb, binary.LittleEndian, uint32(micros))
+	binary.Write(&epb, binary.LittleEndian, uint32(len(datagram)))
+	binary.Write(&epb, binary.LittleEndian, uint32(len(datagram)))
+	epb.Write(datagram)
+	epb.Write(make([]byte, pcapPadding(len(datagram))))
+	var flagsOption [4]byte
+	binary.LittleEndian.PutUint32(flagsOption[:], direction)
+	writePcapOption(&epb, pcapOptionEPBFlags, flagsOption[:])
+	writePcapOption(&epb, pcapOptionEnd, nil)
+	return s.writer.writeBlock(pcapBlockEnhancedPacket, epb.Bytes())
+}
+
+func writePcapOption(w *bytes.Buffer, code uint16, value []byte) {
+	binary.Write(w, binary.LittleEndian, code)
+	binary.Write(w, binary.LittleEndian, uint16(len(value)))
+	w.Write(value)
+	w.Write(make([]byte, pcapPadding(len(value))))
+}
+
+func pcapPadding(n int) int {
+	return (4 - n%4) % 4
+}
+
+func internetChecksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
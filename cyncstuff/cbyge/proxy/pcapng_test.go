@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/unixpickle/cbyge"
+)
+
+func TestPcapWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.pcapng")
+	w, err := NewPcapWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &net.TCPAddr{IP: net.IPv4(192, 168, 1, 5), Port: 40000}
+	server := &net.TCPAddr{IP: net.ParseIP("::1"), Port: 23779}
+	stream, err := w.NewStream(client, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := cbyge.NewPacketSetLum(1, 2, 3, 50)
+	response := &cbyge.Packet{Type: cbyge.PacketTypePipe, IsResponse: true,
+		Data: []byte{0, 0, 0, 1, 0, 2, 0}}
+	large := &cbyge.Packet{Type: cbyge.PacketTypeSync, Data: make([]byte, pcapMaxSegment+10)}
+	for i, p := range []*cbyge.Packet{request, response, large} {
+		if err := stream.WritePacket(i != 1, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := readPcapBlocks(t, path)
+	if len(blocks) != 2+3+4+3 {
+		t.Fatalf("unexpected number of blocks: %d", len(blocks))
+	}
+	if blocks[0].Type != pcapBlockSectionHeader || blocks[1].Type != pcapBlockInterface {
+		t.Fatalf("unexpected header blocks: %x %x", blocks[0].Type, blocks[1].Type)
+	}
+	if binary.LittleEndian.Uint16(blocks[1].Body) != pcapLinkTypeRaw {
+		t.Errorf("unexpected link type")
+	}
+
+	clientIP := net.IPv4(192, 168, 1, 5).To4()
+	serverIP := net.IPv4(10, 0, 0, 2).To4()
+	requestLen := uint32(len(request.Encode()))
+	responseLen := uint32(len(response.Encode()))
+	largeLen := uint32(len(large.Encode()))
+	expected := []pcapSegment{
+		{true, tcpFlagSYN, 1000, 0, 0},
+		{false, tcpFlagSYN | tcpFlagACK, 5000, 1001, 0},
+		{true, tcpFlagACK, 1001, 5001, 0},
+		{true, tcpFlagPSH | tcpFlagACK, 1001, 5001, requestLen},
+		{false, tcpFlagPSH | tcpFlagACK, 5001, 1001 + requestLen, responseLen},
+		{true, tcpFlagPSH | tcpFlagACK, 1001 + requestLen, 5001 + responseLen, pcapMaxSegment},
+		{true, tcpFlagPSH | tcpFlagACK, 1001 + requestLen + pcapMaxSegment, 5001 + responseLen,
+			largeLen - pcapMaxSegment},
+		{true, tcpFlagFIN | tcpFlagACK, 1001 + requestLen + largeLen, 5001 + responseLen, 0},
+		{false, tcpFlagFIN | tcpFlagACK, 5001 + responseLen, 1002 + requestLen + largeLen, 0},
+		{true, tcpFlagACK, 1002 + requestLen + largeLen, 5002 + responseLen, 0},
+	}
+	var payloads [2]bytes.Buffer
+	for i, block := range blocks[2:] {
+		if block.Type != pcapBlockEnhancedPacket {
+			t.Fatalf("block %d: unexpected type %x", i, block.Type)
+		}
+		capLen := binary.LittleEndian.Uint32(block.Body[12:16])
+		datagram := block.Body[20 : 20+capLen]
+		options := block.Body[20+capLen+uint32(pcapPadding(int(capLen))):]
+		direction := binary.LittleEndian.Uint32(options[4:8])
+		if binary.LittleEndian.Uint16(options) != pcapOptionEPBFlags ||
+			(direction == pcapInbound) != expected[i].FromClient {
+			t.Errorf("segment %d: unexpected flags option %x", i, options)
+		}
+
+		header, segment := datagram[:20], datagram[20:]
+		if internetChecksum(header) != 0 {
+			t.Errorf("segment %d: bad IP checksum", i)
+		}
+		if int(binary.BigEndian.Uint16(header[2:4])) != len(datagram) {
+			t.Errorf("segment %d: bad IP length", i)
+		}
+		srcIP, dstIP := net.IP(header[12:16]), net.IP(header[16:20])
+		srcPort := binary.BigEndian.Uint16(segment[0:2])
+		if !expected[i].FromClient {
+			srcIP, dstIP = dstIP, srcIP
+			srcPort = binary.BigEndian.Uint16(segment[2:4])
+		}
+		if !srcIP.Equal(clientIP) || !dstIP.Equal(serverIP) || srcPort != 40000 {
+			t.Errorf("segment %d: unexpected addresses %s:%d -> %s", i, srcIP, srcPort, dstIP)
+		}
+
+		var pseudo bytes.Buffer
+		pseudo.Write(header[12:20])
+		pseudo.Write([]byte{0, 6})
+		binary.Write(&pseudo, binary.BigEndian, uint16(len(segment)))
+		pseudo.Write(segment)
+		if internetChecksum(pseudo.Bytes()) != 0 {
+			t.Errorf("segment %d: bad TCP checksum", i)
+		}
+
+		actual := pcapSegment{
+			FromClient: expected[i].FromClient,
+			Flags:      segment[13],
+			Seq:        binary.BigEndian.Uint32(segment[4:8]),
+			Ack:        binary.BigEndian.Uint32(segment[8:12]),
+			Length:     uint32(len(segment) - 20),
+		}
+		if actual != expected[i] {
+			t.Errorf("segment %d: expected %+v but got %+v", i, expected[i], actual)
+		}
+		if actual.FromClient {
+			payloads[0].Write(segment[20:])
+		} else {
+			payloads[1].Write(segment[20:])
+		}
+	}
+
+	// Each side's payloads join up into the encoded packets.
+	clientData := append(request.Encode(), large.Encode()...)
+	if !bytes.Equal(payloads[0].Bytes(), clientData) ||
+		!bytes.Equal(payloads[1].Bytes(), response.Encode()) {
+		t.Error("unexpected stream contents")
+	}
+}
+
+type pcapSegment struct {
+	FromClient bool
+	Flags      uint8
+	Seq        uint32
+	Ack        uint32
+	Length     uint32
+}
+
+type pcapBlock struct {
+	Type uint32
+	Body []byte
+}
+
+func readPcapBlocks(t *testing.T, path string) []pcapBlock {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res []pcapBlock
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block: %x", data)
+		}
+		blockType := binary.LittleEndian.Uint32(data)
+		length := binary.LittleEndian.Uint32(data[4:])
+		if length%4 != 0 || length < 12 || int(length) > len(data) {
+			t.Fatalf("bad block length: %d", length)
+		}
+		if binary.LittleEndian.Uint32(data[length-4:]) != length {
+			t.Fatal("mismatched trailing block length")
+		}
+		res = append(res, pcapBlock{Type: blockType, Body: data[8 : length-4]})
+		data = data[length:]
+	}
+	return res
+}
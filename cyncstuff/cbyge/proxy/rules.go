@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+// A RuleSet changes packets as they pass through the proxy.
+//
+// Every rule that matches a packet is applied in order, each one seeing the
+// packet as changed by the previous rules, until one drops it.
+type RuleSet struct {
+	Rules []*Rule `json:"rules"`
+}
+
+// A Rule applies an action to the packets that it matches.
+type Rule struct {
+	Name  string    `json:"name"`
+	Match RuleMatch `json:"match"`
+
+	// Action is one of "drop", "delay", "rewrite", "inject" or "log".
+	Action string `json:"action"`
+
+	// Delay is a duration like "500ms" for the delay action.
+	Delay string `json:"delay,omitempty"`
+
+	// Rewrite lists the edits made by the rewrite action.
+	Rewrite []*RewriteOp `json:"rewrite,omitempty"`
+
+	// Inject is the packet sent by the inject action.
+	Inject *InjectSpec `json:"inject,omitempty"`
+
+	// Limit is the maximum number of times the rule applies, or 0 for no
+	// limit.
+	Limit int `json:"limit,omitempty"`
+
+	delay  time.Duration
+	inject *cbyge.Packet
+
+	lock  sync.Mutex
+	count int
+}
+
+// A RuleMatch selects packets. Empty fields match anything.
+type RuleMatch struct {
+	// Direction is "in" for packets from the client, or "out" for packets
+	// from the server.
+	Direction string `json:"direction,omitempty"`
+
+	// Type and Subtype are names like "pipe" and "set_lum", or numbers.
+	Type    string `json:"type,omitempty"`
+	Subtype string `json:"subtype,omitempty"`
+
+	Response *bool   `json:"response,omitempty"`
+	Switch   *uint32 `json:"switch,omitempty"`
+
+	// Bytes is a hex pattern like "7e ?? 01" which must appear in the
+	// packet's data, at Offset if it is set.
+	Bytes  string `json:"bytes,omitempty"`
+	Offset *int   `json:"offset,omitempty"`
+
+	packetType *uint8
+	subtype    *uint8
+	pattern    []int
+}
+
+// A RewriteOp edits a packet's data, either by overwriting the bytes at an
+// offset, or by replacing occurrences of a byte string.
+type RewriteOp struct {
+	Offset *int   `json:"offset,omitempty"`
+	Bytes  string `json:"bytes,omitempty"`
+
+	Find    string `json:"find,omitempty"`
+	Replace string `json:"replace,omitempty"`
+
+	bytes   []byte
+	find    []byte
+	replace []byte
+}
+
+// An InjectSpec describes a packet to send when a rule matches.
+type InjectSpec struct {
+	// Direction is "in" to send the packet to the server, or "out" to send
+	// it to the client. It defaults to the direction of the matched packet.
+	Direction string `json:"direction,omitempty"`
+
+	// Position is "before" or "after" the matched packet. The default is
+	// "after".
+	Position string `json:"position,omitempty"`
+
+	Type     string `json:"type"`
+	Response bool   `json:"response,omitempty"`
+	Data     string `json:"data"`
+
+	// CopySeq copies the sequence number of a matched pipe packet into the
+	// injected pipe packet, for example to forge a response.
+	CopySeq bool `json:"copy_seq,omitempty"`
+}
+
+// An Injection is a packet to send on a connection.
+type Injection struct {
+	Direction string
+	Packet    *cbyge.Packet
+}
+
+// A RuleResult is the outcome of applying a RuleSet to a packet.
+type RuleResult struct {
+	// Packet is the packet to forward, or nil if it was dropped.
+	Packet *cbyge.Packet
+
+	Delay  time.Duration
+	Before []Injection
+	After  []Injection
+
+	// Applied lists the names of the rules which were applied.
+	Applied []string
+}
+
+// LoadRules reads a RuleSet from a JSON file.
+func LoadRules(path string) (*RuleSet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules RuleSet
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, errors.Wrap(err, "load rules")
+	}
+	for i, rule := range rules.Rules {
+		if rule.Name == "" {
+			rule.Name = "#" + strconv.Itoa(i)
+		}
+		if err := rule.compile(); err != nil {
+			return nil, errors.Wrap(err, "load rules: rule "+rule.Name)
+		}
+	}
+	return &rules, nil
+}
+
+// Apply runs the rules on a packet travelling in a direction.
+//
+// The packet itself is never modified.
+func (r *RuleSet) Apply(direction string, p *cbyge.Packet) *RuleResult {
+	res := &RuleResult{Packet: p}
+	for _, rule := range r.Rules {
+		if !rule.Match.matches(direction, res.Packet) || !rule.take() {
+			continue
+		}
+		res.Applied = append(res.Applied, rule.Name+":"+rule.Action)
+		switch rule.Action {
+		case "drop":
+			res.Packet = nil
+			return res
+		case "delay":
+			res.Delay += rule.delay
+		case "rewrite":
+			res.Packet = rule.rewrite(res.Packet)
+		case "inject":
+			injection := rule.injection(direction, res.Packet)
+			if rule.Inject.Position == "before" {
+				res.Before = append(res.Before, injection)
+			} else {
+				res.After = append(res.After, injection)
+			}
+		}
+	}
+	return res
+}
+
+func (r *Rule) compile() error {
+	if err := r.Match.compile(); err != nil {
+		return err
+	}
+	switch r.Action {
+	case "drop", "log":
+	case "delay":
+		var err error
+		r.delay, err = time.ParseDuration(r.Delay)
+		if err != nil {
+			return err
+		}
+	case "rewrite":
+		if len(r.Rewrite) == 0 {
+			return errors.New("rewrite action needs at least one rewrite")
+		}
+		for _, op := range r.Rewrite {
+			if err := op.compile(); err != nil {
+				return err
+			}
+		}
+	case "inject":
+		if r.Inject == nil {
+			return errors.New("inject action needs an inject packet")
+		}
+		if err := checkDirection(r.Inject.Direction); err != nil {
+			return err
+		}
+		if r.Inject.Position != "" && r.Inject.Position != "before" &&
+			r.Inject.Position != "after" {
+			return errors.Errorf("unknown inject position: %q", r.Inject.Position)
+		}
+		packetType, err := parsePacketTypeName(r.Inject.Type)
+		if err != nil {
+			return err
+		}
+		data, err := parseHexBytes(r.Inject.Data)
+		if err != nil {
+			return err
+		}
+		r.inject = &cbyge.Packet{Type: packetType, IsResponse: r.Inject.Response, Data: data}
+	default:
+		return errors.Errorf("unknown action: %q", r.Action)
+	}
+	return nil
+}
+
+// take counts an application of the rule, returning false if the rule has
+// reached its limit.
+func (r *Rule) take() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.Limit > 0 && r.count >= r.Limit {
+		return false
+	}
+	r.count++
+	return true
+}
+
+func (r *Rule) rewrite(p *cbyge.Packet) *cbyge.Packet {
+	data := append([]byte{}, p.Data...)
+	for _, op := range r.Rewrite {
+		if op.Offset != nil {
+			// Edits past the end of the data are cut off.
+			if *op.Offset < len(data) {
+				copy(data[*op.Offset:], op.bytes)
+			}
+		} else {
+			data = bytes.ReplaceAll(data, op.find, op.replace)
+		}
+	}
+	return &cbyge.Packet{Type: p.Type, IsResponse: p.IsResponse, Data: data}
+}
+
+func (r *Rule) injection(direction string, matched *cbyge.Packet) Injection {
+	p := &cbyge.Packet{
+		Type:       r.inject.Type,
+		IsResponse: r.inject.IsResponse,
+		Data:       append([]byte{}, r.inject.Data...),
+	}
+	if r.Inject.CopySeq && len(p.Data) >= 6 {
+		if seq, err := matched.Seq(); err == nil {
+			binary.BigEndian.PutUint16(p.Data[4:6], seq)
+		}
+	}
+	if r.Inject.Direction != "" {
+		direction = r.Inject.Direction
+	}
+	return Injection{Direction: direction, Packet: p}
+}
+
+func (m *RuleMatch) compile() error {
+	if err := checkDirection(m.Direction); err != nil {
+		return err
+	}
+	if m.Type != "" {
+		t, err := parsePacketTypeName(m.Type)
+		if err != nil {
+			return err
+		}
+		m.packetType = &t
+	}
+	if m.Subtype != "" {
+		t, err := parsePipeTypeName(m.Subtype)
+		if err != nil {
+			return err
+		}
+		m.subtype = &t
+	}
+	if m.Bytes != "" {
+		var err error
+		m.pattern, err = parseHexPattern(m.Bytes)
+		if err != nil {
+			return err
+		}
+	} else if m.Offset != nil {
+		return errors.New("match offset needs a byte pattern")
+	}
+	return nil
+}
+
+func (m *RuleMatch) matches(direction string, p *cbyge.Packet) bool {
+	if m.Direction != "" && m.Direction != direction {
+		return false
+	}
+	if m.packetType != nil && *m.packetType != p.Type {
+		return false
+	}
+	if m.Response != nil && *m.Response != p.IsResponse {
+		return false
+	}
+	if m.subtype != nil {
+		if subtype, err := p.PipeSubtype(); err != nil || subtype != *m.subtype {
+			return false
+		}
+	}
+	if m.Switch != nil {
+		if switchID, err := p.PipeSwitchID(); err != nil || switchID != *m.Switch {
+			return false
+		}
+	}
+	if m.pattern != nil {
+		if m.Offset != nil {
+			return patternMatchesAt(m.pattern, p.Data, *m.Offset)
+		}
+		for i := 0; i+len(m.pattern) <= len(p.Data); i++ {
+			if patternMatchesAt(m.pattern, p.Data, i) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (r *RewriteOp) compile() error {
+	var err error
+	if r.Offset != nil {
+		if *r.Offset < 0 {
+			return errors.New("rewrite offset must not be negative")
+		}
+		r.bytes, err = parseHexBytes(r.Bytes)
+		return err
+	}
+	if r.Find == "" {
+		return errors.New("rewrite needs an offset or a find string")
+	}
+	if r.find, err = parseHexBytes(r.Find); err != nil {
+		return err
+	}
+	r.replace, err = parseHexBytes(r.Replace)
+	return err
+}
+
+func checkDirection(direction string) error {
+	if direction != "" && direction != "in" && direction != "out" {
+		return errors.Errorf("unknown direction: %q", direction)
+	}
+	return nil
+}
+
+func parsePacketTypeName(name string) (uint8, error) {
+	if strings.Contains(name, ",") {
+		return 0, errors.Errorf("expected a single packet type: %q", name)
+	}
+	types, err := ParsePacketTypes(name)
+	if err != nil {
+		return 0, err
+	}
+	for t := range types {
+		return t, nil
+	}
+	return 0, errors.New("missing packet type")
+}
+
+func parsePipeTypeName(name string) (uint8, error) {
+	for i := 0; i < 0x100; i++ {
+		if cbyge.PacketPipeTypeName(uint8(i)) == name {
+			return uint8(i), nil
+		}
+	}
+	x, err := strconv.ParseUint(name, 0, 8)
+	if err != nil {
+		return 0, errors.Errorf("unknown pipe subtype: %q", name)
+	}
+	return uint8(x), nil
+}
+
+func parseHexBytes(s string) ([]byte, error) {
+	data, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		return nil, errors.Errorf("invalid hex bytes: %q", s)
+	}
+	return data, nil
+}
+
+// parseHexPattern parses space-separated hex bytes, where "??" matches any
+// byte and is stored as -1.
+func parseHexPattern(s string) ([]int, error) {
+	var res []int
+	for _, field := range strings.Fields(s) {
+		if field == "??" {
+			res = append(res, -1)
+			continue
+		}
+		data, err := parseHexBytes(field)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range data {
+			res = append(res, int(b))
+		}
+	}
+	if len(res) == 0 {
+		return nil, errors.New("empty byte pattern")
+	}
+	return res, nil
+}
+
+func patternMatchesAt(pattern []int, data []byte, offset int) bool {
+	if offset < 0 || offset+len(pattern) > len(data) {
+		return false
+	}
+	for i, b := range pattern {
+		if b >= 0 && data[offset+i] != byte(b) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *RuleResult) String() string {
+	return fmt.Sprintf("rules=%s", strings.Join(r.Applied, ","))
+}
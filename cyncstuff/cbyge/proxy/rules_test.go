@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/unixpickle/cbyge"
+)
+
+func TestRuleSetApply(t *testing.T) {
+	// The brightness is at offset 26 of the packet data.
+	lum := cbyge.NewPacketSetLum(0x01020304, 0x0506, 3, 50)
+	ct := cbyge.NewPacketSetCT(0x01020304, 0x0507, 3, 10)
+	response := &cbyge.Packet{Type: cbyge.PacketTypePipe, IsResponse: true,
+		Data: []byte{1, 2, 3, 4, 0, 0, 0}}
+	sync := &cbyge.Packet{Type: cbyge.PacketTypeSync, Data: []byte{1, 2, 3}}
+
+	cases := []struct {
+		Name      string
+		Rules     string
+		Direction string
+		Packet    *cbyge.Packet
+		Applied   []string
+	}{
+		{"Direction", `{"match": {"direction": "out"}, "action": "log"}`, "in", lum, nil},
+		{"Type", `{"match": {"type": "sync"}, "action": "log"}`, "in", sync, []string{"#0:log"}},
+		{"TypeNumber", `{"match": {"type": "8"}, "action": "log"}`, "in", lum, nil},
+		{"Subtype", `{"match": {"subtype": "set_lum"}, "action": "log"}`, "in", lum,
+			[]string{"#0:log"}},
+		{"SubtypeNumber", `{"match": {"subtype": "0xe2"}, "action": "log"}`, "in", lum, nil},
+		{"SubtypeShort", `{"match": {"subtype": "set_lum"}, "action": "log"}`, "out", response,
+			nil},
+		{"Response", `{"match": {"response": true}, "action": "log"}`, "out", response,
+			[]string{"#0:log"}},
+		{"Switch", `{"match": {"switch": 16909060}, "action": "log"}`, "in", lum,
+			[]string{"#0:log"}},
+		{"OtherSwitch", `{"match": {"switch": 1}, "action": "log"}`, "in", lum, nil},
+		{"Bytes", `{"match": {"bytes": "d2 ?? 00 00"}, "action": "log"}`, "in", lum,
+			[]string{"#0:log"}},
+		{"BytesMissing", `{"match": {"bytes": "d2 ?? 00 01"}, "action": "log"}`, "in", lum, nil},
+		{"Offset", `{"match": {"bytes": "?? 32", "offset": 25}, "action": "log"}`, "in", lum,
+			[]string{"#0:log"}},
+		{"WrongOffset", `{"match": {"bytes": "32", "offset": 24}, "action": "log"}`, "in", lum,
+			nil},
+		{"PastEnd", `{"match": {"bytes": "01 02 03 04", "offset": 1}, "action": "log"}`, "in",
+			sync, nil},
+		{"Named", `{"name": "x", "match": {}, "action": "log"}`, "in", ct, []string{"x:log"}},
+	}
+	for _, c := range cases {
+		rules := parseTestRules(t, `{"rules": [`+c.Rules+`]}`)
+		res := rules.Apply(c.Direction, c.Packet)
+		if !reflect.DeepEqual(res.Applied, c.Applied) {
+			t.Errorf("%s: expected %v but got %v", c.Name, c.Applied, res.Applied)
+		}
+		if res.Packet != c.Packet {
+			t.Errorf("%s: packet was changed", c.Name)
+		}
+	}
+}
+
+func TestRuleSetApplyActions(t *testing.T) {
+	rules := parseTestRules(t, `{"rules": [
+		{"name": "a", "match": {"subtype": "set_lum"}, "action": "delay", "delay": "20ms"},
+		{"name": "b", "match": {"subtype": "set_lum"}, "action": "rewrite",
+		 "rewrite": [{"offset": 26, "bytes": "64"}, {"find": "d2 00", "replace": "d2 ff"},
+		             {"offset": 1000, "bytes": "01"}]},
+		{"name": "c", "match": {"bytes": "64", "offset": 26}, "action": "delay",
+		 "delay": "30ms"},
+		{"name": "d", "match": {"subtype": "set_ct"}, "action": "drop"},
+		{"name": "e", "match": {}, "action": "log"}
+	]}`)
+
+	lum := cbyge.NewPacketSetLum(1, 2, 3, 50)
+	original := append([]byte{}, lum.Data...)
+	res := rules.Apply("in", lum)
+	if !reflect.DeepEqual(res.Applied, []string{"a:delay", "b:rewrite", "c:delay", "e:log"}) {
+		t.Errorf("unexpected rules: %v", res.Applied)
+	}
+	if res.Delay != time.Millisecond*50 {
+		t.Errorf("unexpected delay: %v", res.Delay)
+	}
+	if !bytes.Equal(lum.Data, original) {
+		t.Error("original packet was modified")
+	}
+	expected := bytes.ReplaceAll(original, []byte{0xd2, 0}, []byte{0xd2, 0xff})
+	expected[26] = 100
+	if !bytes.Equal(res.Packet.Data, expected) {
+		t.Errorf("expected data %x but got %x", expected, res.Packet.Data)
+	}
+
+	// Later rules do not see a dropped packet.
+	res = rules.Apply("in", cbyge.NewPacketSetCT(1, 2, 3, 10))
+	if res.Packet != nil || !reflect.DeepEqual(res.Applied, []string{"d:drop"}) {
+		t.Errorf("unexpected result: %v %v", res.Packet, res.Applied)
+	}
+}
+
+func TestRuleSetApplyInject(t *testing.T) {
+	rules := parseTestRules(t, `{"rules": [
+		{"name": "ack", "match": {"direction": "in", "subtype": "set_lum"}, "action": "inject",
+		 "inject": {"direction": "out", "type": "pipe", "response": true,
+		            "data": "00 00 00 01 00 00 00", "copy_seq": true}},
+		{"name": "pre", "match": {"subtype": "set_lum"}, "action": "inject",
+		 "inject": {"position": "before", "type": "sync", "data": "0102"}}
+	]}`)
+	res := rules.Apply("in", cbyge.NewPacketSetLum(1, 0xabcd, 3, 50))
+	if len(res.Before) != 1 || len(res.After) != 1 {
+		t.Fatalf("unexpected injections: %v %v", res.Before, res.After)
+	}
+	ack := res.After[0]
+	if ack.Direction != "out" || !ack.Packet.IsResponse || ack.Packet.Type != cbyge.PacketTypePipe {
+		t.Errorf("unexpected injection: %+v", ack)
+	}
+	if seq, err := ack.Packet.Seq(); err != nil || seq != 0xabcd {
+		t.Errorf("unexpected sequence number: %x (%v)", seq, err)
+	}
+	pre := res.Before[0]
+	if pre.Direction != "in" || pre.Packet.Type != cbyge.PacketTypeSync ||
+		!bytes.Equal(pre.Packet.Data, []byte{1, 2}) {
+		t.Errorf("unexpected injection: %+v", pre)
+	}
+
+	// Each injection is a new packet.
+	res1 := rules.Apply("in", cbyge.NewPacketSetLum(1, 0x1234, 3, 50))
+	if seq, _ := res1.After[0].Packet.Seq(); seq != 0x1234 {
+		t.Errorf("unexpected sequence number: %x", seq)
+	}
+	if seq, _ := ack.Packet.Seq(); seq != 0xabcd {
+		t.Error("earlier injection was modified")
+	}
+}
+
+func TestRuleSetApplyLimit(t *testing.T) {
+	rules := parseTestRules(t, `{"rules": [
+		{"name": "once", "match": {}, "action": "drop", "limit": 2},
+		{"name": "always", "match": {}, "action": "log"}
+	]}`)
+	var applied [][]string
+	for i := 0; i < 3; i++ {
+		applied = append(applied, rules.Apply("in", cbyge.NewPacketSetLum(1, 2, 3, 50)).Applied)
+	}
+	expected := [][]string{{"once:drop"}, {"once:drop"}, {"always:log"}}
+	if !reflect.DeepEqual(applied, expected) {
+		t.Errorf("expected %v but got %v", expected, applied)
+	}
+}
+
+func TestLoadRulesErrors(t *testing.T) {
+	for _, rule := range []string{
+		`{"match": {"direction": "up"}, "action": "log"}`,
+		`{"match": {"type": "pipe,sync"}, "action": "log"}`,
+		`{"match": {"subtype": "set_everything"}, "action": "log"}`,
+		`{"match": {"offset": 3}, "action": "log"}`,
+		`{"match": {"bytes": "7g"}, "action": "log"}`,
+		`{"match": {}, "action": "explode"}`,
+		`{"match": {}, "action": "delay", "delay": "soon"}`,
+		`{"match": {}, "action": "rewrite"}`,
+		`{"match": {}, "action": "rewrite", "rewrite": [{"offset": -1, "bytes": "00"}]}`,
+		`{"match": {}, "action": "rewrite", "rewrite": [{"bytes": "00"}]}`,
+		`{"match": {}, "action": "inject"}`,
+		`{"match": {}, "action": "inject", "inject": {"type": "pipe", "position": "during"}}`,
+	} {
+		path := filepath.Join(t.TempDir(), "rules.json")
+		if err := ioutil.WriteFile(path, []byte(`{"rules": [`+rule+`]}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadRules(path); err == nil {
+			t.Errorf("%s: expected an error", rule)
+		}
+	}
+}
+
+func parseTestRules(t *testing.T, data string) *RuleSet {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := LoadRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+var packetFileExpr = regexp.MustCompile(`^([0-9]+)_(in|out)$`)
+
+// A CapturedPacket is a packet recorded by the proxy command.
+type CapturedPacket struct {
+	Index int
+
+	// FromClient is true for packets sent by the app to the server (the
+	// "in" files), and false for packets sent back by the server.
+	FromClient bool
+
+	// Time is when the packet file was written.
+	Time time.Time
+
+	Packet *cbyge.Packet
+}
+
+// A Capture is the sequence of packets recorded for one connection.
+type Capture struct {
+	Dir     string
+	Packets []*CapturedPacket
+}
+
+// LoadCaptures loads every connection in a directory written by the proxy.
+//
+// The directory may either hold the packet files of a single connection, or
+// a numbered subdirectory per connection.
+func LoadCaptures(dir string) ([]*Capture, error) {
+	listing, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var connIDs []int
+	for _, entry := range listing {
+		if packetFileExpr.MatchString(entry.Name()) {
+			capture, err := LoadCapture(dir)
+			if err != nil {
+				return nil, err
+			}
+			return []*Capture{capture}, nil
+		}
+		if id, err := strconv.Atoi(entry.Name()); err == nil && entry.IsDir() {
+			connIDs = append(connIDs, id)
+		}
+	}
+	if len(connIDs) == 0 {
+		return nil, errors.New("no captured packets in " + dir)
+	}
+	sort.Ints(connIDs)
+	var res []*Capture
+	for _, id := range connIDs {
+		capture, err := LoadCapture(filepath.Join(dir, strconv.Itoa(id)))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, capture)
+	}
+	return res, nil
+}
+
+// LoadCapture loads the packets of a single connection, in the order they
+// were recorded.
+func LoadCapture(dir string) (*Capture, error) {
+	listing, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	res := &Capture{Dir: dir}
+	for _, entry := range listing {
+		match := packetFileExpr.FindStringSubmatch(entry.Name())
+		if match == nil || entry.IsDir() {
+			continue
+		}
+		index, _ := strconv.Atoi(match[1])
+		path := filepath.Join(dir, entry.Name())
+		packet, err := readPacketFile(path)
+		if err != nil {
+			return nil, err
+		}
+		res.Packets = append(res.Packets, &CapturedPacket{
+			Index:      index,
+			FromClient: match[2] == "in",
+			Time:       entry.ModTime(),
+			Packet:     packet,
+		})
+	}
+	sort.Slice(res.Packets, func(i, j int) bool {
+		return res.Packets[i].Index < res.Packets[j].Index
+	})
+	return res, nil
+}
+
+func readPacketFile(path string) (*cbyge.Packet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(data)
+	packet, err := cbyge.ReadPacket(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "read "+path)
+	}
+	if r.Len() > 0 {
+		return nil, errors.Errorf("read %s: %d trailing bytes", path, r.Len())
+	}
+	return packet, nil
+}
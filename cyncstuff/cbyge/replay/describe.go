@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/unixpickle/cbyge"
+)
+
+// Describe summarizes a packet on one line.
+//
+// If hideSeq is true, sequence numbers are left out, so that descriptions of
+// packets from different sessions can be compared.
+func Describe(p *cbyge.Packet, fromClient, hideSeq bool) string {
+	name := cbyge.PacketTypeName(p.Type)
+	if p.IsResponse {
+		name += " response"
+	}
+	switch p.Type {
+	case cbyge.PacketTypeAuth:
+		return name + " " + describeAuth(p, fromClient)
+	case cbyge.PacketTypePipe:
+		return name + " " + describePipe(p, hideSeq)
+	}
+	return name + " data=" + hexString(p.Data)
+}
+
+func describeAuth(p *cbyge.Packet, fromClient bool) string {
+	if !fromClient {
+		if p.IsResponse && len(p.Data) == 2 && p.Data[0] == 0 && p.Data[1] == 0 {
+			return "ok"
+		}
+		return "rejected data=" + hexString(p.Data)
+	}
+	// See PacketConn.Auth() for the layout of this packet.
+	if len(p.Data) < 7 || len(p.Data) < 7+int(p.Data[6]) {
+		return "data=" + hexString(p.Data)
+	}
+	userID := binary.BigEndian.Uint32(p.Data[1:5])
+	return fmt.Sprintf("user=%d code=<%d bytes>", userID, p.Data[6])
+}
+
+func describePipe(p *cbyge.Packet, hideSeq bool) string {
+	var parts []string
+	if switchID, err := p.PipeSwitchID(); err == nil {
+		parts = append(parts, fmt.Sprintf("switch=%d", switchID))
+	}
+	if seq, err := p.Seq(); err == nil && !hideSeq {
+		parts = append(parts, fmt.Sprintf("seq=%d", seq))
+	}
+	subtype, err := p.PipeSubtype()
+	if err != nil {
+		// Acknowledgements have no subtype, and end with a result code
+		// which the Controller checks for errors.
+		if p.IsResponse && len(p.Data) > 6 {
+			result := p.Data[len(p.Data)-1]
+			if result == 0 {
+				parts = append(parts, "result=ok")
+			} else {
+				parts = append(parts, fmt.Sprintf("result=failed(0x%02x)", result))
+			}
+		}
+		parts = append(parts, "data="+hexString(pipeBody(p, 6)))
+		return strings.Join(parts, " ")
+	}
+	parts = append(parts, cbyge.PacketPipeTypeName(subtype))
+	if p.IsResponse && cbyge.IsStatusPaginatedResponse(p) {
+		if statuses, err := cbyge.DecodeStatusPaginatedResponse(p); err == nil {
+			parts = append(parts, fmt.Sprintf("statuses=%d", len(statuses)))
+			return strings.Join(parts, " ")
+		}
+	}
+	if payload, err := p.PipePayload(); err == nil {
+		parts = append(parts, "payload="+hexString(payload))
+	} else {
+		parts = append(parts, "data="+hexString(pipeBody(p, 13)))
+	}
+	return strings.Join(parts, " ")
+}
+
+// pipeBody gets the data after the first n bytes of a pipe packet.
+func pipeBody(p *cbyge.Packet, n int) []byte {
+	if len(p.Data) < n {
+		return p.Data
+	}
+	return p.Data[n:]
+}
+
+// StatusTable formats the statuses in a status response as table rows, or
+// returns nil if the packet has no statuses.
+func StatusTable(p *cbyge.Packet) []string {
+	if !p.IsResponse || !cbyge.IsStatusPaginatedResponse(p) {
+		return nil
+	}
+	statuses, err := cbyge.DecodeStatusPaginatedResponse(p)
+	if err != nil || len(statuses) == 0 {
+		return nil
+	}
+	res := []string{fmt.Sprintf("%-6s %-4s %-10s %-5s %s", "DEVICE", "ON", "BRIGHTNESS",
+		"TONE", "RGB")}
+	for _, status := range statuses {
+		on := "off"
+		if status.IsOn {
+			on = "on"
+		}
+		tone := fmt.Sprint(status.ColorTone)
+		rgb := "-"
+		if status.UseRGB {
+			tone = "-"
+			rgb = fmt.Sprintf("#%02x%02x%02x", status.RGB[0], status.RGB[1], status.RGB[2])
+		}
+		res = append(res, fmt.Sprintf("%-6d %-4s %-10d %-5s %s", status.Device, on,
+			status.Brightness, tone, rgb))
+	}
+	return res
+}
+
+func directionArrow(fromClient bool) string {
+	if fromClient {
+		return "app->srv"
+	}
+	return "srv->app"
+}
+
+func hexString(data []byte) string {
+	var res strings.Builder
+	res.WriteByte('[')
+	for i, b := range data {
+		if i > 0 {
+			res.WriteByte(' ')
+		}
+		fmt.Fprintf(&res, "%02x", b)
+	}
+	res.WriteByte(']')
+	return res.String()
+}
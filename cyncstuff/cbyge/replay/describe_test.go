@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/unixpickle/cbyge"
+)
+
+func TestDescribe(t *testing.T) {
+	setStatus := cbyge.NewPacketSetDeviceStatus(1234, 7, 3, 1)
+	ack := &cbyge.Packet{
+		Type:       cbyge.PacketTypePipe,
+		IsResponse: true,
+		Data:       []byte{0, 0, 4, 0xd2, 0, 7, 0},
+	}
+	failedAck := &cbyge.Packet{
+		Type:       cbyge.PacketTypePipe,
+		IsResponse: true,
+		Data:       []byte{0, 0, 4, 0xd2, 0, 7, 5},
+	}
+	auth := &cbyge.Packet{
+		Type: cbyge.PacketTypeAuth,
+		Data: []byte{3, 0, 0, 0, 42, 0, 3, 'a', 'b', 'c', 0, 0xb4},
+	}
+	cases := []struct {
+		Packet     *cbyge.Packet
+		FromClient bool
+		HideSeq    bool
+		Expected   string
+	}{
+		{setStatus, true, false,
+			"pipe switch=1234 seq=7 set_status payload=[00 00 00 00 00 00 03 00 d0 00 00 01 00]"},
+		{setStatus, true, true,
+			"pipe switch=1234 set_status payload=[00 00 00 00 00 00 03 00 d0 00 00 01 00]"},
+		{ack, false, false, "pipe response switch=1234 seq=7 result=ok data=[00]"},
+		{failedAck, false, false, "pipe response switch=1234 seq=7 result=failed(0x05) data=[05]"},
+		{testStatusResponse(), false, false,
+			"pipe response switch=1234 seq=7 get_status_paginated statuses=1"},
+		{auth, true, false, "auth user=42 code=<3 bytes>"},
+		{&cbyge.Packet{Type: cbyge.PacketTypeAuth, IsResponse: true, Data: []byte{0, 0}},
+			false, false, "auth response ok"},
+		{&cbyge.Packet{Type: cbyge.PacketTypeAuth, IsResponse: true, Data: []byte{0, 5}},
+			false, false, "auth response rejected data=[00 05]"},
+		{&cbyge.Packet{Type: cbyge.PacketTypeSync, Data: []byte{1, 2}}, false, false,
+			"sync data=[01 02]"},
+	}
+	for i, c := range cases {
+		actual := Describe(c.Packet, c.FromClient, c.HideSeq)
+		if actual != c.Expected {
+			t.Errorf("case %d: expected %q but got %q", i, c.Expected, actual)
+		}
+	}
+}
+
+func TestStatusTable(t *testing.T) {
+	expected := []string{
+		"DEVICE ON   BRIGHTNESS TONE  RGB",
+		"3      on   80         -     #ff8000",
+	}
+	if actual := StatusTable(testStatusResponse()); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %q but got %q", expected, actual)
+	}
+	if rows := StatusTable(cbyge.NewPacketSetDeviceStatus(1234, 7, 3, 1)); rows != nil {
+		t.Errorf("unexpected rows: %q", rows)
+	}
+}
+
+// testStatusResponse creates a status response for one device which is on,
+// with an RGB color.
+func testStatusResponse() *cbyge.Packet {
+	data := make([]byte, 30)
+	entry := data[6:]
+	entry[1] = 3
+	entry[9] = 1
+	entry[13] = 80
+	entry[17] = 0xfe
+	entry[21], entry[22], entry[23] = 0xff, 0x80, 0
+	p := cbyge.NewPacketPipe(1234, 7, cbyge.PacketPipeTypeGetStatusPaginated, data)
+	p.IsResponse = true
+	return p
+}
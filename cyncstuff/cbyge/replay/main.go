@@ -0,0 +1,176 @@
+// Command replay inspects and re-sends packet captures recorded by the proxy
+// command.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/unixpickle/essentials"
+)
+
+const usageText = `Usage: replay <command> [flags] [args]
+
+Commands:
+  show [-hex] DIR        print a decoded timeline of a capture
+  diff A B               compare the packets in two captures
+  send [flags] DIR       re-send client packets from a capture
+
+DIR is either a connection directory (saved-packets/0) or a directory of
+connections (saved-packets), in which case each connection is shown.
+Run 'replay <command> -help' for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usageText)
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "show":
+		err = runShow(os.Args[2:])
+	case "diff":
+		err = runDiff(os.Args[2:])
+	case "send":
+		err = runSend(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usageText)
+		os.Exit(2)
+	}
+	if err != nil {
+		essentials.Die(err)
+	}
+}
+
+func runShow(args []string) error {
+	fs := flag.NewFlagSet("show", flag.ExitOnError)
+	showHex := fs.Bool("hex", false, "print the raw bytes of every packet")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: replay show [-hex] DIR")
+		os.Exit(2)
+	}
+	captures, err := LoadCaptures(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	for i, capture := range captures {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("== %s (%d packets)\n", capture.Dir, len(capture.Packets))
+		if len(capture.Packets) == 0 {
+			continue
+		}
+		start := capture.Packets[0].Time
+		for _, p := range capture.Packets {
+			offset := p.Time.Sub(start).Seconds()
+			fmt.Printf("%06d +%7.3fs %s %s\n", p.Index, offset, directionArrow(p.FromClient),
+				Describe(p.Packet, p.FromClient, false))
+			for _, row := range StatusTable(p.Packet) {
+				fmt.Println("        " + row)
+			}
+			if *showHex {
+				fmt.Println("        " + hexString(p.Packet.Encode()))
+			}
+		}
+	}
+	return nil
+}
+
+// runDiff compares two captures, ignoring sequence numbers and auth codes,
+// which differ between sessions. It exits with status 1 if they differ.
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: replay diff A B")
+		os.Exit(2)
+	}
+	a, err := LoadCapture(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	b, err := LoadCapture(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	keysA, keysB := diffKeys(a), diffKeys(b)
+
+	fmt.Printf("--- %s\n+++ %s\n", a.Dir, b.Dir)
+	var onlyA, onlyB int
+	for _, op := range diffSequences(keysA, keysB) {
+		switch {
+		case op.A >= 0 && op.B >= 0:
+			continue
+		case op.A >= 0:
+			onlyA++
+			fmt.Printf("-%06d %s\n", a.Packets[op.A].Index, keysA[op.A])
+		default:
+			onlyB++
+			fmt.Printf("+%06d %s\n", b.Packets[op.B].Index, keysB[op.B])
+		}
+	}
+	fmt.Printf("%d packets only in %s, %d only in %s\n", onlyA, a.Dir, onlyB, b.Dir)
+	if onlyA > 0 || onlyB > 0 {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func diffKeys(c *Capture) []string {
+	res := make([]string, len(c.Packets))
+	for i, p := range c.Packets {
+		key := directionArrow(p.FromClient) + " " + Describe(p.Packet, p.FromClient, true)
+		if rows := StatusTable(p.Packet); len(rows) > 0 {
+			key += " {" + strings.Join(rows[1:], "; ") + "}"
+		}
+		res[i] = key
+	}
+	return res
+}
+
+// A diffOp pairs up an element of each sequence, or has an index of -1 on
+// the side where an element is missing.
+type diffOp struct {
+	A int
+	B int
+}
+
+// diffSequences computes a minimal diff using the longest common
+// subsequence.
+func diffSequences(a, b []string) []diffOp {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = essentials.MaxInt(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var res []diffOp
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			res = append(res, diffOp{A: i, B: j})
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			res = append(res, diffOp{A: i, B: -1})
+			i++
+		default:
+			res = append(res, diffOp{A: -1, B: j})
+			j++
+		}
+	}
+	return res
+}
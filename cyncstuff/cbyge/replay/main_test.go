@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffSequences(t *testing.T) {
+	cases := []struct {
+		A, B     string
+		Expected []diffOp
+	}{
+		{"", "", nil},
+		{"abc", "abc", []diffOp{{0, 0}, {1, 1}, {2, 2}}},
+		{"abc", "", []diffOp{{0, -1}, {1, -1}, {2, -1}}},
+		{"", "ab", []diffOp{{-1, 0}, {-1, 1}}},
+		{"abc", "axc", []diffOp{{0, 0}, {1, -1}, {-1, 1}, {2, 2}}},
+		{"abcd", "acd", []diffOp{{0, 0}, {1, -1}, {2, 1}, {3, 2}}},
+		{"acd", "abcd", []diffOp{{0, 0}, {-1, 1}, {1, 2}, {2, 3}}},
+	}
+	for _, c := range cases {
+		a, b := splitChars(c.A), splitChars(c.B)
+		actual := diffSequences(a, b)
+		if !reflect.DeepEqual(actual, c.Expected) {
+			t.Errorf("%q vs %q: expected %v but got %v", c.A, c.B, c.Expected, actual)
+		}
+	}
+}
+
+func TestDiffSequencesMinimal(t *testing.T) {
+	a := splitChars("xaybzc")
+	b := splitChars("abcxyz")
+	var common int
+	for _, op := range diffSequences(a, b) {
+		if op.A >= 0 && op.B >= 0 {
+			if a[op.A] != b[op.B] {
+				t.Fatalf("paired different elements: %v", op)
+			}
+			common++
+		}
+	}
+	if common != 3 {
+		t.Errorf("expected 3 common elements but got %d", common)
+	}
+}
+
+func splitChars(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "")
+}
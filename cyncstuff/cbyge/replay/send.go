@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+var printLock sync.Mutex
+
+func runSend(args []string) error {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	addr := fs.String("addr", cbyge.DefaultPacketConnHost, "packet server address")
+	selection := fs.String("packets", "",
+		"indices of client packets to send, like 3,5-9 (default: all)")
+	sessionPath := fs.String("session", "",
+		"session file to authenticate with, instead of the captured auth packet")
+	freshSeq := fs.Bool("fresh-seq", false, "give pipe packets new sequence numbers")
+	gap := fs.Duration("gap", time.Millisecond*100, "delay between sent packets")
+	wait := fs.Duration("wait", time.Second*5,
+		"how long to keep reading after the last packet is received")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: replay send [flags] DIR")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	capture, err := LoadCapture(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	packets, err := selectPackets(capture, *selection)
+	if err != nil {
+		return err
+	}
+
+	conn, err := cbyge.NewPacketConnAddr(*addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if *sessionPath != "" {
+		info, err := cbyge.LoadSessionInfo(*sessionPath)
+		if err != nil {
+			return err
+		}
+		if err := conn.Auth(info.UserID, info.Authorize, cbyge.PacketConnTimeout); err != nil {
+			return err
+		}
+		printTimestamped("authenticated with %s", *sessionPath)
+		var withoutAuth []*CapturedPacket
+		for _, p := range packets {
+			if p.Packet.Type != cbyge.PacketTypeAuth {
+				withoutAuth = append(withoutAuth, p)
+			}
+		}
+		packets = withoutAuth
+	}
+
+	received := make(chan struct{}, 1)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			packet, err := conn.Read()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			printPacket("recv", "", packet, false)
+			select {
+			case received <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	seq := uint16(rand.New(rand.NewSource(time.Now().UnixNano())).Int63())
+	for i, p := range packets {
+		if i > 0 {
+			time.Sleep(*gap)
+		}
+		packet := p.Packet
+		if *freshSeq && packet.Type == cbyge.PacketTypePipe && len(packet.Data) >= 6 {
+			packet = &cbyge.Packet{
+				Type:       packet.Type,
+				IsResponse: packet.IsResponse,
+				Data:       append([]byte{}, packet.Data...),
+			}
+			binary.BigEndian.PutUint16(packet.Data[4:6], seq)
+			seq++
+		}
+		printPacket("sent", fmt.Sprintf("%06d", p.Index), packet, true)
+		if err := conn.Write(packet); err != nil {
+			return err
+		}
+	}
+
+	timer := time.NewTimer(*wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-received:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(*wait)
+		case err := <-readErr:
+			printTimestamped("connection closed: %s", err)
+			return nil
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+// selectPackets gets the client packets with the indices in a list like
+// "3,5-9", or every client packet if the list is empty.
+//
+// Server packets within a range are skipped, since the directions share one
+// index counter.
+func selectPackets(c *Capture, list string) ([]*CapturedPacket, error) {
+	byIndex := map[int]*CapturedPacket{}
+	var all []*CapturedPacket
+	for _, p := range c.Packets {
+		if p.FromClient {
+			byIndex[p.Index] = p
+			all = append(all, p)
+		}
+	}
+	if list == "" {
+		return all, nil
+	}
+	var res []*CapturedPacket
+	for _, item := range strings.Split(list, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(item), "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		end := start
+		if err == nil && len(bounds) == 2 {
+			end, err = strconv.Atoi(bounds[1])
+		}
+		if err != nil || end < start {
+			return nil, errors.Errorf("invalid packet range: %q", item)
+		}
+		if start == end {
+			p, ok := byIndex[start]
+			if !ok {
+				return nil, errors.Errorf("no client packet with index %d", start)
+			}
+			res = append(res, p)
+			continue
+		}
+		numSelected := len(res)
+		for i := start; i <= end; i++ {
+			if p, ok := byIndex[i]; ok {
+				res = append(res, p)
+			}
+		}
+		if len(res) == numSelected {
+			return nil, errors.Errorf("no client packets in range %q", item)
+		}
+	}
+	return res, nil
+}
+
+func printPacket(verb, index string, p *cbyge.Packet, fromClient bool) {
+	if index != "" {
+		verb += " " + index
+	}
+	lines := []string{verb + " " + Describe(p, fromClient, false)}
+	for _, row := range StatusTable(p) {
+		lines = append(lines, "    "+row)
+	}
+	printTimestamped("%s", strings.Join(lines, "\n"))
+}
+
+// printTimestamped prints a line prefixed with the current time.
+//
+// It is safe to call from multiple Goroutines.
+func printTimestamped(format string, args ...interface{}) {
+	printLock.Lock()
+	defer printLock.Unlock()
+	fmt.Println(time.Now().Format("15:04:05.000") + " " + fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSelectPackets(t *testing.T) {
+	// Packets 0, 1, 3 and 6 were sent by the client.
+	c := &Capture{}
+	for i, fromClient := range []bool{true, true, false, true, false, false, true} {
+		c.Packets = append(c.Packets, &CapturedPacket{Index: i, FromClient: fromClient})
+	}
+	cases := map[string][]int{
+		"":        {0, 1, 3, 6},
+		"3":       {3},
+		"6,0":     {6, 0},
+		"0-3":     {0, 1, 3},
+		"2-6":     {3, 6},
+		"1-1,3-4": {1, 3},
+	}
+	for list, expected := range cases {
+		packets, err := selectPackets(c, list)
+		if err != nil {
+			t.Errorf("%q: %v", list, err)
+			continue
+		}
+		var actual []int
+		for _, p := range packets {
+			actual = append(actual, p.Index)
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%q: expected %v but got %v", list, expected, actual)
+		}
+	}
+
+	for _, list := range []string{"2", "7", "4-5", "8-9", "3-1", "x", "1-", "1,,3"} {
+		if _, err := selectPackets(c, list); err == nil {
+			t.Errorf("%q: expected an error", list)
+		}
+	}
+}
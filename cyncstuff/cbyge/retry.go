@@ -0,0 +1,89 @@
+package cbyge
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A RetryPolicy configures how setters retry failed writes.
+//
+// Each attempt is sent through the next switch that can reach the device, in
+// the order given by the Controller's SwitchPolicy, so that one unreliable
+// switch does not cause a setter to fail.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of times a write is attempted.
+	// Values less than 1 are treated as 1.
+	MaxAttempts int
+
+	// AttemptTimeout is the timeout for each individual attempt.
+	// If it is 0, the Controller's timeout is used.
+	AttemptTimeout time.Duration
+
+	// Backoff is the delay between consecutive attempts.
+	Backoff time.Duration
+}
+
+// SetRetryPolicy configures how setters like SetDeviceLum() retry failed
+// writes.
+//
+// If p is nil, each write is attempted once, which is the default.
+func (c *Controller) SetRetryPolicy(p *RetryPolicy) {
+	c.policyLock.Lock()
+	defer c.policyLock.Unlock()
+	c.retryPolicy = p
+}
+
+func (c *Controller) getRetryPolicy() *RetryPolicy {
+	c.policyLock.RLock()
+	defer c.policyLock.RUnlock()
+	return c.retryPolicy
+}
+
+// sendWithRetry sends a packet created by makePacket, failing over to other
+// switches according to the retry policy.
+func (c *Controller) sendWithRetry(d *ControllerDevice, context string, async bool,
+	makePacket func(switchID uint32) *Packet) error {
+	switches := c.rankedSwitches(d)
+	if len(switches) == 0 {
+		return errors.Wrap(UnreachableError, context)
+	}
+
+	send := func(switchID uint32, timeout time.Duration) error {
+		return c.checkedCall(d, switchID, makePacket(switchID), context, async, timeout)
+	}
+	return retryWrite(switches, c.getRetryPolicy(), c.timeout, send, time.Sleep)
+}
+
+// retryWrite calls send with each switch in turn until it succeeds or the
+// policy's attempts run out, returning the last error.
+//
+// If p is nil, only the first switch is tried. It waits between attempts by
+// calling sleep.
+func retryWrite(switches []uint32, p *RetryPolicy, timeout time.Duration,
+	send func(switchID uint32, timeout time.Duration) error, sleep func(time.Duration)) error {
+	attempts := 1
+	var backoff time.Duration
+	if p != nil {
+		if p.MaxAttempts > 1 {
+			attempts = p.MaxAttempts
+		}
+		if p.AttemptTimeout != 0 {
+			timeout = p.AttemptTimeout
+		}
+		backoff = p.Backoff
+	}
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 && backoff != 0 {
+			sleep(backoff)
+		}
+		switchID := switches[i%len(switches)]
+		err = send(switchID, timeout)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
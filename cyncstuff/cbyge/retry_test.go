@@ -0,0 +1,101 @@
+package cbyge
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetryWriteFailover(t *testing.T) {
+	fake := &fakeSwitches{failures: map[uint32]bool{10: true}}
+	policy := &RetryPolicy{MaxAttempts: 3, AttemptTimeout: time.Second, Backoff: time.Minute}
+	err := retryWrite([]uint32{10, 20, 30}, policy, time.Hour, fake.Send, fake.Sleep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fake.calls, []uint32{10, 20}) {
+		t.Errorf("unexpected calls: %v", fake.calls)
+	}
+	if !reflect.DeepEqual(fake.timeouts, []time.Duration{time.Second, time.Second}) {
+		t.Errorf("unexpected timeouts: %v", fake.timeouts)
+	}
+	if !reflect.DeepEqual(fake.sleeps, []time.Duration{time.Minute}) {
+		t.Errorf("unexpected sleeps: %v", fake.sleeps)
+	}
+}
+
+func TestRetryWriteAllFail(t *testing.T) {
+	fake := &fakeSwitches{failures: map[uint32]bool{10: true, 20: true}}
+	policy := &RetryPolicy{MaxAttempts: 5}
+	err := retryWrite([]uint32{10, 20}, policy, time.Hour, fake.Send, fake.Sleep)
+	if err != RemoteCallError {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Attempts wrap around to the first switch.
+	if !reflect.DeepEqual(fake.calls, []uint32{10, 20, 10, 20, 10}) {
+		t.Errorf("unexpected calls: %v", fake.calls)
+	}
+	if fake.timeouts[0] != time.Hour || len(fake.sleeps) != 0 {
+		t.Errorf("unexpected timeouts %v or sleeps %v", fake.timeouts, fake.sleeps)
+	}
+}
+
+func TestRetryWriteDefaults(t *testing.T) {
+	for _, policy := range []*RetryPolicy{nil, {}, {MaxAttempts: -1}} {
+		fake := &fakeSwitches{failures: map[uint32]bool{10: true}}
+		err := retryWrite([]uint32{10, 20}, policy, time.Hour, fake.Send, fake.Sleep)
+		if err != RemoteCallError || !reflect.DeepEqual(fake.calls, []uint32{10}) {
+			t.Errorf("policy %+v: unexpected error %v and calls %v", policy, err, fake.calls)
+		}
+	}
+}
+
+func TestRetryWriteSwitchPolicy(t *testing.T) {
+	c := NewController(&SessionInfo{}, 0)
+	c.SetRetryPolicy(&RetryPolicy{MaxAttempts: 3})
+	d := &ControllerDevice{deviceID: "1", switchID: 1 << 40}
+	for _, id := range []uint32{10, 20, 30} {
+		c.addSwitchMapping(d, id)
+	}
+	fake := &fakeSwitches{failures: map[uint32]bool{10: true}}
+	send := func(switchID uint32, timeout time.Duration) error {
+		err := fake.Send(switchID, timeout)
+		c.recordSwitch(d, switchID, time.Millisecond, err)
+		return err
+	}
+
+	// After switch 10 fails over to switch 20, the next write starts with
+	// switch 20.
+	for i := 0; i < 2; i++ {
+		err := retryWrite(c.rankedSwitches(d), c.getRetryPolicy(), c.timeout, send, fake.Sleep)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(fake.calls, []uint32{10, 20, 20}) {
+		t.Errorf("unexpected calls: %v", fake.calls)
+	}
+}
+
+// fakeSwitches records calls to switches, failing those in failures.
+type fakeSwitches struct {
+	failures map[uint32]bool
+
+	calls    []uint32
+	timeouts []time.Duration
+	sleeps   []time.Duration
+}
+
+func (f *fakeSwitches) Send(switchID uint32, timeout time.Duration) error {
+	f.calls = append(f.calls, switchID)
+	f.timeouts = append(f.timeouts, timeout)
+	if f.failures[switchID] {
+		return RemoteCallError
+	}
+	return nil
+}
+
+func (f *fakeSwitches) Sleep(d time.Duration) {
+	f.sleeps = append(f.sleeps, d)
+}
@@ -0,0 +1,550 @@
+package cbyge
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// A Selector is a query which matches devices, such as
+//
+//	group:kitchen & is_on & !name:*night*
+//
+// Terms are combined with & (and), | or , (or), and ! (not), and may be
+// grouped with parentheses. The supported terms are:
+//
+//	123456          the device with this ID
+//	all             every device
+//	is_on, is_off   devices which are online and switched on or off
+//	is_online       devices which could be reached
+//	is_offline      devices which could not be reached
+//	id:123456       the device with this ID
+//	name:GLOB       devices whose name matches a glob, like *lamp*
+//	name:/REGEX/    devices whose name matches a regular expression
+//	group:GLOB      devices in a group whose name matches a glob (or a
+//	                regular expression), or whose ID is given
+//	cap:NAME        devices with a Capability, like cap:rgb
+//
+// Globs are case-insensitive, and values containing spaces can be quoted, as
+// in group:"Living Room".
+type Selector struct {
+	source string
+	root   selectorNode
+}
+
+// A SelectorPredicate adds a custom term to a Selector.
+//
+// It is called with the value of each term (the part after the colon) while
+// parsing, and returns a function to match devices or an error if the value
+// is invalid.
+type SelectorPredicate func(value string) (func(d *ControllerDevice) bool, error)
+
+// A SelectorEnv provides the information that a Selector uses to match
+// devices, besides the devices themselves.
+type SelectorEnv struct {
+	// Groups are used for group terms.
+	Groups []*ControllerGroup
+
+	// Status gets the status of a device for state terms like is_on.
+	// If nil, each device's LastStatus() is used.
+	Status func(d *ControllerDevice) ControllerDeviceStatus
+}
+
+func (s *SelectorEnv) status(d *ControllerDevice) ControllerDeviceStatus {
+	if s == nil || s.Status == nil {
+		return d.LastStatus()
+	}
+	return s.Status(d)
+}
+
+// A SelectorError indicates that a selector could not be parsed.
+type SelectorError struct {
+	Selector string
+	Pos      int
+	Msg      string
+}
+
+func (s *SelectorError) Error() string {
+	return fmt.Sprintf("selector %q: %s at position %d", s.Selector, s.Msg, s.Pos+1)
+}
+
+// ParseSelector parses a selector with the built-in terms.
+func ParseSelector(selector string) (*Selector, error) {
+	return ParseSelectorWith(selector, nil)
+}
+
+// ParseSelectorWith parses a selector, supporting custom key:value terms in
+// addition to the built-in ones.
+func ParseSelectorWith(selector string, predicates map[string]SelectorPredicate) (*Selector, error) {
+	tokens, err := lexSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	p := &selectorParser{source: selector, tokens: tokens, predicates: predicates}
+	if len(tokens) == 0 {
+		return nil, p.errorAt(0, "empty selector")
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(tokens) {
+		t := tokens[p.pos]
+		return nil, p.errorAt(t.pos, "unexpected "+t.describe())
+	}
+	return &Selector{source: selector, root: root}, nil
+}
+
+// MustParseSelector is like ParseSelector, but panics on error.
+func MustParseSelector(selector string) *Selector {
+	s, err := ParseSelector(selector)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// String gets the source of the selector.
+func (s *Selector) String() string {
+	return s.source
+}
+
+// Match checks if the selector matches a device.
+//
+// The env may be nil if the selector does not use groups.
+func (s *Selector) Match(env *SelectorEnv, d *ControllerDevice) bool {
+	return s.root.match(env, d)
+}
+
+// Select finds the devices matched by the selector, preserving their order.
+func (s *Selector) Select(env *SelectorEnv, devs []*ControllerDevice) []*ControllerDevice {
+	var res []*ControllerDevice
+	for _, d := range devs {
+		if s.Match(env, d) {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+// SelectDevices enumerates the devices and groups and finds the devices
+// matched by a selector.
+//
+// The state terms use the statuses fetched during enumeration.
+func (c *Controller) SelectDevices(selector string) ([]*ControllerDevice, error) {
+	s, err := ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	devs, groups, err := c.DevicesAndGroups()
+	if err != nil {
+		return nil, errors.Wrap(err, "select devices")
+	}
+	return s.Select(&SelectorEnv{Groups: groups}, devs), nil
+}
+
+type selectorNode interface {
+	match(env *SelectorEnv, d *ControllerDevice) bool
+}
+
+type selectorAnd []selectorNode
+
+func (s selectorAnd) match(env *SelectorEnv, d *ControllerDevice) bool {
+	for _, x := range s {
+		if !x.match(env, d) {
+			return false
+		}
+	}
+	return true
+}
+
+type selectorOr []selectorNode
+
+func (s selectorOr) match(env *SelectorEnv, d *ControllerDevice) bool {
+	for _, x := range s {
+		if x.match(env, d) {
+			return true
+		}
+	}
+	return false
+}
+
+type selectorNot struct {
+	node selectorNode
+}
+
+func (s selectorNot) match(env *SelectorEnv, d *ControllerDevice) bool {
+	return !s.node.match(env, d)
+}
+
+type selectorFunc func(env *SelectorEnv, d *ControllerDevice) bool
+
+func (s selectorFunc) match(env *SelectorEnv, d *ControllerDevice) bool {
+	return s(env, d)
+}
+
+var selectorKeywords = map[string]selectorFunc{
+	"all": func(env *SelectorEnv, d *ControllerDevice) bool {
+		return true
+	},
+	"is_on": func(env *SelectorEnv, d *ControllerDevice) bool {
+		status := env.status(d)
+		return status.IsOnline && status.IsOn
+	},
+	"is_off": func(env *SelectorEnv, d *ControllerDevice) bool {
+		status := env.status(d)
+		return status.IsOnline && !status.IsOn
+	},
+	"is_online": func(env *SelectorEnv, d *ControllerDevice) bool {
+		return env.status(d).IsOnline
+	},
+	"is_offline": func(env *SelectorEnv, d *ControllerDevice) bool {
+		return !env.status(d).IsOnline
+	},
+}
+
+var selectorKeys = []string{"id", "name", "group", "cap"}
+
+type selectorTokenKind int
+
+const (
+	selectorTokenTerm selectorTokenKind = iota
+	selectorTokenAnd
+	selectorTokenOr
+	selectorTokenNot
+	selectorTokenOpen
+	selectorTokenClose
+)
+
+type selectorToken struct {
+	kind selectorTokenKind
+	pos  int
+
+	// For terms, the key is empty for bare words.
+	key     string
+	value   string
+	isRegex bool
+}
+
+func (s *selectorToken) describe() string {
+	switch s.kind {
+	case selectorTokenTerm:
+		if s.key == "" {
+			return fmt.Sprintf("term %q", s.value)
+		}
+		return fmt.Sprintf("term %q", s.key+":"+s.value)
+	case selectorTokenAnd:
+		return "'&'"
+	case selectorTokenOr:
+		return "'|'"
+	case selectorTokenNot:
+		return "'!'"
+	case selectorTokenOpen:
+		return "'('"
+	default:
+		return "')'"
+	}
+}
+
+var selectorOperators = map[rune]selectorTokenKind{
+	'&': selectorTokenAnd,
+	'|': selectorTokenOr,
+	',': selectorTokenOr,
+	'!': selectorTokenNot,
+	'(': selectorTokenOpen,
+	')': selectorTokenClose,
+}
+
+func lexSelector(source string) ([]*selectorToken, error) {
+	var tokens []*selectorToken
+	runes := []rune(source)
+	fail := func(pos int, msg string) error {
+		return &SelectorError{Selector: source, Pos: pos, Msg: msg}
+	}
+	isWordRune := func(r rune) bool {
+		return !unicode.IsSpace(r) && !strings.ContainsRune("()&|,!\":", r)
+	}
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		if unicode.IsSpace(r) {
+			i++
+			continue
+		}
+		if kind, ok := selectorOperators[r]; ok {
+			tokens = append(tokens, &selectorToken{kind: kind, pos: i})
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(runes) && isWordRune(runes[i]) {
+			i++
+		}
+		token := &selectorToken{kind: selectorTokenTerm, pos: start}
+		if i < len(runes) && runes[i] == ':' {
+			if i == start {
+				return nil, fail(start, "missing key before ':'")
+			}
+			token.key = strings.ToLower(string(runes[start:i]))
+			i++
+			valueStart := i
+			if i < len(runes) && runes[i] == '"' {
+				i++
+				for i < len(runes) && runes[i] != '"' {
+					if runes[i] == '\\' {
+						i++
+					}
+					i++
+				}
+				if i >= len(runes) {
+					return nil, fail(valueStart, "unterminated string")
+				}
+				i++
+				value, err := strconv.Unquote(string(runes[valueStart:i]))
+				if err != nil {
+					return nil, fail(valueStart, "invalid string")
+				}
+				token.value = value
+			} else if i < len(runes) && runes[i] == '/' {
+				i++
+				var expr strings.Builder
+				for i < len(runes) && runes[i] != '/' {
+					if runes[i] == '\\' && i+1 < len(runes) && runes[i+1] == '/' {
+						i++
+					}
+					expr.WriteRune(runes[i])
+					i++
+				}
+				if i >= len(runes) {
+					return nil, fail(valueStart, "unterminated regular expression")
+				}
+				i++
+				token.value = expr.String()
+				token.isRegex = true
+			} else {
+				for i < len(runes) && isWordRune(runes[i]) {
+					i++
+				}
+				token.value = string(runes[valueStart:i])
+			}
+			if token.value == "" {
+				return nil, fail(valueStart, "missing value for '"+token.key+"'")
+			}
+		} else if i == start {
+			return nil, fail(start, fmt.Sprintf("unexpected %q", r))
+		} else {
+			token.value = string(runes[start:i])
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+type selectorParser struct {
+	source     string
+	tokens     []*selectorToken
+	pos        int
+	predicates map[string]SelectorPredicate
+}
+
+func (s *selectorParser) errorAt(pos int, msg string) error {
+	return &SelectorError{Selector: s.source, Pos: pos, Msg: msg}
+}
+
+func (s *selectorParser) peek(kind selectorTokenKind) bool {
+	return s.pos < len(s.tokens) && s.tokens[s.pos].kind == kind
+}
+
+func (s *selectorParser) parseOr() (selectorNode, error) {
+	var res selectorOr
+	for {
+		node, err := s.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, node)
+		if !s.peek(selectorTokenOr) {
+			break
+		}
+		s.pos++
+	}
+	if len(res) == 1 {
+		return res[0], nil
+	}
+	return res, nil
+}
+
+func (s *selectorParser) parseAnd() (selectorNode, error) {
+	var res selectorAnd
+	for {
+		node, err := s.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, node)
+		if !s.peek(selectorTokenAnd) {
+			break
+		}
+		s.pos++
+	}
+	if len(res) == 1 {
+		return res[0], nil
+	}
+	return res, nil
+}
+
+func (s *selectorParser) parseUnary() (selectorNode, error) {
+	if s.pos >= len(s.tokens) {
+		return nil, s.errorAt(len([]rune(s.source)), "unexpected end of selector")
+	}
+	t := s.tokens[s.pos]
+	s.pos++
+	switch t.kind {
+	case selectorTokenNot:
+		node, err := s.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return selectorNot{node}, nil
+	case selectorTokenOpen:
+		node, err := s.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !s.peek(selectorTokenClose) {
+			return nil, s.errorAt(t.pos, "unmatched '('")
+		}
+		s.pos++
+		return node, nil
+	case selectorTokenTerm:
+		return s.parseTerm(t)
+	}
+	return nil, s.errorAt(t.pos, "unexpected "+t.describe())
+}
+
+func (s *selectorParser) parseTerm(t *selectorToken) (selectorNode, error) {
+	if t.key == "" {
+		if f, ok := selectorKeywords[strings.ToLower(t.value)]; ok {
+			return f, nil
+		}
+		if _, err := strconv.ParseUint(t.value, 10, 64); err != nil {
+			var keywords []string
+			for keyword := range selectorKeywords {
+				keywords = append(keywords, keyword)
+			}
+			sort.Strings(keywords)
+			return nil, s.errorAt(t.pos, fmt.Sprintf("unknown term %q (expected a device ID "+
+				"or one of: %s)", t.value, strings.Join(keywords, ", ")))
+		}
+		return matchDeviceID(t.value), nil
+	}
+
+	switch t.key {
+	case "id":
+		return matchDeviceID(t.value), nil
+	case "name":
+		matcher, err := s.textMatcher(t)
+		if err != nil {
+			return nil, err
+		}
+		return selectorFunc(func(env *SelectorEnv, d *ControllerDevice) bool {
+			return matcher(d.Name())
+		}), nil
+	case "group":
+		matcher, err := s.textMatcher(t)
+		if err != nil {
+			return nil, err
+		}
+		groupID := t.value
+		return selectorFunc(func(env *SelectorEnv, d *ControllerDevice) bool {
+			if env == nil {
+				return false
+			}
+			for _, g := range env.Groups {
+				if g.GroupID() != groupID && !matcher(g.Name()) {
+					continue
+				}
+				for _, member := range g.devices {
+					if member.DeviceID() == d.DeviceID() {
+						return true
+					}
+				}
+			}
+			return false
+		}), nil
+	case "cap":
+		capability := Capability(strings.ToLower(t.value))
+		for _, c := range AllCapabilities {
+			if c == capability {
+				return selectorFunc(func(env *SelectorEnv, d *ControllerDevice) bool {
+					return d.HasCapability(capability)
+				}), nil
+			}
+		}
+		var names []string
+		for _, c := range AllCapabilities {
+			names = append(names, string(c))
+		}
+		return nil, s.errorAt(t.pos, fmt.Sprintf("unknown capability %q (expected one of: %s)",
+			t.value, strings.Join(names, ", ")))
+	}
+
+	if predicate, ok := s.predicates[t.key]; ok {
+		f, err := predicate(t.value)
+		if err != nil {
+			return nil, s.errorAt(t.pos, err.Error())
+		}
+		return selectorFunc(func(env *SelectorEnv, d *ControllerDevice) bool {
+			return f(d)
+		}), nil
+	}
+	keys := append([]string{}, selectorKeys...)
+	for key := range s.predicates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return nil, s.errorAt(t.pos, fmt.Sprintf("unknown key %q (expected one of: %s)", t.key,
+		strings.Join(keys, ", ")))
+}
+
+func (s *selectorParser) textMatcher(t *selectorToken) (func(string) bool, error) {
+	expr := t.value
+	if !t.isRegex {
+		expr = globToRegexp(t.value)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, s.errorAt(t.pos, "invalid regular expression: "+err.Error())
+	}
+	return re.MatchString, nil
+}
+
+func matchDeviceID(id string) selectorNode {
+	return selectorFunc(func(env *SelectorEnv, d *ControllerDevice) bool {
+		return d.DeviceID() == id
+	})
+}
+
+// globToRegexp converts a case-insensitive glob with * and ? wildcards into
+// a regular expression matching the whole string.
+func globToRegexp(glob string) string {
+	var res strings.Builder
+	res.WriteString("(?i)^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			res.WriteString(".*")
+		case '?':
+			res.WriteString(".")
+		default:
+			res.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	res.WriteString("$")
+	return res.String()
+}
@@ -0,0 +1,93 @@
+package cbyge
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestSelectorMatch(t *testing.T) {
+	devs := []*ControllerDevice{
+		{deviceID: "1", name: "Kitchen Lamp"},
+		{deviceID: "2", name: "Night Light"},
+		{deviceID: "3", name: "Porch"},
+	}
+	devs[0].lastStatus = ControllerDeviceStatus{IsOnline: true,
+		StatusPaginatedResponse: StatusPaginatedResponse{IsOn: true}}
+	devs[1].lastStatus = ControllerDeviceStatus{IsOnline: true}
+	env := &SelectorEnv{
+		Groups: []*ControllerGroup{
+			{groupID: "10-1", name: "Downstairs", devices: devs[:2]},
+			{groupID: "10-2", name: "Outside", devices: devs[2:]},
+		},
+	}
+
+	cases := map[string][]string{
+		"all":                       {"1", "2", "3"},
+		"2":                         {"2"},
+		"1,3":                       {"1", "3"},
+		"id:3":                      {"3"},
+		"is_on":                     {"1"},
+		"is_off":                    {"2"},
+		"is_offline":                {"3"},
+		"!is_on":                    {"2", "3"},
+		"!!is_on":                   {"1"},
+		"all & !is_on":              {"2", "3"},
+		"name:*lamp*":               {"1"},
+		"name:\"night light\"":      {"2"},
+		"name:/^P/":                 {"3"},
+		"name:?orch":                {"3"},
+		"group:down*":               {"1", "2"},
+		"group:10-2":                {"3"},
+		"1 | 2 & is_on":             {"1"},
+		"1 | is_off & 2":            {"1", "2"},
+		"(1 | 2) & is_off":          {"2"},
+		"group:downstairs & !2 | 3": {"1", "3"},
+		"!(group:outside | is_on)":  {"2"},
+	}
+	for source, expected := range cases {
+		selector, err := ParseSelector(source)
+		if err != nil {
+			t.Errorf("%s: %v", source, err)
+			continue
+		}
+		var actual []string
+		for _, d := range selector.Select(env, devs) {
+			actual = append(actual, d.DeviceID())
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: expected %v but got %v", source, expected, actual)
+		}
+	}
+}
+
+func TestSelectorErrors(t *testing.T) {
+	cases := []struct {
+		Source string
+		Pos    int
+	}{
+		{"", 0},
+		{"all & !is_onn", 7},
+		{"kitchen", 0},
+		{"1 &", 3},
+		{"(1 | 2", 0},
+		{"1 )", 2},
+		{":x", 0},
+		{"name:\"unterminated", 5},
+		{"name:/[/", 0},
+		{"cap:laser", 0},
+		{"color:red", 0},
+		{"1 2", 2},
+	}
+	for _, c := range cases {
+		_, err := ParseSelector(c.Source)
+		var selectorErr *SelectorError
+		if !errors.As(err, &selectorErr) {
+			t.Errorf("%q: expected a SelectorError but got %v", c.Source, err)
+		} else if selectorErr.Pos != c.Pos {
+			t.Errorf("%q: expected position %d but got %d (%v)", c.Source, c.Pos,
+				selectorErr.Pos, err)
+		}
+	}
+}
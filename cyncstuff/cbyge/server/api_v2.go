@@ -0,0 +1,587 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/unixpickle/cbyge"
+)
+
+const v2Prefix = "/api/v2"
+
+const maxV2BodySize = 1 << 16
+
+// Error codes returned by the v2 API.
+const (
+	ErrorCodeBadRequest       = "bad_request"
+	ErrorCodeNotFound         = "not_found"
+	ErrorCodeUnauthorized     = "unauthorized"
+	ErrorCodeForbidden        = "forbidden"
+	ErrorCodeMethodNotAllowed = "method_not_allowed"
+	ErrorCodeRateLimited      = "rate_limited"
+	ErrorCodeUnreachable      = "device_unreachable"
+	ErrorCodeNotConverged     = "not_converged"
+	ErrorCodeRemote           = "remote_error"
+	ErrorCodeInternal         = "internal_error"
+)
+
+// A V2Error is the error object returned by the v2 API.
+type V2Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// A DevicePatch is the request body for changing a device or group.
+//
+// Every field is optional, and only the provided properties are changed.
+type DevicePatch struct {
+	On         *bool   `json:"on,omitempty"`
+	Brightness *int    `json:"brightness,omitempty"`
+	ColorTone  *int    `json:"color_tone,omitempty"`
+	RGB        *[3]int `json:"rgb,omitempty"`
+}
+
+// Validate checks that the patch contains valid values.
+func (d *DevicePatch) Validate() error {
+	if d.On == nil && d.Brightness == nil && d.ColorTone == nil && d.RGB == nil {
+		return errors.New("patch must set at least one property")
+	}
+	if d.Brightness != nil && (*d.Brightness < 1 || *d.Brightness > 100) {
+		return errors.New("brightness out of range [1, 100]")
+	}
+	if d.ColorTone != nil && (*d.ColorTone < 0 || *d.ColorTone > 100) {
+		return errors.New("color_tone out of range [0, 100]")
+	}
+	if d.ColorTone != nil && d.RGB != nil {
+		return errors.New("color_tone and rgb cannot both be set")
+	}
+	if d.RGB != nil {
+		for _, x := range d.RGB {
+			if x < 0 || x > 0xff {
+				return errors.New("rgb component out of range [0, 255]")
+			}
+		}
+	}
+	return nil
+}
+
+// kind identifies the properties which the patch changes, so that patches
+// of the same kind can be coalesced.
+func (d *DevicePatch) kind() string {
+	var parts []string
+	if d.On != nil {
+		parts = append(parts, "on")
+	}
+	if d.Brightness != nil {
+		parts = append(parts, "brightness")
+	}
+	if d.ColorTone != nil {
+		parts = append(parts, "color_tone")
+	}
+	if d.RGB != nil {
+		parts = append(parts, "rgb")
+	}
+	return "patch:" + strings.Join(parts, ",")
+}
+
+// Apply makes the changes in the patch to a device.
+func (d *DevicePatch) Apply(c *cbyge.Controller, dev *cbyge.ControllerDevice) error {
+	if d.On != nil {
+		if err := c.SetDeviceStatus(dev, *d.On); err != nil {
+			return err
+		}
+	}
+	if d.Brightness != nil {
+		if err := c.SetDeviceLum(dev, *d.Brightness); err != nil {
+			return err
+		}
+	}
+	if d.ColorTone != nil {
+		if err := c.SetDeviceCT(dev, *d.ColorTone); err != nil {
+			return err
+		}
+	}
+	if d.RGB != nil {
+		rgb := *d.RGB
+		if err := c.SetDeviceRGB(dev, uint8(rgb[0]), uint8(rgb[1]), uint8(rgb[2])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type v2Handler func(s *Server, w http.ResponseWriter, r *http.Request, id string)
+
+type v2Route struct {
+	Method  string
+	Path    string
+	Summary string
+	Role    Role
+
+	Query []v2QueryParam
+
+	// Names of schemas in v2Schemas.
+	Request       string
+	Response      string
+	ResponseArray bool
+
+	Handler v2Handler
+}
+
+type v2QueryParam struct {
+	Name        string
+	Description string
+	Required    bool
+}
+
+const selectorParamDoc = "Only include devices matching a selector, " +
+	"such as `group:kitchen & is_on & !name:*night*` or `tag:office`."
+
+var v2Routes []v2Route
+
+func init() {
+	// Routes are set up in init() since the OpenAPI handler refers
+	// back to the route table.
+	v2Routes = []v2Route{
+		{
+			Method:        "GET",
+			Path:          "/devices",
+			Summary:       "List devices and their cached statuses.",
+			Query:         []v2QueryParam{{Name: "selector", Description: selectorParamDoc}},
+			Response:      "Device",
+			ResponseArray: true,
+			Handler:       (*Server).handleV2ListDevices,
+		},
+		{
+			Method:  "PATCH",
+			Role:    RoleControl,
+			Path:    "/devices",
+			Summary: "Change one or more properties of every device matching a selector.",
+			Query: []v2QueryParam{
+				{Name: "selector", Description: selectorParamDoc, Required: true},
+			},
+			Request:  "DevicePatch",
+			Response: "PatchResult",
+			Handler:  (*Server).handleV2PatchDevices,
+		},
+		{
+			Method:   "GET",
+			Path:     "/devices/{id}",
+			Summary:  "Get a device. Pass refresh=1 to query its status live.",
+			Response: "Device",
+			Handler:  (*Server).handleV2GetDevice,
+		},
+		{
+			Method:   "PATCH",
+			Role:     RoleControl,
+			Path:     "/devices/{id}",
+			Summary:  "Change one or more properties of a device.",
+			Request:  "DevicePatch",
+			Response: "Device",
+			Handler:  (*Server).handleV2PatchDevice,
+		},
+		{
+			Method:        "GET",
+			Path:          "/groups",
+			Summary:       "List groups of devices.",
+			Response:      "Group",
+			ResponseArray: true,
+			Handler:       (*Server).handleV2ListGroups,
+		},
+		{
+			Method:   "GET",
+			Path:     "/groups/{id}",
+			Summary:  "Get a group of devices.",
+			Response: "Group",
+			Handler:  (*Server).handleV2GetGroup,
+		},
+		{
+			Method:   "PATCH",
+			Role:     RoleControl,
+			Path:     "/groups/{id}",
+			Summary:  "Change one or more properties of every device in a group.",
+			Request:  "DevicePatch",
+			Response: "GroupPatchResult",
+			Handler:  (*Server).handleV2PatchGroup,
+		},
+		{
+			Method:   "GET",
+			Path:     "/openapi.json",
+			Summary:  "Get the OpenAPI document for this API.",
+			Response: "",
+			Handler:  (*Server).handleV2OpenAPI,
+		},
+	}
+}
+
+// HandleV2 routes requests for the v2 API.
+func (s *Server) HandleV2(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, v2Prefix)
+	pathMatched := false
+	for _, route := range v2Routes {
+		id, ok := matchV2Path(route.Path, path)
+		if !ok {
+			continue
+		}
+		pathMatched = true
+		if route.Method == r.Method {
+			if route.Role != "" && !requestPrincipal(r).Role.Allows(route.Role) {
+				s.serveV2Error(w, http.StatusForbidden, ErrorCodeForbidden,
+					"this endpoint requires the '"+string(route.Role)+"' role")
+				return
+			}
+			if route.Role != "" && route.Role.Allows(RoleControl) && !s.checkRate(w, r) {
+				s.serveV2Error(w, http.StatusTooManyRequests, ErrorCodeRateLimited,
+					"too many requests")
+				return
+			}
+			route.Handler(s, w, r, id)
+			return
+		}
+	}
+	if pathMatched {
+		s.serveV2Error(w, http.StatusMethodNotAllowed, ErrorCodeMethodNotAllowed,
+			"method "+r.Method+" is not allowed for this resource")
+	} else {
+		s.serveV2Error(w, http.StatusNotFound, ErrorCodeNotFound, "no such endpoint")
+	}
+}
+
+func matchV2Path(pattern, path string) (string, bool) {
+	patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(patternParts) != len(pathParts) {
+		return "", false
+	}
+	var id string
+	for i, part := range patternParts {
+		if part == "{id}" {
+			if pathParts[i] == "" {
+				return "", false
+			}
+			id = pathParts[i]
+		} else if part != pathParts[i] {
+			return "", false
+		}
+	}
+	return id, true
+}
+
+func (s *Server) handleV2ListDevices(w http.ResponseWriter, r *http.Request, _ string) {
+	var devs []*cbyge.ControllerDevice
+	var err error
+	if selector := r.URL.Query().Get("selector"); selector != "" {
+		devs, err = s.selectDevices(r, selector)
+	} else {
+		devs, err = s.getDevices()
+		devs = filterDevices(r, devs)
+	}
+	if err != nil {
+		s.serveV2SelectorError(w, err)
+		return
+	}
+	cache, err := s.getStatusCache()
+	if err != nil {
+		s.serveV2ControllerError(w, err)
+		return
+	}
+	statuses, errs := cache.Statuses(devs)
+	res := []interface{}{}
+	for i, d := range devs {
+		res = append(res, s.encodeV2Device(d, statuses[i], errs[i]))
+	}
+	s.serveObject(w, http.StatusOK, res)
+}
+
+func (s *Server) handleV2GetDevice(w http.ResponseWriter, r *http.Request, id string) {
+	dev, ok := s.lookupV2Device(w, r, id)
+	if !ok {
+		return
+	}
+	var status cbyge.ControllerDeviceStatus
+	var err error
+	if r.FormValue("refresh") == "1" {
+		status, err = s.liveStatus(dev)
+	} else {
+		cache, cacheErr := s.getStatusCache()
+		if cacheErr != nil {
+			s.serveV2ControllerError(w, cacheErr)
+			return
+		}
+		status, err = cache.Status(dev)
+	}
+	s.serveObject(w, http.StatusOK, s.encodeV2Device(dev, status, err))
+}
+
+func (s *Server) handleV2PatchDevice(w http.ResponseWriter, r *http.Request, id string) {
+	patch, ok := s.decodeV2Patch(w, r)
+	if !ok {
+		return
+	}
+	dev, ok := s.lookupV2Device(w, r, id)
+	if !ok {
+		return
+	}
+	entry := newAuditEntry(r, false, patch)
+	defer s.audit(entry)
+	ctrl, err := s.getController()
+	if err != nil {
+		entry.SetError(err)
+		s.serveV2ControllerError(w, err)
+		return
+	}
+	err = s.coalesce(patch.kind(), dev.DeviceID(), func() error {
+		return patch.Apply(ctrl, dev)
+	})
+	s.publishCommand(r.URL.Path, false, dev.DeviceID(), err)
+	entry.AddResult(dev.DeviceID(), err)
+	if err != nil {
+		s.serveV2ControllerError(w, err)
+		return
+	}
+	status, err := s.liveStatus(dev)
+	s.serveObject(w, http.StatusOK, s.encodeV2Device(dev, status, err))
+}
+
+func (s *Server) handleV2ListGroups(w http.ResponseWriter, r *http.Request, _ string) {
+	groups, err := s.getGroups()
+	if err != nil {
+		s.serveV2ControllerError(w, err)
+		return
+	}
+	res := []interface{}{}
+	for _, g := range groups {
+		res = append(res, encodeV2Group(g, filterDevices(r, g.Devices())))
+	}
+	s.serveObject(w, http.StatusOK, res)
+}
+
+func (s *Server) handleV2GetGroup(w http.ResponseWriter, r *http.Request, id string) {
+	group, ok := s.lookupV2Group(w, id)
+	if ok {
+		s.serveObject(w, http.StatusOK, encodeV2Group(group, filterDevices(r, group.Devices())))
+	}
+}
+
+func (s *Server) handleV2PatchGroup(w http.ResponseWriter, r *http.Request, id string) {
+	patch, ok := s.decodeV2Patch(w, r)
+	if !ok {
+		return
+	}
+	group, ok := s.lookupV2Group(w, id)
+	if !ok {
+		return
+	}
+	entry := newAuditEntry(r, false, patch)
+	defer s.audit(entry)
+	ctrl, err := s.getController()
+	if err != nil {
+		entry.SetError(err)
+		s.serveV2ControllerError(w, err)
+		return
+	}
+	// Devices outside the principal's allow list are left out, so that
+	// their IDs are not revealed.
+	devs := filterDevices(r, group.Devices())
+	results := []interface{}{}
+	for _, dev := range devs {
+		results = append(results, s.applyV2Patch(r, ctrl, patch, dev, entry))
+	}
+	s.serveObject(w, http.StatusOK, map[string]interface{}{
+		"group":   encodeV2Group(group, devs),
+		"results": results,
+	})
+}
+
+func (s *Server) handleV2PatchDevices(w http.ResponseWriter, r *http.Request, _ string) {
+	selector := r.URL.Query().Get("selector")
+	if selector == "" {
+		s.serveV2Error(w, http.StatusBadRequest, ErrorCodeBadRequest,
+			"missing 'selector' argument")
+		return
+	}
+	patch, ok := s.decodeV2Patch(w, r)
+	if !ok {
+		return
+	}
+	devs, err := s.selectDevices(r, selector)
+	if err != nil {
+		s.serveV2SelectorError(w, err)
+		return
+	} else if len(devs) == 0 {
+		s.serveV2Error(w, http.StatusNotFound, ErrorCodeNotFound,
+			"no accessible devices match the selector")
+		return
+	}
+	entry := newAuditEntry(r, false, patch)
+	defer s.audit(entry)
+	ctrl, err := s.getController()
+	if err != nil {
+		entry.SetError(err)
+		s.serveV2ControllerError(w, err)
+		return
+	}
+	results := []interface{}{}
+	for _, dev := range devs {
+		results = append(results, s.applyV2Patch(r, ctrl, patch, dev, entry))
+	}
+	s.serveObject(w, http.StatusOK, map[string]interface{}{"results": results})
+}
+
+// applyV2Patch changes one device for a request which may change several,
+// returning the result for that device.
+func (s *Server) applyV2Patch(r *http.Request, ctrl *cbyge.Controller, patch *DevicePatch,
+	dev *cbyge.ControllerDevice, entry *AuditEntry) map[string]interface{} {
+	err := s.coalesce(patch.kind(), dev.DeviceID(), func() error {
+		return patch.Apply(ctrl, dev)
+	})
+	s.publishCommand(r.URL.Path, false, dev.DeviceID(), err)
+	entry.AddResult(dev.DeviceID(), err)
+	result := map[string]interface{}{"id": dev.DeviceID()}
+	if err != nil {
+		_, v2Err := v2ErrorForController(err)
+		result["error"] = v2Err
+	} else {
+		status, err := s.liveStatus(dev)
+		result["device"] = s.encodeV2Device(dev, status, err)
+	}
+	return result
+}
+
+func (s *Server) handleV2OpenAPI(w http.ResponseWriter, r *http.Request, _ string) {
+	s.serveObject(w, http.StatusOK, v2OpenAPIDocument())
+}
+
+func (s *Server) lookupV2Device(w http.ResponseWriter, r *http.Request,
+	id string) (*cbyge.ControllerDevice, bool) {
+	devs, err := s.getDevices()
+	if err != nil {
+		s.serveV2ControllerError(w, err)
+		return nil, false
+	}
+	for _, d := range devs {
+		if d.DeviceID() == id {
+			if !requestPrincipal(r).CanAccess(id) {
+				s.serveV2Error(w, http.StatusForbidden, ErrorCodeForbidden,
+					"access to this device is not allowed")
+				return nil, false
+			}
+			return d, true
+		}
+	}
+	s.serveV2Error(w, http.StatusNotFound, ErrorCodeNotFound, "no device found with the given ID")
+	return nil, false
+}
+
+func (s *Server) lookupV2Group(w http.ResponseWriter, id string) (*cbyge.ControllerGroup, bool) {
+	groups, err := s.getGroups()
+	if err != nil {
+		s.serveV2ControllerError(w, err)
+		return nil, false
+	}
+	for _, g := range groups {
+		if g.GroupID() == id {
+			return g, true
+		}
+	}
+	s.serveV2Error(w, http.StatusNotFound, ErrorCodeNotFound, "no group found with the given ID")
+	return nil, false
+}
+
+func (s *Server) decodeV2Patch(w http.ResponseWriter, r *http.Request) (*DevicePatch, bool) {
+	var patch DevicePatch
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxV2BodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patch); err != nil {
+		s.serveV2Error(w, http.StatusBadRequest, ErrorCodeBadRequest, "invalid JSON body: "+err.Error())
+		return nil, false
+	}
+	if err := patch.Validate(); err != nil {
+		s.serveV2Error(w, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+		return nil, false
+	}
+	return &patch, true
+}
+
+// liveStatus fetches a device's status and stores it in the status cache.
+func (s *Server) liveStatus(dev *cbyge.ControllerDevice) (cbyge.ControllerDeviceStatus, error) {
+	ctrl, err := s.getController()
+	if err != nil {
+		return cbyge.ControllerDeviceStatus{}, err
+	}
+	status, err := ctrl.DeviceStatus(dev)
+	if cache, cacheErr := s.getStatusCache(); cacheErr == nil {
+		cache.Update(dev, status, err)
+	}
+	return status, err
+}
+
+func (s *Server) serveV2Error(w http.ResponseWriter, status int, code, msg string) {
+	s.serveObject(w, status, map[string]interface{}{
+		"error": &V2Error{Code: code, Message: msg},
+	})
+}
+
+// serveV2SelectorError serves an error from selectDevices.
+func (s *Server) serveV2SelectorError(w http.ResponseWriter, err error) {
+	var selectorErr *cbyge.SelectorError
+	if errors.As(err, &selectorErr) {
+		s.serveV2Error(w, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+	} else {
+		s.serveV2ControllerError(w, err)
+	}
+}
+
+func (s *Server) serveV2ControllerError(w http.ResponseWriter, err error) {
+	status, v2Err := v2ErrorForController(err)
+	s.serveObject(w, status, map[string]interface{}{"error": v2Err})
+}
+
+func v2ErrorForController(err error) (int, *V2Error) {
+	res := &V2Error{Message: err.Error()}
+	status := http.StatusInternalServerError
+	var remoteErr *cbyge.RemoteError
+	// Convergence errors wrap the last status error, which may be
+	// UnreachableError, so they are checked first.
+	if cbyge.IsConvergenceError(err) {
+		status, res.Code = http.StatusGatewayTimeout, ErrorCodeNotConverged
+	} else if errors.Is(err, cbyge.UnreachableError) {
+		status, res.Code = http.StatusServiceUnavailable, ErrorCodeUnreachable
+	} else if errors.Is(err, cbyge.RemoteCallError) || errors.As(err, &remoteErr) {
+		status, res.Code = http.StatusBadGateway, ErrorCodeRemote
+	} else {
+		res.Code = ErrorCodeInternal
+	}
+	return status, res
+}
+
+func (s *Server) encodeV2Device(d *cbyge.ControllerDevice, status cbyge.ControllerDeviceStatus,
+	err error) map[string]interface{} {
+	res := map[string]interface{}{
+		"id":       d.DeviceID(),
+		"name":     d.Name(),
+		"status":   encodeStatus(status),
+		"metadata": s.Metadata.Get(d.DeviceID()),
+	}
+	if err != nil {
+		_, res["error"] = v2ErrorForController(err)
+	}
+	return res
+}
+
+// encodeV2Group encodes a group with the given subset of its devices, which
+// are the ones visible to the request's principal.
+func encodeV2Group(g *cbyge.ControllerGroup, devs []*cbyge.ControllerDevice) map[string]interface{} {
+	ids := []string{}
+	for _, d := range devs {
+		ids = append(ids, d.DeviceID())
+	}
+	return map[string]interface{}{
+		"id":         g.GroupID(),
+		"name":       g.Name(),
+		"device_ids": ids,
+	}
+}
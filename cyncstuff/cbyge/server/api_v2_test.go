@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/unixpickle/cbyge"
+)
+
+func TestV2GroupsRestrictedToken(t *testing.T) {
+	s := newTestServer(t)
+	_, token, err := s.Users.CreateToken("admin", "restricted", RoleRead, []string{"5001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type group struct {
+		ID        string   `json:"id"`
+		DeviceIDs []string `json:"device_ids"`
+	}
+	var groups []group
+	getV2(t, s, "/groups", token, &groups)
+	if len(groups) != 1 || !reflect.DeepEqual(groups[0].DeviceIDs, []string{"5001"}) {
+		t.Errorf("unexpected groups: %+v", groups)
+	}
+	var g group
+	getV2(t, s, "/groups/5-1", token, &g)
+	if !reflect.DeepEqual(g.DeviceIDs, []string{"5001"}) {
+		t.Errorf("unexpected group: %+v", g)
+	}
+
+	_, token, err = s.Users.CreateToken("admin", "unrestricted", RoleRead, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getV2(t, s, "/groups/5-1", token, &g)
+	if !reflect.DeepEqual(g.DeviceIDs, []string{"5001", "5002"}) {
+		t.Errorf("unexpected group: %+v", g)
+	}
+}
+
+func TestV2PatchDevice(t *testing.T) {
+	s := newTestServer(t)
+	_, token, err := s.Users.CreateToken("admin", "restricted", RoleControl, []string{"5001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The devices have no switches, so a valid patch reaches the controller
+	// and fails as unreachable.
+	rec := doV2(s, "PATCH", "/devices/5001", token, "", `{"on":true}`)
+	checkV2Error(t, rec, http.StatusServiceUnavailable, ErrorCodeUnreachable)
+
+	rec = doV2(s, "PATCH", "/devices/5002", token, "", `{"on":true}`)
+	checkV2Error(t, rec, http.StatusForbidden, ErrorCodeForbidden)
+	rec = doV2(s, "PATCH", "/devices/9999", token, "", `{"on":true}`)
+	checkV2Error(t, rec, http.StatusNotFound, ErrorCodeNotFound)
+
+	for _, body := range []string{
+		``,
+		`{}`,
+		`{"on":true,"extra":1}`,
+		`{"brightness":0}`,
+		`{"color_tone":50,"rgb":[1,2,3]}`,
+		`{"rgb":[1,2,256]}`,
+	} {
+		rec = doV2(s, "PATCH", "/devices/5001", token, "", body)
+		checkV2Error(t, rec, http.StatusBadRequest, ErrorCodeBadRequest)
+	}
+}
+
+func TestV2PatchDevices(t *testing.T) {
+	s := newTestServer(t)
+	_, token, err := s.Users.CreateToken("admin", "restricted", RoleControl, []string{"5001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A form content type must not stop the JSON body from being read.
+	for _, contentType := range []string{"", "application/x-www-form-urlencoded"} {
+		rec := doV2(s, "PATCH", "/devices?selector=all", token, contentType, `{"on":false}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+		}
+		var response struct {
+			Results []struct {
+				ID    string   `json:"id"`
+				Error *V2Error `json:"error"`
+			} `json:"results"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Results) != 1 || response.Results[0].ID != "5001" {
+			t.Fatalf("unexpected results: %+v", response.Results)
+		}
+		if e := response.Results[0].Error; e == nil || e.Code != ErrorCodeUnreachable {
+			t.Errorf("unexpected error: %+v", e)
+		}
+	}
+
+	rec := doV2(s, "PATCH", "/devices", token, "", `{"on":false}`)
+	checkV2Error(t, rec, http.StatusBadRequest, ErrorCodeBadRequest)
+	rec = doV2(s, "PATCH", "/devices?selector=id:5002", token, "", `{"on":false}`)
+	checkV2Error(t, rec, http.StatusNotFound, ErrorCodeNotFound)
+	rec = doV2(s, "PATCH", "/devices?selector=all", token, "", `{"on":1}`)
+	checkV2Error(t, rec, http.StatusBadRequest, ErrorCodeBadRequest)
+}
+
+func TestV2AuthErrors(t *testing.T) {
+	s := newTestServer(t)
+	_, token, err := s.Users.CreateToken("admin", "reader", RoleRead, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := doV2(s, "GET", "/devices", "bad-token", "", "")
+	checkV2Error(t, rec, http.StatusUnauthorized, ErrorCodeUnauthorized)
+
+	req := httptest.NewRequest("PATCH", v2Prefix+"/devices/5001", strings.NewReader(`{"on":true}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+	s.Auth(RoleControl, s.HandleV2).ServeHTTP(rec, req)
+	checkV2Error(t, rec, http.StatusForbidden, ErrorCodeForbidden)
+}
+
+func doV2(s *Server, method, path, token, contentType, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, v2Prefix+path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	rec := httptest.NewRecorder()
+	s.Auth(RoleRead, s.HandleV2).ServeHTTP(rec, req)
+	return rec
+}
+
+func checkV2Error(t *testing.T, rec *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	if rec.Code != status {
+		t.Errorf("expected status %d but got %d: %s", status, rec.Code, rec.Body.String())
+		return
+	}
+	var response struct {
+		Error *V2Error `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Error(err)
+	} else if response.Error == nil || response.Error.Code != code {
+		t.Errorf("expected error code %s but got: %s", code, rec.Body.String())
+	}
+}
+
+func getV2(t *testing.T, s *Server, path, token string, response interface{}) {
+	req := httptest.NewRequest("GET", v2Prefix+path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	s.Auth(RoleRead, s.HandleV2).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d: %s", path, rec.Code, rec.Body.String())
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), response); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestServer creates a Server with an admin user, backed by a fake cloud
+// API with two devices in one group.
+//
+// The devices have no switches, so no packet connections are made.
+func newTestServer(t *testing.T) *Server {
+	fakeCloud := http.NewServeMux()
+	fakeCloud.HandleFunc("/v2/user/1/subscribe/devices", func(w http.ResponseWriter,
+		r *http.Request) {
+		w.Write([]byte(`[{"id":5,"product_id":"p1","is_online":true}]`))
+	})
+	fakeCloud.HandleFunc("/v2/product/p1/device/5/property", func(w http.ResponseWriter,
+		r *http.Request) {
+		w.Write([]byte(`{
+			"bulbsArray": [
+				{"deviceID": 5001, "switchID": 1099511627776},
+				{"deviceID": 5002, "switchID": 1099511627776}
+			],
+			"groupsArray": [{"groupID": 1, "displayName": "Room", "deviceIDArray": [1, 2]}]
+		}`))
+	})
+	oldTransport := http.DefaultClient.Transport
+	http.DefaultClient.Transport = handlerTransport{fakeCloud}
+	t.Cleanup(func() {
+		http.DefaultClient.Transport = oldTransport
+	})
+
+	users, err := LoadUserStore(filepath.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.PutUser("admin", "password", RoleAdmin, nil); err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := LoadMetadataStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		Users:      users,
+		Metadata:   metadata,
+		StatusTTL:  time.Minute,
+		events:     NewEventHub(),
+		limiter:    NewRateLimiter(100, 100),
+		controller: cbyge.NewController(&cbyge.SessionInfo{UserID: 1, AccessToken: "t"}, 0),
+	}
+	t.Cleanup(func() {
+		if cache := s.currentStatusCache(); cache != nil {
+			cache.Close()
+		}
+	})
+	return s
+}
+
+// handlerTransport answers HTTP requests with a handler rather than the
+// network.
+type handlerTransport struct {
+	Handler http.Handler
+}
+
+func (h handlerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	h.Handler.ServeHTTP(rec, r)
+	return rec.Result(), nil
+}
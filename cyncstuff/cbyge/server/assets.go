@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+//go:embed assets
+var embeddedAssets embed.FS
+
+// longCacheExtensions are assets which rarely change, so browsers may cache
+// them without revalidating. Other assets are revalidated with ETags, since
+// their names do not change between versions.
+var longCacheExtensions = map[string]bool{
+	".ico": true,
+	".png": true,
+	".svg": true,
+}
+
+const longCacheControl = "public, max-age=86400"
+
+// An AssetHandler serves the website's static files with cache headers.
+type AssetHandler struct {
+	fs      fs.FS
+	handler http.Handler
+
+	// etags are precomputed for embedded assets. If nil, they are
+	// computed for each request.
+	etags map[string]string
+}
+
+// NewAssetHandler serves assets from a directory, or from the assets
+// embedded in the binary if dir is "".
+func NewAssetHandler(dir string) (*AssetHandler, error) {
+	if dir != "" {
+		if _, err := os.Stat(dir); err != nil {
+			return nil, err
+		}
+		assets := os.DirFS(dir)
+		return &AssetHandler{fs: assets, handler: http.FileServer(http.FS(assets))}, nil
+	}
+
+	assets, err := fs.Sub(embeddedAssets, "assets")
+	if err != nil {
+		return nil, err
+	}
+	etags := map[string]string{}
+	err = fs.WalkDir(assets, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		etag, err := assetETag(assets, name)
+		if err != nil {
+			return err
+		}
+		etags[name] = etag
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &AssetHandler{
+		fs:      assets,
+		handler: http.FileServer(http.FS(assets)),
+		etags:   etags,
+	}, nil
+}
+
+func (a *AssetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" || strings.HasSuffix(r.URL.Path, "/") {
+		name = path.Join(name, "index.html")
+	}
+
+	var etag string
+	if a.etags != nil {
+		etag = a.etags[name]
+	} else {
+		etag, _ = assetETag(a.fs, name)
+	}
+	if etag != "" {
+		// The file server compares this to If-None-Match.
+		w.Header().Set("ETag", etag)
+		if longCacheExtensions[path.Ext(name)] {
+			w.Header().Set("Cache-Control", longCacheControl)
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+	}
+	a.handler.ServeHTTP(w, r)
+}
+
+func assetETag(assets fs.FS, name string) (string, error) {
+	f, err := assets.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(hash[:16]) + `"`, nil
+}
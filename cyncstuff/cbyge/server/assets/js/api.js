@@ -2,12 +2,17 @@
 
     class API {
         getDevices() {
-            return apiCall('/api/devices?update_status=1');
+            return apiCall('/api/devices?update_status=1&hidden=1');
+        }
+
+        setMetadata(deviceID, metadata) {
+            const encoded = encodeURIComponent(deviceID);
+            return apiPost('/api/device/metadata?id=' + encoded, metadata);
         }
 
         async getStatus(deviceID) {
             const encoded = encodeURIComponent(deviceID);
-            return (await apiCall('/api/device/status?id=' + encoded))[0];
+            return (await apiCall('/api/device/status?refresh=1&id=' + encoded))[0];
         }
 
         async setOnOff(deviceID, on) {
@@ -35,12 +40,43 @@
             const url = '/api/device/set_rgb?id=' + encoded + '&r=' + r + '&g=' + g + '&b=' + b;
             return (await apiCall(url))[0];
         }
+
+        // Subscribe to server events. The handler is called with
+        // each event type and its data. Returns a function which
+        // closes the subscription.
+        subscribe(handler, onReconnect) {
+            const source = new EventSource('/api/events');
+            let disconnected = false;
+            ['status', 'online', 'offline', 'command', 'metadata'].forEach((eventType) => {
+                source.addEventListener(eventType, (e) => {
+                    handler(eventType, JSON.parse(e.data)['data']);
+                });
+            });
+            source.addEventListener('open', () => {
+                if (disconnected && onReconnect) {
+                    onReconnect();
+                }
+                disconnected = false;
+            });
+            source.addEventListener('error', () => {
+                disconnected = true;
+            });
+            return () => source.close();
+        }
     }
 
     async function apiCall(url) {
         return parseRemoteObject(await fetch(url));
     }
 
+    async function apiPost(url, body) {
+        return parseRemoteObject(await fetch(url, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(body),
+        }));
+    }
+
     async function parseRemoteObject(obj) {
         const parsed = await obj.json();
         if (parsed.hasOwnProperty('error')) {
@@ -152,9 +152,75 @@
         }
     }
 
+    class MetadataPopup extends ControlPopup {
+        constructor(name, metadata) {
+            super();
+
+            this.onMetadata = (_value) => null;
+
+            this.title.textContent = name;
+            this.aliasesInput.value = (metadata['aliases'] || []).join(', ');
+            this.tagsInput.value = (metadata['tags'] || []).join(', ');
+            this.roomInput.value = metadata['room'] || '';
+            this.iconInput.value = metadata['icon'] || '';
+            this.hiddenInput.checked = !!metadata['hidden'];
+
+            this.dialog.classList.add('popup-window-tall');
+        }
+
+        createContent() {
+            this.title = makeElem('label', 'popup-title');
+            this.aliasesInput = makeElem('input', 'popup-field-input', {
+                type: 'text',
+                placeholder: 'desk, reading-lamp',
+            });
+            this.tagsInput = makeElem('input', 'popup-field-input', {
+                type: 'text',
+                placeholder: 'office, lamps',
+            });
+            this.roomInput = makeElem('input', 'popup-field-input', { type: 'text' });
+            this.iconInput = makeElem('input', 'popup-field-input', {
+                type: 'text',
+                placeholder: '💡',
+            });
+            this.hiddenInput = makeElem('input', 'popup-field-checkbox', { type: 'checkbox' });
+            return [
+                this.title,
+                makeField('Aliases', this.aliasesInput),
+                makeField('Tags', this.tagsInput),
+                makeField('Room', this.roomInput),
+                makeField('Icon', this.iconInput),
+                makeField('Hidden', this.hiddenInput),
+            ];
+        }
+
+        confirm() {
+            super.confirm();
+            this.onMetadata({
+                aliases: splitList(this.aliasesInput.value),
+                tags: splitList(this.tagsInput.value),
+                room: this.roomInput.value.trim(),
+                icon: this.iconInput.value.trim(),
+                hidden: this.hiddenInput.checked,
+            });
+        }
+    }
+
+    function makeField(label, input) {
+        return makeElem('label', 'popup-field', {}, [
+            makeElem('span', 'popup-field-label', { textContent: label }),
+            input,
+        ]);
+    }
+
+    function splitList(value) {
+        return value.split(',').map((x) => x.trim()).filter((x) => x.length > 0);
+    }
+
     window.controlPopups = {
         BrightnessPopup: BrightnessPopup,
         ColorPopup: ColorPopup,
+        MetadataPopup: MetadataPopup,
     }
 
 })();
@@ -4,18 +4,55 @@
         constructor() {
             this.element = document.getElementById('devices');
             this.devices = [];
+            this.devicesByID = {};
+
+            this.hiddenToggle = makeElem('button', 'devices-hidden-toggle');
+            this.hiddenToggle.addEventListener('click', () => {
+                this.element.classList.toggle('devices-show-hidden');
+                this.updateHiddenToggle();
+            });
         }
 
         update(devices) {
             this.element.classList.remove('loading');
             this.devices = [];
+            this.devicesByID = {};
             this.element.innerHTML = '';
 
             devices.forEach((info) => {
                 const device = new Device(info);
                 this.element.appendChild(device.element);
                 this.devices.push(device);
+                this.devicesByID[info.id] = device;
             });
+            this.element.appendChild(this.hiddenToggle);
+            this.updateHiddenToggle();
+        }
+
+        updateHiddenToggle() {
+            const numHidden = this.devices.filter((d) => d.isHidden()).length;
+            this.hiddenToggle.style.display = (numHidden ? 'block' : 'none');
+            if (this.element.classList.contains('devices-show-hidden')) {
+                this.hiddenToggle.textContent = 'Hide hidden devices';
+            } else {
+                this.hiddenToggle.textContent = 'Show ' + numHidden + ' hidden device' +
+                    (numHidden === 1 ? '' : 's');
+            }
+        }
+
+        handleEvent(eventType, data) {
+            const device = this.devicesByID[data['id']];
+            if (!device) {
+                return;
+            }
+            if (eventType === 'status') {
+                device.receiveStatus(data);
+            } else if (eventType === 'command' && data['error']) {
+                device.showError(data['error']);
+            } else if (eventType === 'metadata') {
+                device.updateMetadata(data['metadata']);
+                this.updateHiddenToggle();
+            }
         }
 
         showError(err) {
@@ -30,7 +67,9 @@
             this.info = info;
             this.status = null;
 
-            this.name = makeElem('label', 'device-name', { textContent: info.name });
+            this.name = makeElem('label', 'device-name');
+            this.name.addEventListener('click', () => this.editMetadata());
+            this.room = makeElem('label', 'device-room');
             this.onOff = makeElem('div', 'device-on-off');
             this.onOff.addEventListener('click', () => this.toggleOnOff());
 
@@ -56,8 +95,9 @@
             this.loader = makeElem('div', 'loader');
 
             this.element = makeElem('div', 'device', {}, [
-                this.name, this.onOff, this.colorControls, this.error, this.loader,
+                this.name, this.room, this.onOff, this.colorControls, this.error, this.loader,
             ]);
+            this.updateMetadata(info['metadata'] || {});
 
             if (info['status']['is_online']) {
                 this.updateStatus(info['status']);
@@ -86,12 +126,40 @@
             }
         }
 
+        updateMetadata(metadata) {
+            this.metadata = metadata;
+            const aliases = metadata['aliases'] || [];
+            const name = (aliases.length ? aliases[0] : this.info.name);
+            this.name.textContent = (metadata['icon'] ? metadata['icon'] + ' ' : '') + name;
+            this.name.title = this.info.name;
+            this.room.textContent = metadata['room'] || '';
+            this.room.style.display = (metadata['room'] ? 'block' : 'none');
+            if (metadata['hidden']) {
+                this.element.classList.add('device-hidden');
+            } else {
+                this.element.classList.remove('device-hidden');
+            }
+        }
+
+        isHidden() {
+            return !!this.metadata['hidden'];
+        }
+
         showError(err) {
             this.updateStatus(null);
             this.error.textContent = err;
             this.error.style.display = 'block';
         }
 
+        receiveStatus(data) {
+            clearTimeout(this.pendingFetch);
+            if (data['error']) {
+                this.showError(data['error']);
+            } else {
+                this.updateStatus(data['status']);
+            }
+        }
+
         fetchUpdate() {
             this.doCall(lightAPI.getStatus(this.info.id));
         }
@@ -133,6 +201,20 @@
             popup.open();
         }
 
+        editMetadata() {
+            const popup = new window.controlPopups.MetadataPopup(this.info.name, this.metadata);
+            popup.onMetadata = (metadata) => {
+                lightAPI.setMetadata(this.info.id, metadata).then((result) => {
+                    this.updateMetadata(result);
+                    window.deviceList.updateHiddenToggle();
+                }).catch((err) => {
+                    this.error.textContent = err;
+                    this.error.style.display = 'block';
+                });
+            };
+            popup.open();
+        }
+
         doCall(promise) {
             this.element.classList.add('device-loading');
             this.element.classList.add('loading');
@@ -148,9 +230,11 @@
             this.element.classList.add('loading');
             promise.then((status) => {
                 if (!check(status)) {
-                    // The status change might have been delayed,
-                    // so we will attempt to fetch it again.
-                    setTimeout(() => this.fetchUpdate(), 1000);
+                    // The status change might have been delayed.
+                    // We should receive a status event once the
+                    // server notices, but fetch it ourselves if not.
+                    clearTimeout(this.pendingFetch);
+                    this.pendingFetch = setTimeout(() => this.fetchUpdate(), 5000);
                 } else {
                     this.updateStatus(status);
                 }
@@ -170,11 +254,21 @@
 
     window.addEventListener('load', () => {
         window.deviceList = new DeviceList();
-        lightAPI.getDevices().then((devs) => {
-            window.deviceList.update(devs);
-        }).catch((err) => {
-            window.deviceList.showError(err);
-        })
+        const loadDevices = () => {
+            lightAPI.getDevices().then((devs) => {
+                window.deviceList.update(devs);
+            }).catch((err) => {
+                window.deviceList.showError(err);
+            });
+        };
+        loadDevices();
+
+        // Learn about changes through events instead of polling, and
+        // only reload everything if we missed events while disconnected.
+        lightAPI.subscribe(
+            (eventType, data) => window.deviceList.handleEvent(eventType, data),
+            loadDevices,
+        );
     });
 
 })();
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultAuditMaxSize  = 10 << 20
+	DefaultAuditMaxFiles = 5
+
+	defaultAuditQueryLimit = 100
+	maxAuditQueryLimit     = 1000
+)
+
+// Outcomes of an audited action.
+const (
+	AuditOutcomeOK      = "ok"
+	AuditOutcomePartial = "partial"
+	AuditOutcomeError   = "error"
+)
+
+// An AuditEntry records one control action.
+type AuditEntry struct {
+	Time       time.Time   `json:"time"`
+	Principal  string      `json:"principal"`
+	RemoteAddr string      `json:"remote_addr"`
+	Method     string      `json:"method"`
+	Endpoint   string      `json:"endpoint"`
+	Async      bool        `json:"async"`
+	Job        string      `json:"job,omitempty"`
+	Devices    []string    `json:"devices"`
+	Values     interface{} `json:"values,omitempty"`
+	Outcome    string      `json:"outcome"`
+
+	// Error is set if the whole request failed, and Errors maps
+	// device IDs to the errors for individual devices.
+	Error  string            `json:"error,omitempty"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// newAuditEntry starts an entry for a request, to be completed once the
+// outcome is known.
+func newAuditEntry(r *http.Request, async bool, values interface{}) *AuditEntry {
+	return &AuditEntry{
+		Time:       time.Now(),
+		Principal:  requestPrincipal(r).Name(),
+		RemoteAddr: r.RemoteAddr,
+		Method:     r.Method,
+		Endpoint:   r.URL.Path,
+		Async:      async,
+		Devices:    []string{},
+		Values:     values,
+	}
+}
+
+// AddResult records the result of the action for one device.
+func (a *AuditEntry) AddResult(deviceID string, err error) {
+	a.Devices = append(a.Devices, deviceID)
+	if err != nil {
+		if a.Errors == nil {
+			a.Errors = map[string]string{}
+		}
+		a.Errors[deviceID] = err.Error()
+	}
+}
+
+// SetError records a failure for the request as a whole.
+func (a *AuditEntry) SetError(err error) {
+	if err != nil {
+		a.Error = err.Error()
+	}
+}
+
+func (a *AuditEntry) outcome() string {
+	if a.Error != "" || (len(a.Errors) > 0 && len(a.Errors) == len(a.Devices)) {
+		return AuditOutcomeError
+	} else if len(a.Errors) > 0 {
+		return AuditOutcomePartial
+	}
+	return AuditOutcomeOK
+}
+
+// An AuditQuery filters the entries returned by AuditLog.Query.
+//
+// Zero-valued fields do not filter anything.
+type AuditQuery struct {
+	Since     time.Time
+	Until     time.Time
+	Device    string
+	Principal string
+	Limit     int
+}
+
+func (a *AuditQuery) matches(e *AuditEntry) bool {
+	if !a.Since.IsZero() && e.Time.Before(a.Since) {
+		return false
+	}
+	if !a.Until.IsZero() && e.Time.After(a.Until) {
+		return false
+	}
+	if a.Principal != "" && e.Principal != a.Principal {
+		return false
+	}
+	if a.Device != "" {
+		for _, id := range e.Devices {
+			if id == a.Device {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// An AuditLog is an append-only file of JSON entries, one per line.
+//
+// When the file would grow beyond MaxSize bytes, it is renamed to path.1,
+// path.1 is renamed to path.2, and so on, keeping up to MaxFiles old files.
+type AuditLog struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenAuditLog opens or creates an audit log.
+func OpenAuditLog(path string, maxSize int64, maxFiles int) (*AuditLog, error) {
+	a := &AuditLog{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Log appends an entry to the log.
+func (a *AuditLog) Log(e *AuditEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.size > 0 && a.maxSize > 0 && a.size+int64(len(data)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(data)
+	a.size += int64(n)
+	return err
+}
+
+// Query finds the most recent entries matching q, newest first.
+func (a *AuditLog) Query(q AuditQuery) ([]*AuditEntry, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultAuditQueryLimit
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// Scan from the oldest file to the newest, keeping the latest
+	// matches.
+	var res []*AuditEntry
+	for i := a.maxFiles; i >= 0; i-- {
+		f, err := os.Open(a.rotatedPath(i))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 0, 1<<16), 1<<20)
+		for scanner.Scan() {
+			var entry AuditEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+				// Skip lines that were partially written.
+				continue
+			}
+			if q.matches(&entry) {
+				res = append(res, &entry)
+				if len(res) > limit {
+					res = res[1:]
+				}
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := 0; i < len(res)/2; i++ {
+		res[i], res[len(res)-i-1] = res[len(res)-i-1], res[i]
+	}
+	return res, nil
+}
+
+// Close closes the current log file.
+func (a *AuditLog) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.file.Close()
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+func (a *AuditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	if a.maxFiles <= 0 {
+		if err := os.Remove(a.path); err != nil {
+			return err
+		}
+		return a.open()
+	}
+	os.Remove(a.rotatedPath(a.maxFiles))
+	for i := a.maxFiles - 1; i >= 0; i-- {
+		err := os.Rename(a.rotatedPath(i), a.rotatedPath(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return a.open()
+}
+
+func (a *AuditLog) rotatedPath(i int) string {
+	if i == 0 {
+		return a.path
+	}
+	return a.path + "." + strconv.Itoa(i)
+}
+
+// audit completes and saves an entry, if auditing is enabled.
+func (s *Server) audit(e *AuditEntry) {
+	if s.Audit == nil {
+		return
+	}
+	e.Outcome = e.outcome()
+	if err := s.Audit.Log(e); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to write audit log:", err)
+	}
+}
+
+// formAuditValues gets the values requested by a v1 setter, excluding the
+// arguments which are not values.
+func formAuditValues(r *http.Request) map[string]string {
+	r.ParseForm()
+	res := map[string]string{}
+	for key := range r.Form {
+		if key != "id" && key != "async" && !isDeviceSelectorKey(key) {
+			res[key] = r.Form.Get(key)
+		}
+	}
+	return res
+}
+
+// HandleAudit queries the audit log.
+//
+// Arguments are since and until (RFC 3339), device, principal, and limit.
+func (s *Server) HandleAudit(w http.ResponseWriter, r *http.Request) {
+	if s.Audit == nil {
+		s.serveError(w, http.StatusBadRequest, "the server was not started with an audit log")
+		return
+	}
+	var q AuditQuery
+	for _, arg := range []struct {
+		Name  string
+		Value *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		if value := r.FormValue(arg.Name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				s.serveError(w, http.StatusBadRequest, "invalid '"+arg.Name+"' argument")
+				return
+			}
+			*arg.Value = t
+		}
+	}
+	if value := r.FormValue("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxAuditQueryLimit {
+			s.serveError(w, http.StatusBadRequest, "invalid 'limit' argument")
+			return
+		}
+		q.Limit = limit
+	}
+	q.Device = r.FormValue("device")
+	q.Principal = r.FormValue("principal")
+
+	entries, err := s.Audit.Query(q)
+	if err != nil {
+		s.serveError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if entries == nil {
+		entries = []*AuditEntry{}
+	}
+	s.serveObject(w, http.StatusOK, entries)
+}
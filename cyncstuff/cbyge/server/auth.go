@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// A Role determines which endpoints a user or token may access.
+type Role string
+
+const (
+	RoleRead    Role = "read"
+	RoleControl Role = "control"
+	RoleAdmin   Role = "admin"
+)
+
+const tokenPrefix = "cbyge_"
+
+// Valid checks if the role is one of the known roles.
+func (r Role) Valid() bool {
+	return r.level() > 0
+}
+
+// Allows checks if the role grants at least the privileges of other.
+func (r Role) Allows(other Role) bool {
+	return r.level() >= other.level()
+}
+
+func (r Role) level() int {
+	switch r {
+	case RoleRead:
+		return 1
+	case RoleControl:
+		return 2
+	case RoleAdmin:
+		return 3
+	}
+	return 0
+}
+
+// A User is an account which can log in to the server with a password.
+type User struct {
+	Name         string `json:"name"`
+	PasswordHash string `json:"password_hash"`
+	Role         Role   `json:"role"`
+
+	// Devices restricts the user to the given device IDs.
+	// If it is empty, every device is allowed.
+	Devices []string `json:"devices,omitempty"`
+}
+
+// An APIToken is a scoped credential which belongs to a user.
+type APIToken struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	User    string    `json:"user"`
+	Role    Role      `json:"role"`
+	Devices []string  `json:"devices,omitempty"`
+	Created time.Time `json:"created"`
+
+	// SecretHash is the SHA-256 of the token's secret. Secrets are
+	// random, so they do not need a slow password hash.
+	SecretHash string `json:"secret_hash"`
+}
+
+// A Principal is an authenticated user or token making a request.
+type Principal struct {
+	User    string
+	TokenID string
+	Role    Role
+
+	// Devices restricts the principal to the given device IDs.
+	// If it is empty, every device is allowed unless NoDevices is set.
+	Devices []string
+
+	// NoDevices is set when no device is allowed, such as for a token
+	// which shares no devices with its user.
+	NoDevices bool
+}
+
+// Name gets a human-readable identifier for the principal.
+func (p *Principal) Name() string {
+	if p.TokenID != "" {
+		return p.User + " (token " + p.TokenID + ")"
+	}
+	return p.User
+}
+
+// CanAccess checks if the principal may see or control a device.
+func (p *Principal) CanAccess(deviceID string) bool {
+	return !p.NoDevices && deviceAllowed(p.Devices, deviceID)
+}
+
+func deviceAllowed(allowList []string, deviceID string) bool {
+	if len(allowList) == 0 {
+		return true
+	}
+	for _, id := range allowList {
+		if id == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// A UserStore stores users and API tokens in a JSON file.
+type UserStore struct {
+	path string
+
+	lock   sync.RWMutex
+	Users  []*User     `json:"users"`
+	Tokens []*APIToken `json:"tokens"`
+}
+
+// LoadUserStore reads a UserStore from a file, or creates an empty store if
+// the file does not exist.
+func LoadUserStore(path string) (*UserStore, error) {
+	store := &UserStore{path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, store); err != nil {
+		return nil, errors.New("parse user store: " + err.Error())
+	}
+	return store, nil
+}
+
+// NumUsers gets the number of users in the store.
+func (u *UserStore) NumUsers() int {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	return len(u.Users)
+}
+
+// ListUsers gets copies of every user.
+func (u *UserStore) ListUsers() []User {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	var res []User
+	for _, user := range u.Users {
+		res = append(res, *user)
+	}
+	return res
+}
+
+// PutUser creates or replaces a user.
+func (u *UserStore) PutUser(name, password string, role Role, devices []string) error {
+	if name == "" || strings.Contains(name, ":") {
+		return errors.New("invalid user name")
+	}
+	if !role.Valid() {
+		return errors.New("invalid role")
+	}
+	if len(password) < 8 {
+		return errors.New("password must be at least 8 characters")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	user := &User{Name: name, PasswordHash: string(hash), Role: role, Devices: devices}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	replaced := false
+	for i, existing := range u.Users {
+		if existing.Name == name {
+			u.Users[i] = user
+			replaced = true
+		}
+	}
+	if !replaced {
+		u.Users = append(u.Users, user)
+	}
+	return u.save()
+}
+
+// DeleteUser removes a user and all of its tokens.
+func (u *UserStore) DeleteUser(name string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	found := false
+	var users []*User
+	for _, user := range u.Users {
+		if user.Name == name {
+			found = true
+		} else {
+			users = append(users, user)
+		}
+	}
+	if !found {
+		return errors.New("no such user")
+	}
+	u.Users = users
+	var tokens []*APIToken
+	for _, token := range u.Tokens {
+		if token.User != name {
+			tokens = append(tokens, token)
+		}
+	}
+	u.Tokens = tokens
+	return u.save()
+}
+
+// CreateToken creates a new token and returns its secret.
+//
+// The secret is only available at creation time.
+func (u *UserStore) CreateToken(user, name string, role Role,
+	devices []string) (*APIToken, string, error) {
+	if !role.Valid() {
+		return nil, "", errors.New("invalid role")
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+	token := &APIToken{
+		ID:         id,
+		Name:       name,
+		User:       user,
+		Role:       role,
+		Devices:    devices,
+		Created:    time.Now(),
+		SecretHash: hashSecret(secret),
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.Tokens = append(u.Tokens, token)
+	if err := u.save(); err != nil {
+		return nil, "", err
+	}
+	return token, tokenPrefix + id + "_" + secret, nil
+}
+
+// ListTokens gets copies of the tokens, optionally filtered to one user.
+//
+// If user is "", all tokens are returned.
+func (u *UserStore) ListTokens(user string) []APIToken {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	var res []APIToken
+	for _, token := range u.Tokens {
+		if user == "" || token.User == user {
+			res = append(res, *token)
+		}
+	}
+	return res
+}
+
+// GetToken looks up a token by its ID.
+func (u *UserStore) GetToken(id string) (APIToken, bool) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	for _, token := range u.Tokens {
+		if token.ID == id {
+			return *token, true
+		}
+	}
+	return APIToken{}, false
+}
+
+// RevokeToken deletes a token.
+func (u *UserStore) RevokeToken(id string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	for i, token := range u.Tokens {
+		if token.ID == id {
+			u.Tokens = append(u.Tokens[:i], u.Tokens[i+1:]...)
+			return u.save()
+		}
+	}
+	return errors.New("no such token")
+}
+
+// AuthenticatePassword checks a user's password.
+func (u *UserStore) AuthenticatePassword(name, password string) (*Principal, bool) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	for _, user := range u.Users {
+		if user.Name == name {
+			err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+			if err != nil {
+				return nil, false
+			}
+			return &Principal{User: user.Name, Role: user.Role, Devices: user.Devices}, true
+		}
+	}
+	// Spend the same time as a real comparison, so that
+	// valid user names cannot be discovered by timing.
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+	return nil, false
+}
+
+// AuthenticateToken checks a token of the form returned by CreateToken.
+//
+// A token is limited by the privileges of its user as well as its own.
+func (u *UserStore) AuthenticateToken(token string) (*Principal, bool) {
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return nil, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(token, tokenPrefix), "_", 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+	id, secret := parts[0], parts[1]
+
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	for _, t := range u.Tokens {
+		if t.ID != id {
+			continue
+		}
+		expected := []byte(t.SecretHash)
+		if subtle.ConstantTimeCompare(expected, []byte(hashSecret(secret))) != 1 {
+			return nil, false
+		}
+		for _, user := range u.Users {
+			if user.Name == t.User {
+				devices, ok := intersectDevices(t.Devices, user.Devices)
+				return &Principal{
+					User:      t.User,
+					TokenID:   t.ID,
+					Role:      minRole(t.Role, user.Role),
+					Devices:   devices,
+					NoDevices: !ok,
+				}, true
+			}
+		}
+		return nil, false
+	}
+	return nil, false
+}
+
+func (u *UserStore) save() error {
+	data, err := json.MarshalIndent(u, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := u.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, u.path)
+}
+
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+type principalKey struct{}
+
+// Auth wraps a handler to require a principal with at least the given role.
+//
+// Credentials are accepted as a verified TLS client certificate, via HTTP
+// basic auth (for users), or as a bearer token in the Authorization header.
+func (s *Server) Auth(role Role, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var principal *Principal
+		if s.NoAuth {
+			principal = &Principal{User: "anonymous", Role: RoleAdmin}
+		} else {
+			var ok bool
+			principal, ok = s.authenticate(r)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Basic realm="bad credentials"`)
+				if strings.HasPrefix(r.URL.Path, "/api/") {
+					s.serveAuthError(w, r, http.StatusUnauthorized, "invalid credentials")
+				} else {
+					w.WriteHeader(http.StatusUnauthorized)
+					w.Write([]byte("Unauthorised.\n"))
+				}
+				return
+			}
+		}
+		if !principal.Role.Allows(role) {
+			s.serveAuthError(w, r, http.StatusForbidden, "this endpoint requires the '"+
+				string(role)+"' role")
+			return
+		}
+		if r.URL.Query().Get("id") != "" {
+			// Check allow lists for the v1 API, which takes a
+			// list of device IDs. Other selector terms are
+			// filtered once they are resolved.
+			for _, id := range strings.Split(r.URL.Query().Get("id"), ",") {
+				if isDeviceIDLiteral(id) && !principal.CanAccess(id) {
+					s.serveAuthError(w, r, http.StatusForbidden,
+						"access to device "+id+" is not allowed")
+					return
+				}
+			}
+		}
+		r = r.WithContext(context.WithValue(r.Context(), principalKey{}, principal))
+		if role.Allows(RoleControl) && !s.checkRate(w, r) {
+			s.serveAuthError(w, r, http.StatusTooManyRequests, "too many requests")
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// serveAuthError serves an error from Auth, using the v2 error format for
+// v2 endpoints.
+func (s *Server) serveAuthError(w http.ResponseWriter, r *http.Request, status int,
+	msg string) {
+	if !strings.HasPrefix(r.URL.Path, v2Prefix+"/") {
+		s.serveError(w, status, msg)
+		return
+	}
+	code := ErrorCodeForbidden
+	switch status {
+	case http.StatusUnauthorized:
+		code = ErrorCodeUnauthorized
+	case http.StatusTooManyRequests:
+		code = ErrorCodeRateLimited
+	}
+	s.serveV2Error(w, status, code, msg)
+}
+
+func (s *Server) authenticate(r *http.Request) (*Principal, bool) {
+	if principal, ok := s.clientCertPrincipal(r); ok {
+		return principal, true
+	}
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		if s.Users == nil {
+			return nil, false
+		}
+		return s.Users.AuthenticateToken(strings.TrimPrefix(header, "Bearer "))
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return nil, false
+	}
+	if s.Users != nil {
+		return s.Users.AuthenticatePassword(user, pass)
+	}
+	webPassword := s.getConfig().WebPassword
+	if webPassword != "" &&
+		subtle.ConstantTimeCompare([]byte(pass), []byte(webPassword)) == 1 {
+		return &Principal{User: "web", Role: RoleAdmin}, true
+	}
+	return nil, false
+}
+
+// requestPrincipal gets the principal authenticated by Auth().
+func requestPrincipal(r *http.Request) *Principal {
+	if p, ok := r.Context().Value(principalKey{}).(*Principal); ok {
+		return p
+	}
+	return &Principal{Role: RoleRead}
+}
+
+func minRole(r1, r2 Role) Role {
+	if r1.level() < r2.level() {
+		return r1
+	}
+	return r2
+}
+
+// intersectDevices combines two allow lists, where an empty list allows
+// everything.
+//
+// If the lists have no devices in common, ok is false.
+func intersectDevices(d1, d2 []string) (res []string, ok bool) {
+	if len(d1) == 0 {
+		return d2, true
+	} else if len(d2) == 0 {
+		return d1, true
+	}
+	for _, id := range d1 {
+		if deviceAllowed(d2, id) {
+			res = append(res, id)
+		}
+	}
+	return res, len(res) > 0
+}
+
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const maxAuthBodySize = 1 << 14
+
+// HandleTokens lists tokens (GET) or creates a new token (POST).
+//
+// Non-admins can only see and create their own tokens, and a new token can
+// never have more privileges than the principal creating it.
+func (s *Server) HandleTokens(w http.ResponseWriter, r *http.Request) {
+	if s.Users == nil {
+		s.serveError(w, http.StatusBadRequest, "the server was not started with a user store")
+		return
+	}
+	principal := requestPrincipal(r)
+	switch r.Method {
+	case http.MethodGet:
+		user := principal.User
+		if principal.Role == RoleAdmin && r.URL.Query().Get("all") == "1" {
+			user = ""
+		}
+		tokens := s.Users.ListTokens(user)
+		res := []interface{}{}
+		for _, t := range tokens {
+			res = append(res, encodeToken(t))
+		}
+		s.serveObject(w, http.StatusOK, res)
+	case http.MethodPost:
+		var req struct {
+			Name    string   `json:"name"`
+			Role    Role     `json:"role"`
+			Devices []string `json:"devices"`
+		}
+		if !s.decodeAuthBody(w, r, &req) {
+			return
+		}
+		if !req.Role.Valid() {
+			s.serveError(w, http.StatusBadRequest, "role must be one of read, control, or admin")
+			return
+		}
+		if !principal.Role.Allows(req.Role) {
+			s.serveError(w, http.StatusForbidden, "cannot create a token with more privileges "+
+				"than your own")
+			return
+		}
+		if principal.NoDevices {
+			s.serveError(w, http.StatusForbidden, "no devices are allowed")
+			return
+		}
+		devices := req.Devices
+		if len(devices) == 0 {
+			devices = principal.Devices
+		}
+		for _, id := range devices {
+			if !principal.CanAccess(id) {
+				s.serveError(w, http.StatusForbidden, "access to device "+id+" is not allowed")
+				return
+			}
+		}
+		token, secret, err := s.Users.CreateToken(principal.User, req.Name, req.Role, devices)
+		if err != nil {
+			s.serveError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		res := encodeToken(*token)
+		res["token"] = secret
+		s.serveObject(w, http.StatusOK, res)
+	default:
+		s.serveError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// HandleToken revokes a token (DELETE /api/tokens/{id}).
+func (s *Server) HandleToken(w http.ResponseWriter, r *http.Request) {
+	if s.Users == nil {
+		s.serveError(w, http.StatusBadRequest, "the server was not started with a user store")
+		return
+	}
+	if r.Method != http.MethodDelete {
+		s.serveError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	principal := requestPrincipal(r)
+	id := strings.TrimPrefix(r.URL.Path, "/api/tokens/")
+	token, ok := s.Users.GetToken(id)
+	if !ok || (token.User != principal.User && principal.Role != RoleAdmin) {
+		s.serveError(w, http.StatusNotFound, "no such token")
+		return
+	}
+	if err := s.Users.RevokeToken(id); err != nil {
+		s.serveError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.serveObject(w, http.StatusOK, map[string]interface{}{})
+}
+
+// HandleUsers lists users (GET) or creates or updates a user (POST).
+func (s *Server) HandleUsers(w http.ResponseWriter, r *http.Request) {
+	if s.Users == nil {
+		s.serveError(w, http.StatusBadRequest, "the server was not started with a user store")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		res := []interface{}{}
+		for _, u := range s.Users.ListUsers() {
+			res = append(res, map[string]interface{}{
+				"name":    u.Name,
+				"role":    u.Role,
+				"devices": nonNilStrings(u.Devices),
+			})
+		}
+		s.serveObject(w, http.StatusOK, res)
+	case http.MethodPost:
+		var req struct {
+			Name     string   `json:"name"`
+			Password string   `json:"password"`
+			Role     Role     `json:"role"`
+			Devices  []string `json:"devices"`
+		}
+		if !s.decodeAuthBody(w, r, &req) {
+			return
+		}
+		if err := s.Users.PutUser(req.Name, req.Password, req.Role, req.Devices); err != nil {
+			s.serveError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.serveObject(w, http.StatusOK, map[string]interface{}{})
+	default:
+		s.serveError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// HandleUser deletes a user (DELETE /api/users/{name}).
+func (s *Server) HandleUser(w http.ResponseWriter, r *http.Request) {
+	if s.Users == nil {
+		s.serveError(w, http.StatusBadRequest, "the server was not started with a user store")
+		return
+	}
+	if r.Method != http.MethodDelete {
+		s.serveError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/api/users/")
+	if name == requestPrincipal(r).User {
+		s.serveError(w, http.StatusBadRequest, "cannot delete yourself")
+		return
+	}
+	if err := s.Users.DeleteUser(name); err != nil {
+		s.serveError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	s.serveObject(w, http.StatusOK, map[string]interface{}{})
+}
+
+func (s *Server) decodeAuthBody(w http.ResponseWriter, r *http.Request, obj interface{}) bool {
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxAuthBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(obj); err != nil {
+		s.serveError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func encodeToken(t APIToken) map[string]interface{} {
+	return map[string]interface{}{
+		"id":      t.ID,
+		"name":    t.Name,
+		"user":    t.User,
+		"role":    t.Role,
+		"devices": nonNilStrings(t.Devices),
+		"created": t.Created,
+	}
+}
+
+func nonNilStrings(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestTokenWithoutCommonDevices(t *testing.T) {
+	users, err := LoadUserStore(filepath.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.PutUser("alice", "password", RoleControl, []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	_, secret, err := users.CreateToken("alice", "token", RoleRead, []string{"1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.PutUser("alice", "password", RoleControl, []string{"2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	principal, ok := users.AuthenticateToken(secret)
+	if !ok {
+		t.Fatal("token was rejected")
+	}
+	for _, id := range []string{"", "1", "2"} {
+		if principal.CanAccess(id) {
+			t.Errorf("device %q should not be accessible", id)
+		}
+	}
+	deviceless := &Event{Type: "status", Data: map[string]interface{}{}}
+	if eventVisible(principal, deviceless) {
+		t.Error("event without a device should not be visible")
+	}
+}
+
+func TestIntersectDevices(t *testing.T) {
+	cases := []struct {
+		d1, d2 []string
+		res    []string
+		ok     bool
+	}{
+		{nil, nil, nil, true},
+		{[]string{"1"}, nil, []string{"1"}, true},
+		{nil, []string{"2"}, []string{"2"}, true},
+		{[]string{"1", "2"}, []string{"2", "3"}, []string{"2"}, true},
+		{[]string{"1"}, []string{"2"}, nil, false},
+	}
+	for _, c := range cases {
+		res, ok := intersectDevices(c.d1, c.d2)
+		if ok != c.ok || len(res) != len(c.res) {
+			t.Errorf("intersectDevices(%v, %v) = %v, %v", c.d1, c.d2, res, ok)
+			continue
+		}
+		for i, id := range res {
+			if id != c.res[i] {
+				t.Errorf("intersectDevices(%v, %v) = %v, %v", c.d1, c.d2, res, ok)
+				break
+			}
+		}
+	}
+}
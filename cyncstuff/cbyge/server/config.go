@@ -0,0 +1,655 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/unixpickle/cbyge"
+)
+
+const configEnvPrefix = "CBYGE_"
+
+// reloadableSettings are the settings which take effect on SIGHUP. Others
+// require a restart.
+var reloadableSettings = map[string]bool{
+	"web-password":      true,
+	"web-password-file": true,
+	"tls-client-role":   true,
+	"rate-limit":        true,
+	"rate-burst":        true,
+	"job-expiration":    true,
+}
+
+// Config stores the settings for the server.
+//
+// Settings come from flags, environment variables named like CBYGE_WEB_PASSWORD,
+// and a TOML or YAML config file whose keys are flag names, in that order of
+// precedence.
+type Config struct {
+	ConfigFile string
+
+	Addr   string
+	Assets string
+
+	Email        string
+	Password     string
+	PasswordFile string
+	SessionInfo  string
+	SessInfoFile string
+
+	WebPassword     string
+	WebPasswordFile string
+	NoAuth          bool
+	UsersPath       string
+	MetadataPath    string
+
+	TLS            TLSOptions
+	ClientCertRole string
+	RedirectAddr   string
+
+	AuditPath     string
+	AuditMaxSize  int64
+	AuditMaxFiles int
+
+	RateLimit     float64
+	RateBurst     int
+	NoCoalesce    bool
+	JobExpiration time.Duration
+
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+
+	StatusTTL time.Duration
+
+	// values maps every flag name to its final value, for detecting
+	// changes when reloading.
+	values map[string]string
+}
+
+func (c *Config) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.ConfigFile, "config", "",
+		"TOML or YAML config file (also "+configEnvPrefix+"CONFIG)")
+	fs.StringVar(&c.Assets, "assets", "",
+		"assets directory to serve instead of the embedded assets (for development)")
+	fs.StringVar(&c.Addr, "addr", ":8080", "address to listen on")
+	fs.StringVar(&c.Email, "email", "", "C by GE account email")
+	fs.StringVar(&c.Password, "password", "", "C by GE account password")
+	fs.StringVar(&c.PasswordFile, "password-file", "", "file containing the C by GE password")
+	fs.StringVar(&c.SessionInfo, "sessinfo", "", "Cync session info from 2FA login")
+	fs.StringVar(&c.SessInfoFile, "sessinfo-file", "", "file containing the session info")
+	fs.StringVar(&c.WebPassword, "web-password", "",
+		"password for basic auth (also the initial 'admin' password when using -users)")
+	fs.StringVar(&c.WebPasswordFile, "web-password-file", "", "file containing the web password")
+	fs.StringVar(&c.UsersPath, "users", "", "JSON file for storing users and API tokens")
+	fs.StringVar(&c.MetadataPath, "metadata", "",
+		"JSON file for storing device aliases, tags, and rooms")
+	fs.BoolVar(&c.NoAuth, "no-auth", false, "do not require any password")
+	fs.StringVar(&c.TLS.CertFile, "tls-cert", "", "TLS certificate file for HTTPS")
+	fs.StringVar(&c.TLS.KeyFile, "tls-key", "", "TLS private key file for HTTPS")
+	fs.BoolVar(&c.TLS.SelfSigned, "tls-self-signed", false,
+		"generate and save a self-signed certificate if -tls-cert and -tls-key do not exist")
+	fs.StringVar(&c.TLS.Hosts, "tls-hosts", "",
+		"comma-separated extra host names for the self-signed certificate")
+	fs.StringVar(&c.TLS.ClientCAFile, "tls-client-ca", "",
+		"CA certificates for authenticating clients by TLS certificate")
+	fs.StringVar(&c.ClientCertRole, "tls-client-role", string(RoleControl),
+		"role for client certificates that do not match a user")
+	fs.StringVar(&c.RedirectAddr, "redirect-addr", "",
+		"address to listen on for plain HTTP requests to redirect to HTTPS")
+	fs.StringVar(&c.AuditPath, "audit-log", "", "file for logging every control action")
+	fs.Int64Var(&c.AuditMaxSize, "audit-max-size", DefaultAuditMaxSize,
+		"size in bytes at which to rotate the audit log")
+	fs.IntVar(&c.AuditMaxFiles, "audit-max-files", DefaultAuditMaxFiles,
+		"number of rotated audit log files to keep")
+	fs.Float64Var(&c.RateLimit, "rate-limit", DefaultRateLimit,
+		"control requests per second allowed for each client (0 for no limit)")
+	fs.IntVar(&c.RateBurst, "rate-burst", DefaultRateBurst,
+		"control requests each client may send at once")
+	fs.BoolVar(&c.NoCoalesce, "no-coalesce", false,
+		"do not merge commands for a device which arrive while one is in flight")
+	fs.DurationVar(&c.JobExpiration, "job-expiration", DefaultJobExpiration,
+		"how long to remember finished async requests")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", DefaultReadTimeout,
+		"maximum time to read a request")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", DefaultWriteTimeout,
+		"maximum time to handle a request and write the response, except for event streams")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", DefaultIdleTimeout,
+		"maximum time to keep idle connections open")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", DefaultShutdownTimeout,
+		"maximum time to finish in-flight requests when shutting down")
+	fs.DurationVar(&c.StatusTTL, "status-ttl", cbyge.DefaultStatusCacheTTL,
+		"how long cached device statuses are considered fresh")
+}
+
+// LoadConfig parses the command-line arguments, the environment, and the
+// config file, and validates the result.
+func LoadConfig(args []string, handling flag.ErrorHandling) (*Config, error) {
+	c := &Config{}
+	fs := flag.NewFlagSet(os.Args[0], handling)
+	if handling != flag.ExitOnError {
+		fs.SetOutput(ioutil.Discard)
+	}
+	c.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, errors.New("unexpected argument: " + fs.Arg(0))
+	}
+	fromArgs := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		fromArgs[f.Name] = true
+	})
+
+	var problems []string
+	if c.ConfigFile == "" {
+		c.ConfigFile = os.Getenv(configEnvPrefix + "CONFIG")
+	}
+	if c.ConfigFile != "" {
+		entries, err := readConfigFile(c.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if err := setConfigValue(fs, fromArgs, entry.Key, entry.Value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s:%d: %s", c.ConfigFile, entry.Line, err))
+			}
+		}
+	}
+	for _, env := range os.Environ() {
+		parts := strings.SplitN(env, "=", 2)
+		if !strings.HasPrefix(parts[0], configEnvPrefix) || parts[0] == configEnvPrefix+"CONFIG" {
+			continue
+		}
+		name := strings.ToLower(strings.TrimPrefix(parts[0], configEnvPrefix))
+		name = strings.Replace(name, "_", "-", -1)
+		if fs.Lookup(name) == nil {
+			// Other tools share the prefix, such as CBYGE_SESSION for the
+			// cbyge command, so unknown variables are not errors.
+			continue
+		}
+		if err := setConfigValue(fs, fromArgs, name, parts[1]); err != nil {
+			problems = append(problems, fmt.Sprintf("environment variable %s: %s", parts[0], err))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, &ConfigError{Problems: problems}
+	}
+
+	if err := c.readSecrets(); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	c.values = map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		c.values[f.Name] = f.Value.String()
+	})
+	return c, nil
+}
+
+// Validate checks for missing or inconsistent settings.
+func (c *Config) Validate() error {
+	var problems []string
+	if c.SessionInfo == "" && (c.Email == "" || c.Password == "") {
+		problems = append(problems, "must provide email and password, or sessinfo")
+	}
+	if c.SessionInfo != "" {
+		var info cbyge.SessionInfo
+		if err := json.Unmarshal([]byte(c.SessionInfo), &info); err != nil {
+			problems = append(problems, "sessinfo is not valid JSON: "+err.Error())
+		}
+	}
+	if c.UsersPath == "" && c.WebPassword == "" && !c.NoAuth && c.TLS.ClientCAFile == "" {
+		problems = append(problems, "must provide web-password, users, tls-client-ca, or no-auth")
+	}
+	if !Role(c.ClientCertRole).Valid() {
+		problems = append(problems, fmt.Sprintf("tls-client-role must be read, control, "+
+			"or admin (got %q)", c.ClientCertRole))
+	}
+	if !c.TLS.Enabled() && (c.RedirectAddr != "" || c.TLS.ClientCAFile != "") {
+		problems = append(problems, "redirect-addr and tls-client-ca require tls-cert and "+
+			"tls-key, or tls-self-signed")
+	}
+	if c.RateLimit < 0 {
+		problems = append(problems, "rate-limit must not be negative")
+	} else if c.RateLimit > 0 && c.RateBurst < 1 {
+		problems = append(problems, "rate-burst must be at least 1")
+	}
+	if c.AuditMaxSize < 0 || c.AuditMaxFiles < 0 {
+		problems = append(problems, "audit-max-size and audit-max-files must not be negative")
+	}
+	durations := []struct {
+		Name  string
+		Value time.Duration
+	}{
+		{"job-expiration", c.JobExpiration},
+		{"read-timeout", c.ReadTimeout},
+		{"write-timeout", c.WriteTimeout},
+		{"idle-timeout", c.IdleTimeout},
+		{"shutdown-timeout", c.ShutdownTimeout},
+		{"status-ttl", c.StatusTTL},
+	}
+	for _, d := range durations {
+		if d.Value < 0 {
+			problems = append(problems, d.Name+" must not be negative")
+		}
+	}
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// changedSettings lists the settings which differ between two configs.
+func (c *Config) changedSettings(other *Config) []string {
+	var res []string
+	for name, value := range c.values {
+		if other.values[name] != value {
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (c *Config) readSecrets() error {
+	secrets := []struct {
+		Name  string
+		Path  string
+		Value *string
+	}{
+		{"password", c.PasswordFile, &c.Password},
+		{"sessinfo", c.SessInfoFile, &c.SessionInfo},
+		{"web-password", c.WebPasswordFile, &c.WebPassword},
+	}
+	for _, secret := range secrets {
+		if secret.Path == "" {
+			continue
+		}
+		if *secret.Value != "" {
+			return &ConfigError{Problems: []string{
+				"cannot set both " + secret.Name + " and " + secret.Name + "-file",
+			}}
+		}
+		data, err := ioutil.ReadFile(secret.Path)
+		if err != nil {
+			return &ConfigError{Problems: []string{
+				"read " + secret.Name + "-file: " + err.Error(),
+			}}
+		}
+		*secret.Value = strings.TrimRight(string(data), "\r\n")
+	}
+	return nil
+}
+
+// A ConfigError lists every problem found in the settings.
+type ConfigError struct {
+	Problems []string
+}
+
+func (c *ConfigError) Error() string {
+	if len(c.Problems) == 1 {
+		return "invalid configuration: " + c.Problems[0]
+	}
+	return "invalid configuration:\n  " + strings.Join(c.Problems, "\n  ")
+}
+
+func setConfigValue(fs *flag.FlagSet, fromArgs map[string]bool, name, value string) error {
+	if name == "config" {
+		return errors.New("the config file cannot be set from a config file")
+	}
+	f := fs.Lookup(name)
+	if f == nil {
+		msg := fmt.Sprintf("unknown setting %q", name)
+		if suggestion := closestFlag(fs, name); suggestion != "" {
+			msg += fmt.Sprintf(" (did you mean %q?)", suggestion)
+		}
+		return errors.New(msg)
+	}
+	if fromArgs[name] {
+		return nil
+	}
+	if err := fs.Set(name, value); err != nil {
+		return fmt.Errorf("invalid value %q for %q (%s)", value, name, expectedFlagValue(f))
+	}
+	return nil
+}
+
+func expectedFlagValue(f *flag.Flag) string {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return "unexpected format"
+	}
+	switch getter.Get().(type) {
+	case bool:
+		return "expected true or false"
+	case int, int64:
+		return "expected an integer"
+	case float64:
+		return "expected a number"
+	case time.Duration:
+		return "expected a duration such as 30s or 5m"
+	}
+	return "unexpected format"
+}
+
+func closestFlag(fs *flag.FlagSet, name string) string {
+	best := ""
+	bestDist := 3
+	fs.VisitAll(func(f *flag.Flag) {
+		if d := editDistance(name, f.Name); d < bestDist {
+			best, bestDist = f.Name, d
+		}
+	})
+	return best
+}
+
+func editDistance(a, b string) int {
+	row := make([]int, len(b)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		prev := row[0]
+		row[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			next := minInt(minInt(row[j]+1, row[j-1]+1), prev+cost)
+			prev, row[j] = row[j], next
+		}
+	}
+	return row[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+type configEntry struct {
+	Line  int
+	Key   string
+	Value string
+}
+
+func readConfigFile(path string) ([]configEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("read config: " + err.Error())
+	}
+	var entries []configEntry
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		entries, err = parseTOMLConfig(string(data))
+	case ".yaml", ".yml":
+		entries, err = parseYAMLConfig(string(data))
+	default:
+		return nil, errors.New("config file must end in .toml, .yaml, or .yml")
+	}
+	if err != nil {
+		return nil, errors.New(path + ":" + err.Error())
+	}
+	return entries, nil
+}
+
+// parseTOMLConfig parses the subset of TOML used for config files: tables
+// of keys with string, number, or boolean values.
+//
+// Keys in a [table] are prefixed with the table name, so that "cert" in
+// [tls] sets "tls-cert".
+func parseTOMLConfig(data string) ([]configEntry, error) {
+	var res []configEntry
+	var table string
+	for i, line := range strings.Split(data, "\n") {
+		lineNum := i + 1
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			end := strings.Index(line, "]")
+			if strings.HasPrefix(line, "[[") || end == -1 ||
+				!isConfigComment(line[end+1:]) {
+				return nil, fmt.Errorf("%d: invalid table header", lineNum)
+			}
+			table = strings.TrimSpace(line[1:end])
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq == -1 {
+			return nil, fmt.Errorf("%d: expected 'key = value'", lineNum)
+		}
+		key, err := parseConfigKey(strings.TrimSpace(line[:eq]))
+		if err != nil {
+			return nil, fmt.Errorf("%d: %s", lineNum, err)
+		}
+		value, err := parseTOMLValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%d: %s", lineNum, err)
+		}
+		if table != "" {
+			key = table + "." + key
+		}
+		res = append(res, configEntry{Line: lineNum, Key: configKeyName(key), Value: value})
+	}
+	return res, nil
+}
+
+func parseTOMLValue(s string) (string, error) {
+	if strings.HasPrefix(s, `"`) || strings.HasPrefix(s, "'") {
+		return parseQuotedConfigValue(s)
+	}
+	if strings.HasPrefix(s, "[") || strings.HasPrefix(s, "{") {
+		return "", errors.New("arrays and inline tables are not supported")
+	}
+	if idx := strings.Index(s, "#"); idx != -1 {
+		s = strings.TrimSpace(s[:idx])
+	}
+	if s == "true" || s == "false" {
+		return s, nil
+	}
+	number := strings.Replace(s, "_", "", -1)
+	if _, err := strconv.ParseFloat(number, 64); err == nil && number != "" {
+		return number, nil
+	}
+	return "", fmt.Errorf("invalid value %q (strings must be quoted)", s)
+}
+
+// parseYAMLConfig parses the subset of YAML used for config files: nested
+// mappings of scalar values.
+//
+// Nested keys are joined with dashes, so that "cert" under "tls:" sets
+// "tls-cert".
+func parseYAMLConfig(data string) ([]configEntry, error) {
+	type level struct {
+		indent int
+		key    string
+	}
+	var res []configEntry
+	var stack []level
+	for i, line := range strings.Split(data, "\n") {
+		lineNum := i + 1
+		line = strings.TrimRight(line, " \r")
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("%d: tabs cannot be used for indentation", lineNum)
+		}
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			return nil, fmt.Errorf("%d: lists are not supported", lineNum)
+		}
+		indent := len(line) - len(trimmed)
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+
+		colon := strings.Index(trimmed, ":")
+		if strings.HasPrefix(trimmed, `"`) || strings.HasPrefix(trimmed, "'") {
+			end := strings.Index(trimmed[1:], trimmed[:1])
+			if end == -1 {
+				return nil, fmt.Errorf("%d: unterminated key", lineNum)
+			}
+			colon = strings.Index(trimmed[end+2:], ":")
+			if colon != -1 {
+				colon += end + 2
+			}
+		}
+		if colon == -1 {
+			return nil, fmt.Errorf("%d: expected 'key: value'", lineNum)
+		}
+		key, err := parseConfigKey(strings.TrimSpace(trimmed[:colon]))
+		if err != nil {
+			return nil, fmt.Errorf("%d: %s", lineNum, err)
+		}
+		rest := strings.TrimSpace(trimmed[colon+1:])
+		if isConfigComment(rest) {
+			stack = append(stack, level{indent: indent, key: key})
+			continue
+		}
+
+		var value string
+		if strings.HasPrefix(rest, `"`) || strings.HasPrefix(rest, "'") {
+			value, err = parseQuotedConfigValue(rest)
+			if err != nil {
+				return nil, fmt.Errorf("%d: %s", lineNum, err)
+			}
+		} else if strings.HasPrefix(rest, "[") || strings.HasPrefix(rest, "{") ||
+			strings.HasPrefix(rest, "|") || strings.HasPrefix(rest, ">") {
+			return nil, fmt.Errorf("%d: only single-line scalar values are supported", lineNum)
+		} else {
+			if idx := strings.Index(rest, " #"); idx != -1 {
+				rest = strings.TrimSpace(rest[:idx])
+			}
+			value = rest
+		}
+
+		for i := len(stack) - 1; i >= 0; i-- {
+			key = stack[i].key + "." + key
+		}
+		res = append(res, configEntry{Line: lineNum, Key: configKeyName(key), Value: value})
+	}
+	return res, nil
+}
+
+// parseQuotedConfigValue parses a double- or single-quoted string, followed
+// by an optional comment.
+func parseQuotedConfigValue(s string) (string, error) {
+	quote := s[0]
+	end := -1
+	for i := 1; i < len(s); i++ {
+		if quote == '"' && s[i] == '\\' {
+			i++
+		} else if s[i] == quote {
+			if quote == '\'' && i+1 < len(s) && s[i+1] == '\'' {
+				// YAML escapes single quotes by doubling them.
+				i++
+				continue
+			}
+			end = i
+			break
+		}
+	}
+	if end == -1 {
+		return "", errors.New("unterminated string")
+	}
+	if !isConfigComment(s[end+1:]) {
+		return "", errors.New("unexpected text after string")
+	}
+	if quote == '\'' {
+		return strings.Replace(s[1:end], "''", "'", -1), nil
+	}
+	value, err := strconv.Unquote(s[:end+1])
+	if err != nil {
+		return "", errors.New("invalid escape sequence in string")
+	}
+	return value, nil
+}
+
+func parseConfigKey(s string) (string, error) {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		s = s[1 : len(s)-1]
+	}
+	if s == "" {
+		return "", errors.New("empty key")
+	}
+	return s, nil
+}
+
+func isConfigComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || strings.HasPrefix(s, "#")
+}
+
+// configKeyName converts a key from a config file to a flag name.
+func configKeyName(key string) string {
+	key = strings.ToLower(key)
+	key = strings.Replace(key, "_", "-", -1)
+	return strings.Replace(key, ".", "-", -1)
+}
+
+func (s *Server) getConfig() *Config {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.config
+}
+
+// Reload loads the settings again, applying the reloadable ones.
+//
+// It returns the names of changed settings which require a restart.
+func (s *Server) Reload() ([]string, error) {
+	cfg, err := LoadConfig(s.configArgs, flag.ContinueOnError)
+	if err != nil {
+		return nil, err
+	}
+
+	s.configLock.Lock()
+	old := s.config
+	next := *old
+	next.WebPassword = cfg.WebPassword
+	next.WebPasswordFile = cfg.WebPasswordFile
+	next.ClientCertRole = cfg.ClientCertRole
+	next.RateLimit = cfg.RateLimit
+	next.RateBurst = cfg.RateBurst
+	next.JobExpiration = cfg.JobExpiration
+	next.values = map[string]string{}
+	for name, value := range old.values {
+		if reloadableSettings[name] {
+			value = cfg.values[name]
+		}
+		next.values[name] = value
+	}
+	s.config = &next
+	s.configLock.Unlock()
+
+	s.limiter.SetLimit(cfg.RateLimit, cfg.RateBurst)
+	s.jobs.SetExpiration(cfg.JobExpiration)
+
+	var needRestart []string
+	for _, name := range cfg.changedSettings(old) {
+		if !reloadableSettings[name] {
+			needRestart = append(needRestart, name)
+		}
+	}
+	return needRestart, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOMLConfig(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Data     string
+		Expected []configEntry
+		Error    string
+	}{
+		{
+			Name: "Scalars",
+			Data: "addr = \":9000\"\nno-auth = true\nrate-limit = 2.5\naudit_max_size = 1_000\n",
+			Expected: []configEntry{
+				{1, "addr", ":9000"},
+				{2, "no-auth", "true"},
+				{3, "rate-limit", "2.5"},
+				{4, "audit-max-size", "1000"},
+			},
+		},
+		{
+			Name: "Quoting",
+			Data: `a = "x \"y\" # z"` + "\n" + `b = 'c:\path'` + "\n" + `"c" = "tab\t"`,
+			Expected: []configEntry{
+				{1, "a", `x "y" # z`},
+				{2, "b", `c:\path`},
+				{3, "c", "tab\t"},
+			},
+		},
+		{
+			Name: "Comments",
+			Data: "# header\n\naddr = \":1\" # trailing\nrate-burst = 3 # trailing\n  # indented\n",
+			Expected: []configEntry{
+				{3, "addr", ":1"},
+				{4, "rate-burst", "3"},
+			},
+		},
+		{
+			Name: "Tables",
+			Data: "email = \"a@b\"\n[tls]\ncert = \"c.pem\"\n[tls.client] # comment\nca = \"ca.pem\"\n",
+			Expected: []configEntry{
+				{1, "email", "a@b"},
+				{3, "tls-cert", "c.pem"},
+				{5, "tls-client-ca", "ca.pem"},
+			},
+		},
+		{Name: "MissingEquals", Data: "addr = \":1\"\n\njunk\n", Error: "3: expected 'key = value'"},
+		{Name: "Unquoted", Data: "\naddr = :1\n", Error: "2: invalid value \":1\" (strings must be quoted)"},
+		{Name: "Unterminated", Data: "a = 1\nb = \"x\n", Error: "2: unterminated string"},
+		{Name: "TrailingText", Data: "a = \"x\" y\n", Error: "1: unexpected text after string"},
+		{Name: "Array", Data: "a = 1\nb = 2\nc = [1]\n", Error: "3: arrays and inline tables are not supported"},
+		{Name: "ArrayTable", Data: "[[x]]\n", Error: "1: invalid table header"},
+		{Name: "EmptyKey", Data: "a = 1\n= 2\n", Error: "2: empty key"},
+		{Name: "BadEscape", Data: "a = \"\\q\"\n", Error: "1: invalid escape sequence in string"},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			checkConfigParse(t, parseTOMLConfig, test.Data, test.Expected, test.Error)
+		})
+	}
+}
+
+func TestParseYAMLConfig(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Data     string
+		Expected []configEntry
+		Error    string
+	}{
+		{
+			Name: "Scalars",
+			Data: "---\naddr: :9000\nno_auth: true\nrate-limit: 2.5\n",
+			Expected: []configEntry{
+				{2, "addr", ":9000"},
+				{3, "no-auth", "true"},
+				{4, "rate-limit", "2.5"},
+			},
+		},
+		{
+			Name: "Quoting",
+			Data: `a: "x \"y\" # z"` + "\n" + `b: 'it''s'` + "\n" + `"c:d": 'e'`,
+			Expected: []configEntry{
+				{1, "a", `x "y" # z`},
+				{2, "b", "it's"},
+				{3, "c:d", "e"},
+			},
+		},
+		{
+			Name: "Comments",
+			Data: "# header\naddr: x # trailing\nemail: a#b\n\n   # indented\n",
+			Expected: []configEntry{
+				{2, "addr", "x"},
+				{3, "email", "a#b"},
+			},
+		},
+		{
+			Name: "Nesting",
+			Data: "tls: # comment\n  cert: c.pem\n  client:\n    ca: ca.pem\n  key: k.pem\naddr: :1\n",
+			Expected: []configEntry{
+				{2, "tls-cert", "c.pem"},
+				{4, "tls-client-ca", "ca.pem"},
+				{5, "tls-key", "k.pem"},
+				{6, "addr", ":1"},
+			},
+		},
+		{Name: "MissingColon", Data: "a: 1\njunk\n", Error: "2: expected 'key: value'"},
+		{Name: "List", Data: "a:\n  - 1\n", Error: "2: lists are not supported"},
+		{Name: "Tab", Data: "a:\n\tb: 1\n", Error: "2: tabs cannot be used for indentation"},
+		{Name: "Block", Data: "a: 1\n\nb: |\n", Error: "3: only single-line scalar values are supported"},
+		{Name: "Flow", Data: "a: {b: 1}\n", Error: "1: only single-line scalar values are supported"},
+		{Name: "UnterminatedKey", Data: "\"a: 1\n", Error: "1: unterminated key"},
+		{Name: "UnterminatedValue", Data: "a: 'x\n", Error: "1: unterminated string"},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			checkConfigParse(t, parseYAMLConfig, test.Data, test.Expected, test.Error)
+		})
+	}
+}
+
+func checkConfigParse(t *testing.T, parse func(string) ([]configEntry, error), data string,
+	expected []configEntry, expectedErr string) {
+	actual, err := parse(data)
+	if expectedErr != "" {
+		if err == nil || err.Error() != expectedErr {
+			t.Fatalf("expected error %q but got %v", expectedErr, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected %v but got %v", expected, actual)
+	}
+}
+
+func TestLoadConfigEnvironment(t *testing.T) {
+	setEnv(t, "CBYGE_SESSION", "/tmp/session.json")
+	setEnv(t, "CBYGE_RATE_BURST", "7")
+	cfg, err := LoadConfig([]string{"-email", "a", "-password", "b", "-no-auth"},
+		flag.ContinueOnError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RateBurst != 7 {
+		t.Errorf("expected rate burst 7 but got %d", cfg.RateBurst)
+	}
+
+	setEnv(t, "CBYGE_RATE_BURST", "many")
+	_, err = LoadConfig([]string{"-email", "a", "-password", "b", "-no-auth"},
+		flag.ContinueOnError)
+	if err == nil || !strings.Contains(err.Error(), "CBYGE_RATE_BURST") {
+		t.Errorf("expected an error for CBYGE_RATE_BURST but got %v", err)
+	}
+}
+
+func setEnv(t *testing.T, name, value string) {
+	old, hadOld := os.LookupEnv(name)
+	os.Setenv(name, value)
+	t.Cleanup(func() {
+		if hadOld {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/unixpickle/cbyge"
+)
+
+const (
+	EventTypeStatus   = "status"
+	EventTypeOnline   = "online"
+	EventTypeOffline  = "offline"
+	EventTypeCommand  = "command"
+	EventTypeJob      = "job"
+	EventTypeMetadata = "metadata"
+)
+
+const (
+	eventBufferSize   = 64
+	eventKeepAlive    = time.Second * 15
+	eventWatchTimeout = time.Minute
+)
+
+// An Event is a notification streamed to clients of /api/events.
+type Event struct {
+	ID   uint64      `json:"id"`
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// An EventHub broadcasts events to every subscribed client.
+type EventHub struct {
+	lock        sync.Mutex
+	nextID      uint64
+	subscribers map[chan *Event]struct{}
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{subscribers: map[chan *Event]struct{}{}}
+}
+
+// Subscribe creates a channel of future events.
+//
+// Call the returned function to unsubscribe. Events are dropped for
+// subscribers which fall too far behind.
+func (e *EventHub) Subscribe() (<-chan *Event, func()) {
+	ch := make(chan *Event, eventBufferSize)
+	e.lock.Lock()
+	e.subscribers[ch] = struct{}{}
+	e.lock.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			e.lock.Lock()
+			delete(e.subscribers, ch)
+			e.lock.Unlock()
+		})
+	}
+}
+
+// Publish sends an event to every subscriber.
+func (e *EventHub) Publish(eventType string, data interface{}) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.nextID++
+	event := &Event{ID: e.nextID, Type: eventType, Time: time.Now(), Data: data}
+	for ch := range e.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// watchStatuses publishes events for every status change in the cache,
+// including devices going online or offline.
+func (s *Server) watchStatuses(cache *cbyge.StatusCache) {
+	online := map[string]bool{}
+	changes, version := cache.Changes(0)
+	for _, change := range changes {
+		online[change.Device.DeviceID()] = change.Status.IsOnline
+	}
+	for {
+		// WaitChanges returns immediately once the cache is closed.
+		select {
+		case <-cache.Done():
+			return
+		default:
+		}
+		changes, version = cache.WaitChanges(version, eventWatchTimeout)
+		for _, change := range changes {
+			id := change.Device.DeviceID()
+			obj := map[string]interface{}{
+				"id":     id,
+				"name":   change.Device.Name(),
+				"status": encodeStatus(change.Status),
+			}
+			if change.Err != nil {
+				obj["error"] = change.Err.Error()
+			}
+			s.events.Publish(EventTypeStatus, obj)
+
+			wasOnline, known := online[id]
+			if !known || wasOnline != change.Status.IsOnline {
+				online[id] = change.Status.IsOnline
+				eventType := EventTypeOffline
+				if change.Status.IsOnline {
+					eventType = EventTypeOnline
+				}
+				s.events.Publish(eventType, map[string]interface{}{
+					"id":   id,
+					"name": change.Device.Name(),
+				})
+			}
+		}
+	}
+}
+
+// publishCommand publishes the outcome of a control action on a device.
+func (s *Server) publishCommand(endpoint string, async bool, id string, err error) {
+	obj := map[string]interface{}{
+		"endpoint": endpoint,
+		"id":       id,
+		"async":    async,
+		"error":    nil,
+	}
+	if err != nil {
+		obj["error"] = err.Error()
+	}
+	s.events.Publish(EventTypeCommand, obj)
+}
+
+// eventVisible checks if a principal may receive an event.
+func eventVisible(p *Principal, e *Event) bool {
+	if job, ok := e.Data.(Job); ok {
+		return jobVisible(p, &job)
+	}
+	return p.CanAccess(eventDeviceID(e))
+}
+
+// eventDeviceID gets the device an event refers to.
+func eventDeviceID(e *Event) string {
+	if obj, ok := e.Data.(map[string]interface{}); ok {
+		if id, ok := obj["id"].(string); ok {
+			return id
+		}
+	}
+	return ""
+}
+
+var eventUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// HandleEvents streams events to the client, either as Server-Sent Events or
+// over a WebSocket if the client requests an upgrade.
+func (s *Server) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	// Make sure the status cache exists, so that there is
+	// something to watch.
+	if _, err := s.getStatusCache(); err != nil {
+		s.serveError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if websocket.IsWebSocketUpgrade(r) {
+		s.serveEventsWebSocket(w, r)
+	} else {
+		s.serveEventsSSE(w, r)
+	}
+}
+
+func (s *Server) serveEventsSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.serveError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	principal := requestPrincipal(r)
+	events, unsubscribe := s.events.Subscribe()
+	defer unsubscribe()
+
+	clearWriteDeadline(r)
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-events:
+			if !eventVisible(principal, event) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-s.lifecycle.Done():
+			return
+		}
+	}
+}
+
+func (s *Server) serveEventsWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := eventUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied with an error.
+		return
+	}
+	defer conn.Close()
+
+	principal := requestPrincipal(r)
+	events, unsubscribe := s.events.Subscribe()
+	defer unsubscribe()
+
+	// We never expect messages from the client, but we must read
+	// to process control frames and notice disconnects.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-events:
+			if !eventVisible(principal, event) {
+				continue
+			}
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			deadline := time.Now().Add(eventKeepAlive)
+			if err := conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-s.lifecycle.Done():
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+				time.Now().Add(time.Second))
+			return
+		}
+	}
+}
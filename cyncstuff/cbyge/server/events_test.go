@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/unixpickle/cbyge"
+)
+
+func TestWatchStatusesStopsOnClose(t *testing.T) {
+	cache := cbyge.NewStatusCache(nil, nil, time.Minute)
+	done := make(chan struct{})
+	go func() {
+		(&Server{}).watchStatuses(cache)
+		close(done)
+	}()
+	cache.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("watchStatuses did not return after the cache was closed")
+	}
+}
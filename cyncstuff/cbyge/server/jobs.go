@@ -0,0 +1,216 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultJobExpiration = time.Minute * 10
+
+// States of a Job or of one of its devices.
+const (
+	JobStatePending = "pending"
+	JobStateRunning = "running"
+	JobStateOK      = "ok"
+	JobStatePartial = "partial"
+	JobStateError   = "error"
+)
+
+// A Job tracks an asynchronous control request.
+type Job struct {
+	ID       string      `json:"id"`
+	User     string      `json:"user"`
+	Endpoint string      `json:"endpoint"`
+	State    string      `json:"state"`
+	Created  time.Time   `json:"created"`
+	Finished *time.Time  `json:"finished,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Devices  []JobDevice `json:"devices"`
+}
+
+// A JobDevice is the outcome of a job for one device.
+type JobDevice struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+func (j *Job) copy() Job {
+	res := *j
+	res.Devices = append([]JobDevice{}, j.Devices...)
+	return res
+}
+
+// A JobStore keeps jobs in memory until they have been finished for a
+// while.
+type JobStore struct {
+	expiration time.Duration
+
+	lock sync.Mutex
+	jobs map[string]*Job
+}
+
+// NewJobStore creates a JobStore which forgets finished jobs after the
+// expiration time.
+func NewJobStore(expiration time.Duration) *JobStore {
+	return &JobStore{expiration: expiration, jobs: map[string]*Job{}}
+}
+
+// Start creates a running job for the given devices.
+func (j *JobStore) Start(user, endpoint string, deviceIDs []string) (string, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return "", err
+	}
+	job := &Job{
+		ID:       id,
+		User:     user,
+		Endpoint: endpoint,
+		State:    JobStateRunning,
+		Created:  time.Now(),
+		Devices:  []JobDevice{},
+	}
+	for _, devID := range deviceIDs {
+		job.Devices = append(job.Devices, JobDevice{ID: devID, State: JobStatePending})
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.expire()
+	j.jobs[id] = job
+	return id, nil
+}
+
+// SetResult records the outcome for one of a job's devices.
+func (j *JobStore) SetResult(id, deviceID string, err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	job, ok := j.jobs[id]
+	if !ok {
+		return
+	}
+	for i, dev := range job.Devices {
+		if dev.ID == deviceID && dev.State == JobStatePending {
+			if err != nil {
+				job.Devices[i].State = JobStateError
+				job.Devices[i].Error = err.Error()
+			} else {
+				job.Devices[i].State = JobStateOK
+			}
+			return
+		}
+	}
+}
+
+// Finish marks a job as done, with an optional error for the whole job.
+//
+// Devices without results are marked as failed.
+func (j *JobStore) Finish(id string, err error) (Job, bool) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	job, ok := j.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	now := time.Now()
+	job.Finished = &now
+	if err != nil {
+		job.Error = err.Error()
+	}
+	var numFailed int
+	for i, dev := range job.Devices {
+		if dev.State == JobStatePending {
+			job.Devices[i].State = JobStateError
+			job.Devices[i].Error = job.Error
+		}
+		if job.Devices[i].State == JobStateError {
+			numFailed++
+		}
+	}
+	if err != nil || (numFailed > 0 && numFailed == len(job.Devices)) {
+		job.State = JobStateError
+	} else if numFailed > 0 {
+		job.State = JobStatePartial
+	} else {
+		job.State = JobStateOK
+	}
+	return job.copy(), true
+}
+
+// SetExpiration changes how long finished jobs are kept.
+func (j *JobStore) SetExpiration(expiration time.Duration) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.expiration = expiration
+}
+
+// Get looks up a job by ID.
+func (j *JobStore) Get(id string) (Job, bool) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.expire()
+	job, ok := j.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return job.copy(), true
+}
+
+func (j *JobStore) expire() {
+	now := time.Now()
+	for id, job := range j.jobs {
+		if job.Finished != nil && now.Sub(*job.Finished) > j.expiration {
+			delete(j.jobs, id)
+		}
+	}
+}
+
+// startJob creates a job for an async request, or returns "" if the job
+// could not be created.
+func (s *Server) startJob(r *http.Request, deviceIDs []string) string {
+	id, err := s.jobs.Start(requestPrincipal(r).User, r.URL.Path, deviceIDs)
+	if err != nil {
+		return ""
+	}
+	return id
+}
+
+// finishJob completes a job and notifies event subscribers.
+func (s *Server) finishJob(id string, err error) {
+	if job, ok := s.jobs.Finish(id, err); ok {
+		s.events.Publish(EventTypeJob, job)
+	}
+}
+
+// serveJobStarted replies to an async request.
+func (s *Server) serveJobStarted(w http.ResponseWriter, id string) {
+	if id == "" {
+		s.serveObject(w, http.StatusOK, map[string]interface{}{})
+		return
+	}
+	w.Header().Set("Location", "/api/jobs/"+id)
+	s.serveObject(w, http.StatusOK, map[string]interface{}{"job_id": id})
+}
+
+// HandleJob gets the progress of an async request (GET /api/jobs/{id}).
+//
+// Users can only see their own jobs, unless they are admins.
+func (s *Server) HandleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.serveError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/api/jobs/")
+	job, ok := s.jobs.Get(id)
+	if !ok || !jobVisible(requestPrincipal(r), &job) {
+		s.serveError(w, http.StatusNotFound, "no such job")
+		return
+	}
+	s.serveObject(w, http.StatusOK, job)
+}
+
+func jobVisible(p *Principal, job *Job) bool {
+	return p.Role == RoleAdmin || p.User == job.User
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultReadTimeout     = time.Second * 30
+	DefaultWriteTimeout    = time.Second * 90
+	DefaultIdleTimeout     = time.Minute * 2
+	DefaultShutdownTimeout = time.Second * 30
+
+	pingCacheTime = time.Second * 10
+)
+
+// Lifecycle tracks background work and shutdown for the server.
+type Lifecycle struct {
+	work sync.WaitGroup
+
+	shutdownOnce sync.Once
+	shutdown     chan struct{}
+
+	pingLock sync.Mutex
+	pingTime time.Time
+	pingErr  error
+
+	readyLock     sync.Mutex
+	readyFailures string
+}
+
+func NewLifecycle() *Lifecycle {
+	return &Lifecycle{shutdown: make(chan struct{})}
+}
+
+// Go runs f in the background, and shutdown waits for it to finish.
+func (l *Lifecycle) Go(f func()) {
+	l.work.Add(1)
+	go func() {
+		defer l.work.Done()
+		f()
+	}()
+}
+
+// Done is closed once the server starts shutting down, so that long-lived
+// requests can end.
+func (l *Lifecycle) Done() <-chan struct{} {
+	return l.shutdown
+}
+
+// ShuttingDown checks if Done() is closed.
+func (l *Lifecycle) ShuttingDown() bool {
+	select {
+	case <-l.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *Lifecycle) beginShutdown() {
+	l.shutdownOnce.Do(func() {
+		close(l.shutdown)
+	})
+}
+
+// wait waits for background work, or returns false if the context ends
+// first.
+func (l *Lifecycle) wait(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		l.work.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+type connContextKey struct{}
+
+// newHTTPServer creates a server with the timeouts from the flags.
+func newHTTPServer(addr string, handler http.Handler, read, write, idle time.Duration) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: read,
+		ReadTimeout:       read,
+		WriteTimeout:      write,
+		IdleTimeout:       idle,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, c)
+		},
+	}
+}
+
+// clearWriteDeadline removes the server's write timeout for a request which
+// streams its response.
+func clearWriteDeadline(r *http.Request) {
+	if conn, ok := r.Context().Value(connContextKey{}).(net.Conn); ok {
+		conn.SetWriteDeadline(time.Time{})
+	}
+}
+
+// serveUntilSignal runs the servers until SIGTERM or SIGINT, and then
+// drains in-flight requests and background work. SIGHUP reloads settings.
+//
+// The first server is the main one, and its errors are returned.
+func (s *Server) serveUntilSignal(timeout time.Duration, servers []*http.Server,
+	listen []func() error) error {
+	for _, srv := range servers {
+		srv.RegisterOnShutdown(s.lifecycle.beginShutdown)
+	}
+
+	errs := make(chan error, len(servers))
+	for i, f := range listen {
+		i, f := i, f
+		go func() {
+			err := f()
+			if err == http.ErrServerClosed {
+				err = nil
+			}
+			if i == 0 || err != nil {
+				errs <- err
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for waiting := true; waiting; {
+		select {
+		case err := <-errs:
+			return err
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				s.reloadAndLog()
+				continue
+			}
+			fmt.Fprintln(os.Stderr, "Received", sig, "- shutting down.")
+			waiting = false
+		}
+	}
+
+	s.lifecycle.beginShutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var shutdownErr error
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil && shutdownErr == nil {
+			shutdownErr = err
+		}
+	}
+	if !s.lifecycle.wait(ctx) && shutdownErr == nil {
+		shutdownErr = ctx.Err()
+	}
+	if cache := s.currentStatusCache(); cache != nil {
+		cache.Close()
+	}
+	if s.Audit != nil {
+		s.Audit.Close()
+	}
+	return shutdownErr
+}
+
+func (s *Server) reloadAndLog() {
+	needRestart, err := s.Reload()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Not reloading settings:", err)
+		return
+	}
+	fmt.Fprintln(os.Stderr, "Reloaded settings.")
+	if len(needRestart) > 0 {
+		fmt.Fprintln(os.Stderr, "Restart to apply changes to:", strings.Join(needRestart, ", "))
+	}
+}
+
+// HandleHealth reports that the process is up.
+func (s *Server) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	s.serveObject(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+}
+
+// HandleReady reports if the server can control devices, checking that
+// the session is valid, the packet server is reachable, and the devices
+// have been enumerated.
+//
+// Unauthenticated callers only see whether each check passed. The reasons
+// for failures are logged instead.
+func (s *Server) HandleReady(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]interface{}{}
+	var failures []string
+	check := func(name string, err error) {
+		if err != nil {
+			checks[name] = err.Error()
+			failures = append(failures, name+": "+err.Error())
+		} else {
+			checks[name] = "ok"
+		}
+	}
+
+	if s.lifecycle.ShuttingDown() {
+		check("shutdown", errors.New("shutting down"))
+	}
+	_, err := s.getController()
+	check("session", err)
+	if err == nil {
+		check("packet_server", s.ping())
+		_, err = s.getDevices()
+		check("devices", err)
+	}
+	s.logReadyFailures(failures)
+
+	if _, ok := s.authenticate(r); !ok {
+		for name, result := range checks {
+			if result != "ok" {
+				checks[name] = "failed"
+			}
+		}
+	}
+	ready := len(failures) == 0
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	s.serveObject(w, status, map[string]interface{}{"ready": ready, "checks": checks})
+}
+
+// logReadyFailures logs failed readiness checks when they change, so that
+// frequent probes do not flood the log.
+func (s *Server) logReadyFailures(failures []string) {
+	l := s.lifecycle
+	joined := strings.Join(failures, "; ")
+	l.readyLock.Lock()
+	defer l.readyLock.Unlock()
+	if joined == l.readyFailures {
+		return
+	}
+	l.readyFailures = joined
+	if joined == "" {
+		fmt.Fprintln(os.Stderr, "Ready.")
+	} else {
+		fmt.Fprintln(os.Stderr, "Not ready:", joined)
+	}
+}
+
+// ping checks the connection to the packet server, caching the result so
+// that frequent readiness probes do not open many connections.
+func (s *Server) ping() error {
+	l := s.lifecycle
+	l.pingLock.Lock()
+	defer l.pingLock.Unlock()
+	if time.Since(l.pingTime) < pingCacheTime {
+		return l.pingErr
+	}
+	ctrl, err := s.getController()
+	if err == nil {
+		err = ctrl.Ping()
+	}
+	l.pingTime = time.Now()
+	l.pingErr = err
+	return err
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandleReadyHidesDetails(t *testing.T) {
+	s := newTestServer(t)
+	s.lifecycle = NewLifecycle()
+	s.lifecycle.pingTime = time.Now()
+	s.lifecycle.pingErr = errors.New("dial tcp 10.0.0.1:23778: connection refused")
+
+	type readyResponse struct {
+		Ready  bool              `json:"ready"`
+		Checks map[string]string `json:"checks"`
+	}
+	getReady := func(authenticated bool) *readyResponse {
+		req := httptest.NewRequest("GET", "/readyz", nil)
+		if authenticated {
+			req.SetBasicAuth("admin", "password")
+		}
+		rec := httptest.NewRecorder()
+		s.HandleReady(rec, req)
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("unexpected status: %d", rec.Code)
+		}
+		var res readyResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return &res
+	}
+
+	res := getReady(false)
+	if res.Ready || res.Checks["session"] != "ok" || res.Checks["packet_server"] != "failed" {
+		t.Errorf("unexpected response: %+v", res)
+	}
+	res = getReady(true)
+	if res.Checks["packet_server"] != s.lifecycle.pingErr.Error() {
+		t.Errorf("unexpected response: %+v", res)
+	}
+}
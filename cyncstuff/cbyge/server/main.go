@@ -1,7 +1,6 @@
 package main
 
 import (
-	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -22,38 +21,97 @@ import (
 const SessionExpiration = time.Hour / 2
 
 func main() {
-	s := &Server{}
-	var addr string
-	var assets string
-	flag.StringVar(&assets, "assets", "assets", "assets directory")
-	flag.StringVar(&addr, "addr", ":8080", "address to listen on")
-	flag.StringVar(&s.Email, "email", "", "C by GE account email")
-	flag.StringVar(&s.Password, "password", "", "C by GE account password")
-	flag.StringVar(&s.SessionInfo, "sessinfo", "", "Cync session info from 2FA login")
-	flag.StringVar(&s.WebPassword, "web-password", "",
-		"password for basic auth, if different than the account password")
-	flag.BoolVar(&s.NoAuth, "no-auth", false, "do not require any password")
-	flag.Parse()
-
-	if s.SessionInfo == "" && (s.Email == "" || s.Password == "") {
-		essentials.Die("Must provide -email and -password flags, or the -sessinfo flag. See -help.")
-	}
-
-	if s.WebPassword == "" {
-		s.WebPassword = s.Password
-	}
-
-	http.Handle("/", s.Auth(s.Redirect2FA(http.FileServer(http.Dir(assets)).ServeHTTP).ServeHTTP))
-	http.Handle("/2fa/stage1", s.Auth(s.Handle2FAStage1))
-	http.Handle("/2fa/stage2", s.Auth(s.Handle2FAStage2))
-	http.Handle("/api/devices", s.Auth(s.HandleDevices))
-	http.Handle("/api/device/status", s.Auth(s.HandleDeviceStatus))
-	http.Handle("/api/device/set_on", s.Auth(s.HandleDeviceSetOn))
-	http.Handle("/api/device/blast_on", s.Auth(s.HandleDeviceBlastOn))
-	http.Handle("/api/device/set_color_tone", s.Auth(s.HandleDeviceSetColorTone))
-	http.Handle("/api/device/set_rgb", s.Auth(s.HandleDeviceSetRGB))
-	http.Handle("/api/device/set_brightness", s.Auth(s.HandleDeviceSetBrightness))
-	http.ListenAndServe(addr, nil)
+	cfg, err := LoadConfig(os.Args[1:], flag.ExitOnError)
+	if err != nil {
+		essentials.Die(err)
+	}
+
+	s := &Server{
+		Email:       cfg.Email,
+		Password:    cfg.Password,
+		SessionInfo: cfg.SessionInfo,
+		NoAuth:      cfg.NoAuth,
+		StatusTTL:   cfg.StatusTTL,
+
+		config:     cfg,
+		configArgs: os.Args[1:],
+		events:     NewEventHub(),
+		lifecycle:  NewLifecycle(),
+		jobs:       NewJobStore(cfg.JobExpiration),
+		limiter:    NewRateLimiter(cfg.RateLimit, cfg.RateBurst),
+	}
+	if !cfg.NoCoalesce {
+		s.coalescer = NewCoalescer(s.lifecycle.Go)
+	}
+
+	if cfg.UsersPath != "" {
+		users, err := LoadUserStore(cfg.UsersPath)
+		essentials.Must(err)
+		if users.NumUsers() == 0 {
+			if cfg.WebPassword == "" {
+				essentials.Die("Must provide -web-password to create the initial admin user.")
+			}
+			essentials.Must(users.PutUser("admin", cfg.WebPassword, RoleAdmin, nil))
+		}
+		s.Users = users
+	}
+
+	metadata, err := LoadMetadataStore(cfg.MetadataPath)
+	essentials.Must(err)
+	s.Metadata = metadata
+
+	if cfg.AuditPath != "" {
+		audit, err := OpenAuditLog(cfg.AuditPath, cfg.AuditMaxSize, cfg.AuditMaxFiles)
+		essentials.Must(err)
+		s.Audit = audit
+	}
+
+	http.HandleFunc("/healthz", s.HandleHealth)
+	http.HandleFunc("/readyz", s.HandleReady)
+	assets, err := NewAssetHandler(cfg.Assets)
+	essentials.Must(err)
+	http.Handle("/", s.Auth(RoleRead, s.Redirect2FA(assets.ServeHTTP).ServeHTTP))
+	http.Handle("/2fa/stage1", s.Auth(RoleAdmin, s.Handle2FAStage1))
+	http.Handle("/2fa/stage2", s.Auth(RoleAdmin, s.Handle2FAStage2))
+	http.Handle("/api/devices", s.Auth(RoleRead, s.HandleDevices))
+	http.Handle("/api/devices/changes", s.Auth(RoleRead, s.HandleDeviceChanges))
+	http.Handle("/api/events", s.Auth(RoleRead, s.HandleEvents))
+	http.Handle("/api/device/status", s.Auth(RoleRead, s.HandleDeviceStatus))
+	http.Handle("/api/device/metadata", s.Auth(RoleRead, s.HandleDeviceMetadata))
+	http.Handle("/api/metadata", s.Auth(RoleRead, s.HandleMetadata))
+	http.Handle("/api/device/set_on", s.Auth(RoleControl, s.HandleDeviceSetOn))
+	http.Handle("/api/device/blast_on", s.Auth(RoleControl, s.HandleDeviceBlastOn))
+	http.Handle("/api/device/set_color_tone", s.Auth(RoleControl, s.HandleDeviceSetColorTone))
+	http.Handle("/api/device/set_rgb", s.Auth(RoleControl, s.HandleDeviceSetRGB))
+	http.Handle("/api/device/set_brightness", s.Auth(RoleControl, s.HandleDeviceSetBrightness))
+	http.Handle("/api/v2/", s.Auth(RoleRead, s.HandleV2))
+	http.Handle("/api/tokens", s.Auth(RoleRead, s.HandleTokens))
+	http.Handle("/api/tokens/", s.Auth(RoleRead, s.HandleToken))
+	http.Handle("/api/users", s.Auth(RoleAdmin, s.HandleUsers))
+	http.Handle("/api/users/", s.Auth(RoleAdmin, s.HandleUser))
+	http.Handle("/api/jobs/", s.Auth(RoleRead, s.HandleJob))
+	http.Handle("/api/audit", s.Auth(RoleAdmin, s.HandleAudit))
+
+	server := newHTTPServer(cfg.Addr, nil, cfg.ReadTimeout, cfg.WriteTimeout, cfg.IdleTimeout)
+	servers := []*http.Server{server}
+	var listen []func() error
+	if !cfg.TLS.Enabled() {
+		listen = append(listen, server.ListenAndServe)
+	} else {
+		tlsConfig, err := cfg.TLS.Config()
+		essentials.Must(err)
+		server.TLSConfig = tlsConfig
+		listen = append(listen, func() error {
+			return server.ListenAndServeTLS("", "")
+		})
+		if cfg.RedirectAddr != "" {
+			redirect := newHTTPServer(cfg.RedirectAddr, RedirectHTTPS(cfg.Addr), cfg.ReadTimeout,
+				cfg.WriteTimeout, cfg.IdleTimeout)
+			servers = append(servers, redirect)
+			listen = append(listen, redirect.ListenAndServe)
+		}
+	}
+	essentials.Must(s.serveUntilSignal(cfg.ShutdownTimeout, servers, listen))
 }
 
 type Server struct {
@@ -61,42 +119,35 @@ type Server struct {
 	Password    string
 	SessionInfo string
 
-	WebPassword string
-	NoAuth      bool
+	NoAuth   bool
+	Users    *UserStore
+	Audit    *AuditLog
+	Metadata *MetadataStore
+
+	StatusTTL time.Duration
+
+	// config holds the latest settings, some of which can be
+	// reloaded while the server is running.
+	configLock sync.RWMutex
+	config     *Config
+	configArgs []string
 
 	devicesLock sync.Mutex
 	devices     []*cbyge.ControllerDevice
+	groups      []*cbyge.ControllerGroup
+	statusCache *cbyge.StatusCache
+
+	events    *EventHub
+	limiter   *RateLimiter
+	coalescer *Coalescer
+	jobs      *JobStore
+	lifecycle *Lifecycle
 
 	controllerLock sync.Mutex
 	sessionInfo    *cbyge.SessionInfo
 	controller     *cbyge.Controller
 }
 
-func (s *Server) Auth(handler http.HandlerFunc) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if s.NoAuth {
-			handler(w, r)
-			return
-		}
-		pass := r.FormValue("auth")
-
-		if pass == "" {
-			// Most likely a front-end request.
-			_, pass, ok := r.BasicAuth()
-			if !ok || subtle.ConstantTimeCompare([]byte(pass), []byte(s.WebPassword)) != 1 {
-				w.Header().Set("WWW-Authenticate", `Basic realm="bad credentials"`)
-				w.WriteHeader(http.StatusUnauthorized)
-				w.Write([]byte("Unauthorised.\n"))
-				return
-			}
-		} else if subtle.ConstantTimeCompare([]byte(pass), []byte(s.WebPassword)) != 1 {
-			s.serveError(w, http.StatusUnauthorized, "incorrect 'auth' parameter")
-			return
-		}
-		handler(w, r)
-	})
-}
-
 func (s *Server) Redirect2FA(handler http.HandlerFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/" && r.URL.Path != "" {
@@ -146,6 +197,10 @@ func (s *Server) HandleDevices(w http.ResponseWriter, r *http.Request) {
 		s.serveError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	devs = filterDevices(r, devs)
+	if r.FormValue("hidden") == "" {
+		devs = s.withoutHidden(devs)
+	}
 	sort.Slice(devs, func(i, j int) bool {
 		return strings.Compare(devs[i].DeviceID(), devs[j].DeviceID()) < 0
 	})
@@ -154,39 +209,115 @@ func (s *Server) HandleDevices(w http.ResponseWriter, r *http.Request) {
 		statuses[i] = d.LastStatus()
 	}
 	if r.FormValue("update_status") != "" {
-		ctrl, err := s.getController()
+		cache, err := s.getStatusCache()
 		if err != nil {
 			s.serveError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		statuses, _ = ctrl.DeviceStatuses(devs)
+		statuses, _ = cache.Statuses(devs)
 	}
 	data := []map[string]interface{}{}
 	for i, d := range devs {
 		data = append(data, map[string]interface{}{
-			"id":     d.DeviceID(),
-			"name":   d.Name(),
-			"status": encodeStatus(statuses[i]),
+			"id":       d.DeviceID(),
+			"name":     d.Name(),
+			"status":   encodeStatus(statuses[i]),
+			"metadata": s.Metadata.Get(d.DeviceID()),
 		})
 	}
 	s.serveObject(w, http.StatusOK, data)
 }
 
+func (s *Server) HandleDeviceChanges(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	if r.FormValue("since") != "" {
+		var err error
+		since, err = strconv.ParseUint(r.FormValue("since"), 10, 64)
+		if err != nil {
+			s.serveError(w, http.StatusBadRequest, "invalid 'since' argument")
+			return
+		}
+	}
+	var wait time.Duration
+	if r.FormValue("wait") != "" {
+		seconds, err := strconv.Atoi(r.FormValue("wait"))
+		if err != nil || seconds < 0 || seconds > 60 {
+			s.serveError(w, http.StatusBadRequest, "invalid 'wait' argument")
+			return
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+
+	cache, err := s.getStatusCache()
+	if err != nil {
+		s.serveError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var changes []cbyge.StatusChange
+	var version uint64
+	if wait != 0 {
+		clearWriteDeadline(r)
+		changes, version = cache.WaitChanges(since, wait)
+	} else {
+		changes, version = cache.Changes(since)
+	}
+
+	data := []map[string]interface{}{}
+	principal := requestPrincipal(r)
+	for _, change := range changes {
+		if !principal.CanAccess(change.Device.DeviceID()) {
+			continue
+		}
+		data = append(data, map[string]interface{}{
+			"id":      change.Device.DeviceID(),
+			"name":    change.Device.Name(),
+			"status":  encodeStatus(change.Status),
+			"version": change.Version,
+		})
+	}
+	s.serveObject(w, http.StatusOK, map[string]interface{}{
+		"version": version,
+		"changes": data,
+	})
+}
+
 func (s *Server) HandleDeviceStatus(w http.ResponseWriter, r *http.Request) {
+	ids, ok := s.serveDeviceIDs(w, r)
+	if !ok {
+		return
+	}
+	s.serveDeviceStatus(w, ids, r.FormValue("refresh") != "")
+}
+
+// serveDeviceStatus serves the statuses of the given devices.
+//
+// If live is false, the statuses may come from the status cache.
+func (s *Server) serveDeviceStatus(w http.ResponseWriter, ids []string, live bool) {
 	ctrl, err := s.getController()
 	if err != nil {
 		s.serveError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	cache, err := s.getStatusCache()
+	if err != nil {
+		s.serveError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
 	statuses := []map[string]interface{}{}
-	for _, id := range strings.Split(r.FormValue("id"), ",") {
+	for _, id := range ids {
 		dev, err := s.getDevice(id)
 		if err != nil {
 			s.serveError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		status, err := ctrl.DeviceStatus(dev)
+		var status cbyge.ControllerDeviceStatus
+		if live {
+			status, err = ctrl.DeviceStatus(dev)
+			cache.Update(dev, status, err)
+		} else {
+			status, err = cache.Status(dev)
+		}
 		if err != nil {
 			s.serveError(w, http.StatusInternalServerError, err.Error())
 			return
@@ -207,7 +338,10 @@ func (s *Server) HandleDeviceSetOn(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) HandleDeviceBlastOn(w http.ResponseWriter, r *http.Request) {
-	ids := strings.Split(r.FormValue("id"), ",")
+	ids, ok := s.serveDeviceIDs(w, r)
+	if !ok {
+		return
+	}
 	status := r.FormValue("on") == "1"
 	numSwitches := 3
 
@@ -220,7 +354,27 @@ func (s *Server) HandleDeviceBlastOn(w http.ResponseWriter, r *http.Request) {
 		numSwitches = n
 	}
 
-	runFunc := func() error {
+	endpoint := r.URL.Path
+	async := r.FormValue("async") == "1"
+	entry := newAuditEntry(r, async, formAuditValues(r))
+	var jobID string
+	if async {
+		jobID = s.startJob(r, ids)
+		entry.Job = jobID
+	}
+	runFunc := func() (err error) {
+		defer func() {
+			// Errors before the blast apply to the whole request.
+			var requestErr error
+			if err != nil && len(entry.Devices) == 0 {
+				requestErr = err
+				entry.SetError(err)
+			}
+			s.audit(entry)
+			if async {
+				s.finishJob(jobID, requestErr)
+			}
+		}()
 		ctrl, err := s.getController()
 		if err != nil {
 			return err
@@ -235,11 +389,19 @@ func (s *Server) HandleDeviceBlastOn(w http.ResponseWriter, r *http.Request) {
 			devs = append(devs, dev)
 			statuses = append(statuses, status)
 		}
-		return ctrl.BlastDeviceStatuses(devs, statuses, numSwitches)
+		err = ctrl.BlastDeviceStatuses(devs, statuses, numSwitches)
+		for _, id := range ids {
+			s.publishCommand(endpoint, async, id, err)
+			entry.AddResult(id, err)
+			if async {
+				s.jobs.SetResult(jobID, id, err)
+			}
+		}
+		return err
 	}
-	if r.FormValue("async") == "1" {
-		go runFunc()
-		s.serveObject(w, http.StatusOK, map[string]interface{}{})
+	if async {
+		s.lifecycle.Go(func() { runFunc() })
+		s.serveJobStarted(w, jobID)
 	} else {
 		err := runFunc()
 		if err != nil {
@@ -307,39 +469,70 @@ func (s *Server) HandleDeviceSetBrightness(w http.ResponseWriter, r *http.Reques
 
 func (s *Server) handleSetter(w http.ResponseWriter, r *http.Request,
 	f func(c *cbyge.Controller, d *cbyge.ControllerDevice, async bool) error) {
+	endpoint := r.URL.Path
+	ids, ok := s.serveDeviceIDs(w, r)
+	if !ok {
+		return
+	}
 	if r.FormValue("async") == "1" {
-		ids := strings.Split(r.FormValue("id"), ",")
-		go func() {
+		entry := newAuditEntry(r, true, formAuditValues(r))
+		jobID := s.startJob(r, ids)
+		entry.Job = jobID
+		s.lifecycle.Go(func() {
+			var jobErr error
+			defer func() {
+				s.audit(entry)
+				s.finishJob(jobID, jobErr)
+			}()
 			ctrl, err := s.getController()
 			if err != nil {
+				entry.SetError(err)
+				jobErr = err
 				return
 			}
+			var devs []*cbyge.ControllerDevice
 			for _, id := range ids {
-				// Ignore errors; apply the change to as many
-				// devices as possible in async mode.
+				// Apply the change to as many devices as
+				// possible in async mode.
 				dev, err := s.getDevice(id)
 				if err == nil {
-					f(ctrl, dev, true)
+					err = s.coalesce(endpoint, id, func() error {
+						return f(ctrl, dev, true)
+					})
+					devs = append(devs, dev)
 				}
+				s.publishCommand(endpoint, true, id, err)
+				entry.AddResult(id, err)
+				s.jobs.SetResult(jobID, id, err)
 			}
-		}()
-		s.serveObject(w, http.StatusOK, []interface{}{})
+			s.refreshStatuses(devs)
+		})
+		s.serveJobStarted(w, jobID)
 		return
 	}
 
+	entry := newAuditEntry(r, false, formAuditValues(r))
+	defer s.audit(entry)
+
 	ctrl, err := s.getController()
 	if err != nil {
+		entry.SetError(err)
 		s.serveError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	for _, id := range strings.Split(r.FormValue("id"), ",") {
+	for _, id := range ids {
 		dev, err := s.getDevice(id)
 		if err != nil {
+			entry.AddResult(id, err)
 			s.serveError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		err = f(ctrl, dev, false)
+		err = s.coalesce(endpoint, id, func() error {
+			return f(ctrl, dev, false)
+		})
+		s.publishCommand(endpoint, false, id, err)
+		entry.AddResult(id, err)
 		if err != nil {
 			s.serveError(w, http.StatusInternalServerError, err.Error())
 			return
@@ -347,7 +540,7 @@ func (s *Server) handleSetter(w http.ResponseWriter, r *http.Request,
 	}
 
 	// Return the new device statuses.
-	s.HandleDeviceStatus(w, r)
+	s.serveDeviceStatus(w, ids, true)
 }
 
 func (s *Server) serveError(w http.ResponseWriter, code int, err string) {
@@ -379,6 +572,30 @@ func (s *Server) getDevice(id string) (*cbyge.ControllerDevice, error) {
 	return nil, errors.New("no device found with the given ID")
 }
 
+// filterDevices removes the devices which the request's principal cannot
+// access.
+func filterDevices(r *http.Request, devs []*cbyge.ControllerDevice) []*cbyge.ControllerDevice {
+	principal := requestPrincipal(r)
+	res := make([]*cbyge.ControllerDevice, 0, len(devs))
+	for _, d := range devs {
+		if principal.CanAccess(d.DeviceID()) {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+// withoutHidden removes the devices which are hidden in their metadata.
+func (s *Server) withoutHidden(devs []*cbyge.ControllerDevice) []*cbyge.ControllerDevice {
+	res := make([]*cbyge.ControllerDevice, 0, len(devs))
+	for _, d := range devs {
+		if !s.Metadata.Get(d.DeviceID()).Hidden {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
 func (s *Server) getDevices() ([]*cbyge.ControllerDevice, error) {
 	s.devicesLock.Lock()
 	devs := s.devices
@@ -389,21 +606,87 @@ func (s *Server) getDevices() ([]*cbyge.ControllerDevice, error) {
 	return s.refreshDevices()
 }
 
+func (s *Server) getGroups() ([]*cbyge.ControllerGroup, error) {
+	if _, err := s.getDevices(); err != nil {
+		return nil, err
+	}
+	s.devicesLock.Lock()
+	defer s.devicesLock.Unlock()
+	return s.groups, nil
+}
+
 func (s *Server) refreshDevices() ([]*cbyge.ControllerDevice, error) {
 	ctrl, err := s.getController()
 	if err != nil {
 		return nil, err
 	}
-	devs, err := ctrl.Devices()
+	devs, groups, err := ctrl.DevicesAndGroups()
 	if err != nil {
 		return nil, err
 	}
 	s.devicesLock.Lock()
 	s.devices = devs
+	s.groups = groups
+	if s.statusCache == nil {
+		s.statusCache = cbyge.NewStatusCache(ctrl, devs, s.StatusTTL)
+		s.statusCache.Start(0)
+		go s.watchStatuses(s.statusCache)
+	} else {
+		s.statusCache.SetDevices(devs)
+	}
+	// Devices() fetches the initial status of every device.
+	for _, d := range devs {
+		status := d.LastStatus()
+		if status.IsOnline {
+			s.statusCache.Update(d, status, nil)
+		} else {
+			s.statusCache.Update(d, status, cbyge.UnreachableError)
+		}
+	}
 	s.devicesLock.Unlock()
 	return devs, nil
 }
 
+// refreshStatuses fetches the status of devices and stores them in the status
+// cache, so that subscribers learn about the changes.
+func (s *Server) refreshStatuses(devs []*cbyge.ControllerDevice) {
+	if len(devs) == 0 {
+		return
+	}
+	ctrl, err := s.getController()
+	if err != nil {
+		return
+	}
+	cache, err := s.getStatusCache()
+	if err != nil {
+		return
+	}
+	statuses, errs := ctrl.DeviceStatuses(devs)
+	for i, d := range devs {
+		if errs[i] != nil {
+			cache.Update(d, cbyge.ControllerDeviceStatus{}, errs[i])
+		} else {
+			cache.Update(d, statuses[i], nil)
+		}
+	}
+}
+
+func (s *Server) getStatusCache() (*cbyge.StatusCache, error) {
+	if _, err := s.getDevices(); err != nil {
+		return nil, err
+	}
+	s.devicesLock.Lock()
+	defer s.devicesLock.Unlock()
+	return s.statusCache, nil
+}
+
+// currentStatusCache gets the status cache if it has been created.
+func (s *Server) currentStatusCache() *cbyge.StatusCache {
+	s.devicesLock.Lock()
+	defer s.devicesLock.Unlock()
+	return s.statusCache
+}
+
 func (s *Server) getController() (*cbyge.Controller, error) {
 	s.controllerLock.Lock()
 	defer s.controllerLock.Unlock()
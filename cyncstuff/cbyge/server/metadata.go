@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	maxMetadataLabelLength = 64
+	maxMetadataIconLength  = 16
+	maxMetadataBodySize    = 1 << 14
+)
+
+// DeviceMetadata is information about a device which is stored by the server
+// rather than in the cloud.
+type DeviceMetadata struct {
+	Aliases []string `json:"aliases,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	Room    string   `json:"room,omitempty"`
+	Hidden  bool     `json:"hidden,omitempty"`
+	Icon    string   `json:"icon,omitempty"`
+}
+
+// Normalize lower-cases and de-duplicates aliases and tags, and trims
+// whitespace from every field.
+func (d *DeviceMetadata) Normalize() {
+	d.Aliases = normalizeLabels(d.Aliases)
+	d.Tags = normalizeLabels(d.Tags)
+	d.Room = strings.TrimSpace(d.Room)
+	d.Icon = strings.TrimSpace(d.Icon)
+}
+
+// Validate checks that aliases and tags can be used in selectors, and that
+// no field is too long.
+func (d *DeviceMetadata) Validate() error {
+	for _, labels := range [][]string{d.Aliases, d.Tags} {
+		for _, label := range labels {
+			if err := validateLabel(label); err != nil {
+				return err
+			}
+		}
+	}
+	if utf8.RuneCountInString(d.Room) > maxMetadataLabelLength {
+		return fmt.Errorf("room must be at most %d characters", maxMetadataLabelLength)
+	}
+	if utf8.RuneCountInString(d.Icon) > maxMetadataIconLength {
+		return fmt.Errorf("icon must be at most %d characters", maxMetadataIconLength)
+	}
+	return nil
+}
+
+func (d *DeviceMetadata) hasTag(tag string) bool {
+	for _, t := range d.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *DeviceMetadata) isEmpty() bool {
+	return len(d.Aliases) == 0 && len(d.Tags) == 0 && d.Room == "" && !d.Hidden && d.Icon == ""
+}
+
+func normalizeLabels(labels []string) []string {
+	var res []string
+	seen := map[string]bool{}
+	for _, label := range labels {
+		label = strings.ToLower(strings.TrimSpace(label))
+		if label != "" && !seen[label] {
+			seen[label] = true
+			res = append(res, label)
+		}
+	}
+	return res
+}
+
+func validateLabel(label string) error {
+	if len(label) > maxMetadataLabelLength {
+		return fmt.Errorf("alias or tag %q is too long", label)
+	}
+	for _, ch := range label {
+		if !(ch >= 'a' && ch <= 'z') && !(ch >= '0' && ch <= '9') && !strings.ContainsRune("-_.", ch) {
+			return fmt.Errorf("alias or tag %q may only contain letters, digits, '-', '_', and '.'",
+				label)
+		}
+	}
+	return nil
+}
+
+// A MetadataStore stores DeviceMetadata by device ID in a JSON file.
+//
+// If the store has no path, changes are only kept in memory.
+type MetadataStore struct {
+	path string
+
+	lock    sync.RWMutex
+	Devices map[string]*DeviceMetadata `json:"devices"`
+}
+
+// LoadMetadataStore reads a MetadataStore from a file, or creates an empty
+// store if path is "" or the file does not exist.
+func LoadMetadataStore(path string) (*MetadataStore, error) {
+	store := &MetadataStore{path: path, Devices: map[string]*DeviceMetadata{}}
+	if path == "" {
+		return store, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, store); err != nil {
+		return nil, errors.New("parse metadata store: " + err.Error())
+	}
+	if store.Devices == nil {
+		store.Devices = map[string]*DeviceMetadata{}
+	}
+	return store, nil
+}
+
+// Get gets a copy of a device's metadata.
+func (m *MetadataStore) Get(id string) DeviceMetadata {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if meta, ok := m.Devices[id]; ok {
+		return *meta
+	}
+	return DeviceMetadata{}
+}
+
+// Put replaces a device's metadata.
+//
+// Aliases must be unique across devices.
+func (m *MetadataStore) Put(id string, meta DeviceMetadata) error {
+	meta.Normalize()
+	if err := meta.Validate(); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for otherID, other := range m.Devices {
+		if otherID == id {
+			continue
+		}
+		for _, alias := range meta.Aliases {
+			for _, otherAlias := range other.Aliases {
+				if alias == otherAlias {
+					return fmt.Errorf("alias %q is already used by device %s", alias, otherID)
+				}
+			}
+		}
+	}
+	if meta.isEmpty() {
+		delete(m.Devices, id)
+	} else {
+		m.Devices[id] = &meta
+	}
+	return m.save()
+}
+
+// FindAlias looks up the device with an alias.
+func (m *MetadataStore) FindAlias(alias string) (string, bool) {
+	alias = strings.ToLower(alias)
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for id, meta := range m.Devices {
+		for _, a := range meta.Aliases {
+			if a == alias {
+				return id, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (m *MetadataStore) save() error {
+	if m.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := m.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, m.path)
+}
+
+// HandleMetadata lists the metadata of every accessible device.
+func (s *Server) HandleMetadata(w http.ResponseWriter, r *http.Request) {
+	devs, err := s.getDevices()
+	if err != nil {
+		s.serveError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	res := map[string]DeviceMetadata{}
+	for _, d := range filterDevices(r, devs) {
+		res[d.DeviceID()] = s.Metadata.Get(d.DeviceID())
+	}
+	s.serveObject(w, http.StatusOK, res)
+}
+
+// HandleDeviceMetadata gets (GET) or replaces (POST) a device's metadata.
+func (s *Server) HandleDeviceMetadata(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if _, err := s.getDevice(id); err != nil {
+		s.serveError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.serveObject(w, http.StatusOK, s.Metadata.Get(id))
+	case http.MethodPost, http.MethodPut:
+		if !requestPrincipal(r).Role.Allows(RoleControl) {
+			s.serveError(w, http.StatusForbidden, "this endpoint requires the 'control' role")
+			return
+		}
+		var meta DeviceMetadata
+		decoder := json.NewDecoder(io.LimitReader(r.Body, maxMetadataBodySize))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&meta); err != nil {
+			s.serveError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		if err := s.Metadata.Put(id, meta); err != nil {
+			s.serveError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		meta = s.Metadata.Get(id)
+		s.events.Publish(EventTypeMetadata, map[string]interface{}{
+			"id":       id,
+			"metadata": meta,
+		})
+		s.serveObject(w, http.StatusOK, meta)
+	default:
+		s.serveError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
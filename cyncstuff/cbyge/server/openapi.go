@@ -0,0 +1,244 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+type jsonObject = map[string]interface{}
+
+// v2Schemas are the JSON schemas referenced by v2Routes.
+var v2Schemas = map[string]jsonObject{
+	"DeviceStatus": {
+		"type": "object",
+		"properties": jsonObject{
+			"is_online":  jsonObject{"type": "boolean"},
+			"is_on":      jsonObject{"type": "boolean"},
+			"brightness": jsonObject{"type": "integer", "minimum": 0, "maximum": 100},
+			"color_tone": jsonObject{"type": "integer", "minimum": 0, "maximum": 255},
+			"use_rgb":    jsonObject{"type": "boolean"},
+			"rgb":        rgbSchema(),
+		},
+	},
+	"Device": {
+		"type":     "object",
+		"required": []string{"id", "name", "status"},
+		"properties": jsonObject{
+			"id":       jsonObject{"type": "string"},
+			"name":     jsonObject{"type": "string"},
+			"status":   schemaRef("DeviceStatus"),
+			"metadata": schemaRef("DeviceMetadata"),
+			"error":    schemaRef("Error"),
+		},
+	},
+	"DeviceMetadata": {
+		"type": "object",
+		"properties": jsonObject{
+			"aliases": jsonObject{"type": "array", "items": jsonObject{"type": "string"}},
+			"tags":    jsonObject{"type": "array", "items": jsonObject{"type": "string"}},
+			"room":    jsonObject{"type": "string"},
+			"hidden":  jsonObject{"type": "boolean"},
+			"icon":    jsonObject{"type": "string"},
+		},
+	},
+	"Group": {
+		"type":     "object",
+		"required": []string{"id", "name", "device_ids"},
+		"properties": jsonObject{
+			"id":         jsonObject{"type": "string"},
+			"name":       jsonObject{"type": "string"},
+			"device_ids": jsonObject{"type": "array", "items": jsonObject{"type": "string"}},
+		},
+	},
+	"DevicePatch": {
+		"type":                 "object",
+		"additionalProperties": false,
+		"minProperties":        1,
+		"properties": jsonObject{
+			"on":         jsonObject{"type": "boolean"},
+			"brightness": jsonObject{"type": "integer", "minimum": 1, "maximum": 100},
+			"color_tone": jsonObject{"type": "integer", "minimum": 0, "maximum": 100},
+			"rgb":        rgbSchema(),
+		},
+	},
+	"GroupPatchResult": {
+		"type": "object",
+		"properties": jsonObject{
+			"group":   schemaRef("Group"),
+			"results": patchResultsSchema(),
+		},
+	},
+	"PatchResult": {
+		"type": "object",
+		"properties": jsonObject{
+			"results": patchResultsSchema(),
+		},
+	},
+	"Error": {
+		"type":     "object",
+		"required": []string{"code", "message"},
+		"properties": jsonObject{
+			"code": jsonObject{
+				"type": "string",
+				"enum": []string{
+					ErrorCodeBadRequest,
+					ErrorCodeNotFound,
+					ErrorCodeUnauthorized,
+					ErrorCodeForbidden,
+					ErrorCodeMethodNotAllowed,
+					ErrorCodeRateLimited,
+					ErrorCodeUnreachable,
+					ErrorCodeNotConverged,
+					ErrorCodeRemote,
+					ErrorCodeInternal,
+				},
+			},
+			"message": jsonObject{"type": "string"},
+		},
+	},
+}
+
+// v2OpenAPIDocument generates an OpenAPI 3 document from v2Routes.
+func v2OpenAPIDocument() jsonObject {
+	paths := jsonObject{}
+	for _, route := range v2Routes {
+		op := jsonObject{
+			"summary":     route.Summary,
+			"operationId": operationID(route),
+			"responses":   v2Responses(route),
+		}
+		var params []jsonObject
+		if strings.Contains(route.Path, "{id}") {
+			params = append(params, jsonObject{
+				"name":     "id",
+				"in":       "path",
+				"required": true,
+				"schema":   jsonObject{"type": "string"},
+			})
+		}
+		for _, param := range route.Query {
+			params = append(params, jsonObject{
+				"name":        param.Name,
+				"in":          "query",
+				"description": param.Description,
+				"required":    param.Required,
+				"schema":      jsonObject{"type": "string"},
+			})
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		if route.Request != "" {
+			op["requestBody"] = jsonObject{
+				"required": true,
+				"content": jsonObject{
+					"application/json": jsonObject{"schema": schemaRef(route.Request)},
+				},
+			}
+		}
+		item, ok := paths[route.Path].(jsonObject)
+		if !ok {
+			item = jsonObject{}
+			paths[route.Path] = item
+		}
+		item[strings.ToLower(route.Method)] = op
+	}
+
+	schemas := jsonObject{}
+	for name, schema := range v2Schemas {
+		schemas[name] = schema
+	}
+
+	return jsonObject{
+		"openapi": "3.0.3",
+		"info": jsonObject{
+			"title":   "cbyge server",
+			"version": "2",
+		},
+		"servers": []jsonObject{{"url": v2Prefix}},
+		"paths":   paths,
+		"components": jsonObject{
+			"schemas": schemas,
+			"securitySchemes": jsonObject{
+				"basicAuth":  jsonObject{"type": "http", "scheme": "basic"},
+				"bearerAuth": jsonObject{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []jsonObject{
+			{"basicAuth": []string{}},
+			{"bearerAuth": []string{}},
+		},
+	}
+}
+
+func v2Responses(route v2Route) jsonObject {
+	var okSchema interface{} = jsonObject{"type": "object"}
+	if route.Response != "" {
+		okSchema = schemaRef(route.Response)
+		if route.ResponseArray {
+			okSchema = jsonObject{"type": "array", "items": okSchema}
+		}
+	}
+	errorContent := jsonObject{
+		"application/json": jsonObject{
+			"schema": jsonObject{
+				"type":       "object",
+				"properties": jsonObject{"error": schemaRef("Error")},
+			},
+		},
+	}
+	res := jsonObject{
+		"200": jsonObject{
+			"description": http.StatusText(http.StatusOK),
+			"content": jsonObject{
+				"application/json": jsonObject{"schema": okSchema},
+			},
+		},
+		"default": jsonObject{
+			"description": "An error response.",
+			"content":     errorContent,
+		},
+	}
+	return res
+}
+
+func operationID(route v2Route) string {
+	var res strings.Builder
+	res.WriteString(strings.ToLower(route.Method))
+	for _, part := range strings.Split(route.Path, "/") {
+		part = strings.Trim(part, "{}")
+		part = strings.TrimSuffix(part, ".json")
+		if part == "" {
+			continue
+		}
+		res.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return res.String()
+}
+
+func schemaRef(name string) jsonObject {
+	return jsonObject{"$ref": "#/components/schemas/" + name}
+}
+
+func rgbSchema() jsonObject {
+	return jsonObject{
+		"type":     "array",
+		"minItems": 3,
+		"maxItems": 3,
+		"items":    jsonObject{"type": "integer", "minimum": 0, "maximum": 255},
+	}
+}
+
+func patchResultsSchema() jsonObject {
+	return jsonObject{
+		"type": "array",
+		"items": jsonObject{
+			"type": "object",
+			"properties": jsonObject{
+				"id":     jsonObject{"type": "string"},
+				"device": schemaRef("Device"),
+				"error":  schemaRef("Error"),
+			},
+		},
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/unixpickle/cbyge"
+)
+
+// deviceSelectorKeys are the request arguments which select devices by
+// their metadata, in addition to "id".
+var deviceSelectorKeys = []string{"alias", "tag", "room"}
+
+func isDeviceSelectorKey(key string) bool {
+	for _, k := range deviceSelectorKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// isDeviceIDLiteral checks if a term of a selector is a plain device ID.
+func isDeviceIDLiteral(term string) bool {
+	if term == "" {
+		return false
+	}
+	for _, ch := range term {
+		if ch < '0' || ch > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestDeviceIDs resolves the devices targeted by a request.
+//
+// The "id" argument is a selector (see cbyge.Selector), which may be a
+// comma-separated list of device IDs or use metadata terms like alias:desk,
+// tag:office, or room:kitchen. The alias, tag, and room arguments are
+// shorthands for these terms. Devices which the principal cannot access are
+// left out of the results.
+//
+// If the request fails, an HTTP status code is returned with the error.
+func (s *Server) requestDeviceIDs(r *http.Request) ([]string, int, error) {
+	var terms []string
+	if id := r.FormValue("id"); id != "" {
+		terms = append(terms, id)
+	}
+	for _, key := range deviceSelectorKeys {
+		if value := r.FormValue(key); value != "" {
+			terms = append(terms, key+":"+strconv.Quote(value))
+		}
+	}
+	if len(terms) == 0 {
+		return nil, http.StatusBadRequest, errors.New("no devices specified")
+	}
+
+	principal := requestPrincipal(r)
+	if len(terms) == 1 {
+		// Keep the order of plain ID lists, since responses
+		// correspond to the requested devices.
+		ids := strings.Split(terms[0], ",")
+		plain := true
+		for _, id := range ids {
+			plain = plain && isDeviceIDLiteral(id)
+		}
+		if plain {
+			for _, id := range ids {
+				if !principal.CanAccess(id) {
+					return nil, http.StatusForbidden,
+						errors.New("access to device " + id + " is not allowed")
+				}
+			}
+			return ids, 0, nil
+		}
+	}
+
+	source := "(" + strings.Join(terms, "), (") + ")"
+	if len(terms) == 1 {
+		source = terms[0]
+	}
+	devs, err := s.selectDevices(r, source)
+	if err != nil {
+		var selectorErr *cbyge.SelectorError
+		if errors.As(err, &selectorErr) {
+			return nil, http.StatusBadRequest, err
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+	if len(devs) == 0 {
+		return nil, http.StatusNotFound, fmt.Errorf("no accessible devices match %q", source)
+	}
+	var ids []string
+	for _, d := range devs {
+		ids = append(ids, d.DeviceID())
+	}
+	return ids, 0, nil
+}
+
+// selectDevices finds the devices matching a selector which the request's
+// principal can access.
+//
+// Invalid selectors result in a *cbyge.SelectorError.
+func (s *Server) selectDevices(r *http.Request, source string) ([]*cbyge.ControllerDevice,
+	error) {
+	selector, err := cbyge.ParseSelectorWith(source, s.selectorPredicates())
+	if err != nil {
+		return nil, err
+	}
+	devs, err := s.getDevices()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := s.getGroups()
+	if err != nil {
+		return nil, err
+	}
+	env := &cbyge.SelectorEnv{Groups: groups, Status: s.selectorStatus}
+	return filterDevices(r, selector.Select(env, devs)), nil
+}
+
+// serveDeviceIDs is like requestDeviceIDs, but serves the error if the
+// devices cannot be resolved.
+func (s *Server) serveDeviceIDs(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	ids, status, err := s.requestDeviceIDs(r)
+	if err != nil {
+		s.serveError(w, status, err.Error())
+		return nil, false
+	}
+	return ids, true
+}
+
+// selectorStatus gets statuses for selector state terms from the status
+// cache when possible.
+func (s *Server) selectorStatus(d *cbyge.ControllerDevice) cbyge.ControllerDeviceStatus {
+	if cache := s.currentStatusCache(); cache != nil {
+		status, _ := cache.Status(d)
+		return status
+	}
+	return d.LastStatus()
+}
+
+// selectorPredicates adds the metadata terms to selectors.
+func (s *Server) selectorPredicates() map[string]cbyge.SelectorPredicate {
+	return map[string]cbyge.SelectorPredicate{
+		"alias": func(value string) (func(d *cbyge.ControllerDevice) bool, error) {
+			id, ok := s.Metadata.FindAlias(value)
+			if !ok {
+				return nil, fmt.Errorf("no device has the alias %q", value)
+			}
+			return func(d *cbyge.ControllerDevice) bool {
+				return d.DeviceID() == id
+			}, nil
+		},
+		"tag": func(value string) (func(d *cbyge.ControllerDevice) bool, error) {
+			value = strings.ToLower(value)
+			return func(d *cbyge.ControllerDevice) bool {
+				meta := s.Metadata.Get(d.DeviceID())
+				return meta.hasTag(value)
+			}, nil
+		},
+		"room": func(value string) (func(d *cbyge.ControllerDevice) bool, error) {
+			return func(d *cbyge.ControllerDevice) bool {
+				return strings.EqualFold(s.Metadata.Get(d.DeviceID()).Room, value)
+			}, nil
+		},
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRateLimit = 10.0
+	DefaultRateBurst = 20
+
+	rateLimiterSweepInterval = time.Minute
+)
+
+// A Coalescer merges commands with the same key while one is in flight.
+//
+// If several commands arrive while a command is running, only the latest
+// of them is run afterwards, and every caller whose command was replaced
+// receives the result of the command which replaced it.
+type Coalescer struct {
+	spawn func(f func())
+
+	lock    sync.Mutex
+	running map[string]bool
+	pending map[string]*coalescedCall
+}
+
+type coalescedCall struct {
+	f    func() error
+	err  error
+	done chan struct{}
+}
+
+// NewCoalescer creates an empty Coalescer.
+//
+// Replacement commands are run in the background with spawn, such as
+// Lifecycle.Go, so that shutdown can wait for them. If spawn is nil, a plain
+// goroutine is used.
+func NewCoalescer(spawn func(f func())) *Coalescer {
+	if spawn == nil {
+		spawn = func(f func()) {
+			go f()
+		}
+	}
+	return &Coalescer{
+		spawn:   spawn,
+		running: map[string]bool{},
+		pending: map[string]*coalescedCall{},
+	}
+}
+
+// Do runs f, or a later command with the same key which supersedes it.
+func (c *Coalescer) Do(key string, f func() error) error {
+	c.lock.Lock()
+	if c.running[key] {
+		call, ok := c.pending[key]
+		if !ok {
+			call = &coalescedCall{done: make(chan struct{})}
+			c.pending[key] = call
+		}
+		call.f = f
+		c.lock.Unlock()
+		<-call.done
+		return call.err
+	}
+	c.running[key] = true
+	c.lock.Unlock()
+
+	// If f panics, the key must still be released for later commands.
+	defer c.finish(key)
+	return f()
+}
+
+func (c *Coalescer) finish(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	call, ok := c.pending[key]
+	if !ok {
+		delete(c.running, key)
+		return
+	}
+	delete(c.pending, key)
+	c.spawn(func() {
+		defer close(call.done)
+		defer c.finish(key)
+		defer func() {
+			// Nothing would recover a panic in this goroutine, so
+			// it is passed to the waiting callers instead.
+			if r := recover(); r != nil {
+				call.err = fmt.Errorf("command panicked: %v", r)
+			}
+		}()
+		call.err = call.f()
+	})
+}
+
+// coalesce runs a command for a device through the server's Coalescer.
+//
+// The kind distinguishes commands which would not override each other.
+func (s *Server) coalesce(kind, deviceID string, f func() error) error {
+	if s.coalescer == nil {
+		return f()
+	}
+	return s.coalescer.Do(kind+"\x00"+deviceID, f)
+}
+
+// A RateLimiter limits requests per client with token buckets.
+type RateLimiter struct {
+	lock sync.Mutex
+
+	// rate is the number of requests per second, or 0 to allow
+	// every request.
+	rate float64
+
+	// burst is the number of requests allowed at once.
+	burst int
+
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a RateLimiter with no history.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:      rate,
+		burst:     burst,
+		buckets:   map[string]*tokenBucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow uses up a request for the client.
+//
+// If the request is not allowed, the time until it would be is returned.
+func (r *RateLimiter) Allow(client string) (bool, time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.rate <= 0 {
+		return true, 0
+	}
+	now := time.Now()
+	r.sweep(now)
+	bucket, ok := r.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(r.burst), last: now}
+		r.buckets[client] = bucket
+	}
+	bucket.tokens = r.refill(bucket, now)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - bucket.tokens) / r.rate * float64(time.Second))
+	return false, wait
+}
+
+// SetLimit changes the rate and burst size.
+func (r *RateLimiter) SetLimit(rate float64, burst int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.rate = rate
+	r.burst = burst
+	r.buckets = map[string]*tokenBucket{}
+}
+
+func (r *RateLimiter) refill(bucket *tokenBucket, now time.Time) float64 {
+	elapsed := now.Sub(bucket.last).Seconds()
+	return math.Min(float64(r.burst), bucket.tokens+elapsed*r.rate)
+}
+
+// sweep forgets clients whose buckets have refilled, since they are
+// equivalent to new clients.
+func (r *RateLimiter) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < rateLimiterSweepInterval {
+		return
+	}
+	r.lastSweep = now
+	for client, bucket := range r.buckets {
+		if r.refill(bucket, now) >= float64(r.burst) {
+			delete(r.buckets, client)
+		}
+	}
+}
+
+// checkRate applies the rate limit to a control request.
+//
+// If the client has sent too many requests, the Retry-After header is set,
+// and the caller should reply with an error.
+func (s *Server) checkRate(w http.ResponseWriter, r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	client := requestPrincipal(r).Name() + "@" + host
+	ok, wait := s.limiter.Allow(client)
+	if !ok {
+		seconds := int(math.Ceil(wait.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+	return ok
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCoalescerPanic(t *testing.T) {
+	var spawned sync.WaitGroup
+	c := NewCoalescer(func(f func()) {
+		spawned.Add(1)
+		go func() {
+			defer spawned.Done()
+			f()
+		}()
+	})
+
+	// A panic in the first command still releases the key.
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected the panic to reach the caller")
+			}
+		}()
+		c.Do("key", func() error {
+			panic("first")
+		})
+	}()
+	if err := doWithTimeout(t, c, "key", func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	// A panic in a replacement command is returned to its callers.
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go c.Do("key", func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+	result := make(chan error, 1)
+	go func() {
+		result <- c.Do("key", func() error {
+			panic("replacement")
+		})
+	}()
+	// Wait for the replacement to be queued before releasing the first
+	// command.
+	for {
+		c.lock.Lock()
+		_, queued := c.pending["key"]
+		c.lock.Unlock()
+		if queued {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	select {
+	case err := <-result:
+		if err == nil || !strings.Contains(err.Error(), "replacement") {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("replacement command never finished")
+	}
+	spawned.Wait()
+
+	expected := errors.New("done")
+	if err := doWithTimeout(t, c, "key", func() error { return expected }); err != expected {
+		t.Errorf("expected %v but got %v", expected, err)
+	}
+}
+
+func doWithTimeout(t *testing.T, c *Coalescer, key string, f func() error) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- c.Do(key, f)
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(time.Second * 5):
+		t.Fatal("command never ran")
+		return nil
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultSelfSignedCert = "server-cert.pem"
+	DefaultSelfSignedKey  = "server-key.pem"
+
+	selfSignedValidity = time.Hour * 24 * 365 * 5
+)
+
+// TLSOptions configures HTTPS for the server.
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+
+	// SelfSigned creates and saves a certificate at CertFile and
+	// KeyFile if they do not already exist.
+	SelfSigned bool
+	Hosts      string
+
+	// ClientCAFile enables mutual TLS. Clients presenting a
+	// certificate signed by one of these CAs are authenticated by
+	// their certificate's common name.
+	ClientCAFile string
+}
+
+// Enabled checks if the options request HTTPS at all.
+func (t *TLSOptions) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != "" || t.SelfSigned
+}
+
+// Config prepares the certificate files and creates a TLS config.
+func (t *TLSOptions) Config() (*tls.Config, error) {
+	if t.SelfSigned {
+		if t.CertFile == "" {
+			t.CertFile = DefaultSelfSignedCert
+		}
+		if t.KeyFile == "" {
+			t.KeyFile = DefaultSelfSignedKey
+		}
+		if err := ensureSelfSigned(t.CertFile, t.KeyFile, t.Hosts); err != nil {
+			return nil, err
+		}
+	} else if t.CertFile == "" || t.KeyFile == "" {
+		return nil, errors.New("both -tls-cert and -tls-key must be provided")
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if t.ClientCAFile != "" {
+		data, err := ioutil.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificates found in " + t.ClientCAFile)
+		}
+		config.ClientCAs = pool
+
+		// Browsers without a client certificate can still use
+		// passwords or tokens.
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// ensureSelfSigned creates a self-signed certificate unless both files
+// already exist.
+func ensureSelfSigned(certFile, keyFile, hosts string) error {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if certErr == nil && keyErr == nil {
+		return nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "cbyge server"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range selfSignedHosts(hosts) {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range []string{certFile, keyFile} {
+		if dir := filepath.Dir(path); dir != "" {
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return err
+			}
+		}
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, certPEM, 0644)
+}
+
+func selfSignedHosts(hosts string) []string {
+	res := []string{"localhost", "127.0.0.1", "::1"}
+	if name, err := os.Hostname(); err == nil {
+		res = append(res, name)
+	}
+	for _, host := range strings.Split(hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			res = append(res, host)
+		}
+	}
+	return res
+}
+
+// RedirectHTTPS redirects every request to the same URL over HTTPS, on the
+// port that httpsAddr listens on.
+func RedirectHTTPS(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
+
+// clientCertPrincipal authenticates a request by its verified client
+// certificate, if it has one.
+func (s *Server) clientCertPrincipal(r *http.Request) (*Principal, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if name == "" {
+		return nil, false
+	}
+	if s.Users != nil {
+		for _, u := range s.Users.ListUsers() {
+			if u.Name == name {
+				return &Principal{User: u.Name, Role: u.Role, Devices: u.Devices}, true
+			}
+		}
+	}
+	return &Principal{User: name, Role: Role(s.getConfig().ClientCertRole)}, true
+}
@@ -0,0 +1,50 @@
+package cbyge
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// SessionEnvVar is an environment variable which overrides
+// DefaultSessionPath.
+const SessionEnvVar = "CBYGE_SESSION"
+
+// An InvalidSessionError is returned by LoadSessionInfo when a file does not
+// contain a usable session.
+var InvalidSessionError = errors.New("invalid session file")
+
+// DefaultSessionPath gets the session file shared by the command-line tools.
+//
+// This is the value of SessionEnvVar if it is set, or else cbyge/session.json
+// in the user's configuration directory.
+func DefaultSessionPath() string {
+	if path := os.Getenv(SessionEnvVar); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "cbyge-session.json"
+	}
+	return filepath.Join(dir, "cbyge", "session.json")
+}
+
+// LoadSessionInfo reads a SessionInfo from a JSON file, such as the one
+// saved by 'cbyge login'.
+//
+// If the file does not exist, the error wraps os.ErrNotExist. If it is not
+// valid JSON or has no access token, the error wraps InvalidSessionError.
+func LoadSessionInfo(path string) (*SessionInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "load session")
+	}
+	var info SessionInfo
+	if err := json.Unmarshal(data, &info); err != nil || info.AccessToken == "" {
+		return nil, errors.Wrap(InvalidSessionError, "load session "+path)
+	}
+	return &info, nil
+}
@@ -0,0 +1,334 @@
+package cbyge
+
+import (
+	"sync"
+	"time"
+)
+
+const DefaultStatusCacheTTL = time.Second * 30
+
+// A StatusCache remembers the statuses of devices, so that they can be served
+// without contacting the packet server for every request.
+//
+// Entries older than the TTL are stale. Reading a stale entry returns it
+// immediately while it is refreshed in the background.
+//
+// Every time a device's status changes, the cache's version is incremented,
+// and the change can later be retrieved with Changes().
+type StatusCache struct {
+	ctrl *Controller
+	ttl  time.Duration
+
+	lock       sync.Mutex
+	devices    []*ControllerDevice
+	deviceIDs  map[string]bool
+	entries    map[string]*statusCacheEntry
+	version    uint64
+	refreshing bool
+	changed    chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+type statusCacheEntry struct {
+	device  *ControllerDevice
+	status  ControllerDeviceStatus
+	err     error
+	fetched time.Time
+	version uint64
+}
+
+// A StatusChange records a new status for a device.
+type StatusChange struct {
+	Device *ControllerDevice
+	Status ControllerDeviceStatus
+
+	// Err is set if the status could not be fetched, in which case
+	// Status.IsOnline is false.
+	Err error
+
+	// Version is the cache version at which the change occurred.
+	Version uint64
+}
+
+// NewStatusCache creates a StatusCache for the given devices.
+//
+// If ttl is 0, DefaultStatusCacheTTL is used.
+func NewStatusCache(c *Controller, devs []*ControllerDevice, ttl time.Duration) *StatusCache {
+	if ttl == 0 {
+		ttl = DefaultStatusCacheTTL
+	}
+	res := &StatusCache{
+		ctrl:    c,
+		ttl:     ttl,
+		entries: map[string]*statusCacheEntry{},
+		changed: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	res.SetDevices(devs)
+	return res
+}
+
+// SetDevices changes the devices tracked by the cache.
+//
+// Entries for devices which are no longer present are discarded.
+func (s *StatusCache) SetDevices(devs []*ControllerDevice) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.devices = append([]*ControllerDevice{}, devs...)
+	s.deviceIDs = map[string]bool{}
+	for _, d := range devs {
+		s.deviceIDs[d.deviceID] = true
+		if entry, ok := s.entries[d.deviceID]; ok {
+			entry.device = d
+		}
+	}
+	for id := range s.entries {
+		if !s.deviceIDs[id] {
+			delete(s.entries, id)
+		}
+	}
+}
+
+// Devices gets the devices tracked by the cache.
+func (s *StatusCache) Devices() []*ControllerDevice {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*ControllerDevice{}, s.devices...)
+}
+
+// Status gets the cached status of a device.
+//
+// If the device has never been fetched, it is fetched synchronously.
+// If the cached status is stale, it is returned and a background refresh of
+// every device is started.
+func (s *StatusCache) Status(d *ControllerDevice) (ControllerDeviceStatus, error) {
+	s.lock.Lock()
+	entry, ok := s.entries[d.deviceID]
+	if ok {
+		status, err := entry.status, entry.err
+		if time.Since(entry.fetched) > s.ttl {
+			s.refreshInBackground()
+		}
+		s.lock.Unlock()
+		return status, err
+	}
+	s.lock.Unlock()
+
+	status, err := s.ctrl.DeviceStatus(d)
+	s.Update(d, status, err)
+	return status, err
+}
+
+// Statuses gets the cached statuses of devices.
+//
+// Devices that have never been fetched are fetched synchronously, together.
+// If any cached status is stale, a background refresh is started.
+func (s *StatusCache) Statuses(devs []*ControllerDevice) ([]ControllerDeviceStatus, []error) {
+	statuses := make([]ControllerDeviceStatus, len(devs))
+	errs := make([]error, len(devs))
+
+	var missing []*ControllerDevice
+	var missingIdxs []int
+	s.lock.Lock()
+	stale := false
+	for i, d := range devs {
+		if entry, ok := s.entries[d.deviceID]; ok {
+			statuses[i], errs[i] = entry.status, entry.err
+			stale = stale || time.Since(entry.fetched) > s.ttl
+		} else {
+			missing = append(missing, d)
+			missingIdxs = append(missingIdxs, i)
+		}
+	}
+	if stale {
+		s.refreshInBackground()
+	}
+	s.lock.Unlock()
+
+	if len(missing) > 0 {
+		newStatuses, newErrs := s.ctrl.DeviceStatuses(missing)
+		s.updateMany(missing, newStatuses, newErrs)
+		for i, idx := range missingIdxs {
+			if newErrs[i] == nil {
+				statuses[idx] = newStatuses[i]
+			}
+			errs[idx] = newErrs[i]
+		}
+	}
+	return statuses, errs
+}
+
+// Refresh synchronously fetches the status of every device.
+func (s *StatusCache) Refresh() {
+	devs := s.Devices()
+	if len(devs) == 0 {
+		return
+	}
+	statuses, errs := s.ctrl.DeviceStatuses(devs)
+	s.updateMany(devs, statuses, errs)
+}
+
+// Update stores a new status for a device, for example after the status was
+// fetched or changed outside of the cache.
+//
+// If err is non-nil, the device is recorded as offline.
+// Devices which are not tracked by the cache are ignored.
+func (s *StatusCache) Update(d *ControllerDevice, status ControllerDeviceStatus, err error) {
+	s.updateMany([]*ControllerDevice{d}, []ControllerDeviceStatus{status}, []error{err})
+}
+
+// Invalidate marks a device's cached status as stale, so that the next read
+// triggers a refresh.
+func (s *StatusCache) Invalidate(d *ControllerDevice) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if entry, ok := s.entries[d.deviceID]; ok {
+		entry.fetched = time.Time{}
+	}
+}
+
+// Version gets the current version of the cache.
+//
+// The version starts at 0 and increases every time a status changes.
+func (s *StatusCache) Version() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.version
+}
+
+// Changes gets the latest status of every device that changed after the
+// given version, along with the current version.
+//
+// Pass the returned version to a later call to get only newer changes.
+func (s *StatusCache) Changes(since uint64) ([]StatusChange, uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var res []StatusChange
+	for _, d := range s.devices {
+		entry, ok := s.entries[d.deviceID]
+		if ok && entry.version > since {
+			res = append(res, StatusChange{
+				Device:  entry.device,
+				Status:  entry.status,
+				Err:     entry.err,
+				Version: entry.version,
+			})
+		}
+	}
+	return res, s.version
+}
+
+// WaitChanges is like Changes, but blocks until at least one device has
+// changed after the given version, or until the timeout elapses.
+func (s *StatusCache) WaitChanges(since uint64, timeout time.Duration) ([]StatusChange, uint64) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		s.lock.Lock()
+		version, changed := s.version, s.changed
+		s.lock.Unlock()
+		if version > since {
+			return s.Changes(since)
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil, version
+		case <-s.closed:
+			return nil, version
+		}
+	}
+}
+
+// Start refreshes every device periodically in a background Goroutine,
+// until Close() is called.
+//
+// If interval is 0, the cache's TTL is used.
+func (s *StatusCache) Start(interval time.Duration) {
+	if interval == 0 {
+		interval = s.ttl
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Refresh()
+			case <-s.closed:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops background refreshes and wakes up any calls to WaitChanges().
+func (s *StatusCache) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+}
+
+// Done returns a channel which is closed once Close() is called.
+func (s *StatusCache) Done() <-chan struct{} {
+	return s.closed
+}
+
+// refreshInBackground starts a refresh unless one is already running.
+//
+// The caller must hold s.lock.
+func (s *StatusCache) refreshInBackground() {
+	if s.refreshing {
+		return
+	}
+	s.refreshing = true
+	go func() {
+		defer func() {
+			s.lock.Lock()
+			s.refreshing = false
+			s.lock.Unlock()
+		}()
+		s.Refresh()
+	}()
+}
+
+func (s *StatusCache) updateMany(devs []*ControllerDevice, statuses []ControllerDeviceStatus,
+	errs []error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	anyChanged := false
+	for i, d := range devs {
+		if !s.deviceIDs[d.deviceID] {
+			// The device was removed by SetDevices() while its
+			// status was being fetched.
+			continue
+		}
+		// DeviceStatuses() may return no statuses when every
+		// device failed.
+		var status ControllerDeviceStatus
+		err := errs[i]
+		if err == nil {
+			status = statuses[i]
+		}
+		entry, ok := s.entries[d.deviceID]
+		if !ok {
+			entry = &statusCacheEntry{device: d}
+			s.entries[d.deviceID] = entry
+		}
+		if !ok || entry.status != status || (entry.err == nil) != (err == nil) {
+			s.version++
+			entry.version = s.version
+			anyChanged = true
+		}
+		entry.status = status
+		entry.err = err
+		entry.fetched = now
+	}
+	if anyChanged {
+		close(s.changed)
+		s.changed = make(chan struct{})
+	}
+}
@@ -0,0 +1,163 @@
+package cbyge
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestStatusCacheTTL(t *testing.T) {
+	cache, devs := newTestStatusCache(time.Hour)
+	defer cache.Close()
+
+	on := onStatus()
+	cache.Update(devs[0], on, nil)
+	status, err := cache.Status(devs[0])
+	if err != nil || status != on {
+		t.Fatalf("unexpected status: %v %v", status, err)
+	}
+	cache.lock.Lock()
+	refreshing := cache.refreshing
+	cache.lock.Unlock()
+	if refreshing {
+		t.Error("fresh entry should not start a refresh")
+	}
+
+	// The devices have no switches, so a refresh finds them unreachable.
+	cache.Invalidate(devs[0])
+	version := cache.Version()
+	status, err = cache.Status(devs[0])
+	if err != nil || status != on {
+		t.Fatalf("stale status should be returned while refreshing: %v %v", status, err)
+	}
+	// The refresh fetches every device, so both devices change.
+	changes, _ := cache.WaitChanges(version, time.Second*5)
+	if len(changes) != 2 || changes[0].Device != devs[0] ||
+		errors.Cause(changes[0].Err) != UnreachableError {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+	if _, err := cache.Status(devs[0]); errors.Cause(err) != UnreachableError {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Missing devices are fetched synchronously.
+	if _, err := cache.Status(devs[1]); errors.Cause(err) != UnreachableError {
+		t.Errorf("unexpected error: %v", err)
+	}
+	_, errs := cache.Statuses(devs)
+	for i, err := range errs {
+		if errors.Cause(err) != UnreachableError {
+			t.Errorf("device %d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestStatusCacheStaleRefresh(t *testing.T) {
+	cache, devs := newTestStatusCache(time.Millisecond)
+	defer cache.Close()
+
+	cache.Update(devs[0], onStatus(), nil)
+	time.Sleep(time.Millisecond * 2)
+	version := cache.Version()
+	if status, err := cache.Status(devs[0]); err != nil || !status.IsOn {
+		t.Fatalf("unexpected status: %v %v", status, err)
+	}
+	changes, _ := cache.WaitChanges(version, time.Second*5)
+	if len(changes) == 0 {
+		t.Fatal("stale entry was not refreshed")
+	}
+}
+
+func TestStatusCacheChanges(t *testing.T) {
+	cache, devs := newTestStatusCache(time.Hour)
+	defer cache.Close()
+
+	if cache.Version() != 0 {
+		t.Fatal("unexpected initial version")
+	}
+	cache.Update(devs[0], onStatus(), nil)
+	cache.Update(devs[1], ControllerDeviceStatus{IsOnline: true}, nil)
+	if v := cache.Version(); v != 2 {
+		t.Fatalf("expected version 2 but got %d", v)
+	}
+
+	// Unchanged statuses do not create a version.
+	cache.Update(devs[0], onStatus(), nil)
+	if v := cache.Version(); v != 2 {
+		t.Fatalf("expected version 2 but got %d", v)
+	}
+
+	changes, version := cache.Changes(1)
+	if version != 2 || len(changes) != 1 || changes[0].Device != devs[1] ||
+		changes[0].Version != 2 {
+		t.Fatalf("unexpected changes: %+v (version %d)", changes, version)
+	}
+	changes, _ = cache.Changes(0)
+	if len(changes) != 2 {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+
+	// An error is a change, even though the status is still zero.
+	cache.Update(devs[1], ControllerDeviceStatus{}, nil)
+	v := cache.Version()
+	cache.Update(devs[1], ControllerDeviceStatus{}, UnreachableError)
+	changes, _ = cache.Changes(v)
+	if len(changes) != 1 || changes[0].Err != UnreachableError {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+}
+
+func TestStatusCacheWaitChangesTimeout(t *testing.T) {
+	cache, devs := newTestStatusCache(time.Hour)
+	defer cache.Close()
+	cache.Update(devs[0], onStatus(), nil)
+
+	start := time.Now()
+	changes, version := cache.WaitChanges(1, time.Millisecond*50)
+	if changes != nil || version != 1 {
+		t.Errorf("unexpected result: %+v (version %d)", changes, version)
+	}
+	if time.Since(start) < time.Millisecond*50 {
+		t.Error("returned before the timeout")
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		cache.Update(devs[1], onStatus(), nil)
+	}()
+	changes, version = cache.WaitChanges(1, time.Second*5)
+	if len(changes) != 1 || changes[0].Device != devs[1] || version != 2 {
+		t.Errorf("unexpected result: %+v (version %d)", changes, version)
+	}
+}
+
+func TestStatusCacheRemovedDevices(t *testing.T) {
+	cache, devs := newTestStatusCache(time.Hour)
+	defer cache.Close()
+	cache.Update(devs[0], onStatus(), nil)
+	cache.Update(devs[1], onStatus(), nil)
+
+	// Simulate a refresh which finishes after a device was removed.
+	cache.SetDevices(devs[:1])
+	version := cache.Version()
+	cache.updateMany(devs, []ControllerDeviceStatus{{}, {}}, []error{nil, nil})
+	if _, ok := cache.entries[devs[1].deviceID]; ok {
+		t.Error("entry was recreated for a removed device")
+	}
+	changes, _ := cache.Changes(version)
+	if len(changes) != 1 || changes[0].Device != devs[0] {
+		t.Errorf("unexpected changes: %+v", changes)
+	}
+}
+
+// newTestStatusCache creates a cache for two devices without switches, so
+// that fetching their statuses fails without any network access.
+func newTestStatusCache(ttl time.Duration) (*StatusCache, []*ControllerDevice) {
+	devs := []*ControllerDevice{
+		{deviceID: "1", switchID: 1 << 40},
+		{deviceID: "2", switchID: 1 << 40},
+	}
+	ctrl := NewController(&SessionInfo{}, 0)
+	return NewStatusCache(ctrl, devs, ttl), devs
+}
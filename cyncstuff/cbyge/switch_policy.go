@@ -0,0 +1,233 @@
+package cbyge
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSwitchPolicyWindow      = 20
+	DefaultSwitchPolicyHealthyRate = 0.8
+	DefaultSwitchPolicyFlapLimit   = 4
+)
+
+// A SwitchPolicy decides which wifi-connected switches are used to reach a
+// device.
+//
+// The Controller reports the outcome of every call it makes through a switch
+// to Record(), and asks Rank() to order the known switches for a device
+// whenever it needs to send a packet.
+//
+// Implementations must be safe to use from multiple Goroutines.
+type SwitchPolicy interface {
+	// Rank orders the switches that can reach a device, from most to least
+	// preferred. It should return a permutation of switches, and it must not
+	// modify the slice that it is passed.
+	Rank(d *ControllerDevice, switches []uint32) []uint32
+
+	// Record reports the result of a call to a device through a switch.
+	//
+	// If err is nil, rtt is the time it took to receive a response.
+	Record(d *ControllerDevice, switchID uint32, rtt time.Duration, err error)
+}
+
+// RoundRobinSwitchPolicy is a SwitchPolicy which keeps using the same switch
+// for a device until an error occurs, at which point it moves on to the next
+// known switch.
+type RoundRobinSwitchPolicy struct {
+	lock    sync.Mutex
+	indices map[string]int
+}
+
+// NewRoundRobinSwitchPolicy creates a RoundRobinSwitchPolicy.
+func NewRoundRobinSwitchPolicy() *RoundRobinSwitchPolicy {
+	return &RoundRobinSwitchPolicy{indices: map[string]int{}}
+}
+
+// Rank rotates switches so that the current switch for the device is first.
+func (r *RoundRobinSwitchPolicy) Rank(d *ControllerDevice, switches []uint32) []uint32 {
+	if len(switches) == 0 {
+		return nil
+	}
+	r.lock.Lock()
+	idx := r.indices[d.deviceID] % len(switches)
+	r.lock.Unlock()
+	return append(append([]uint32{}, switches[idx:]...), switches[:idx]...)
+}
+
+// Record advances the device to the next switch if err is non-nil.
+func (r *RoundRobinSwitchPolicy) Record(d *ControllerDevice, switchID uint32, rtt time.Duration,
+	err error) {
+	if err != nil {
+		r.lock.Lock()
+		r.indices[d.deviceID]++
+		r.lock.Unlock()
+	}
+}
+
+// ScoredSwitchPolicy is a SwitchPolicy which ranks switches by their recent
+// success rate and round-trip time.
+//
+// Statistics are tracked per switch over a sliding window of the most recent
+// calls. A device's own switch is always preferred while it is healthy, and
+// switches which alternate between success and failure ("flapping") are
+// ranked below every stable switch.
+type ScoredSwitchPolicy struct {
+	// Window is the number of recent calls remembered for each switch.
+	Window int
+
+	// HealthyRate is the minimum success rate for a device's own switch to
+	// be preferred over every other switch.
+	HealthyRate float64
+
+	// FlapLimit is the number of success/failure transitions within the
+	// window at which a switch is considered to be flapping.
+	FlapLimit int
+
+	lock    sync.Mutex
+	history map[uint32][]switchSample
+}
+
+type switchSample struct {
+	RTT time.Duration
+	OK  bool
+}
+
+// NewScoredSwitchPolicy creates a ScoredSwitchPolicy with the default
+// settings.
+func NewScoredSwitchPolicy() *ScoredSwitchPolicy {
+	return &ScoredSwitchPolicy{
+		Window:      DefaultSwitchPolicyWindow,
+		HealthyRate: DefaultSwitchPolicyHealthyRate,
+		FlapLimit:   DefaultSwitchPolicyFlapLimit,
+		history:     map[uint32][]switchSample{},
+	}
+}
+
+// Rank orders switches by health, preferring the device's own switch.
+func (s *ScoredSwitchPolicy) Rank(d *ControllerDevice, switches []uint32) []uint32 {
+	s.lock.Lock()
+	stats := make(map[uint32]SwitchStats, len(switches))
+	for _, id := range switches {
+		stats[id] = s.stats(id)
+	}
+	s.lock.Unlock()
+
+	res := append([]uint32{}, switches...)
+	sort.SliceStable(res, func(i, j int) bool {
+		s1, s2 := stats[res[i]], stats[res[j]]
+		own1 := d.isSwitch(res[i]) && s.isHealthy(s1)
+		own2 := d.isSwitch(res[j]) && s.isHealthy(s2)
+		if own1 != own2 {
+			return own1
+		}
+		flap1, flap2 := s.isFlapping(s1), s.isFlapping(s2)
+		if flap1 != flap2 {
+			return flap2
+		}
+		if score1, score2 := s1.score(), s2.score(); score1 != score2 {
+			return score1 > score2
+		}
+		return s1.MeanRTT < s2.MeanRTT
+	})
+	return res
+}
+
+// Record adds a sample to the switch's sliding window.
+func (s *ScoredSwitchPolicy) Record(d *ControllerDevice, switchID uint32, rtt time.Duration,
+	err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	window := s.Window
+	if window <= 0 {
+		window = DefaultSwitchPolicyWindow
+	}
+	samples := append(s.history[switchID], switchSample{RTT: rtt, OK: err == nil})
+	if len(samples) > window {
+		samples = append([]switchSample{}, samples[len(samples)-window:]...)
+	}
+	s.history[switchID] = samples
+}
+
+// Stats gets the current statistics for a switch.
+func (s *ScoredSwitchPolicy) Stats(switchID uint32) SwitchStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stats(switchID)
+}
+
+func (s *ScoredSwitchPolicy) stats(switchID uint32) SwitchStats {
+	samples := s.history[switchID]
+	res := SwitchStats{Samples: len(samples)}
+	if len(samples) == 0 {
+		return res
+	}
+	var totalRTT time.Duration
+	for i, sample := range samples {
+		if sample.OK {
+			res.Successes++
+			totalRTT += sample.RTT
+		}
+		if i > 0 && sample.OK != samples[i-1].OK {
+			res.Flaps++
+		}
+	}
+	if res.Successes > 0 {
+		res.MeanRTT = totalRTT / time.Duration(res.Successes)
+	}
+	res.LastFailed = !samples[len(samples)-1].OK
+	return res
+}
+
+func (s *ScoredSwitchPolicy) isHealthy(stats SwitchStats) bool {
+	if stats.Samples == 0 {
+		return true
+	}
+	return !stats.LastFailed && !s.isFlapping(stats) && stats.SuccessRate() >= s.HealthyRate
+}
+
+func (s *ScoredSwitchPolicy) isFlapping(stats SwitchStats) bool {
+	return s.FlapLimit > 0 && stats.Flaps >= s.FlapLimit
+}
+
+// SwitchStats summarizes the recent calls made through a switch.
+type SwitchStats struct {
+	Samples   int
+	Successes int
+
+	// Flaps is the number of times consecutive calls went from success to
+	// failure or vice versa.
+	Flaps int
+
+	// MeanRTT is the average round-trip time of successful calls.
+	MeanRTT time.Duration
+
+	// LastFailed is true if the most recent call failed.
+	LastFailed bool
+}
+
+// SuccessRate gets the fraction of calls which succeeded.
+//
+// Switches with no samples are treated as entirely successful.
+func (s SwitchStats) SuccessRate() float64 {
+	if s.Samples == 0 {
+		return 1
+	}
+	return float64(s.Successes) / float64(s.Samples)
+}
+
+func (s SwitchStats) score() float64 {
+	if s.Samples == 0 {
+		// Give unexplored switches a chance before failing ones,
+		// but not before ones that are known to work well.
+		return 0.75
+	}
+	res := s.SuccessRate()
+	if s.LastFailed {
+		// Move away from a switch as soon as it fails, like the
+		// round-robin policy, but let it recover later.
+		res -= 0.5
+	}
+	return res
+}
@@ -0,0 +1,161 @@
+package cbyge
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var errTestSwitch = errors.New("switch failed")
+
+func TestRoundRobinSwitchPolicy(t *testing.T) {
+	policy := NewRoundRobinSwitchPolicy()
+	d1 := &ControllerDevice{deviceID: "1"}
+	d2 := &ControllerDevice{deviceID: "2"}
+	switches := []uint32{10, 20, 30}
+
+	checkRank(t, policy, d1, switches, []uint32{10, 20, 30})
+	policy.Record(d1, 10, time.Millisecond, nil)
+	checkRank(t, policy, d1, switches, []uint32{10, 20, 30})
+	policy.Record(d1, 10, 0, errTestSwitch)
+	checkRank(t, policy, d1, switches, []uint32{20, 30, 10})
+	policy.Record(d1, 20, 0, errTestSwitch)
+	policy.Record(d1, 30, 0, errTestSwitch)
+	checkRank(t, policy, d1, switches, []uint32{10, 20, 30})
+
+	// Each device has its own position.
+	checkRank(t, policy, d2, switches, []uint32{10, 20, 30})
+	if res := policy.Rank(d1, nil); res != nil {
+		t.Errorf("unexpected ranking: %v", res)
+	}
+}
+
+func TestScoredSwitchPolicyScoring(t *testing.T) {
+	policy := NewScoredSwitchPolicy()
+	d := &ControllerDevice{deviceID: "1", switchID: 1 << 40}
+	switches := []uint32{10, 20, 30, 40}
+
+	// Switches are ranked by success rate, then by RTT, and unexplored
+	// switches come after ones that are known to work well.
+	recordResults(policy, d, 10, time.Millisecond*50, "ok ok ok ok")
+	recordResults(policy, d, 20, time.Millisecond*10, "ok ok ok ok")
+	recordResults(policy, d, 30, time.Millisecond, "ok fail ok ok")
+	checkRank(t, policy, d, switches, []uint32{20, 10, 40, 30})
+
+	// A switch moves down as soon as it fails, and recovers later.
+	recordResults(policy, d, 20, 0, "fail")
+	checkRank(t, policy, d, switches, []uint32{10, 40, 30, 20})
+	recordResults(policy, d, 20, time.Millisecond*10, "ok")
+	checkRank(t, policy, d, switches, []uint32{10, 20, 40, 30})
+
+	stats := policy.Stats(20)
+	expected := SwitchStats{Samples: 6, Successes: 5, Flaps: 2, MeanRTT: time.Millisecond * 10}
+	if stats != expected {
+		t.Errorf("expected %+v but got %+v", expected, stats)
+	}
+}
+
+func TestScoredSwitchPolicyWindow(t *testing.T) {
+	policy := NewScoredSwitchPolicy()
+	policy.Window = 3
+	d := &ControllerDevice{deviceID: "1", switchID: 1 << 40}
+	recordResults(policy, d, 10, time.Millisecond, "fail fail ok ok ok")
+	stats := policy.Stats(10)
+	if stats.Samples != 3 || stats.Successes != 3 || stats.Flaps != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestScoredSwitchPolicyFlapping(t *testing.T) {
+	policy := NewScoredSwitchPolicy()
+	d := &ControllerDevice{deviceID: "1", switchID: 1 << 40}
+	switches := []uint32{10, 20}
+
+	// A flapping switch has a better success rate than switch 20, but is
+	// still ranked below it.
+	recordResults(policy, d, 10, time.Millisecond, "ok ok ok fail ok fail ok ok ok ok ok")
+	recordResults(policy, d, 20, time.Millisecond, "ok fail ok ok")
+	if policy.Stats(10).SuccessRate() <= policy.Stats(20).SuccessRate() {
+		t.Fatal("unexpected success rates")
+	}
+	checkRank(t, policy, d, switches, []uint32{20, 10})
+
+	// With fewer transitions, the better success rate wins.
+	policy.FlapLimit = 5
+	checkRank(t, policy, d, switches, []uint32{10, 20})
+	policy.FlapLimit = 0
+	checkRank(t, policy, d, switches, []uint32{10, 20})
+}
+
+func TestScoredSwitchPolicyOwnSwitch(t *testing.T) {
+	policy := NewScoredSwitchPolicy()
+	d := &ControllerDevice{deviceID: "1", switchID: 30}
+	switches := []uint32{10, 20, 30}
+
+	// The device's own switch is preferred while it is healthy, even if
+	// other switches are faster.
+	recordResults(policy, d, 10, time.Millisecond, "ok ok ok ok ok")
+	recordResults(policy, d, 20, time.Millisecond*2, "ok ok ok ok ok")
+	checkRank(t, policy, d, switches, []uint32{30, 10, 20})
+	recordResults(policy, d, 30, time.Millisecond*100, "ok ok ok ok fail ok ok ok ok ok")
+	checkRank(t, policy, d, switches, []uint32{30, 10, 20})
+
+	// Below the healthy rate, it is ranked by its score like any other.
+	policy = NewScoredSwitchPolicy()
+	recordResults(policy, d, 10, time.Millisecond, "ok ok ok ok ok")
+	recordResults(policy, d, 30, time.Millisecond, "fail fail ok ok ok ok ok")
+	if rate := policy.Stats(30).SuccessRate(); rate >= policy.HealthyRate {
+		t.Fatalf("unexpected success rate: %f", rate)
+	}
+	checkRank(t, policy, d, switches, []uint32{10, 20, 30})
+	recordResults(policy, d, 30, time.Millisecond, "ok ok ok")
+	checkRank(t, policy, d, switches, []uint32{30, 10, 20})
+
+	// A failure on the last call also loses the preference.
+	policy = NewScoredSwitchPolicy()
+	recordResults(policy, d, 10, time.Millisecond, "ok")
+	recordResults(policy, d, 30, time.Millisecond, "ok ok ok ok ok ok ok ok ok fail")
+	checkRank(t, policy, d, switches, []uint32{10, 20, 30})
+
+	// A flapping own switch loses the preference too.
+	policy = NewScoredSwitchPolicy()
+	recordResults(policy, d, 10, time.Millisecond, "ok ok")
+	recordResults(policy, d, 30, time.Millisecond,
+		"ok ok ok ok ok ok fail ok fail ok ok ok ok ok ok ok")
+	checkRank(t, policy, d, switches, []uint32{10, 20, 30})
+}
+
+func TestScoredSwitchPolicyRankCopies(t *testing.T) {
+	policy := NewScoredSwitchPolicy()
+	d := &ControllerDevice{deviceID: "1", switchID: 1 << 40}
+	recordResults(policy, d, 10, 0, "fail")
+	switches := []uint32{10, 20}
+	checkRank(t, policy, d, switches, []uint32{20, 10})
+	if !reflect.DeepEqual(switches, []uint32{10, 20}) {
+		t.Errorf("Rank modified its argument: %v", switches)
+	}
+}
+
+// recordResults records a space-separated sequence of "ok" and "fail"
+// results for a switch.
+func recordResults(policy SwitchPolicy, d *ControllerDevice, switchID uint32,
+	rtt time.Duration, results string) {
+	for _, result := range strings.Fields(results) {
+		if result == "ok" {
+			policy.Record(d, switchID, rtt, nil)
+		} else {
+			policy.Record(d, switchID, 0, errTestSwitch)
+		}
+	}
+}
+
+func checkRank(t *testing.T, policy SwitchPolicy, d *ControllerDevice, switches,
+	expected []uint32) {
+	t.Helper()
+	if actual := policy.Rank(d, switches); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected ranking %v but got %v", expected, actual)
+	}
+}
@@ -0,0 +1,193 @@
+-- Wireshark dissector for the C by GE packet protocol.
+--
+-- Copy this file into your Wireshark plugins directory (see Help > About >
+-- Folders), or run `wireshark -X lua_script:cbyge.lua capture.pcapng`.
+--
+-- Every message starts with a five byte header: a type byte, whose high
+-- nibble is the packet type and whose 0x08 bit marks responses, followed by
+-- a big-endian 32-bit length of the data that follows.
+
+local cbyge = Proto("cbyge", "C by GE")
+
+local packet_types = {
+    [1] = "auth",
+    [4] = "sync",
+    [7] = "pipe",
+    [8] = "pipe_sync",
+}
+
+local pipe_types = {
+    [0xd0] = "set_status",
+    [0xd2] = "set_lum",
+    [0xe2] = "set_ct",
+    [0xdb] = "get_status",
+    [0x52] = "get_status_paginated",
+}
+
+local f = cbyge.fields
+f.type = ProtoField.uint8("cbyge.type", "Type", base.DEC, packet_types, 0xf0)
+f.response = ProtoField.bool("cbyge.response", "Response", 8, nil, 0x08)
+f.flags = ProtoField.uint8("cbyge.flags", "Low bits", base.HEX, nil, 0x07)
+f.length = ProtoField.uint32("cbyge.length", "Length", base.DEC)
+f.data = ProtoField.bytes("cbyge.data", "Data")
+
+f.auth_user = ProtoField.uint32("cbyge.auth.user", "User ID", base.DEC)
+f.auth_code = ProtoField.string("cbyge.auth.code", "Authorization code")
+f.auth_result = ProtoField.bytes("cbyge.auth.result", "Result")
+
+f.pipe_switch = ProtoField.uint32("cbyge.pipe.switch", "Switch ID", base.DEC)
+f.pipe_seq = ProtoField.uint16("cbyge.pipe.seq", "Sequence number", base.DEC)
+f.pipe_subtype = ProtoField.uint8("cbyge.pipe.subtype", "Subtype", base.HEX, pipe_types)
+f.pipe_length = ProtoField.uint8("cbyge.pipe.length", "Payload length", base.DEC)
+f.pipe_payload = ProtoField.bytes("cbyge.pipe.payload", "Payload")
+f.pipe_result = ProtoField.uint8("cbyge.pipe.result", "Result", base.HEX)
+
+f.status_device = ProtoField.uint8("cbyge.status.device", "Device index", base.DEC)
+f.status_on = ProtoField.bool("cbyge.status.on", "On")
+f.status_brightness = ProtoField.uint8("cbyge.status.brightness", "Brightness", base.DEC)
+f.status_tone = ProtoField.uint8("cbyge.status.tone", "Color tone", base.DEC)
+f.status_rgb = ProtoField.bytes("cbyge.status.rgb", "RGB")
+
+local pref_port = 23778
+cbyge.prefs.port = Pref.uint("TCP port", pref_port, "TCP port of the packet server")
+
+local function dissect_auth(buf, tree, is_response)
+    if is_response then
+        local item = tree:add(f.auth_result, buf)
+        if buf:len() == 2 and buf:uint() == 0 then
+            item:append_text(" (ok)")
+        else
+            item:append_text(" (rejected)")
+        end
+        return "auth response"
+    end
+    -- 0x03, user ID, 0x00, code length, code, 0x00 0x00 0xb4
+    if buf:len() < 7 then
+        return "auth"
+    end
+    tree:add(f.auth_user, buf(1, 4))
+    local code_len = buf(6, 1):uint()
+    if buf:len() >= 7 + code_len and code_len > 0 then
+        tree:add(f.auth_code, buf(7, code_len))
+    end
+    return "auth user=" .. buf(1, 4):uint()
+end
+
+local function dissect_statuses(buf, tree)
+    -- The payload has a six byte header, followed by 24 bytes per device.
+    local offset = 6
+    local count = 0
+    while offset + 24 <= buf:len() do
+        local entry = buf(offset, 24)
+        local sub = tree:add(cbyge, entry, "Device status")
+        sub:add(f.status_device, entry(1, 1))
+        sub:add(f.status_on, entry(9, 1))
+        sub:add(f.status_brightness, entry(13, 1))
+        if entry(17, 1):uint() == 0xfe then
+            sub:add(f.status_rgb, entry(21, 3))
+        else
+            sub:add(f.status_tone, entry(17, 1))
+        end
+        offset = offset + 24
+        count = count + 1
+    end
+    return count
+end
+
+local function dissect_pipe(buf, tree, is_response)
+    local summary = "pipe"
+    if is_response then
+        summary = summary .. " response"
+    end
+    if buf:len() < 6 then
+        return summary
+    end
+    tree:add(f.pipe_switch, buf(0, 4))
+    tree:add(f.pipe_seq, buf(4, 2))
+    summary = summary .. " seq=" .. buf(4, 2):uint()
+    if buf:len() < 15 then
+        -- Acknowledgements end with a result code, where zero is success.
+        if is_response and buf:len() > 6 then
+            tree:add(f.pipe_result, buf(buf:len() - 1, 1))
+            if buf(buf:len() - 1, 1):uint() == 0 then
+                summary = summary .. " ok"
+            else
+                summary = summary .. " failed"
+            end
+        end
+        return summary
+    end
+    local subtype = buf(13, 1):uint()
+    tree:add(f.pipe_subtype, buf(13, 1))
+    summary = summary .. " " .. (pipe_types[subtype] or string.format("0x%02x", subtype))
+    local length = buf(14, 1):uint()
+    tree:add(f.pipe_length, buf(14, 1))
+    if length > buf:len() - 15 then
+        return summary
+    end
+    if length > 0 then
+        local payload = buf(15, length)
+        local item = tree:add(f.pipe_payload, payload)
+        if is_response and subtype == 0x52 then
+            local count = dissect_statuses(payload, item)
+            summary = summary .. " statuses=" .. count
+        end
+    end
+    return summary
+end
+
+local function dissect_message(buf, pinfo, tree)
+    local type_byte = buf(0, 1):uint()
+    local packet_type = bit.rshift(type_byte, 4)
+    local is_response = bit.band(type_byte, 0x08) ~= 0
+    local length = buf(1, 4):uint()
+
+    local subtree = tree:add(cbyge, buf(0, 5 + length))
+    subtree:add(f.type, buf(0, 1))
+    subtree:add(f.response, buf(0, 1))
+    subtree:add(f.flags, buf(0, 1))
+    subtree:add(f.length, buf(1, 4))
+
+    local summary = packet_types[packet_type] or ("type " .. packet_type)
+    if length > 0 then
+        local data = buf(5, length)
+        local data_tree = subtree:add(f.data, data)
+        if packet_type == 1 then
+            summary = dissect_auth(data, data_tree, is_response)
+        elseif packet_type == 7 then
+            summary = dissect_pipe(data, data_tree, is_response)
+        elseif is_response then
+            summary = summary .. " response"
+        end
+    end
+    subtree:append_text(": " .. summary)
+
+    -- A TCP segment may hold several messages, which are listed together.
+    pinfo.cols.protocol = "CBYGE"
+    if tostring(pinfo.cols.info) == "" then
+        pinfo.cols.info = summary
+    else
+        pinfo.cols.info:append(", " .. summary)
+    end
+    return 5 + length
+end
+
+local function message_length(buf, pinfo, offset)
+    return 5 + buf(offset + 1, 4):uint()
+end
+
+function cbyge.dissector(buf, pinfo, tree)
+    pinfo.cols.info = ""
+    dissect_tcp_pdus(buf, tree, 5, message_length, dissect_message)
+end
+
+local tcp_port = DissectorTable.get("tcp.port")
+tcp_port:add(pref_port, cbyge)
+
+function cbyge.prefs_changed()
+    if cbyge.prefs.port ~= pref_port then
+        tcp_port:remove(pref_port, cbyge)
+        pref_port = cbyge.prefs.port
+        tcp_port:add(pref_port, cbyge)
+    end
+end